@@ -0,0 +1,32 @@
+// Command migrate-history converts chat histories from the old layout, one
+// DynamoDB item per user holding every chat, into the chat table layout with
+// one item per chat.
+//
+//	go run ./cmd/migrate-history -source History -target Chats
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+
+	"backend/models"
+)
+
+func main() {
+	source := flag.String("source", "History", "legacy table with one item per user")
+	target := flag.String("target", "Chats", "chat table with one item per chat")
+	dryRun := flag.Bool("dry-run", false, "only report what would be migrated")
+	flag.Parse()
+
+	client, err := models.NewDynamoDBClient(*target)
+	if err != nil {
+		log.Fatalf("Failed to connect to DynamoDB, %s\n", err)
+	}
+
+	stats, err := client.MigrateLegacyHistories(context.Background(), *source, *dryRun)
+	if err != nil {
+		log.Fatalf("Migration failed after %d histories, %s\n", stats.Histories, err)
+	}
+	log.Printf("Migrated %d histories with %d chats from %s to %s", stats.Histories, stats.Chats, *source, *target)
+}
@@ -0,0 +1,391 @@
+// Package config holds the settings of the server. They are read once at
+// startup from a YAML file, the environment and command line flags, in that
+// order of precedence, and validated as a whole.
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Config is the configuration of the server. Every setting has a YAML key
+// under its section, an environment variable named by its env tag and a
+// flag named section.key, e.g. -server.addr.
+type Config struct {
+	Server     Server     `yaml:"server"`
+	Auth       Auth       `yaml:"auth"`
+	History    History    `yaml:"history"`
+	Personas   Personas   `yaml:"personas"`
+	LLM        LLM        `yaml:"llm"`
+	Moderation Moderation `yaml:"moderation"`
+	TTS        TTS        `yaml:"tts"`
+	SpeechJobs SpeechJobs `yaml:"speech_jobs"`
+	Audio      Audio      `yaml:"audio"`
+	STT        STT        `yaml:"stt"`
+	Quota      Quota      `yaml:"quota"`
+	Usage      Usage      `yaml:"usage"`
+	Timeouts   Timeouts   `yaml:"timeouts"`
+}
+
+// Server configures the HTTP server. An empty LogFile logs to stderr.
+// LogLevel is one of debug, info, warn and error, LogFormat json or text.
+// The log file is rotated once it reaches LogMaxSizeMB or is LogMaxAgeHours
+// old, 0 turning either off, and LogMaxBackups rotated files are kept.
+// In-flight requests and queued speech jobs get ShutdownTimeoutSeconds to
+// finish on shutdown, and readiness checks are repeated at most every
+// ReadinessCacheSeconds.
+type Server struct {
+	Addr                   string `yaml:"addr" env:"LISTEN_ADDR"`
+	LogFile                string `yaml:"log_file" env:"LOG_FILE"`
+	LogLevel               string `yaml:"log_level" env:"LOG_LEVEL"`
+	LogFormat              string `yaml:"log_format" env:"LOG_FORMAT"`
+	LogMaxSizeMB           int    `yaml:"log_max_size_mb" env:"LOG_MAX_SIZE_MB"`
+	LogMaxAgeHours         int    `yaml:"log_max_age_hours" env:"LOG_MAX_AGE_HOURS"`
+	LogMaxBackups          int    `yaml:"log_max_backups" env:"LOG_MAX_BACKUPS"`
+	ShutdownTimeoutSeconds int    `yaml:"shutdown_timeout_seconds" env:"SHUTDOWN_TIMEOUT_SECONDS"`
+	ReadinessCacheSeconds  int    `yaml:"readiness_cache_seconds" env:"READINESS_CACHE_SECONDS"`
+}
+
+// Auth configures how requests are authenticated. At least one of
+// JWTSecret, JWKSURL, JWKSFile and APIKeysFile must be set unless Disabled.
+type Auth struct {
+	Disabled           bool   `yaml:"disabled" env:"AUTH_DISABLED"`
+	JWTSecret          string `yaml:"jwt_secret" env:"AUTH_JWT_SECRET"`
+	JWKSURL            string `yaml:"jwks_url" env:"AUTH_JWKS_URL"`
+	JWKSFile           string `yaml:"jwks_file" env:"AUTH_JWKS_FILE"`
+	JWKSRefreshMinutes int    `yaml:"jwks_refresh_minutes" env:"AUTH_JWKS_REFRESH_MINUTES"`
+	Issuer             string `yaml:"issuer" env:"AUTH_JWT_ISSUER"`
+	Audience           string `yaml:"audience" env:"AUTH_JWT_AUDIENCE"`
+	UserClaim          string `yaml:"user_claim" env:"AUTH_USER_CLAIM"`
+	RolesClaim         string `yaml:"roles_claim" env:"AUTH_ROLES_CLAIM"`
+	APIKeysFile        string `yaml:"api_keys_file" env:"AUTH_API_KEYS_FILE"`
+}
+
+// History selects the chat history store: dynamodb, memory or bolt.
+type History struct {
+	Store  string `yaml:"store" env:"HISTORY_STORE"`
+	Table  string `yaml:"table" env:"CHAT_TABLE"`
+	DBPath string `yaml:"db_path" env:"HISTORY_DB_PATH"`
+}
+
+// Personas configures the persona registry. Dir is checked for changes
+// every ReloadSeconds; 0 turns hot reloading off.
+type Personas struct {
+	Default       string `yaml:"default" env:"DEFAULT_PERSONA"`
+	Dir           string `yaml:"dir" env:"PERSONA_DIR"`
+	ReloadSeconds int    `yaml:"reload_seconds" env:"PERSONA_RELOAD_INTERVAL"`
+}
+
+// LLM configures the LLM providers and the context sent to them. Provider
+// is the default provider, whose settings must be present.
+type LLM struct {
+	Provider                string `yaml:"provider" env:"LLM_PROVIDER"`
+	NovaInferenceProfileARN string `yaml:"nova_inference_profile_arn" env:"NOVA_INFERENCE_PROFILE_ARN"`
+	ClaudeModelID           string `yaml:"claude_model_id" env:"CLAUDE_MODEL_ID"`
+	ClaudeMaxTokens         int    `yaml:"claude_max_tokens" env:"CLAUDE_MAX_TOKENS"`
+	GuardrailID             string `yaml:"guardrail_id" env:"BEDROCK_GUARDRAIL_ID"`
+	GuardrailVersion        string `yaml:"guardrail_version" env:"BEDROCK_GUARDRAIL_VERSION"`
+	OpenAIBaseURL           string `yaml:"openai_base_url" env:"OPENAI_BASE_URL"`
+	OpenAIAPIKey            string `yaml:"openai_api_key" env:"OPENAI_API_KEY"`
+	OpenAIModel             string `yaml:"openai_model" env:"OPENAI_MODEL"`
+	ContextMaxTurns         int    `yaml:"context_max_turns" env:"CHAT_CONTEXT_MAX_TURNS"`
+	ContextMaxTokens        int    `yaml:"context_max_tokens" env:"CHAT_CONTEXT_MAX_TOKENS"`
+}
+
+// Moderation names the YAML or JSON file with the content policy.
+type Moderation struct {
+	RulesFile string `yaml:"rules_file" env:"MODERATION_RULES"`
+}
+
+// TTS configures the TTS providers. An empty Provider picks vyin when
+// VyinAPIKey is set and none otherwise.
+type TTS struct {
+	Provider       string  `yaml:"provider" env:"TTS_PROVIDER"`
+	VyinAPIKey     string  `yaml:"vyin_api_key" env:"VYIN_API_KEY"`
+	VyinBaseURL    string  `yaml:"vyin_base_url" env:"VYIN_BASE_URL"`
+	TimeoutSeconds int     `yaml:"timeout_seconds" env:"TTS_TIMEOUT_SECONDS"`
+	HTTPRetries    int     `yaml:"http_retries" env:"TTS_HTTP_RETRIES"`
+	HTTPBackoffMS  int     `yaml:"http_backoff_ms" env:"TTS_HTTP_BACKOFF_MS"`
+	Speed          float64 `yaml:"speed" env:"TTS_SPEED"`
+	Mode           string  `yaml:"mode" env:"TTS_MODE"`
+	Emotion        string  `yaml:"emotion" env:"TTS_EMOTION"`
+	Pitch          float64 `yaml:"pitch" env:"TTS_PITCH"`
+	PollyEngine    string  `yaml:"polly_engine" env:"POLLY_ENGINE"`
+}
+
+// SpeechJobs configures the queue of speech jobs.
+type SpeechJobs struct {
+	Workers          int `yaml:"workers" env:"TTS_WORKERS"`
+	SentenceWorkers  int `yaml:"sentence_workers" env:"TTS_SENTENCE_WORKERS"`
+	MaxSentenceChars int `yaml:"max_sentence_chars" env:"TTS_MAX_SENTENCE_CHARS"`
+	QueueSize        int `yaml:"queue_size" env:"TTS_QUEUE_SIZE"`
+	MaxAttempts      int `yaml:"max_attempts" env:"TTS_MAX_ATTEMPTS"`
+	RetryDelayMS     int `yaml:"retry_delay_ms" env:"TTS_RETRY_DELAY_MS"`
+	RetentionMinutes int `yaml:"retention_minutes" env:"TTS_JOB_RETENTION_MINUTES"`
+}
+
+// Audio selects the blob store of generated audio, fs, s3 or none, and the
+// base of audio URLs.
+type Audio struct {
+	Store      string `yaml:"store" env:"BLOB_STORE"`
+	Dir        string `yaml:"dir" env:"BLOB_DIR"`
+	S3Bucket   string `yaml:"s3_bucket" env:"BLOB_S3_BUCKET"`
+	S3Prefix   string `yaml:"s3_prefix" env:"BLOB_S3_PREFIX"`
+	S3Endpoint string `yaml:"s3_endpoint" env:"BLOB_S3_ENDPOINT"`
+	BaseURL    string `yaml:"base_url" env:"AUDIO_BASE_URL"`
+}
+
+// STT configures speech to text. An empty Provider picks whisper when
+// WhisperURL is set, transcribe when TranscribeBucket is set and none
+// otherwise.
+type STT struct {
+	Provider         string `yaml:"provider" env:"STT_PROVIDER"`
+	WhisperURL       string `yaml:"whisper_url" env:"STT_WHISPER_URL"`
+	WhisperAPIKey    string `yaml:"whisper_api_key" env:"STT_WHISPER_API_KEY"`
+	WhisperModel     string `yaml:"whisper_model" env:"STT_WHISPER_MODEL"`
+	TranscribeBucket string `yaml:"transcribe_bucket" env:"STT_TRANSCRIBE_BUCKET"`
+	TranscribePrefix string `yaml:"transcribe_prefix" env:"STT_TRANSCRIBE_PREFIX"`
+}
+
+// Quota selects the counter store, memory or dynamodb, and the limits per
+// user; 0 turns a limit off.
+type Quota struct {
+	Store             string `yaml:"store" env:"QUOTA_STORE"`
+	Table             string `yaml:"table" env:"QUOTA_TABLE"`
+	RequestsPerMinute int64  `yaml:"requests_per_minute" env:"RATE_LIMIT_PER_MINUTE"`
+	DailyInputTokens  int64  `yaml:"daily_input_tokens" env:"QUOTA_DAILY_INPUT_TOKENS"`
+	DailyOutputTokens int64  `yaml:"daily_output_tokens" env:"QUOTA_DAILY_OUTPUT_TOKENS"`
+}
+
+// Usage selects the usage ledger, memory or dynamodb, and the prices per
+// 1000 tokens or characters.
+type Usage struct {
+	Store              string  `yaml:"store" env:"USAGE_STORE"`
+	Table              string  `yaml:"table" env:"USAGE_TABLE"`
+	PriceInputTokens   float64 `yaml:"price_input_tokens" env:"USAGE_PRICE_INPUT_TOKENS"`
+	PriceOutputTokens  float64 `yaml:"price_output_tokens" env:"USAGE_PRICE_OUTPUT_TOKENS"`
+	PriceTTSCharacters float64 `yaml:"price_tts_characters" env:"USAGE_PRICE_TTS_CHARACTERS"`
+}
+
+// Timeouts bound the stages of a request: every call to the history store,
+// to the LLM, to speak a phrase and to transcribe a voice message, retries
+// included. Exceeding one fails
+// the request with 504; 0 leaves the stage bounded by the request only.
+type Timeouts struct {
+	StorageSeconds int `yaml:"storage_seconds" env:"STORAGE_TIMEOUT_SECONDS"`
+	LLMSeconds     int `yaml:"llm_seconds" env:"LLM_TIMEOUT_SECONDS"`
+	TTSSeconds     int `yaml:"tts_seconds" env:"TTS_STAGE_TIMEOUT_SECONDS"`
+	STTSeconds     int `yaml:"stt_seconds" env:"STT_TIMEOUT_SECONDS"`
+}
+
+// Default returns the configuration used for settings that are set
+// nowhere.
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			Addr:                   "0.0.0.0:8888",
+			LogFile:                "app.log",
+			LogLevel:               "info",
+			LogFormat:              "json",
+			LogMaxSizeMB:           100,
+			LogMaxAgeHours:         24,
+			LogMaxBackups:          7,
+			ShutdownTimeoutSeconds: 30,
+			ReadinessCacheSeconds:  30,
+		},
+		Auth: Auth{
+			JWKSRefreshMinutes: 60,
+		},
+		History: History{
+			Store:  "dynamodb",
+			Table:  "Chats",
+			DBPath: "history.db",
+		},
+		Personas: Personas{
+			Default:       "eden",
+			ReloadSeconds: 10,
+		},
+		LLM: LLM{
+			Provider:         "nova",
+			ClaudeMaxTokens:  1024,
+			ContextMaxTurns:  20,
+			ContextMaxTokens: 4000,
+		},
+		TTS: TTS{
+			VyinBaseURL:    "https://uat-persona-sound.data.gamania.com",
+			TimeoutSeconds: 30,
+			HTTPRetries:    2,
+			HTTPBackoffMS:  500,
+			Speed:          1,
+			Mode:           "stream",
+			PollyEngine:    "neural",
+		},
+		SpeechJobs: SpeechJobs{
+			Workers:          4,
+			SentenceWorkers:  3,
+			MaxSentenceChars: 100,
+			QueueSize:        100,
+			MaxAttempts:      3,
+			RetryDelayMS:     1000,
+			RetentionMinutes: 60,
+		},
+		Audio: Audio{
+			Store: "fs",
+			Dir:   "audio-cache",
+		},
+		Quota: Quota{
+			Store:             "memory",
+			Table:             "Quotas",
+			RequestsPerMinute: 60,
+		},
+		Usage: Usage{
+			Store: "memory",
+			Table: "Usage",
+		},
+		Timeouts: Timeouts{
+			StorageSeconds: 10,
+			LLMSeconds:     60,
+			TTSSeconds:     60,
+			STTSeconds:     120,
+		},
+	}
+}
+
+// Validate checks the configuration as a whole and returns all problems
+// found joined into one error.
+func (c *Config) Validate() error {
+	v := &validator{}
+
+	v.require(c.Server.Addr != "", "server.addr must be set")
+	switch c.Server.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		v.fail("unknown server.log_level %q", c.Server.LogLevel)
+	}
+	switch c.Server.LogFormat {
+	case "json", "text":
+	default:
+		v.fail("unknown server.log_format %q", c.Server.LogFormat)
+	}
+	v.require(c.Server.LogMaxSizeMB >= 0, "server.log_max_size_mb must not be negative")
+	v.require(c.Server.LogMaxAgeHours >= 0, "server.log_max_age_hours must not be negative")
+	v.require(c.Server.LogMaxBackups >= 0, "server.log_max_backups must not be negative")
+	v.require(c.Server.ShutdownTimeoutSeconds > 0, "server.shutdown_timeout_seconds must be positive")
+	v.require(c.Server.ReadinessCacheSeconds >= 0, "server.readiness_cache_seconds must not be negative")
+
+	if !c.Auth.Disabled {
+		v.require(c.Auth.JWTSecret != "" || c.Auth.JWKSURL != "" || c.Auth.JWKSFile != "" || c.Auth.APIKeysFile != "",
+			"no authentication configured: set auth.jwt_secret, auth.jwks_url, auth.jwks_file or auth.api_keys_file, or auth.disabled for development")
+		v.require(c.Auth.JWKSRefreshMinutes > 0, "auth.jwks_refresh_minutes must be positive")
+	}
+
+	switch c.History.Store {
+	case "dynamodb":
+		v.require(c.History.Table != "", "history.table must be set for history.store dynamodb")
+	case "memory":
+	case "bolt":
+		v.require(c.History.DBPath != "", "history.db_path must be set for history.store bolt")
+	default:
+		v.fail("unknown history.store %q", c.History.Store)
+	}
+
+	v.require(c.Personas.Default != "", "personas.default must be set")
+	v.require(c.Personas.ReloadSeconds >= 0, "personas.reload_seconds must not be negative")
+
+	switch c.LLM.Provider {
+	case "nova":
+		v.require(c.LLM.NovaInferenceProfileARN != "", "llm.nova_inference_profile_arn must be set for llm.provider nova")
+	case "claude":
+		v.require(c.LLM.ClaudeModelID != "", "llm.claude_model_id must be set for llm.provider claude")
+	case "openai":
+		v.require(c.LLM.OpenAIBaseURL != "", "llm.openai_base_url must be set for llm.provider openai")
+	case "fake":
+	default:
+		v.fail("unknown llm.provider %q", c.LLM.Provider)
+	}
+	v.require(c.LLM.ClaudeMaxTokens > 0, "llm.claude_max_tokens must be positive")
+	v.require(c.LLM.GuardrailVersion == "" || c.LLM.GuardrailID != "", "llm.guardrail_version is set without llm.guardrail_id")
+
+	switch c.TTS.Provider {
+	case "", "polly", "stub", "none":
+	case "vyin":
+		v.require(c.TTS.VyinAPIKey != "", "tts.vyin_api_key must be set for tts.provider vyin")
+	default:
+		v.fail("unknown tts.provider %q", c.TTS.Provider)
+	}
+	v.require(c.TTS.TimeoutSeconds > 0, "tts.timeout_seconds must be positive")
+	v.require(c.TTS.HTTPRetries >= 0, "tts.http_retries must not be negative")
+	v.require(c.TTS.HTTPBackoffMS >= 0, "tts.http_backoff_ms must not be negative")
+	// The bounds of the speed clients may ask for
+	v.require(c.TTS.Speed >= 0.5 && c.TTS.Speed <= 2, "tts.speed %v outside of [0.5, 2]", c.TTS.Speed)
+
+	v.require(c.SpeechJobs.Workers > 0, "speech_jobs.workers must be positive")
+	v.require(c.SpeechJobs.SentenceWorkers > 0, "speech_jobs.sentence_workers must be positive")
+	v.require(c.SpeechJobs.MaxSentenceChars > 0, "speech_jobs.max_sentence_chars must be positive")
+	v.require(c.SpeechJobs.QueueSize > 0, "speech_jobs.queue_size must be positive")
+	v.require(c.SpeechJobs.MaxAttempts > 0, "speech_jobs.max_attempts must be positive")
+	v.require(c.SpeechJobs.RetryDelayMS >= 0, "speech_jobs.retry_delay_ms must not be negative")
+	v.require(c.SpeechJobs.RetentionMinutes > 0, "speech_jobs.retention_minutes must be positive")
+
+	switch c.Audio.Store {
+	case "fs":
+		v.require(c.Audio.Dir != "", "audio.dir must be set for audio.store fs")
+	case "s3":
+		v.require(c.Audio.S3Bucket != "", "audio.s3_bucket must be set for audio.store s3")
+	case "none":
+	default:
+		v.fail("unknown audio.store %q", c.Audio.Store)
+	}
+
+	switch c.STT.Provider {
+	case "", "fake", "none":
+	case "whisper":
+		v.require(c.STT.WhisperURL != "", "stt.whisper_url must be set for stt.provider whisper")
+	case "transcribe":
+		v.require(c.STT.TranscribeBucket != "", "stt.transcribe_bucket must be set for stt.provider transcribe")
+	default:
+		v.fail("unknown stt.provider %q", c.STT.Provider)
+	}
+
+	v.store("quota", c.Quota.Store, c.Quota.Table)
+	v.require(c.Quota.RequestsPerMinute >= 0, "quota.requests_per_minute must not be negative")
+	v.require(c.Quota.DailyInputTokens >= 0, "quota.daily_input_tokens must not be negative")
+	v.require(c.Quota.DailyOutputTokens >= 0, "quota.daily_output_tokens must not be negative")
+
+	v.store("usage", c.Usage.Store, c.Usage.Table)
+	v.require(c.Usage.PriceInputTokens >= 0 && c.Usage.PriceOutputTokens >= 0 && c.Usage.PriceTTSCharacters >= 0,
+		"usage prices must not be negative")
+
+	v.require(c.Timeouts.StorageSeconds >= 0, "timeouts.storage_seconds must not be negative")
+	v.require(c.Timeouts.LLMSeconds >= 0, "timeouts.llm_seconds must not be negative")
+	v.require(c.Timeouts.TTSSeconds >= 0, "timeouts.tts_seconds must not be negative")
+	v.require(c.Timeouts.STTSeconds >= 0, "timeouts.stt_seconds must not be negative")
+
+	return errors.Join(v.errs...)
+}
+
+// validator collects the problems of a configuration.
+type validator struct {
+	errs []error
+}
+
+func (v *validator) fail(format string, args ...interface{}) {
+	v.errs = append(v.errs, fmt.Errorf(format, args...))
+}
+
+func (v *validator) require(ok bool, format string, args ...interface{}) {
+	if !ok {
+		v.fail(format, args...)
+	}
+}
+
+// store checks a section with a memory or dynamodb store.
+func (v *validator) store(section, kind, table string) {
+	switch kind {
+	case "memory":
+	case "dynamodb":
+		v.require(table != "", "%s.table must be set for %s.store dynamodb", section, section)
+	default:
+		v.fail("unknown %s.store %q", section, kind)
+	}
+}
@@ -0,0 +1,149 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	return file
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := writeConfig(t, `
+server:
+  addr: file:1
+  log_file: file.log
+auth:
+  disabled: true
+llm:
+  provider: fake
+tts:
+  speed: 1.5
+speech_jobs:
+  workers: 8
+`)
+	t.Setenv("LOG_FILE", "env.log")
+	t.Setenv("TTS_WORKERS", "2")
+	t.Setenv("TTS_SPEED", "")
+
+	cfg, err := Load([]string{"-config", file, "-speech_jobs.workers", "6", "-quota.daily_input_tokens=500"})
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	if cfg.Server.Addr != "file:1" || cfg.Server.LogFile != "env.log" {
+		t.Fatalf("Expected the address of the file and the log file of the environment, got %+v", cfg.Server)
+	}
+	if cfg.SpeechJobs.Workers != 6 || cfg.Quota.DailyInputTokens != 500 {
+		t.Fatalf("Expected the flags to win, got %+v %+v", cfg.SpeechJobs, cfg.Quota)
+	}
+	if cfg.TTS.Speed != 1.5 {
+		t.Fatalf("Expected an empty variable to count as unset, got speed %v", cfg.TTS.Speed)
+	}
+	if cfg.SpeechJobs.QueueSize != 100 || cfg.History.Table != "Chats" {
+		t.Fatalf("Expected defaults for settings set nowhere, got %+v %+v", cfg.SpeechJobs, cfg.History)
+	}
+}
+
+func TestLoadFileFromEnv(t *testing.T) {
+	t.Setenv("CONFIG_FILE", writeConfig(t, "auth:\n  disabled: true\nllm:\n  provider: fake\n"))
+
+	cfg, err := Load([]string{"-auth.disabled=false", "-auth.jwt_secret", "secret"})
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Auth.Disabled || cfg.Auth.JWTSecret != "secret" || cfg.LLM.Provider != "fake" {
+		t.Fatalf("Unexpected config %+v %+v", cfg.Auth, cfg.LLM)
+	}
+}
+
+func TestLoadRejectsBadInput(t *testing.T) {
+	cases := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		want []string
+	}{
+		{
+			name: "unknown key",
+			file: "server:\n  adress: x\n",
+			want: []string{"adress"},
+		},
+		{
+			name: "bad environment",
+			env:  map[string]string{"TTS_WORKERS": "many", "AUTH_DISABLED": "maybe"},
+			want: []string{"TTS_WORKERS", "AUTH_DISABLED"},
+		},
+		{
+			name: "bad flag",
+			args: []string{"-quota.requests_per_minute", "lots"},
+			want: []string{"quota.requests_per_minute"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			args := tc.args
+			if tc.file != "" {
+				args = append([]string{"-config", writeConfig(t, tc.file)}, args...)
+			}
+			for key, value := range tc.env {
+				t.Setenv(key, value)
+			}
+
+			_, err := Load(args)
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Fatalf("Expected %q in %v", want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateReportsAllProblems(t *testing.T) {
+	cfg := Default()
+	cfg.History.Store = "sqlite"
+	cfg.Audio.Store = "s3"
+	cfg.STT.Provider = "whisper"
+	cfg.SpeechJobs.Workers = 0
+	cfg.Server.LogLevel = "chatty"
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("Expected the config to be invalid")
+	}
+	for _, want := range []string{
+		"no authentication configured",
+		`unknown history.store "sqlite"`,
+		"llm.nova_inference_profile_arn must be set",
+		"audio.s3_bucket must be set",
+		"stt.whisper_url must be set",
+		"speech_jobs.workers must be positive",
+		`unknown server.log_level "chatty"`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %q in %v", want, err)
+		}
+	}
+}
+
+func TestDefaultIsValidOnceRequiredSettingsAreSet(t *testing.T) {
+	cfg := Default()
+	cfg.Auth.JWTSecret = "secret"
+	cfg.LLM.NovaInferenceProfileARN = "arn:aws:bedrock:us-east-1:123456789012:inference-profile/us.amazon.nova-pro-v1:0"
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Expected a valid config, got %v", err)
+	}
+}
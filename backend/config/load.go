@@ -0,0 +1,165 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Load returns the validated configuration for the command line arguments
+// args, without the program name. Settings are taken from, in increasing
+// order of precedence, the defaults, the YAML file named by the -config
+// flag or CONFIG_FILE, the environment and the flags. Empty environment
+// variables count as unset.
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+	settings := cfg.settings()
+
+	flags := flag.NewFlagSet("backend", flag.ContinueOnError)
+	file := flags.String("config", os.Getenv("CONFIG_FILE"), "YAML configuration `file`")
+	for _, s := range settings {
+		flags.Var(s.flag, s.name, "overrides $"+s.env)
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *file != "" {
+		if err := cfg.readFile(*file); err != nil {
+			return nil, err
+		}
+	}
+
+	var errs []error
+	for _, s := range settings {
+		if raw := os.Getenv(s.env); raw != "" {
+			if err := setValue(s.value, raw); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", s.env, err))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	for _, s := range settings {
+		if s.flag.set {
+			// flagValue.Set has checked the value already
+			_ = setValue(s.value, s.flag.raw)
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// readFile reads the YAML file name over c. Unknown keys are an error so
+// that typos don't go unnoticed.
+func (c *Config) readFile(name string) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && err != io.EOF {
+		return fmt.Errorf("config file %s: %w", name, err)
+	}
+	return nil
+}
+
+// setting is a single field of a Config.
+type setting struct {
+	// name is the flag name, the YAML keys of section and field joined by a dot
+	name  string
+	env   string
+	value reflect.Value
+	flag  *flagValue
+}
+
+// settings lists the fields of the sections of c.
+func (c *Config) settings() []setting {
+	var settings []setting
+	sections := reflect.ValueOf(c).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+		prefix := sections.Type().Field(i).Tag.Get("yaml")
+		for j := 0; j < section.NumField(); j++ {
+			field := section.Type().Field(j)
+			settings = append(settings, setting{
+				name:  prefix + "." + field.Tag.Get("yaml"),
+				env:   field.Tag.Get("env"),
+				value: section.Field(j),
+				flag:  &flagValue{typ: field.Type},
+			})
+		}
+	}
+	return settings
+}
+
+// setValue parses raw into v, a string, bool, int, int64 or float64.
+func setValue(v reflect.Value, raw string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", raw)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", raw)
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", raw)
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
+
+// flagValue remembers the value of a flag, so flags can be applied after
+// the file and the environment.
+type flagValue struct {
+	typ reflect.Type
+	raw string
+	set bool
+}
+
+func (f *flagValue) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.raw
+}
+
+func (f *flagValue) Set(raw string) error {
+	if err := setValue(reflect.New(f.typ).Elem(), raw); err != nil {
+		return err
+	}
+	f.raw = raw
+	f.set = true
+	return nil
+}
+
+// IsBoolFlag lets boolean settings be given as -name without a value.
+func (f *flagValue) IsBoolFlag() bool {
+	return f.typ.Kind() == reflect.Bool
+}
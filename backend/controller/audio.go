@@ -0,0 +1,73 @@
+package controller
+
+import (
+	"backend/models"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetAudio answers GET /audio/<id>: cached audio keys are served as audio,
+// anything else is looked up as a speech job.
+func (ops *BaseController) GetAudio(c *gin.Context) {
+	if models.IsAudioKey(c.Param("id")) {
+		ops.GetAudioFile(c)
+		return
+	}
+	ops.GetAudioJob(c)
+}
+
+// GetAudioFile serves cached audio. The content never changes for a key, so
+// clients may cache it forever; range requests let players seek.
+func (ops *BaseController) GetAudioFile(c *gin.Context) {
+	key := c.Param("id")
+	blob, err := ops.Service.OpenAudio(c.Request.Context(), key)
+	if err != nil {
+		handleServiceError(c, err)
+		return
+	}
+	defer blob.Close()
+
+	if blob.ContentType != "" {
+		c.Header("Content-Type", blob.ContentType)
+	}
+	c.Header("ETag", `"`+key+`"`)
+	c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeContent(c.Writer, c.Request, "", blob.ModTime, blob)
+}
+
+// GetAudioJob answers GET /audio/<job_id> with the state of a speech job.
+// Clients asking for text/event-stream, like EventSource does, get a
+// "status" event right away and, unless the job already finished, another
+// one once it does.
+func (ops *BaseController) GetAudioJob(c *gin.Context) {
+	id := c.Param("id")
+	job, err := ops.Service.SpeechJob(id)
+	if err == nil && !ownsResource(c, job.UserID) {
+		err = models.ErrSpeechJobNotFound
+	}
+	if err != nil {
+		handleServiceError(c, err)
+		return
+	}
+
+	if !strings.Contains(c.GetHeader("Accept"), "text/event-stream") {
+		HandleSucccessResponse(c, "", job)
+		return
+	}
+
+	c.SSEvent("status", job)
+	c.Writer.Flush()
+	if job.Finished() {
+		return
+	}
+
+	ctx := c.Request.Context()
+	job, err = ops.Service.WaitSpeechJob(ctx, id)
+	if err != nil || ctx.Err() != nil {
+		return
+	}
+	c.SSEvent("status", job)
+	c.Writer.Flush()
+}
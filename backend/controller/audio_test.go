@@ -0,0 +1,76 @@
+package controller
+
+import (
+	"backend/models"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGetAudioJob(t *testing.T) {
+	service := newStubService()
+	router := newTestRouter(service)
+
+	w := postJSON(router, "/chat", ChatRequest{UserID: "fan", Message: "hi"})
+	var reply ChatResponse
+	decodeData(t, w.Body.Bytes(), &reply)
+	waitForAudio(t, service, reply.AudioJobID)
+
+	w = sendJSON(router, http.MethodGet, "/audio/"+reply.AudioJobID, nil)
+	var job models.SpeechJob
+	decodeData(t, w.Body.Bytes(), &job)
+	if job.Status != models.SpeechJobDone || job.ChatID != reply.ID || job.AudioURL == "" {
+		t.Fatalf("Unexpected job %+v", job)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/audio/"+reply.AudioJobID, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if !strings.Contains(w.Body.String(), "event:status") || !strings.Contains(w.Body.String(), job.AudioURL) {
+		t.Fatalf("Expected a status event with the audio URL, got %s", w.Body.String())
+	}
+
+	w = sendJSON(router, http.MethodGet, "/audio/unknown", nil)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for an unknown job, got %d", w.Code)
+	}
+}
+
+func TestGetAudioFile(t *testing.T) {
+	blobs, err := models.NewFSBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := strings.Repeat("ab", 32)
+	if err := blobs.Put(context.Background(), key, []byte("0123456789"), "audio/mpeg"); err != nil {
+		t.Fatal(err)
+	}
+
+	service := newStubService()
+	service.AudioService = models.NewSpeechCache(nil, blobs, "")
+	router := newTestRouter(service)
+
+	w := sendJSON(router, http.MethodGet, "/audio/"+key, nil)
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+		t.Fatalf("Expected the audio, got %d %q", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Type") != "audio/mpeg" || w.Header().Get("ETag") == "" {
+		t.Fatalf("Unexpected headers %v", w.Header())
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/audio/"+key, nil)
+	req.Header.Set("Range", "bytes=2-5")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusPartialContent || w.Body.String() != "2345" {
+		t.Fatalf("Expected bytes 2-5, got %d %q", w.Code, w.Body.String())
+	}
+
+	w = sendJSON(router, http.MethodGet, "/audio/"+strings.Repeat("cd", 32), nil)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for unknown audio, got %d", w.Code)
+	}
+}
@@ -9,6 +9,7 @@ import (
 
 type BaseController struct {
 	Service models.Service
+	Sockets *SocketHub
 }
 
 type ResponseMessage struct {
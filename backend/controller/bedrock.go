@@ -1,27 +1,85 @@
 package controller
 
 import (
+	"backend/middleware/auth"
+	"backend/models"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// BedrockRequest asks for a reply to a single prompt. The system prompt of
+// Persona applies only when one is named; the sampling parameters and
+// Guardrail of the persona apply either way, and those of the request
+// replace them when set.
 type BedrockRequest struct {
-	Prompt string `json:"prompt"`
+	Prompt  string `json:"prompt"`
+	Persona string `json:"persona"`
+	models.InferenceConfig
+	Guardrail *models.Guardrail `json:"guardrail,omitempty"`
 }
 
+// HeaderStopReason reports why the model stopped generating a reply.
+const HeaderStopReason = "X-Stop-Reason"
+
 func (ops *BaseController) GenerateResponse(c *gin.Context) {
 	var request BedrockRequest
 	if err := c.ShouldBindJSON(&request); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
 		return
 	}
+	if err := request.InferenceConfig.Validate(); err != nil {
+		handleServiceError(c, err)
+		return
+	}
+	if request.Guardrail != nil && request.Guardrail.ID == "" {
+		handleServiceError(c, models.ErrInvalidInferenceConfig)
+		return
+	}
 
-	response, err := ops.Service.GenerateResponse(request.Prompt)
+	// Prompts aren't tied to a user, so only authenticated ones are charged
+	identity := auth.FromContext(c)
+	if identity != nil && !ops.allowTokens(c, identity.UserID) {
+		return
+	}
+
+	persona, err := ops.Service.Persona(request.Persona)
 	if err != nil {
-		HandleFailedResponse(c, http.StatusInternalServerError, err)
+		handleServiceError(c, err)
+		return
+	}
+
+	input := ops.Service.Moderate(models.ModerationInput, request.Prompt, persona)
+	if input.Blocked() {
+		handleServiceError(c, models.ErrContentBlocked)
 		return
 	}
+	if input.Replaced() {
+		HandleSucccessResponse(c, "", input.Text)
+		return
+	}
+
+	opts := persona.ChatOptions()
+	if request.Persona == "" {
+		// Plain prompts are sent as they are
+		opts.System = ""
+	}
+	opts.InferenceConfig = opts.InferenceConfig.Merge(request.InferenceConfig)
+	if request.Guardrail != nil {
+		opts.Guardrail = request.Guardrail
+	}
+
+	started := time.Now()
+	completion, err := ops.Service.GenerateResponse(c.Request.Context(), input.Text, opts)
+	if err != nil {
+		handleServiceError(c, err)
+		return
+	}
+	if identity != nil {
+		ops.recordUsage(c.Request.Context(), newUsage(c.FullPath(), identity.UserID, "", persona, completion, started))
+	}
 
-	HandleSucccessResponse(c, "", response)
+	c.Header(HeaderStopReason, completion.StopReason)
+	HandleSucccessResponse(c, "", ops.Service.Moderate(models.ModerationOutput, completion.Text, persona).Text)
 } 
\ No newline at end of file
@@ -0,0 +1,68 @@
+package controller
+
+import (
+	"backend/models"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestGenerateResponseInferenceConfig(t *testing.T) {
+	router := newTestRouter(newStubService())
+
+	request := BedrockRequest{Prompt: "one two three END four"}
+	request.StopSequences = []string{"END"}
+	w := postJSON(router, "/generate_response", request)
+	if w.Code != http.StatusOK || w.Header().Get(HeaderStopReason) != "stop_sequence" {
+		t.Fatalf("Expected the reply to stop at END, got %d %v", w.Code, w.Header())
+	}
+	var response struct {
+		Data string `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || response.Data != "Fake reply #1: one two three " {
+		t.Fatalf("Unexpected reply %s", w.Body.String())
+	}
+
+	w = postJSON(router, "/generate_response", map[string]interface{}{"prompt": "hi there, how are you?", "max_tokens": 3})
+	if w.Code != http.StatusOK || w.Header().Get(HeaderStopReason) != "max_tokens" {
+		t.Fatalf("Expected the reply to stop at max_tokens, got %d %v", w.Code, w.Header())
+	}
+
+	for _, body := range []map[string]interface{}{
+		{"prompt": "hi", "temperature": 1.5},
+		{"prompt": "hi", "top_p": -0.1},
+		{"prompt": "hi", "guardrail": map[string]string{"version": "1"}},
+	} {
+		w := postJSON(router, "/generate_response", body)
+		var apiErr apiError
+		if err := json.Unmarshal(w.Body.Bytes(), &apiErr); w.Code != http.StatusBadRequest || err != nil || apiErr.Code != "invalid_inference_config" {
+			t.Errorf("Expected 400 invalid_inference_config for %v, got %d: %s", body, w.Code, w.Body.String())
+		}
+	}
+}
+
+// systemRecorder records the system prompts of single prompt replies.
+type systemRecorder struct {
+	*stubService
+	systems []string
+}
+
+func (s *systemRecorder) GenerateResponse(ctx context.Context, prompt string, opts models.ChatOptions) (*models.ChatCompletion, error) {
+	s.systems = append(s.systems, opts.System)
+	return s.stubService.GenerateResponse(ctx, prompt, opts)
+}
+
+func TestGenerateResponseSystemPromptOnlyForNamedPersona(t *testing.T) {
+	service := &systemRecorder{stubService: newStubService()}
+	router := newTestRouter(service)
+
+	for _, request := range []BedrockRequest{{Prompt: "hi"}, {Prompt: "hi", Persona: "eden"}} {
+		if w := postJSON(router, "/generate_response", request); w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+	if len(service.systems) != 2 || service.systems[0] != "" || service.systems[1] == "" {
+		t.Fatalf("Expected only the named persona to send a system prompt, got %q", service.systems)
+	}
+}
@@ -1,22 +1,45 @@
 package controller
 
 import (
+	"backend/metrics"
 	"backend/models"
+	"context"
+	"errors"
+	"log/slog"
 	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// ChatRequest is a message to a session. SessionID may be empty for the
+// default session. Persona overrides the persona of the session for this
+// message; Type names the persona of a session created by the message.
 type ChatRequest struct {
-	UserID  string `json:"user_id"`
-	Message string `json:"message"`
-	Type    string `json:"type"`
+	UserID    string `json:"user_id"`
+	SessionID string `json:"session_id"`
+	Message   string `json:"message"`
+	Type      string `json:"type"`
+	Persona   string `json:"persona"`
+	// TTS adjusts the speech of the reply, like its speed.
+	TTS models.SpeechOptions `json:"tts"`
 }
 
+// ChatResponse is the reply to a ChatRequest. Title is set once the session
+// has one. The speech of the reply is generated in the background by the
+// speech job AudioJobID, so AudioURL is usually still empty. Replies to
+// voice messages also carry the Transcript and the VoiceURL of the
+// recording.
 type ChatResponse struct {
-	Text     string `json:"text"`
-	AudioURL string `json:"audio_url"`
+	ID         string `json:"id"`
+	SessionID  string `json:"session_id"`
+	Title      string `json:"title,omitempty"`
+	Text       string `json:"text"`
+	AudioURL   string `json:"audio_url"`
+	AudioJobID string `json:"audio_job_id,omitempty"`
+	StopReason string `json:"stop_reason,omitempty"`
+	Transcript string `json:"transcript,omitempty"`
+	VoiceURL   string `json:"voice_url,omitempty"`
 }
 
 func (ops *BaseController) ProcessChat(c *gin.Context) {
@@ -25,64 +48,237 @@ func (ops *BaseController) ProcessChat(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
 		return
 	}
+	var ok bool
+	if request.UserID, ok = requestUser(c, request.UserID); !ok {
+		return
+	}
+	if err := request.TTS.Validate(); err != nil {
+		handleServiceError(c, err)
+		return
+	}
+	if !ops.allowTokens(c, request.UserID) {
+		return
+	}
+
+	if response := ops.reply(c, request, newChat("user", request.Message)); response != nil {
+		// Return response to frontend
+		HandleSucccessResponse(c, "", response)
+	}
+}
+
+// reply answers userChat, the message of request, and saves both to the
+// session. On failure it responds with the error and returns nil.
+func (ops *BaseController) reply(c *gin.Context, request ChatRequest, userChat models.Chat) *ChatResponse {
+	// Get the history of the session
+	ctx := c.Request.Context()
+	session, chats, err := ops.loadSession(ctx, request)
+	if err != nil {
+		handleServiceError(c, err)
+		return nil
+	}
+
+	persona, speaker, err := ops.chatPersona(request, session)
+	if err != nil {
+		handleServiceError(c, err)
+		return nil
+	}
+
+	// Check the message against the content policy
+	canned, err := ops.moderateInput(&request, &userChat, persona)
+	if err != nil {
+		handleServiceError(c, err)
+		return nil
+	}
+
+	// Get response from Bedrock, using the earlier chats as context
+	started := time.Now()
+	completion := cannedCompletion(canned)
+	if canned == "" {
+		completion, err = ops.Service.GenerateChatResponse(ctx, chats, request.Message, persona.ChatOptions())
+		metrics.ObserveStage(metrics.StageLLM, started, err)
+		if err != nil {
+			handleServiceError(c, err)
+			return nil
+		}
+	}
+	usage := newUsage(c.FullPath(), request.UserID, session.SessionID, persona, completion, started)
+	defer ops.recordUsage(ctx, usage)
+
+	// Add the moderated assistant response to history
+	assistantChat := ops.moderateReply(request.UserID, completion, persona)
+
+	// Add the new chats to history
+	if err := ops.saveChats(ctx, session, userChat, assistantChat); err != nil {
+		handleServiceError(c, err)
+		return nil
+	}
+
+	// Generate speech from Vyin AI in the voice of the session, in the
+	// background
+	audioJobID := ops.submitSpeech(session, assistantChat, persona, speaker, request.TTS)
+	if audioJobID != "" {
+		addSpeech(usage, persona, assistantChat.Content)
+	}
+
+	// Name a new session after its first exchange
+	title := session.Title
+	if len(chats) == 0 {
+		title = ops.titleSession(ctx, session, persona, userChat, assistantChat)
+	}
+
+	return &ChatResponse{
+		ID:         assistantChat.ID,
+		SessionID:  session.SessionID,
+		Title:      title,
+		Text:       assistantChat.Content,
+		AudioJobID: audioJobID,
+		StopReason: completion.StopReason,
+	}
+}
+
+// contextChatLimit is how many of the latest chats are loaded as context
+// for a reply. The LLM service trims them further to its context budget.
+const contextChatLimit = 100
+
+// loadSession returns the requested session and its latest chats. The
+// default session is created on the first message of a new user, other
+// sessions must have been created before and must not be archived.
+func (ops *BaseController) loadSession(ctx context.Context, request ChatRequest) (session *models.History, chats []models.Chat, err error) {
+	defer func(started time.Time) {
+		metrics.ObserveStage(metrics.StageHistoryLoad, started, err)
+	}(time.Now())
+
+	session, err = ops.Service.Get_session(ctx, request.UserID, request.SessionID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if session == nil {
+		if request.SessionID != "" && request.SessionID != models.DefaultSessionID {
+			return nil, nil, models.ErrSessionNotFound
+		}
 
-	// Get user history
-	exists, chats := ops.Service.Search_chat(request.UserID)
-	if !exists {
 		// Create new history if user doesn't exist
-		history := models.History{
+		persona, speaker, err := ops.chatPersona(request, &models.History{Type: request.Type})
+		if err != nil {
+			return nil, nil, err
+		}
+		now := time.Now()
+		session = &models.History{
 			UserID:      request.UserID,
-			Type:        request.Type,
+			SessionID:   models.DefaultSessionID,
+			Type:        persona.Name,
+			VoiceID:     speaker,
 			Chats:       []models.Chat{},
-			LastUpdated: time.Now(),
+			CreatedAt:   now,
+			LastUpdated: now,
 		}
-		if err := ops.Service.Create_chat(history); err != nil {
-			HandleFailedResponse(c, http.StatusInternalServerError, err)
-			return
+		// Another request may have created it meanwhile, which is fine
+		if err := ops.Service.Create_chat(ctx, *session); err != nil && !errors.Is(err, models.ErrHistoryExists) {
+			return nil, nil, err
 		}
+		return session, []models.Chat{}, nil
 	}
 
-	// Add user message to history
-	userChat := models.Chat{
-		Role:      "user",
-		Content:   request.Message,
-		Time:      time.Now().Format(time.RFC3339),
-		Timestamp: time.Now(),
+	if session.Archived {
+		return nil, nil, models.ErrSessionArchived
+	}
+	page, err := ops.Service.List_chat(ctx, request.UserID, session.SessionID, contextChatLimit, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	return session, page.Chats, nil
+}
+
+// saveChats appends the chats of an exchange to the session.
+func (ops *BaseController) saveChats(ctx context.Context, session *models.History, chats ...models.Chat) error {
+	started := time.Now()
+	err := ops.Service.Append_chat(ctx, session.UserID, session.SessionID, chats...)
+	metrics.ObserveStage(metrics.StageHistorySave, started, err)
+	return err
+}
+
+// chatPersona returns the persona answering a chat and the speaker of its
+// replies. A persona named in the request applies with its own voice.
+// Otherwise the session type names the persona, falling back to the default
+// persona for types of older histories that aren't personas, and the voice
+// of the session is used.
+func (ops *BaseController) chatPersona(request ChatRequest, session *models.History) (*models.Persona, string, error) {
+	if request.Persona != "" {
+		persona, err := ops.Service.Persona(request.Persona)
+		if err != nil {
+			return nil, "", err
+		}
+		return persona, persona.SpeakerName, nil
 	}
 
-	// Get response from Bedrock
-	response, err := ops.Service.GenerateResponse(request.Message)
+	persona, err := ops.Service.Persona(session.Type)
+	if errors.Is(err, models.ErrPersonaNotFound) {
+		persona, err = ops.Service.Persona("")
+	}
 	if err != nil {
-		HandleFailedResponse(c, http.StatusInternalServerError, err)
-		return
+		return nil, "", err
+	}
+	if session.VoiceID != "" {
+		return persona, session.VoiceID, nil
 	}
+	return persona, persona.SpeakerName, nil
+}
 
-	// Generate speech from Vyin AI
-	audioURL, err := ops.Service.GenerateSpeech(response, 1, "max") // You can customize the voice ID
+// submitSpeech queues the speech of an assistant chat and returns the job
+// ID. The reply is useful without audio, so a full queue is only logged and
+// yields an empty ID.
+func (ops *BaseController) submitSpeech(session *models.History, chat models.Chat, persona *models.Persona, speaker string, opts models.SpeechOptions) string {
+	opts.Provider = persona.TTSProvider
+	job, err := ops.Service.SubmitSpeechJob(models.SpeechRequest{
+		UserID:      session.UserID,
+		SessionID:   session.SessionID,
+		ChatID:      chat.ID,
+		Text:        chat.Content,
+		ModelID:     persona.ModelID,
+		SpeakerName: speaker,
+		Options:     opts,
+	})
 	if err != nil {
-		HandleFailedResponse(c, http.StatusInternalServerError, err)
-		return
+		slog.Warn("Failed to queue speech of chat", "chat_id", chat.ID, "user_id", session.UserID, "error", err)
+		return ""
 	}
+	return job.ID
+}
 
-	// Add assistant response to history
-	assistantChat := models.Chat{
-		Role:      "assistant",
-		Content:   response,
-		Time:      time.Now().Format(time.RFC3339),
-		AudioURL:  audioURL,
-		Timestamp: time.Now(),
+// titleMaxTokens caps the reply of the LLM when titling a session.
+const titleMaxTokens = 32
+
+// titleSession asks the LLM for a title of a session that has none yet and
+// saves it. The guardrail and sampling parameters of persona apply, with
+// the reply capped at titleMaxTokens. The reply has already been stored, so
+// failing to title the session is only logged.
+func (ops *BaseController) titleSession(ctx context.Context, session *models.History, persona *models.Persona, chats ...models.Chat) string {
+	if session.Title != "" {
+		return session.Title
 	}
 
-	// Update history with new chats
-	chats = append(chats, userChat, assistantChat)
-	if err := ops.Service.Insert_chat(request.UserID, chats); err != nil {
-		HandleFailedResponse(c, http.StatusInternalServerError, err)
-		return
+	opts := persona.ChatOptions()
+	opts.MaxTokens = titleMaxTokens
+	title, err := ops.Service.GenerateTitle(ctx, chats, opts)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to generate a session title", "session_id", session.SessionID, "user_id", session.UserID, "error", err)
+		return ""
+	}
+	if _, err := ops.Service.Update_session(ctx, session.UserID, session.SessionID, models.SessionUpdate{Title: &title}); err != nil {
+		slog.WarnContext(ctx, "Failed to save the session title", "session_id", session.SessionID, "user_id", session.UserID, "error", err)
+		return ""
 	}
+	return title
+}
 
-	// Return response to frontend
-	HandleSucccessResponse(c, "", ChatResponse{
-		Text:     response,
-		AudioURL: audioURL,
-	})
+func newChat(role, content string) models.Chat {
+	now := time.Now()
+	return models.Chat{
+		ID:        models.NewChatID(),
+		Role:      role,
+		Content:   content,
+		Time:      now.Format(time.RFC3339),
+		Timestamp: now,
+	}
 }
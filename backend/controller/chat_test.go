@@ -0,0 +1,267 @@
+package controller
+
+import (
+	"backend/models"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// stubService serves chats from the in-memory store, replies with the fake
+// LLM provider, transcribes with the fake STT service, counts quotas in
+// memory without limits, records usage in memory, moderates only the
+// forbidden topics of personas and checks no dependencies, so the chat flow
+// runs without AWS or Vyin.
+type stubService struct {
+	models.HistoryService
+	models.BedrockService
+	models.PersonaService
+	models.AudioService
+	models.STTService
+	models.QuotaService
+	models.UsageService
+	models.ModerationService
+	models.HealthService
+	*models.SpeechJobQueue
+}
+
+func newStubService() *stubService {
+	return newStubServiceWithPersonas("")
+}
+
+// newStubServiceWithPersonas also loads the personas in personaDir.
+func newStubServiceWithPersonas(personaDir string) *stubService {
+	registry := models.NewProviderRegistry(models.ProviderFake)
+	registry.Register(models.NewFakeProvider())
+	personas, err := models.NewPersonaRegistry(personaDir, "eden")
+	if err != nil {
+		panic(err)
+	}
+	moderation, err := models.NewModerationService(models.ModerationPolicy{})
+	if err != nil {
+		panic(err)
+	}
+	store := models.NewMemoryHistoryStore()
+	service := &stubService{
+		HistoryService:    models.NewHistoryService(store),
+		BedrockService:    models.NewBedrockServiceWithRegistry(registry),
+		PersonaService:    personas,
+		AudioService:      models.NewSpeechCache(nil, nil, ""),
+		STTService:        models.NewFakeSTT(),
+		QuotaService:      models.NewQuotaService(models.NewMemoryCounterStore(), models.QuotaLimits{}),
+		UsageService:      models.NewUsageService(models.NewMemoryUsageLedger(), models.UsagePrices{}),
+		ModerationService: moderation,
+		HealthService:     models.NewHealthService(0),
+	}
+	service.SpeechJobQueue = models.NewSpeechJobQueue(service, service, store, models.SpeechJobOptions{Workers: 1, QueueSize: 10})
+	return service
+}
+
+// waitForAudio waits for the speech job of a reply and returns its audio
+// URL.
+func waitForAudio(t *testing.T, service models.Service, jobID string) string {
+	t.Helper()
+	job, err := service.WaitSpeechJob(context.Background(), jobID)
+	if err != nil || job.Status != models.SpeechJobDone {
+		t.Fatalf("Expected the speech job to finish, got %+v, %v", job, err)
+	}
+	return job.AudioURL
+}
+
+func (s *stubService) GenerateSpeech(ctx context.Context, text string, model_id int, speaker_name string, opts models.SpeechOptions) (string, error) {
+	return "https://audio.example/" + speaker_name, nil
+}
+
+func newTestRouter(service models.Service) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	controller := &BaseController{Service: service, Sockets: NewSocketHub()}
+	router := gin.New()
+	router.POST("/generate_response", controller.GenerateResponse)
+	router.POST("/chat", controller.ProcessChat)
+	router.POST("/chat/stream", controller.ProcessChatStream)
+	router.POST("/chat/voice", controller.ProcessVoiceChat)
+	router.GET("/audio/:id", controller.GetAudio)
+	router.GET("/ws/chat", controller.ChatSocket)
+	router.GET("/sessions", controller.ListSessions)
+	router.POST("/sessions", controller.CreateSession)
+	router.PATCH("/sessions/:session_id", controller.UpdateSession)
+	router.DELETE("/sessions/:session_id", controller.DeleteSession)
+	router.GET("/admin/usage", controller.GetUsage)
+	router.GET("/healthz", controller.Healthz)
+	router.GET("/readyz", controller.Readyz)
+	return router
+}
+
+func postJSON(router http.Handler, path string, body interface{}) *httptest.ResponseRecorder {
+	return sendJSON(router, http.MethodPost, path, body)
+}
+
+func sendJSON(router http.Handler, method, path string, body interface{}) *httptest.ResponseRecorder {
+	payload, _ := json.Marshal(body)
+	req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestProcessChatKeepsContext(t *testing.T) {
+	service := newStubService()
+	router := newTestRouter(service)
+
+	turns := []struct {
+		message string
+		want    string
+	}{
+		{"hi", "Fake reply #1: hi"},
+		{"again", "Fake reply #2: again"},
+	}
+	for _, turn := range turns {
+		w := postJSON(router, "/chat", ChatRequest{UserID: "fan", Message: turn.message})
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var response struct {
+			Data ChatResponse `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if response.Data.Text != turn.want || response.Data.ID == "" || response.Data.AudioJobID == "" {
+			t.Fatalf("Unexpected response %+v", response.Data)
+		}
+		waitForAudio(t, service, response.Data.AudioJobID)
+	}
+
+	_, chats := service.Search_chat(context.Background(), "fan")
+	if len(chats) != 4 {
+		t.Fatalf("Expected 4 stored chats, got %d", len(chats))
+	}
+	if chats[3].AudioURL == "" {
+		t.Fatalf("Expected the audio URL to be saved with the reply, got %+v", chats[3])
+	}
+}
+
+func TestProcessChatStream(t *testing.T) {
+	service := newStubService()
+	router := newTestRouter(service)
+
+	w := postJSON(router, "/chat/stream", ChatRequest{UserID: "fan", Message: "hello there"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+		t.Fatalf("Unexpected content type %q", w.Header().Get("Content-Type"))
+	}
+
+	body := w.Body.String()
+	if !strings.Contains(body, "event:delta") || !strings.Contains(body, "event:done") || !strings.Contains(body, "event:audio") {
+		t.Fatalf("Expected delta, done and audio events, got %s", body)
+	}
+
+	_, chats := service.Search_chat(context.Background(), "fan")
+	if len(chats) != 2 || chats[1].Content != "Fake reply #1: hello there" {
+		t.Fatalf("Expected the streamed reply to be stored, got %+v", chats)
+	}
+	if !strings.Contains(body, chats[1].ID) {
+		t.Fatalf("Expected the done event to carry message ID %s", chats[1].ID)
+	}
+}
+
+func TestProcessChatSpeaksWithPersonaVoice(t *testing.T) {
+	dir := t.TempDir()
+	persona := "name: luna\nspeaker_name: luna\nmodel_id: 2\nsystem_prompt: You are Luna.\n"
+	if err := os.WriteFile(filepath.Join(dir, "luna.yaml"), []byte(persona), 0644); err != nil {
+		t.Fatalf("Failed to write persona: %v", err)
+	}
+	service := newStubServiceWithPersonas(dir)
+	router := newTestRouter(service)
+
+	cases := []struct {
+		request ChatRequest
+		voice   string
+		code    int
+	}{
+		{ChatRequest{UserID: "fan", Message: "hi"}, "max", http.StatusOK},
+		{ChatRequest{UserID: "fan", Message: "hi", Persona: "luna"}, "luna", http.StatusOK},
+		{ChatRequest{UserID: "moon", Message: "hi", Type: "luna"}, "luna", http.StatusOK},
+		{ChatRequest{UserID: "moon", Message: "again"}, "luna", http.StatusOK},
+		{ChatRequest{UserID: "fan", Message: "hi", Persona: "nobody"}, "", http.StatusBadRequest},
+		{ChatRequest{UserID: "fan", Message: "hi", TTS: models.SpeechOptions{Speed: 3}}, "", http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		w := postJSON(router, "/chat", tc.request)
+		if w.Code != tc.code {
+			t.Fatalf("Expected %d for %+v, got %d: %s", tc.code, tc.request, w.Code, w.Body.String())
+		}
+		if tc.code != http.StatusOK {
+			continue
+		}
+		var reply ChatResponse
+		decodeData(t, w.Body.Bytes(), &reply)
+		if audioURL := waitForAudio(t, service, reply.AudioJobID); !strings.HasSuffix(audioURL, "/"+tc.voice) {
+			t.Fatalf("Expected voice %s for %+v, got %s", tc.voice, tc.request, audioURL)
+		}
+	}
+}
+
+// hangingProvider answers like the fake provider, but only once ctx is done.
+type hangingProvider struct {
+	models.LLMProvider
+}
+
+func (p hangingProvider) Complete(ctx context.Context, request models.LLMRequest) (*models.ChatCompletion, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// hangingStore keeps chats in memory, but only reads sessions once ctx is
+// done.
+type hangingStore struct {
+	models.HistoryStore
+}
+
+func (s hangingStore) GetHistory(ctx context.Context, userID, sessionID string) (*models.History, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestProcessChatTimeouts(t *testing.T) {
+	slowLLM := newStubService()
+	registry := models.NewProviderRegistry(models.ProviderFake)
+	registry.Register(hangingProvider{models.NewFakeProvider()})
+	slowLLM.BedrockService = models.NewBedrockService(registry, models.ContextBudget{MaxTurns: 20, MaxTokens: 4000}, 10*time.Millisecond)
+
+	slowStorage := newStubService()
+	slowStorage.HistoryService = models.NewHistoryServiceWithTimeout(hangingStore{models.NewMemoryHistoryStore()}, 10*time.Millisecond)
+
+	cases := []struct {
+		name    string
+		service *stubService
+		want    string
+	}{
+		{"llm", slowLLM, "llm_timeout"},
+		{"storage", slowStorage, "storage_timeout"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := postJSON(newTestRouter(tc.service), "/chat", ChatRequest{UserID: "fan", Message: "hi"})
+			if w.Code != http.StatusGatewayTimeout {
+				t.Fatalf("Expected 504, got %d: %s", w.Code, w.Body.String())
+			}
+			if !strings.Contains(w.Body.String(), tc.want) {
+				t.Fatalf("Expected code %s, got %s", tc.want, w.Body.String())
+			}
+		})
+	}
+}
@@ -1,5 +1,13 @@
 package controller
 
+import (
+	"backend/models"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
 type apiError struct {
 	Code    string `json:"code"`
 	Message string `json:"message"`
@@ -8,3 +16,142 @@ type apiError struct {
 func (e *apiError) Error() string {
 	return e.Message
 }
+
+var errHistoryConflict = &apiError{
+	Code:    "history_conflict",
+	Message: "history was changed by another request, reload it and try again",
+}
+
+var errSessionNotFound = &apiError{
+	Code:    "session_not_found",
+	Message: "session not found",
+}
+
+var errSessionArchived = &apiError{
+	Code:    "session_archived",
+	Message: "session is archived, restore it before chatting",
+}
+
+var errPersonaNotFound = &apiError{
+	Code:    "persona_not_found",
+	Message: "persona not found",
+}
+
+var errSpeechJobNotFound = &apiError{
+	Code:    "audio_job_not_found",
+	Message: "audio job not found or expired",
+}
+
+var errAudioNotFound = &apiError{
+	Code:    "audio_not_found",
+	Message: "audio not found",
+}
+
+var errInvalidSpeechOptions = &apiError{
+	Code:    "invalid_tts_options",
+	Message: "tts options are out of range",
+}
+
+var errSTTUnavailable = &apiError{
+	Code:    "stt_unavailable",
+	Message: "voice messages are not supported by this server",
+}
+
+var errInvalidUsageQuery = &apiError{
+	Code:    "invalid_usage_query",
+	Message: "from and to must be days like 2006-01-02, from not after to, and group_by any of day, user and model",
+}
+
+var errInvalidInferenceConfig = &apiError{
+	Code:    "invalid_inference_config",
+	Message: "max_tokens must not be negative, temperature and top_p within [0, 1], at most 4 stop_sequences and a guardrail needs an id",
+}
+
+var errUnsupportedAudio = &apiError{
+	Code:    "unsupported_audio",
+	Message: "audio must be WAV, WebM or MP3",
+}
+
+var errEmptyTranscript = &apiError{
+	Code:    "empty_transcript",
+	Message: "no speech was recognized in the voice message",
+}
+
+var errVoiceTooLarge = &apiError{
+	Code:    "voice_too_large",
+	Message: "voice message is too large",
+}
+
+var errSocketBusy = &apiError{
+	Code:    "busy",
+	Message: "still answering the previous message",
+}
+
+var errSocketInvalidMessage = &apiError{
+	Code:    "invalid_message",
+	Message: "text messages must be chat requests in JSON",
+}
+
+// timeoutErrors are reported for the stages of models.TimeoutError.
+var timeoutErrors = map[string]*apiError{
+	models.StageStorage: {Code: "storage_timeout", Message: "the history store did not answer in time"},
+	models.StageLLM:     {Code: "llm_timeout", Message: "the model did not answer in time"},
+	models.StageTTS:     {Code: "tts_timeout", Message: "speech was not generated in time"},
+	models.StageSTT:     {Code: "stt_timeout", Message: "the voice message was not transcribed in time"},
+}
+
+// isTimeout reports whether err is a models.TimeoutError.
+func isTimeout(err error) bool {
+	var timeoutErr *models.TimeoutError
+	return errors.As(err, &timeoutErr)
+}
+
+// handleServiceError responds to an error of the service layer with the
+// status and code of the known model errors, and 500 otherwise.
+func handleServiceError(c *gin.Context, err error) {
+	code, err := serviceErrorStatus(err)
+	HandleFailedResponse(c, code, err)
+}
+
+// serviceErrorStatus maps an error of the service layer to its HTTP status
+// and the error to report.
+func serviceErrorStatus(err error) (int, error) {
+	var timeoutErr *models.TimeoutError
+	switch {
+	case errors.As(err, &timeoutErr):
+		if apiErr, ok := timeoutErrors[timeoutErr.Stage]; ok {
+			return http.StatusGatewayTimeout, apiErr
+		}
+		return http.StatusGatewayTimeout, err
+	case errors.Is(err, models.ErrSessionNotFound):
+		return http.StatusNotFound, errSessionNotFound
+	case errors.Is(err, models.ErrSessionArchived):
+		return http.StatusConflict, errSessionArchived
+	case errors.Is(err, models.ErrPersonaNotFound):
+		return http.StatusBadRequest, errPersonaNotFound
+	case errors.Is(err, models.ErrSpeechJobNotFound):
+		return http.StatusNotFound, errSpeechJobNotFound
+	case errors.Is(err, models.ErrBlobNotFound):
+		return http.StatusNotFound, errAudioNotFound
+	case errors.Is(err, models.ErrInvalidSpeechOptions):
+		return http.StatusBadRequest, errInvalidSpeechOptions
+	case errors.Is(err, models.ErrSTTUnavailable):
+		return http.StatusServiceUnavailable, errSTTUnavailable
+	case errors.Is(err, models.ErrUnsupportedAudio):
+		return http.StatusUnsupportedMediaType, errUnsupportedAudio
+	case errors.Is(err, models.ErrEmptyTranscript):
+		return http.StatusUnprocessableEntity, errEmptyTranscript
+	case errors.Is(err, models.ErrHistoryConflict):
+		return http.StatusConflict, errHistoryConflict
+	case errors.Is(err, models.ErrInvalidInferenceConfig):
+		return http.StatusBadRequest, errInvalidInferenceConfig
+	case errors.Is(err, models.ErrContentBlocked):
+		return http.StatusUnprocessableEntity, errContentBlocked
+	case errors.Is(err, models.ErrInvalidUsageQuery):
+		return http.StatusBadRequest, errInvalidUsageQuery
+	case errors.Is(err, models.ErrTokenQuotaExceeded):
+		return http.StatusTooManyRequests, errTokenQuotaExceeded
+	default:
+		return http.StatusInternalServerError, err
+	}
+}
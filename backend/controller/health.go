@@ -0,0 +1,30 @@
+package controller
+
+import (
+	"backend/models"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ReadinessResponse lists the checks of the dependencies of the server.
+type ReadinessResponse struct {
+	Status string                  `json:"status"`
+	Checks []models.ReadinessCheck `json:"checks"`
+}
+
+// Healthz reports that the process is up, without checking anything else.
+func (ops *BaseController) Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Readyz reports whether the server can serve requests, answering 503 when
+// a dependency isn't usable so load balancers route around it.
+func (ops *BaseController) Readyz(c *gin.Context) {
+	checks := ops.Service.CheckReadiness(c.Request.Context())
+	if !models.Ready(checks) {
+		c.JSON(http.StatusServiceUnavailable, ReadinessResponse{Status: "not_ready", Checks: checks})
+		return
+	}
+	c.JSON(http.StatusOK, ReadinessResponse{Status: "ready", Checks: checks})
+}
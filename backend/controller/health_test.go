@@ -0,0 +1,41 @@
+package controller
+
+import (
+	"backend/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	service := newStubService()
+	router := newTestRouter(service)
+
+	for _, path := range []string{"/healthz", "/readyz"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200 for %s, got %d: %s", path, w.Code, w.Body.String())
+		}
+	}
+
+	service.HealthService = models.NewHealthService(0,
+		models.Checker{Name: "llm", Check: func(ctx context.Context) error { return nil }},
+		models.Checker{Name: "dynamodb:Chats", Check: func(ctx context.Context) error { return errors.New("unreachable") }},
+	)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503, got %d: %s", w.Code, w.Body.String())
+	}
+	var response ReadinessResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Status != "not_ready" || len(response.Checks) != 2 || response.Checks[1].Error != "unreachable" {
+		t.Fatalf("Unexpected response %+v", response)
+	}
+}
@@ -2,55 +2,108 @@ package controller
 
 import (
 	"backend/models"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 )
 
+// HistoryRequest asks for one page of the chats of a session, the default
+// session when SessionID is empty. Limit caps the number of chats, all of
+// them when zero; Before is the next_cursor of the previous page and is left
+// empty for the latest chats.
+type HistoryRequest struct {
+	UserID    string `json:"user_id"`
+	SessionID string `json:"session_id"`
+	Limit     int    `json:"limit"`
+	Before    string `json:"before"`
+}
+
 func (ops *BaseController) GetHistory(c *gin.Context) {
-	var request models.History
-	log.Printf("%v", c.Request)
-	if err := c.ShouldBindJSON(&request); err != nil {
+	var request HistoryRequest
+	if err := c.ShouldBindJSON(&request); err != nil || request.Limit < 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
 		return
 	}
-	log.Println("Valid JSON data")
-	ok, history := ops.Service.Search_chat(request.UserID)
-	if ok {
-		HandleSucccessResponse(c, "", history)
+	var ok bool
+	if request.UserID, ok = requestUser(c, request.UserID); !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	page, err := ops.Service.List_chat(ctx, request.UserID, request.SessionID, request.Limit, request.Before)
+	if err != nil {
+		handleServiceError(c, err)
+		return
+	}
+	if len(page.Chats) > 0 {
+		HandleSucccessResponse(c, "", page)
+		return
+	}
+	session, err := ops.Service.Get_session(ctx, request.UserID, request.SessionID)
+	if err != nil {
+		handleServiceError(c, err)
+		return
+	}
+	if session != nil {
+		HandleSucccessResponse(c, "", page)
+		return
+	}
+	if request.SessionID != "" && request.SessionID != models.DefaultSessionID {
+		HandleFailedResponse(c, http.StatusNotFound, errSessionNotFound)
 		return
-	} else {
-		HandleFailedResponse(c, http.StatusNotFound, fmt.Errorf("user %s not found", request.UserID))
 	}
+	HandleFailedResponse(c, http.StatusNotFound, fmt.Errorf("user %s not found", request.UserID))
 }
 
+// PostHistory creates or overwrites the history of a session. It replaces
+// chats wholesale, so the route is restricted to admins.
 func (ops *BaseController) PostHistory(c *gin.Context) {
 	var request models.History
 	if err := c.ShouldBindJSON(&request); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
 		return
 	}
-	log.Println("Valid JSON data")
-	is_existed, _ := ops.Service.Search_chat(request.UserID)
-	if is_existed {
-		log.Print("user already existed")
-		err := ops.Service.Insert_chat(request.UserID, request.Chats)
-		if err != nil {
-			HandleFailedResponse(c, http.StatusBadRequest, err)
+	var ok bool
+	if request.UserID, ok = requestUser(c, request.UserID); !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	session, err := ops.Service.Get_session(ctx, request.UserID, request.SessionID)
+	if err != nil {
+		handleServiceError(c, err)
+		return
+	}
+	if session == nil {
+		// Only the default session is created implicitly, others through
+		// POST /sessions
+		if request.SessionID != "" && request.SessionID != models.DefaultSessionID {
+			HandleFailedResponse(c, http.StatusNotFound, errSessionNotFound)
 			return
 		}
-		HandleSucccessResponse(c, "")
-		return
-	} else {
-		log.Print("user does not exist")
-		err := ops.Service.Create_chat(request)
-		if err != nil {
+		err := ops.Service.Create_chat(ctx, request)
+		if err == nil {
+			HandleSucccessResponse(c, "")
+			return
+		}
+		if isTimeout(err) {
+			handleServiceError(c, err)
+			return
+		}
+		if !errors.Is(err, models.ErrHistoryExists) {
 			HandleFailedResponse(c, http.StatusBadRequest, err)
 			return
 		}
-		HandleSucccessResponse(c, "")
+	}
+
+	err = ops.Service.Insert_chat(ctx, request.UserID, request.SessionID, request.Chats, request.Version)
+	if errors.Is(err, models.ErrHistoryConflict) || isTimeout(err) {
+		handleServiceError(c, err)
+		return
+	}
+	if err != nil {
+		HandleFailedResponse(c, http.StatusBadRequest, err)
 		return
 	}
+	HandleSucccessResponse(c, "")
 }
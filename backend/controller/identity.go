@@ -0,0 +1,38 @@
+package controller
+
+import (
+	"backend/middleware/auth"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errUserMismatch = &apiError{
+	Code:    "user_mismatch",
+	Message: "user_id doesn't match the authenticated user",
+}
+
+// requestUser returns the user a request acts for. Authenticated requests
+// act for their own user, who may be left out of the request; only admins
+// may name another one. Without authentication the requested user is
+// trusted. On a mismatch it responds with 403 and returns false.
+func requestUser(c *gin.Context, requested string) (string, bool) {
+	identity := auth.FromContext(c)
+	switch {
+	case identity == nil:
+		return requested, true
+	case requested == "" || requested == identity.UserID:
+		return identity.UserID, true
+	case identity.IsAdmin():
+		return requested, true
+	}
+	HandleFailedResponse(c, http.StatusForbidden, errUserMismatch)
+	return "", false
+}
+
+// ownsResource reports whether the request may see a resource of userID,
+// like a speech job.
+func ownsResource(c *gin.Context, userID string) bool {
+	identity := auth.FromContext(c)
+	return identity == nil || identity.UserID == userID || identity.IsAdmin()
+}
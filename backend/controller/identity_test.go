@@ -0,0 +1,64 @@
+package controller
+
+import (
+	"backend/middleware/auth"
+	"backend/models"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newAuthenticatedRouter serves the routes of newTestRouter as if
+// authenticated as identity.
+func newAuthenticatedRouter(service models.Service, identity *auth.Identity) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	controller := &BaseController{Service: service, Sockets: NewSocketHub()}
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		auth.SetIdentity(c, identity)
+	})
+	router.POST("/user_history", controller.GetHistory)
+	router.POST("/chat", controller.ProcessChat)
+	router.GET("/audio/:id", controller.GetAudio)
+	router.GET("/sessions", controller.ListSessions)
+	return router
+}
+
+func TestRequestUserFromIdentity(t *testing.T) {
+	service := newStubService()
+	router := newAuthenticatedRouter(service, &auth.Identity{UserID: "fan"})
+
+	w := postJSON(router, "/chat", ChatRequest{Message: "hi"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var reply ChatResponse
+	decodeData(t, w.Body.Bytes(), &reply)
+	if _, chats := service.Search_chat(context.Background(), "fan"); len(chats) != 2 {
+		t.Fatalf("Expected the chat to be saved for the authenticated user, got %d chats", len(chats))
+	}
+
+	for _, w := range []*httptest.ResponseRecorder{
+		postJSON(router, "/chat", ChatRequest{UserID: "idol", Message: "hi"}),
+		postJSON(router, "/user_history", HistoryRequest{UserID: "idol"}),
+		sendJSON(router, http.MethodGet, "/sessions?user_id=idol", nil),
+	} {
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("Expected 403 for another user, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	// Speech jobs of others look like unknown ones
+	other := newAuthenticatedRouter(service, &auth.Identity{UserID: "idol"})
+	if w := sendJSON(other, http.MethodGet, "/audio/"+reply.AudioJobID, nil); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for the speech job of another user, got %d", w.Code)
+	}
+
+	admin := newAuthenticatedRouter(service, &auth.Identity{UserID: "ops", Roles: []string{auth.RoleAdmin}})
+	if w := postJSON(admin, "/user_history", HistoryRequest{UserID: "fan"}); w.Code != http.StatusOK {
+		t.Fatalf("Expected admins to read any history, got %d: %s", w.Code, w.Body.String())
+	}
+}
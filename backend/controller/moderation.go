@@ -0,0 +1,65 @@
+package controller
+
+import (
+	"backend/models"
+	"log/slog"
+)
+
+var errContentBlocked = &apiError{
+	Code:    "content_blocked",
+	Message: "message was blocked by the content policy",
+}
+
+// moderateInput moderates the message of request before the LLM sees it,
+// redacting it in request and userChat and recording the decision on
+// userChat. It fails with models.ErrContentBlocked for a refused message
+// and returns the canned reply to answer with if the LLM must not be
+// asked.
+func (ops *BaseController) moderateInput(request *ChatRequest, userChat *models.Chat, persona *models.Persona) (string, error) {
+	result := ops.Service.Moderate(models.ModerationInput, request.Message, persona)
+	if result.Decision == nil {
+		return "", nil
+	}
+	slog.Info("Moderated message", "action", result.Decision.Action, "user_id", request.UserID, "rules", result.Decision.Rules)
+	if result.Blocked() {
+		return "", models.ErrContentBlocked
+	}
+	userChat.Moderation = append(userChat.Moderation, *result.Decision)
+	if result.Replaced() {
+		return result.Text, nil
+	}
+	request.Message = result.Text
+	userChat.Content = result.Text
+	return "", nil
+}
+
+// cannedCompletion stands in for the LLM when moderation answers a message
+// with a canned reply.
+func cannedCompletion(reply string) *models.ChatCompletion {
+	return &models.ChatCompletion{Text: reply, StopReason: models.StopReasonModerated}
+}
+
+// moderateReply returns the assistant chat of a reply of persona after
+// moderating it, with the decisions of the content policy and of a Bedrock
+// guardrail recorded on it.
+func (ops *BaseController) moderateReply(userID string, completion *models.ChatCompletion, persona *models.Persona) models.Chat {
+	if completion.StopReason == models.StopReasonModerated {
+		return newChat("assistant", completion.Text)
+	}
+
+	result := ops.Service.Moderate(models.ModerationOutput, completion.Text, persona)
+	chat := newChat("assistant", result.Text)
+	if completion.StopReason == models.StopReasonGuardrail {
+		slog.Info("Bedrock guardrail intervened in reply", "user_id", userID)
+		chat.Moderation = append(chat.Moderation, models.ModerationDecision{
+			Stage:  models.ModerationOutput,
+			Action: models.ModerationReplace,
+			Rules:  []string{models.RuleBedrockGuardrail},
+		})
+	}
+	if result.Decision != nil {
+		slog.Info("Moderated reply", "action", result.Decision.Action, "user_id", userID, "rules", result.Decision.Rules)
+		chat.Moderation = append(chat.Moderation, *result.Decision)
+	}
+	return chat
+}
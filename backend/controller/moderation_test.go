@@ -0,0 +1,60 @@
+package controller
+
+import (
+	"backend/models"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestProcessChatModeration(t *testing.T) {
+	service := newStubService()
+	moderation, err := models.NewModerationService(models.ModerationPolicy{
+		CannedReply: "Let's talk about music!",
+		Rules: []models.ModerationRule{
+			{Name: "pii", Stages: []string{models.ModerationInput}, Detectors: []string{"email"}, Action: models.ModerationRedact},
+			{Name: "slurs", Stages: []string{models.ModerationInput}, Keywords: []string{"idiot"}, Action: models.ModerationBlock},
+			{Name: "secrets", Stages: []string{models.ModerationOutput}, Keywords: []string{"secret"}, Action: models.ModerationReplace},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.ModerationService = moderation
+	router := newTestRouter(service)
+
+	w := postJSON(router, "/chat", ChatRequest{UserID: "fan", Message: "you idiot"})
+	var blocked apiError
+	if err := json.Unmarshal(w.Body.Bytes(), &blocked); w.Code != http.StatusUnprocessableEntity || err != nil || blocked.Code != "content_blocked" {
+		t.Fatalf("Expected 422 content_blocked, got %d: %s", w.Code, w.Body.String())
+	}
+	if _, chats := service.Search_chat(context.Background(), "fan"); len(chats) != 0 {
+		t.Fatalf("Expected blocked messages not to be saved, got %+v", chats)
+	}
+
+	if w := postJSON(router, "/chat", ChatRequest{UserID: "fan", Message: "mail fan@example.com"}); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	w = postJSON(router, "/chat", ChatRequest{UserID: "fan", Message: "tell me a secret"})
+	var response struct {
+		Data ChatResponse `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || response.Data.Text != "Let's talk about music!" {
+		t.Fatalf("Expected the canned reply, got %d: %s", w.Code, w.Body.String())
+	}
+
+	_, chats := service.Search_chat(context.Background(), "fan")
+	if len(chats) != 4 {
+		t.Fatalf("Expected 4 stored chats, got %d", len(chats))
+	}
+	if chats[0].Content != "mail [redacted]" || len(chats[0].Moderation) != 1 || chats[0].Moderation[0].Action != models.ModerationRedact {
+		t.Errorf("Expected the redacted message to be saved with its decision, got %+v", chats[0])
+	}
+	if chats[1].Content != "Fake reply #1: mail [redacted]" {
+		t.Errorf("Expected the LLM to see the redacted message, got %q", chats[1].Content)
+	}
+	if reply := chats[3]; reply.Content != "Let's talk about music!" || len(reply.Moderation) != 1 || reply.Moderation[0].Rules[0] != "secrets" {
+		t.Errorf("Expected the replaced reply to be saved with its decision, got %+v", reply)
+	}
+}
@@ -0,0 +1,26 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// PersonaInfo is what clients see of a persona; the prompt stays private.
+type PersonaInfo struct {
+	Name        string `json:"name"`
+	Greeting    string `json:"greeting"`
+	SpeakerName string `json:"speaker_name"`
+}
+
+// ListPersonas returns the personas that can be chosen as session type or
+// per message.
+func (ops *BaseController) ListPersonas(c *gin.Context) {
+	personas := []PersonaInfo{}
+	for _, persona := range ops.Service.Personas() {
+		personas = append(personas, PersonaInfo{
+			Name:        persona.Name,
+			Greeting:    persona.Greeting,
+			SpeakerName: persona.SpeakerName,
+		})
+	}
+	HandleSucccessResponse(c, "", personas)
+}
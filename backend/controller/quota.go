@@ -0,0 +1,28 @@
+package controller
+
+import (
+	"backend/middleware/ratelimit"
+	"backend/models"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errTokenQuotaExceeded = &apiError{
+	Code:    "quota_exceeded",
+	Message: "daily token quota exceeded, try again tomorrow",
+}
+
+// allowTokens checks the daily token budgets of userID before a reply is
+// generated. Once one is spent it responds with 429 and a Retry-After until
+// the budgets reset, and returns false.
+func (ops *BaseController) allowTokens(c *gin.Context, userID string) bool {
+	status, err := ops.Service.TokenQuota(c.Request.Context(), userID)
+	if !errors.Is(err, models.ErrTokenQuotaExceeded) {
+		return true
+	}
+	ratelimit.SetRetryAfter(c, status.Input.Reset)
+	HandleFailedResponse(c, http.StatusTooManyRequests, errTokenQuotaExceeded)
+	return false
+}
@@ -0,0 +1,35 @@
+package controller
+
+import (
+	"backend/models"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestProcessChatTokenQuota(t *testing.T) {
+	service := newStubService()
+	service.QuotaService = models.NewQuotaService(models.NewMemoryCounterStore(), models.QuotaLimits{DailyOutputTokens: 1})
+	router := newTestRouter(service)
+
+	if w := postJSON(router, "/chat", ChatRequest{UserID: "fan", Message: "hi"}); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	status, _ := service.TokenQuota(context.Background(), "fan")
+	if status.Output.Remaining != 0 {
+		t.Fatalf("Expected the reply to be charged, got %+v", status)
+	}
+
+	w := postJSON(router, "/chat", ChatRequest{UserID: "fan", Message: "again"})
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("Expected 429 with Retry-After, got %d %v", w.Code, w.Header())
+	}
+	var body apiError
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Code != "quota_exceeded" {
+		t.Fatalf("Unexpected error %+v", body)
+	}
+	if w := postJSON(router, "/chat", ChatRequest{UserID: "idol", Message: "hi"}); w.Code != http.StatusOK {
+		t.Fatalf("Expected other users to keep their budget, got %d", w.Code)
+	}
+}
@@ -0,0 +1,121 @@
+package controller
+
+import (
+	"backend/models"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SessionRequest creates or changes a session of a user. When changing a
+// session, fields left out stay as they are.
+type SessionRequest struct {
+	UserID   string  `json:"user_id"`
+	Title    *string `json:"title"`
+	Archived *bool   `json:"archived"`
+	Type     string  `json:"type"`
+}
+
+// ListSessions answers GET /sessions?user_id=<id>[&archived=true] with the
+// sessions of the user, most recently active first.
+func (ops *BaseController) ListSessions(c *gin.Context) {
+	userID, ok := requestUser(c, c.Query("user_id"))
+	if !ok {
+		return
+	}
+	archived, err := strconv.ParseBool(c.DefaultQuery("archived", "false"))
+	if userID == "" || err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query parameters"})
+		return
+	}
+
+	sessions, err := ops.Service.List_session(c.Request.Context(), userID, archived)
+	if err != nil {
+		handleServiceError(c, err)
+		return
+	}
+	HandleSucccessResponse(c, "", sessions)
+}
+
+// CreateSession starts a new conversation with the persona named by Type,
+// the default persona if empty, speaking in the persona's voice. Without a
+// title the session is named by the LLM after its first exchange.
+func (ops *BaseController) CreateSession(c *gin.Context) {
+	var request SessionRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
+		return
+	}
+	var ok bool
+	if request.UserID, ok = requestUser(c, request.UserID); !ok {
+		return
+	}
+	if request.UserID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
+		return
+	}
+
+	persona, err := ops.Service.Persona(request.Type)
+	if err != nil {
+		handleServiceError(c, err)
+		return
+	}
+
+	session := models.History{UserID: request.UserID, Type: persona.Name, VoiceID: persona.SpeakerName}
+	if request.Title != nil {
+		session.Title = *request.Title
+	}
+	created, err := ops.Service.Create_session(c.Request.Context(), session)
+	if err != nil {
+		handleServiceError(c, err)
+		return
+	}
+	HandleSucccessResponse(c, "", created)
+}
+
+// UpdateSession renames, archives or restores the session in the path.
+func (ops *BaseController) UpdateSession(c *gin.Context) {
+	var request SessionRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
+		return
+	}
+	var ok bool
+	if request.UserID, ok = requestUser(c, request.UserID); !ok {
+		return
+	}
+	if request.UserID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
+		return
+	}
+
+	session, err := ops.Service.Update_session(c.Request.Context(), request.UserID, c.Param("session_id"), models.SessionUpdate{
+		Title:    request.Title,
+		Archived: request.Archived,
+	})
+	if err != nil {
+		handleServiceError(c, err)
+		return
+	}
+	HandleSucccessResponse(c, "", session)
+}
+
+// DeleteSession answers DELETE /sessions/<session_id>?user_id=<id> by
+// deleting the session with all of its chats.
+func (ops *BaseController) DeleteSession(c *gin.Context) {
+	userID, ok := requestUser(c, c.Query("user_id"))
+	if !ok {
+		return
+	}
+	if userID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query parameters"})
+		return
+	}
+
+	if err := ops.Service.Delete_session(c.Request.Context(), userID, c.Param("session_id")); err != nil {
+		handleServiceError(c, err)
+		return
+	}
+	HandleSucccessResponse(c, "")
+}
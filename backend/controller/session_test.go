@@ -0,0 +1,93 @@
+package controller
+
+import (
+	"backend/models"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func decodeData(t *testing.T, body []byte, data interface{}) {
+	t.Helper()
+	var response struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if err := json.Unmarshal(response.Data, data); err != nil {
+		t.Fatalf("Failed to decode response data: %v", err)
+	}
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	service := newStubService()
+	router := newTestRouter(service)
+
+	w := postJSON(router, "/sessions", SessionRequest{UserID: "fan"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var session models.History
+	decodeData(t, w.Body.Bytes(), &session)
+	if session.SessionID == "" || session.SessionID == models.DefaultSessionID {
+		t.Fatalf("Expected a new session ID, got %q", session.SessionID)
+	}
+
+	w = postJSON(router, "/chat", ChatRequest{UserID: "fan", SessionID: session.SessionID, Message: "hi"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var reply ChatResponse
+	decodeData(t, w.Body.Bytes(), &reply)
+	if reply.SessionID != session.SessionID || reply.Title == "" {
+		t.Fatalf("Expected the session to be titled after the first exchange, got %+v", reply)
+	}
+
+	// The default session is separate from the new one
+	postJSON(router, "/chat", ChatRequest{UserID: "fan", Message: "elsewhere"})
+	if _, chats := service.Search_chat(context.Background(), "fan"); len(chats) != 2 {
+		t.Fatalf("Expected 2 chats in the default session, got %d", len(chats))
+	}
+	page, _ := service.List_chat(context.Background(), "fan", session.SessionID, 0, "")
+	if len(page.Chats) != 2 || page.Chats[0].Content != "hi" {
+		t.Fatalf("Unexpected chats of the session %+v", page.Chats)
+	}
+
+	archived := true
+	w = sendJSON(router, http.MethodPatch, "/sessions/"+session.SessionID, SessionRequest{UserID: "fan", Archived: &archived})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	decodeData(t, w.Body.Bytes(), &session)
+	if !session.Archived || session.Title != reply.Title {
+		t.Fatalf("Expected an archived session keeping its title, got %+v", session)
+	}
+
+	w = postJSON(router, "/chat", ChatRequest{UserID: "fan", SessionID: session.SessionID, Message: "again"})
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected 409 for an archived session, got %d", w.Code)
+	}
+
+	var sessions []models.History
+	w = sendJSON(router, http.MethodGet, "/sessions?user_id=fan", nil)
+	decodeData(t, w.Body.Bytes(), &sessions)
+	if len(sessions) != 1 || sessions[0].SessionID != models.DefaultSessionID {
+		t.Fatalf("Expected only the default session to be listed, got %+v", sessions)
+	}
+	w = sendJSON(router, http.MethodGet, "/sessions?user_id=fan&archived=true", nil)
+	decodeData(t, w.Body.Bytes(), &sessions)
+	if len(sessions) != 2 {
+		t.Fatalf("Expected archived sessions to be listed on request, got %+v", sessions)
+	}
+
+	w = sendJSON(router, http.MethodDelete, "/sessions/"+session.SessionID+"?user_id=fan", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	w = postJSON(router, "/chat", ChatRequest{UserID: "fan", SessionID: session.SessionID, Message: "gone"})
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for a deleted session, got %d", w.Code)
+	}
+}
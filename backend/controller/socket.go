@@ -0,0 +1,412 @@
+package controller
+
+import (
+	"backend/metrics"
+	"backend/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	socketWriteWait  = 10 * time.Second
+	socketPongWait   = 60 * time.Second
+	socketPingPeriod = socketPongWait * 9 / 10
+	// socketSendBuffer is how many events may wait for a slow client before
+	// its socket is closed.
+	socketSendBuffer = 256
+	// closeReplaced closes a socket replaced by a newer one of its user.
+	closeReplaced = 4000
+	// socketEndpoint names the socket in usage events.
+	socketEndpoint = "/ws/chat"
+)
+
+var socketUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	// Any origin may connect, like CORS allows for the other routes
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// SocketEvent is a message sent to a chat socket client.
+type SocketEvent struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+// SocketAudio is the data of an "audio" event: the speech of one sentence
+// of the reply, in the order given by Index.
+type SocketAudio struct {
+	Index    int    `json:"index"`
+	Text     string `json:"text"`
+	AudioURL string `json:"audio_url,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// SocketHub tracks the open chat sockets, one per user.
+type SocketHub struct {
+	mu      sync.Mutex
+	sockets map[string]*chatSocket
+	closed  bool
+}
+
+func NewSocketHub() *SocketHub {
+	return &SocketHub{sockets: map[string]*chatSocket{}}
+}
+
+// Close closes every socket with a going away frame and refuses new ones.
+// http.Server.Shutdown doesn't track WebSocket connections, so it is meant
+// to be registered with RegisterOnShutdown.
+func (h *SocketHub) Close() {
+	h.mu.Lock()
+	h.closed = true
+	sockets := h.sockets
+	h.sockets = map[string]*chatSocket{}
+	h.mu.Unlock()
+
+	for _, socket := range sockets {
+		socket.close(websocket.CloseGoingAway, "server is shutting down")
+	}
+}
+
+// add registers the socket of a user, closing the one it replaces.
+func (h *SocketHub) add(socket *chatSocket) bool {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return false
+	}
+	previous := h.sockets[socket.userID]
+	h.sockets[socket.userID] = socket
+	h.mu.Unlock()
+
+	if previous != nil {
+		previous.close(closeReplaced, "replaced by a newer connection")
+	}
+	return true
+}
+
+func (h *SocketHub) remove(socket *chatSocket) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.sockets[socket.userID] == socket {
+		delete(h.sockets, socket.userID)
+	}
+}
+
+// ChatSocket upgrades GET /ws/chat?user_id=<id> to a WebSocket for live
+// conversations, user_id defaulting to the authenticated user. The session_id, persona and type query parameters are the
+// defaults of the messages, language that of voice messages.
+//
+// Text frames are ChatRequest JSON, binary frames voice recordings. The
+// reply is pushed as "delta" events while it is generated and a "done"
+// event once saved, and every sentence as an "audio" event as soon as it is
+// spoken, followed by "audio_end". Voice messages first get a "transcript"
+// event. Only one message is answered at a time.
+func (ops *BaseController) ChatSocket(c *gin.Context) {
+	userID, ok := requestUser(c, c.Query("user_id"))
+	if !ok {
+		return
+	}
+	if userID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing user_id"})
+		return
+	}
+
+	conn, err := socketUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// The upgrader already responded
+		slog.WarnContext(c.Request.Context(), "Failed to upgrade chat socket", "user_id", userID, "error", err)
+		return
+	}
+
+	// The socket outlives the handler, but keeps the request ID for logging
+	ctx, cancel := context.WithCancel(context.WithoutCancel(c.Request.Context()))
+	socket := &chatSocket{
+		ops:    ops,
+		conn:   conn,
+		userID: userID,
+		defaults: ChatRequest{
+			UserID:    userID,
+			SessionID: c.Query("session_id"),
+			Persona:   c.Query("persona"),
+			Type:      c.Query("type"),
+		},
+		language: c.Query("language"),
+		send:     make(chan SocketEvent, socketSendBuffer),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	if !ops.Sockets.add(socket) {
+		socket.close(websocket.CloseGoingAway, "server is shutting down")
+	}
+	go socket.write()
+	socket.read()
+	ops.Sockets.remove(socket)
+}
+
+// chatSocket is the connection of one user. Events are written by a single
+// goroutine from the send buffer; a client that doesn't keep up is
+// disconnected instead of stalling the reply.
+type chatSocket struct {
+	ops      *BaseController
+	conn     *websocket.Conn
+	userID   string
+	defaults ChatRequest
+	language string
+
+	send   chan SocketEvent
+	ctx    context.Context
+	cancel context.CancelFunc
+	busy   int32
+
+	closeOnce    sync.Once
+	closeMessage []byte
+}
+
+// close ends the socket with a close frame of the given code.
+func (s *chatSocket) close(code int, text string) {
+	s.closeOnce.Do(func() {
+		s.closeMessage = websocket.FormatCloseMessage(code, text)
+		s.cancel()
+	})
+}
+
+// emit queues an event for the client.
+func (s *chatSocket) emit(eventType string, data interface{}) bool {
+	select {
+	case <-s.ctx.Done():
+		return false
+	default:
+	}
+
+	select {
+	case s.send <- SocketEvent{Type: eventType, Data: data}:
+		return true
+	default:
+		slog.WarnContext(s.ctx, "Chat socket is not keeping up, closing it", "user_id", s.userID)
+		s.close(websocket.ClosePolicyViolation, "client is not reading fast enough")
+		return false
+	}
+}
+
+// emitError sends err with the code it has in HTTP responses.
+func (s *chatSocket) emitError(err error) {
+	code, err := serviceErrorStatus(err)
+	if apiErr, ok := err.(*apiError); ok {
+		s.emit("error", apiErr)
+		return
+	}
+	s.emit("error", gin.H{"code": code, "message": err.Error()})
+}
+
+func (s *chatSocket) write() {
+	ticker := time.NewTicker(socketPingPeriod)
+	defer func() {
+		ticker.Stop()
+		s.conn.Close()
+	}()
+
+	for {
+		select {
+		case event := <-s.send:
+			s.conn.SetWriteDeadline(time.Now().Add(socketWriteWait))
+			if err := s.conn.WriteJSON(event); err != nil {
+				s.cancel()
+				return
+			}
+		case <-ticker.C:
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(socketWriteWait)); err != nil {
+				s.cancel()
+				return
+			}
+		case <-s.ctx.Done():
+			message := s.closeMessage
+			if message == nil {
+				message = websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+			}
+			s.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(socketWriteWait))
+			return
+		}
+	}
+}
+
+func (s *chatSocket) read() {
+	defer s.cancel()
+	s.conn.SetReadLimit(maxVoiceUploadBytes)
+	s.conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(socketPongWait))
+	})
+
+	for {
+		messageType, data, err := s.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) && s.ctx.Err() == nil {
+				slog.WarnContext(s.ctx, "Chat socket failed", "user_id", s.userID, "error", err)
+			}
+			return
+		}
+
+		if !atomic.CompareAndSwapInt32(&s.busy, 0, 1) {
+			s.emit("error", errSocketBusy)
+			continue
+		}
+		go func() {
+			defer atomic.StoreInt32(&s.busy, 0)
+			if messageType == websocket.BinaryMessage {
+				s.voice(data)
+			} else {
+				s.text(data)
+			}
+		}()
+	}
+}
+
+// text answers a ChatRequest.
+func (s *chatSocket) text(data []byte) {
+	request := s.defaults
+	if err := json.Unmarshal(data, &request); err != nil {
+		s.emit("error", errSocketInvalidMessage)
+		return
+	}
+	request.UserID = s.userID
+	s.chat(request, newChat("user", request.Message))
+}
+
+// voice transcribes a recording and answers it.
+func (s *chatSocket) voice(audio []byte) {
+	format, err := models.AudioFormat(http.DetectContentType(audio), "")
+	if err != nil {
+		s.emitError(err)
+		return
+	}
+	transcript, err := s.ops.Service.Transcribe(s.ctx, audio, format, s.language)
+	if err == nil && strings.TrimSpace(transcript) == "" {
+		err = models.ErrEmptyTranscript
+	}
+	if err != nil {
+		s.emitError(err)
+		return
+	}
+
+	voiceURL, err := s.ops.Service.SaveAudio(s.ctx, audio, models.AudioContentType(format))
+	if err != nil {
+		slog.ErrorContext(s.ctx, "Failed to save voice message", "user_id", s.userID, "error", err)
+	}
+	s.emit("transcript", gin.H{"text": transcript, "voice_url": voiceURL})
+
+	request := s.defaults
+	request.Message = transcript
+	userChat := newChat("user", transcript)
+	userChat.VoiceURL = voiceURL
+	s.chat(request, userChat)
+}
+
+// chat streams the reply to userChat and speaks it sentence by sentence
+// while it is generated.
+func (s *chatSocket) chat(request ChatRequest, userChat models.Chat) {
+	ops := s.ops
+	if err := request.TTS.Validate(); err != nil {
+		s.emitError(err)
+		return
+	}
+	if _, err := ops.Service.TokenQuota(s.ctx, request.UserID); errors.Is(err, models.ErrTokenQuotaExceeded) {
+		s.emitError(err)
+		return
+	}
+	session, chats, err := ops.loadSession(s.ctx, request)
+	if err != nil {
+		s.emitError(err)
+		return
+	}
+	persona, speaker, err := ops.chatPersona(request, session)
+	if err != nil {
+		s.emitError(err)
+		return
+	}
+	canned, err := ops.moderateInput(&request, &userChat, persona)
+	if err != nil {
+		s.emitError(err)
+		return
+	}
+
+	opts := request.TTS
+	opts.Provider = persona.TTSProvider
+	speech := ops.Service.SpeakSentences(s.ctx, persona.ModelID, speaker, opts, func(audio models.SentenceAudio) {
+		event := SocketAudio{Index: audio.Index, Text: audio.Text, AudioURL: audio.AudioURL}
+		if audio.Err != nil {
+			slog.WarnContext(s.ctx, "Failed to speak sentence", "index", audio.Index, "user_id", s.userID, "error", audio.Err)
+			event.Error = audio.Err.Error()
+		}
+		s.emit("audio", event)
+	})
+	started := time.Now()
+	filter := models.NewModerationFilter(ops.Service, persona, func(text string) error {
+		if !s.emit("delta", gin.H{"text": text}) {
+			return s.ctx.Err()
+		}
+		speech.Write(text)
+		return nil
+	})
+	completion := cannedCompletion(canned)
+	if canned == "" {
+		completion, err = ops.Service.StreamChatResponse(s.ctx, chats, request.Message, persona.ChatOptions(), filter.Write)
+		metrics.ObserveStage(metrics.StageLLM, started, err)
+	} else {
+		err = filter.Write(canned)
+	}
+	if err == nil {
+		err = filter.Flush()
+	}
+	if err != nil {
+		if s.ctx.Err() == nil {
+			s.emitError(err)
+		}
+		return
+	}
+
+	assistantChat := ops.moderateReply(request.UserID, completion, persona)
+	if filter.Held() {
+		// Say the canned reply instead of the rest that was held back
+		speech.Write(assistantChat.Content)
+	}
+	speech.Flush()
+	usage := newUsage(socketEndpoint, request.UserID, session.SessionID, persona, completion, started)
+	addSpeech(usage, persona, assistantChat.Content)
+	defer ops.recordUsage(s.ctx, usage)
+
+	if err := ops.saveChats(s.ctx, session, userChat, assistantChat); err != nil {
+		s.emitError(err)
+		return
+	}
+
+	title := session.Title
+	if len(chats) == 0 {
+		title = ops.titleSession(s.ctx, session, persona, userChat, assistantChat)
+	}
+	s.emit("done", StreamDoneEvent{
+		ID:         assistantChat.ID,
+		SessionID:  session.SessionID,
+		Title:      title,
+		Text:       assistantChat.Content,
+		StopReason: completion.StopReason,
+		Usage:      completion.Usage,
+	})
+
+	end := gin.H{"id": assistantChat.ID, "count": speech.Count()}
+	if reply, err := speech.Finish(request.UserID, session.SessionID, assistantChat.ID); err == nil {
+		end["audio_url"] = reply.AudioURL
+		end["playlist"] = reply.Playlist
+	}
+	s.emit("audio_end", end)
+}
@@ -0,0 +1,117 @@
+package controller
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// dialSocket connects to /ws/chat of server with the given query.
+func dialSocket(t *testing.T, server *httptest.Server, query string) *websocket.Conn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/chat?" + query
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// readEvent reads the next event, with its data as raw JSON.
+func readEvent(t *testing.T, conn *websocket.Conn) (string, map[string]interface{}) {
+	t.Helper()
+	var event struct {
+		Type string                 `json:"type"`
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := conn.ReadJSON(&event); err != nil {
+		t.Fatalf("Failed to read event: %v", err)
+	}
+	return event.Type, event.Data
+}
+
+func TestChatSocket(t *testing.T) {
+	server := httptest.NewServer(newTestRouter(newStubService()))
+	defer server.Close()
+	conn := dialSocket(t, server, "user_id=fan")
+	defer conn.Close()
+
+	if err := conn.WriteJSON(ChatRequest{Message: "Hello there. How are you?"}); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+
+	var text strings.Builder
+	var done map[string]interface{}
+	audio := map[int]string{}
+	for {
+		eventType, data := readEvent(t, conn)
+		switch eventType {
+		case "delta":
+			text.WriteString(data["text"].(string))
+		case "done":
+			done = data
+		case "audio":
+			if data["audio_url"] != "https://audio.example/max" {
+				t.Fatalf("Unexpected audio event %v", data)
+			}
+			audio[int(data["index"].(float64))] = data["text"].(string)
+		case "audio_end":
+			if done == nil || int(data["count"].(float64)) != len(audio) {
+				t.Fatalf("Expected audio_end after done and all audio, got %v with %v", data, audio)
+			}
+			if done["text"] != text.String() || done["session_id"] != "default" {
+				t.Fatalf("Unexpected done event %v for deltas %q", done, text.String())
+			}
+			if audio[0] != "Fake reply #1: Hello there." || audio[1] != "How are you?" {
+				t.Fatalf("Expected the reply spoken by sentence, got %v", audio)
+			}
+			return
+		default:
+			t.Fatalf("Unexpected event %s: %v", eventType, data)
+		}
+	}
+}
+
+func TestChatSocketCloses(t *testing.T) {
+	router := newTestRouter(newStubService())
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	first := dialSocket(t, server, "user_id=fan")
+	defer first.Close()
+	second := dialSocket(t, server, "user_id=fan")
+	defer second.Close()
+
+	if _, _, err := first.ReadMessage(); !websocket.IsCloseError(err, closeReplaced) {
+		t.Fatalf("Expected the first socket to be replaced, got %v", err)
+	}
+
+	second.WriteMessage(websocket.TextMessage, []byte("not json"))
+	if eventType, data := readEvent(t, second); eventType != "error" || data["code"] != "invalid_message" {
+		t.Fatalf("Expected an invalid_message error, got %s %v", eventType, data)
+	}
+}
+
+func TestSocketHubCloseOnShutdown(t *testing.T) {
+	hub := NewSocketHub()
+	router := gin.New()
+	router.GET("/ws/chat", (&BaseController{Service: newStubService(), Sockets: hub}).ChatSocket)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	conn := dialSocket(t, server, "user_id=fan")
+	defer conn.Close()
+	// Wait until the socket is registered
+	conn.WriteMessage(websocket.TextMessage, []byte("not json"))
+	readEvent(t, conn)
+
+	hub.Close()
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("Expected a going away close, got %v", err)
+	}
+}
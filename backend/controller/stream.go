@@ -0,0 +1,153 @@
+package controller
+
+import (
+	"backend/metrics"
+	"backend/models"
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StreamDoneEvent is the payload of the final "done" event of a chat stream.
+type StreamDoneEvent struct {
+	ID         string            `json:"id"`
+	SessionID  string            `json:"session_id"`
+	Title      string            `json:"title,omitempty"`
+	Text       string            `json:"text"`
+	AudioURL   string            `json:"audio_url"`
+	AudioJobID string            `json:"audio_job_id,omitempty"`
+	StopReason string            `json:"stop_reason"`
+	Usage      models.TokenUsage `json:"usage"`
+}
+
+// ProcessChatStream answers a chat message like ProcessChat but pushes the
+// reply to the client as Server-Sent Events: a "delta" event for every piece
+// of text, then a "done" event once the history is saved. The stream stays
+// open for a final "audio" event with the finished speech job. Failures
+// after the stream started are sent as an "error" event. A client disconnect
+// cancels the Bedrock call.
+func (ops *BaseController) ProcessChatStream(c *gin.Context) {
+	var request ChatRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON data"})
+		return
+	}
+	var ok bool
+	if request.UserID, ok = requestUser(c, request.UserID); !ok {
+		return
+	}
+	if err := request.TTS.Validate(); err != nil {
+		handleServiceError(c, err)
+		return
+	}
+	if !ops.allowTokens(c, request.UserID) {
+		return
+	}
+
+	ctx := c.Request.Context()
+	session, chats, err := ops.loadSession(ctx, request)
+	if err != nil {
+		handleServiceError(c, err)
+		return
+	}
+
+	persona, speaker, err := ops.chatPersona(request, session)
+	if err != nil {
+		handleServiceError(c, err)
+		return
+	}
+
+	userChat := newChat("user", request.Message)
+	canned, err := ops.moderateInput(&request, &userChat, persona)
+	if err != nil {
+		handleServiceError(c, err)
+		return
+	}
+
+	started := time.Now()
+	filter := models.NewModerationFilter(ops.Service, persona, func(text string) error {
+		c.SSEvent("delta", gin.H{"text": text})
+		c.Writer.Flush()
+		return ctx.Err()
+	})
+	completion := cannedCompletion(canned)
+	if canned == "" {
+		completion, err = ops.Service.StreamChatResponse(ctx, chats, request.Message, persona.ChatOptions(), filter.Write)
+		metrics.ObserveStage(metrics.StageLLM, started, err)
+	} else {
+		err = filter.Write(canned)
+	}
+	if err == nil {
+		err = filter.Flush()
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			slog.InfoContext(ctx, "Client disconnected during chat stream", "user_id", request.UserID)
+			return
+		}
+		failStream(c, err)
+		return
+	}
+	usage := newUsage(c.FullPath(), request.UserID, session.SessionID, persona, completion, started)
+	defer ops.recordUsage(ctx, usage)
+
+	assistantChat := ops.moderateReply(request.UserID, completion, persona)
+
+	// The reply was streamed in full, so keep the exchange even when the
+	// client disconnects now. Append_chat bounds the save by the storage
+	// timeout.
+	if err := ops.saveChats(context.WithoutCancel(ctx), session, userChat, assistantChat); err != nil {
+		failStream(c, err)
+		return
+	}
+
+	audioJobID := ops.submitSpeech(session, assistantChat, persona, speaker, request.TTS)
+	if audioJobID != "" {
+		addSpeech(usage, persona, assistantChat.Content)
+	}
+
+	title := session.Title
+	if len(chats) == 0 {
+		title = ops.titleSession(ctx, session, persona, userChat, assistantChat)
+	}
+
+	c.SSEvent("done", StreamDoneEvent{
+		ID:         assistantChat.ID,
+		SessionID:  session.SessionID,
+		Title:      title,
+		Text:       assistantChat.Content,
+		AudioJobID: audioJobID,
+		StopReason: completion.StopReason,
+		Usage:      completion.Usage,
+	})
+	c.Writer.Flush()
+
+	if audioJobID == "" {
+		return
+	}
+	job, err := ops.Service.WaitSpeechJob(ctx, audioJobID)
+	if err != nil || ctx.Err() != nil {
+		return
+	}
+	c.SSEvent("audio", job)
+	c.Writer.Flush()
+}
+
+// failStream reports err as a normal JSON error while nothing has been
+// streamed yet, and as an "error" event afterwards.
+func failStream(c *gin.Context, err error) {
+	code, err := serviceErrorStatus(err)
+	if !c.Writer.Written() {
+		HandleFailedResponse(c, code, err)
+		return
+	}
+	c.Error(err)
+	c.SSEvent("error", gin.H{
+		"code":    code,
+		"message": err.Error(),
+	})
+	c.Writer.Flush()
+}
@@ -0,0 +1,149 @@
+package controller
+
+import (
+	"backend/models"
+	"context"
+	"encoding/csv"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultUsageDays is the range of a usage report without from.
+const defaultUsageDays = 30
+
+// newUsage starts the usage event of a reply generated since started.
+// Callers add the speech of the reply before recording it.
+func newUsage(endpoint, userID, sessionID string, persona *models.Persona, completion *models.ChatCompletion, started time.Time) *models.UsageEvent {
+	return &models.UsageEvent{
+		Time:             started,
+		UserID:           userID,
+		SessionID:        sessionID,
+		Persona:          persona.Name,
+		Endpoint:         endpoint,
+		Provider:         completion.Provider,
+		Model:            completion.Model,
+		InputTokens:      completion.Usage.InputTokens,
+		OutputTokens:     completion.Usage.OutputTokens,
+		CacheReadTokens:  completion.Usage.CacheReadInputTokenCount,
+		CacheWriteTokens: completion.Usage.CacheWriteInputTokenCount,
+		LatencyMs:        time.Since(started).Milliseconds(),
+	}
+}
+
+// addSpeech counts the characters of text sent to the TTS provider of
+// persona.
+func addSpeech(usage *models.UsageEvent, persona *models.Persona, text string) {
+	usage.TTSProvider = persona.TTSProvider
+	usage.TTSCharacters = models.SpeechCharacters(text)
+}
+
+// recordUsage charges the tokens of a reply to the daily budgets of its
+// user and adds it to the usage ledger. The reply was already generated, so
+// failures are only logged, and the usage is recorded even when the request
+// was cancelled meanwhile.
+func (ops *BaseController) recordUsage(ctx context.Context, usage *models.UsageEvent) {
+	ctx = context.WithoutCancel(ctx)
+	tokens := models.TokenUsage{InputTokens: usage.InputTokens, OutputTokens: usage.OutputTokens}
+	if err := ops.Service.ChargeTokens(ctx, usage.UserID, tokens); err != nil {
+		slog.ErrorContext(ctx, "Failed to charge tokens", "input_tokens", usage.InputTokens, "output_tokens", usage.OutputTokens, "user_id", usage.UserID, "error", err)
+	}
+	if err := ops.Service.RecordUsage(ctx, *usage); err != nil {
+		slog.ErrorContext(ctx, "Failed to record usage", "endpoint", usage.Endpoint, "user_id", usage.UserID, "error", err)
+	}
+}
+
+// GetUsage reports the usage of the API for admins. The from and to query
+// parameters are days like 2006-01-02, both included, to defaulting to
+// today and from to 30 days before. group_by lists any of day, user and
+// model, comma separated, and user_id only counts one user. With
+// format=csv the rows are sent as CSV instead of JSON.
+func (ops *BaseController) GetUsage(c *gin.Context) {
+	query, err := usageQuery(c)
+	if err != nil {
+		HandleFailedResponse(c, http.StatusBadRequest, errInvalidUsageQuery)
+		return
+	}
+
+	report, err := ops.Service.UsageReport(c.Request.Context(), *query)
+	if err != nil {
+		handleServiceError(c, err)
+		return
+	}
+
+	if c.Query("format") == "csv" {
+		writeUsageCSV(c, report)
+		return
+	}
+	HandleSucccessResponse(c, "", report)
+}
+
+func usageQuery(c *gin.Context) (*models.UsageQuery, error) {
+	now := time.Now().UTC()
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if value := c.Query("to"); value != "" {
+		day, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return nil, err
+		}
+		to = day
+	}
+	from := to.AddDate(0, 0, -defaultUsageDays+1)
+	if value := c.Query("from"); value != "" {
+		day, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return nil, err
+		}
+		from = day
+	}
+	return &models.UsageQuery{
+		From:    from,
+		To:      to.AddDate(0, 0, 1),
+		GroupBy: models.ParseUsageGroups(c.Query("group_by")),
+		UserID:  c.Query("user_id"),
+	}, nil
+}
+
+// writeUsageCSV sends the rows of report as CSV with a header, the columns
+// of the grouped dimensions first.
+func writeUsageCSV(c *gin.Context, report *models.UsageReport) {
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="usage.csv"`)
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	header := append([]string{}, report.GroupBy...)
+	header = append(header, "calls", "input_tokens", "output_tokens", "cache_read_tokens", "cache_write_tokens", "tts_characters", "avg_latency_ms", "estimated_cost")
+	w.Write(header)
+	for _, row := range report.Rows {
+		var record []string
+		for _, dimension := range report.GroupBy {
+			switch dimension {
+			case models.UsageByDay:
+				record = append(record, row.Day)
+			case models.UsageByUser:
+				record = append(record, row.UserID)
+			case models.UsageByModel:
+				record = append(record, row.Model)
+			}
+		}
+		record = append(record,
+			strconv.Itoa(row.Calls),
+			strconv.Itoa(row.InputTokens),
+			strconv.Itoa(row.OutputTokens),
+			strconv.Itoa(row.CacheReadTokens),
+			strconv.Itoa(row.CacheWriteTokens),
+			strconv.Itoa(row.TTSCharacters),
+			strconv.FormatInt(row.AvgLatencyMs, 10),
+			strconv.FormatFloat(row.EstimatedCost, 'f', -1, 64),
+		)
+		w.Write(record)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to write usage CSV", "error", err)
+	}
+}
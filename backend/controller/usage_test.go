@@ -0,0 +1,62 @@
+package controller
+
+import (
+	"backend/models"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetUsage(t *testing.T) {
+	service := newStubService()
+	router := newTestRouter(service)
+
+	for _, user := range []string{"fan", "fan", "idol"} {
+		if w := postJSON(router, "/chat", ChatRequest{UserID: user, Message: "hi"}); w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	today := time.Now().UTC().Format("2006-01-02")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/usage?group_by=user&from="+today+"&to="+today, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var response struct {
+		Data models.UsageReport `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	rows := response.Data.Rows
+	if len(rows) != 2 || rows[0].UserID != "fan" || rows[0].Calls != 2 || rows[1].UserID != "idol" {
+		t.Fatalf("Unexpected rows %+v", rows)
+	}
+	if rows[0].InputTokens == 0 || rows[0].OutputTokens == 0 || rows[0].TTSCharacters == 0 {
+		t.Errorf("Expected tokens and speech to be recorded, got %+v", rows[0])
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/usage?group_by=day,model&format=csv", nil))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/csv") {
+		t.Fatalf("Expected CSV, got %d %v", w.Code, w.Header())
+	}
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0][0] != "day" || records[0][1] != "model" || records[1][0] != today || records[1][1] != models.ProviderFake || records[1][2] != "3" {
+		t.Fatalf("Unexpected CSV %v", records)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/usage?group_by=persona", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an unknown group, got %d", w.Code)
+	}
+}
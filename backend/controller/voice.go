@@ -0,0 +1,97 @@
+package controller
+
+import (
+	"backend/models"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxVoiceUploadBytes caps the size of a voice message upload.
+const maxVoiceUploadBytes = 10 << 20
+
+// ProcessVoiceChat answers a voice message. It takes a multipart form with
+// the recording as "audio" (WAV, WebM or MP3), the fields of a ChatRequest
+// except message, an optional "language" of the recording and "tts" options
+// as JSON. The transcript is answered like a text message.
+func (ops *BaseController) ProcessVoiceChat(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxVoiceUploadBytes)
+	file, header, err := c.Request.FormFile("audio")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			HandleFailedResponse(c, http.StatusRequestEntityTooLarge, errVoiceTooLarge)
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing audio file"})
+		return
+	}
+	defer file.Close()
+
+	userID, ok := requestUser(c, c.PostForm("user_id"))
+	if !ok {
+		return
+	}
+	request := ChatRequest{
+		UserID:    userID,
+		SessionID: c.PostForm("session_id"),
+		Type:      c.PostForm("type"),
+		Persona:   c.PostForm("persona"),
+	}
+	if options := c.PostForm("tts"); options != "" {
+		if err := json.Unmarshal([]byte(options), &request.TTS); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tts options"})
+			return
+		}
+	}
+	if err := request.TTS.Validate(); err != nil {
+		handleServiceError(c, err)
+		return
+	}
+	if !ops.allowTokens(c, request.UserID) {
+		return
+	}
+
+	format, err := models.AudioFormat(header.Header.Get("Content-Type"), header.Filename)
+	if err != nil {
+		handleServiceError(c, err)
+		return
+	}
+	audio, err := io.ReadAll(file)
+	if err != nil {
+		HandleFailedResponse(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	transcript, err := ops.Service.Transcribe(c.Request.Context(), audio, format, c.PostForm("language"))
+	if err == nil && strings.TrimSpace(transcript) == "" {
+		err = models.ErrEmptyTranscript
+	}
+	if err != nil {
+		handleServiceError(c, err)
+		return
+	}
+
+	// The transcript is what the idol answers, so a recording that can't be
+	// kept is only logged
+	voiceURL, err := ops.Service.SaveAudio(c.Request.Context(), audio, models.AudioContentType(format))
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to save voice message", "user_id", request.UserID, "error", err)
+	}
+
+	request.Message = transcript
+	userChat := newChat("user", transcript)
+	userChat.VoiceURL = voiceURL
+	response := ops.reply(c, request, userChat)
+	if response == nil {
+		return
+	}
+	response.Transcript = transcript
+	response.VoiceURL = voiceURL
+	HandleSucccessResponse(c, "", response)
+}
@@ -0,0 +1,88 @@
+package controller
+
+import (
+	"backend/models"
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// postVoice uploads audio of the given content type with the form fields
+// to /chat/voice.
+func postVoice(router http.Handler, fields map[string]string, audio, contentType string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for key, value := range fields {
+		form.WriteField(key, value)
+	}
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="audio"; filename="voice"`)
+	header.Set("Content-Type", contentType)
+	part, _ := form.CreatePart(header)
+	part.Write([]byte(audio))
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/chat/voice", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestProcessVoiceChat(t *testing.T) {
+	blobs, err := models.NewFSBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := newStubService()
+	service.AudioService = models.NewSpeechCache(nil, blobs, "")
+	router := newTestRouter(service)
+
+	w := postVoice(router, map[string]string{"user_id": "fan"}, "hello idol", "audio/wav")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var reply ChatResponse
+	decodeData(t, w.Body.Bytes(), &reply)
+	if reply.Transcript != "hello idol" || !strings.Contains(reply.Text, "hello idol") || !strings.HasPrefix(reply.VoiceURL, "/audio/") {
+		t.Fatalf("Unexpected reply %+v", reply)
+	}
+
+	page, err := service.List_chat(context.Background(), "fan", models.DefaultSessionID, 0, "")
+	if err != nil {
+		t.Fatalf("List_chat failed: %v", err)
+	}
+	if len(page.Chats) != 2 || page.Chats[0].Content != "hello idol" || page.Chats[0].VoiceURL != reply.VoiceURL {
+		t.Fatalf("Expected the transcript and recording to be saved, got %+v", page.Chats)
+	}
+
+	w = sendJSON(router, http.MethodGet, reply.VoiceURL, nil)
+	if w.Code != http.StatusOK || w.Body.String() != "hello idol" || w.Header().Get("Content-Type") != "audio/wav" {
+		t.Fatalf("Expected the recording, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestProcessVoiceChatRejectsBadUploads(t *testing.T) {
+	router := newTestRouter(newStubService())
+
+	cases := []struct {
+		audio       string
+		contentType string
+		code        int
+	}{
+		{"hello", "image/png", http.StatusUnsupportedMediaType},
+		{"   ", "audio/webm", http.StatusUnprocessableEntity},
+		{strings.Repeat("a", maxVoiceUploadBytes+1), "audio/mpeg", http.StatusRequestEntityTooLarge},
+	}
+	for _, tc := range cases {
+		w := postVoice(router, map[string]string{"user_id": "fan"}, tc.audio, tc.contentType)
+		if w.Code != tc.code {
+			t.Fatalf("Expected %d for %s, got %d: %s", tc.code, tc.contentType, w.Code, w.Body.String())
+		}
+	}
+}
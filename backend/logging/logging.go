@@ -0,0 +1,161 @@
+// Package logging sets up the structured logger of the server: JSON or
+// text records tagged with the ID of the request they belong to, written
+// to stderr or a rotating file.
+//
+// Secrets never reach the log: attributes named like authorization,
+// api_key, token, secret or password are replaced by [REDACTED] at every
+// level. Message bodies, logged under the keys body, text, content, prompt,
+// transcript or reply, are only written at debug level and replaced by
+// their length otherwise.
+package logging
+
+import (
+	"backend/config"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+const redacted = "[REDACTED]"
+
+// bodyKeys are the attribute keys of message bodies.
+var bodyKeys = map[string]bool{
+	"body":       true,
+	"text":       true,
+	"content":    true,
+	"prompt":     true,
+	"transcript": true,
+	"reply":      true,
+}
+
+// secretKeys are the attribute keys of secrets; keys ending in _key,
+// _secret or _token are secrets too.
+var secretKeys = map[string]bool{
+	"authorization": true,
+	"api_key":       true,
+	"apikey":        true,
+	"token":         true,
+	"secret":        true,
+	"password":      true,
+}
+
+// New returns the logger configured in cfg and the file it writes to,
+// which the caller closes on exit.
+func New(cfg config.Server) (*slog.Logger, io.Closer, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		return nil, nil, err
+	}
+
+	var out io.WriteCloser = nopCloser{os.Stderr}
+	if cfg.LogFile != "" {
+		file, err := OpenRotatingFile(cfg.LogFile, int64(cfg.LogMaxSizeMB)<<20,
+			time.Duration(cfg.LogMaxAgeHours)*time.Hour, cfg.LogMaxBackups)
+		if err != nil {
+			return nil, nil, fmt.Errorf("opening log file: %w", err)
+		}
+		out = file
+	}
+
+	handler, err := NewHandler(out, cfg.LogFormat, level)
+	if err != nil {
+		out.Close()
+		return nil, nil, err
+	}
+	return slog.New(handler), out, nil
+}
+
+// NewHandler returns a handler writing records of level and above to out
+// in format, json or text, with request IDs and redaction.
+func NewHandler(out io.Writer, format string, level slog.Leveler) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redactSecret}
+	switch format {
+	case "json":
+		return &contextHandler{next: slog.NewJSONHandler(out, opts)}, nil
+	case "text":
+		return &contextHandler{next: slog.NewTextHandler(out, opts)}, nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns ctx carrying the ID of a request, which is added
+// to every record logged with it.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by ctx, or "".
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// contextHandler adds the request ID of the context to records and keeps
+// bodies out of records above debug level.
+type contextHandler struct {
+	next slog.Handler
+}
+
+func (h *contextHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level > slog.LevelDebug {
+		record := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+		r.Attrs(func(a slog.Attr) bool {
+			record.AddAttrs(redactBody(a))
+			return true
+		})
+		r = record
+	}
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.next.Handle(ctx, r)
+}
+
+// WithAttrs redacts bodies whatever the level, as the attributes are
+// added to records of every level.
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	for i, a := range attrs {
+		attrs[i] = redactBody(a)
+	}
+	return &contextHandler{next: h.next.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{next: h.next.WithGroup(name)}
+}
+
+// redactBody replaces a message body by its length.
+func redactBody(a slog.Attr) slog.Attr {
+	if !bodyKeys[strings.ToLower(a.Key)] {
+		return a
+	}
+	return slog.String(a.Key, fmt.Sprintf("[%d chars redacted]", len([]rune(a.Value.String()))))
+}
+
+// redactSecret is the ReplaceAttr of the handlers, hiding secrets.
+func redactSecret(groups []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	if secretKeys[key] || strings.HasSuffix(key, "_key") || strings.HasSuffix(key, "_secret") || strings.HasSuffix(key, "_token") {
+		return slog.String(a.Key, redacted)
+	}
+	return a
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,132 @@
+package logging
+
+import (
+	"backend/config"
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func decodeRecords(t *testing.T, out *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Expected a JSON record, got %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestHandlerRedacts(t *testing.T) {
+	var out bytes.Buffer
+	handler, err := NewHandler(&out, "json", slog.LevelDebug)
+	if err != nil {
+		t.Fatalf("NewHandler failed: %v", err)
+	}
+	logger := slog.New(handler)
+	ctx := WithRequestID(context.Background(), "req-1")
+
+	logger.InfoContext(ctx, "Reply", "text", "my secret diary", "api_key", "k-123", "user_id", "fan")
+	logger.DebugContext(ctx, "Reply", "text", "my secret diary", "authorization", "Bearer x")
+	logger.With("body", "raw body").Debug("Call")
+
+	records := decodeRecords(t, &out)
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 records, got %d", len(records))
+	}
+	info, debug, with := records[0], records[1], records[2]
+	if info["text"] != "[15 chars redacted]" || info["api_key"] != redacted || info["user_id"] != "fan" || info["request_id"] != "req-1" {
+		t.Fatalf("Unexpected info record %v", info)
+	}
+	if debug["text"] != "my secret diary" || debug["authorization"] != redacted {
+		t.Fatalf("Expected bodies but no secrets at debug level, got %v", debug)
+	}
+	if with["body"] != "[8 chars redacted]" {
+		t.Fatalf("Expected bodies added with With to be redacted, got %v", with)
+	}
+}
+
+func TestNewRejectsBadSettings(t *testing.T) {
+	if _, err := NewHandler(&bytes.Buffer{}, "xml", slog.LevelInfo); err == nil {
+		t.Fatal("Expected an unknown format to fail")
+	}
+	if _, _, err := New(config.Server{LogLevel: "chatty", LogFormat: "json"}); err == nil {
+		t.Fatal("Expected an unknown level to fail")
+	}
+	if _, _, err := New(config.Server{LogFile: filepath.Join(t.TempDir(), "missing", "app.log"), LogLevel: "info", LogFormat: "json"}); err == nil {
+		t.Fatal("Expected a log file that can't be opened to fail")
+	}
+}
+
+func TestRotatingFileRotatesBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	if err := os.WriteFile(path, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := OpenRotatingFile(path, 8, 0, 2)
+	if err != nil {
+		t.Fatalf("OpenRotatingFile failed: %v", err)
+	}
+	defer file.Close()
+	clock := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	file.now = func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n"} {
+		if _, err := file.Write([]byte(line)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	current, _ := os.ReadFile(path)
+	if string(current) != "five\n" {
+		t.Fatalf("Expected the latest record in the log, got %q", current)
+	}
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Fatalf("Expected 2 backups to be kept, got %v", backups)
+	}
+	newest, _ := os.ReadFile(backups[1])
+	if string(newest) != "four\n" {
+		t.Fatalf("Expected the newest backup to hold the previous record, got %q", newest)
+	}
+}
+
+func TestRotatingFileRotatesByAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	file, err := OpenRotatingFile(path, 0, 24*time.Hour, 0)
+	if err != nil {
+		t.Fatalf("OpenRotatingFile failed: %v", err)
+	}
+	defer file.Close()
+	clock := time.Date(2026, 1, 2, 23, 0, 0, 0, time.UTC)
+	file.now = func() time.Time { return clock }
+	file.period = file.periodOf(clock)
+
+	file.Write([]byte("monday\n"))
+	clock = clock.Add(30 * time.Minute)
+	file.Write([]byte("still monday\n"))
+	clock = clock.Add(time.Hour)
+	file.Write([]byte("tuesday\n"))
+
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 1 {
+		t.Fatalf("Expected one rotation at midnight, got %v", backups)
+	}
+	old, _ := os.ReadFile(backups[0])
+	current, _ := os.ReadFile(path)
+	if string(old) != "monday\nstill monday\n" || string(current) != "tuesday\n" {
+		t.Fatalf("Unexpected split %q / %q", old, current)
+	}
+}
@@ -1,35 +1,83 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"backend/config"
+	"backend/logging"
 	"backend/models"
 	"backend/server"
 )
 
-func init_log() {
-	flag.Parse()
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	logFile, err := os.OpenFile("app.log", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-	if err != nil {
-		log.Println("Failed to open log file:", err)
-	}
-	log.SetOutput(logFile)
+// fatal logs err and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
 
 func main() {
-	init_log()
-	service, err := models.New()
+	cfg, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%s\n", err)
+		os.Exit(2)
+	}
+	logger, logFile, err := logging.New(cfg.Server)
 	if err != nil {
-		log.Fatalf("Failed to initialize model for operating all service, %s\n", err)
+		fmt.Fprintf(os.Stderr, "Failed to set up logging: %s\n", err)
+		os.Exit(1)
+	}
+	defer logFile.Close()
+	slog.SetDefault(logger)
+
+	service, err := models.New(cfg)
+	if err != nil {
+		fatal("Failed to initialize model for operating all service", err)
+	}
+	server, err := server.NewServer(service, cfg)
+	if err != nil {
+		fatal("Failed to create http server", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ListenAndServe()
+	}()
+	slog.Info("Serving", "addr", server.Addr)
+
+	select {
+	case err := <-served:
+		fatal("Failed to listen for http server", err)
+	case <-ctx.Done():
+	}
+	// A second signal kills the process right away
+	stop()
+
+	slog.Info("Shutting down, draining requests and speech jobs")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Server.ShutdownTimeoutSeconds)*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Failed to drain http server", "error", err)
+	}
+	if err := service.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Failed to drain speech jobs", "error", err)
 	}
-	server := server.NewServer(service)
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("Failed to listen for http server, %s\n", err)
+	if err := <-served; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Http server failed", "error", err)
 	}
-	fmt.Printf("%v", server.Addr)
-	log.Print("start serving")
+	slog.Info("Stopped")
 }
@@ -0,0 +1,133 @@
+// Package metrics holds the Prometheus metrics of the server, served at
+// GET /metrics. Labels only take bounded values, like route templates
+// instead of paths, so that series don't grow with traffic.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Stages of the chat pipeline timed by ChatStageDuration.
+const (
+	StageHistoryLoad = "history_load"
+	StageLLM         = "llm"
+	StageTTS         = "tts"
+	StageHistorySave = "history_save"
+)
+
+// Outcomes of a stage.
+const (
+	OutcomeOK      = "ok"
+	OutcomeError   = "error"
+	OutcomeTimeout = "timeout"
+)
+
+// Registry holds every metric of the server along with the Go runtime and
+// process metrics.
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+var (
+	// HTTPRequestsInFlight counts the requests being answered by route.
+	HTTPRequestsInFlight = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "http_requests_in_flight",
+		Help: "Requests being answered, by route template.",
+	}, []string{"route"})
+
+	// HTTPRequests counts answered requests.
+	HTTPRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "Answered requests by method, route template and status code.",
+	}, []string{"method", "route", "status"})
+
+	// HTTPRequestDuration times answered requests. WebSocket connections
+	// count with their whole lifetime.
+	HTTPRequestDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Time to answer a request by method and route template.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	// ChatStageDuration times the stages of answering a chat message.
+	ChatStageDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "chat_stage_duration_seconds",
+		Help:    "Time spent in a stage of the chat pipeline: history_load, llm, tts or history_save, by outcome.",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 20, 40, 80},
+	}, []string{"stage", "outcome"})
+
+	// LLMStopReasons counts model replies by why the model stopped.
+	LLMStopReasons = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "llm_stop_reasons_total",
+		Help: "Model replies by provider and stop reason.",
+	}, []string{"provider", "stop_reason"})
+
+	// LLMTokens counts the tokens of model calls.
+	LLMTokens = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "llm_tokens_total",
+		Help: "Tokens of model calls by provider and type, input or output.",
+	}, []string{"provider", "type"})
+
+	// TTSResponses counts the answers of TTS APIs by HTTP status code,
+	// "error" when no answer came.
+	TTSResponses = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "tts_http_responses_total",
+		Help: "Responses of TTS APIs by provider and HTTP status code.",
+	}, []string{"provider", "code"})
+
+	// DynamoDBErrors counts failed DynamoDB calls.
+	DynamoDBErrors = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "dynamodb_errors_total",
+		Help: "Failed DynamoDB calls by operation and error code.",
+	}, []string{"operation", "code"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// ObserveStage records a chat pipeline stage that started at started and
+// ended with err.
+func ObserveStage(stage string, started time.Time, err error) {
+	ChatStageDuration.WithLabelValues(stage, Outcome(err)).Observe(time.Since(started).Seconds())
+}
+
+// Outcome classifies err as one of the outcomes of a stage; timeouts
+// match context.DeadlineExceeded.
+func Outcome(err error) string {
+	switch {
+	case err == nil:
+		return OutcomeOK
+	case errors.Is(err, context.DeadlineExceeded):
+		return OutcomeTimeout
+	default:
+		return OutcomeError
+	}
+}
+
+// ObserveTTSResponse counts an answer of a TTS API, or the lack of one
+// for a zero status code.
+func ObserveTTSResponse(provider string, statusCode int) {
+	code := "error"
+	if statusCode != 0 {
+		code = strconv.Itoa(statusCode)
+	}
+	TTSResponses.WithLabelValues(provider, code).Inc()
+}
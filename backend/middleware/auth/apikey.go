@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// apiKeys maps the SHA-256 of every API key to its identity, so keys
+// aren't kept in memory and lookups don't depend on their content.
+type apiKeys map[string]*Identity
+
+// loadAPIKeys reads a YAML list of API keys, each with its key or the hex
+// SHA-256 of it as key_sha256, a user_id and optional roles.
+func loadAPIKeys(path string) (apiKeys, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []struct {
+		Key       string   `yaml:"key"`
+		KeySHA256 string   `yaml:"key_sha256"`
+		UserID    string   `yaml:"user_id"`
+		Roles     []string `yaml:"roles"`
+	}
+	if err := yaml.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("invalid API keys file %s: %w", path, err)
+	}
+
+	keys := apiKeys{}
+	for i, entry := range entries {
+		hash := strings.ToLower(entry.KeySHA256)
+		if entry.Key != "" {
+			hash = hashAPIKey(entry.Key)
+		}
+		if len(hash) != sha256.Size*2 || entry.UserID == "" {
+			return nil, fmt.Errorf("API key %d in %s needs a key or key_sha256 and a user_id", i+1, path)
+		}
+		keys[hash] = &Identity{UserID: entry.UserID, Roles: entry.Roles, Method: "api_key"}
+	}
+	return keys, nil
+}
+
+func (k apiKeys) lookup(key string) (*Identity, bool) {
+	identity, ok := k[hashAPIKey(key)]
+	return identity, ok
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
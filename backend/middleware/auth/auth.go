@@ -0,0 +1,223 @@
+// Package auth authenticates requests with JWTs or API keys and tells the
+// controllers which user a request comes from.
+package auth
+
+import (
+	"backend/config"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RoleAdmin may act for any user and overwrite histories.
+const RoleAdmin = "admin"
+
+// identityKey is the gin context key of the Identity of a request.
+const identityKey = "auth.identity"
+
+var (
+	// ErrNoCredentials is returned for requests without a token or API key.
+	ErrNoCredentials = errors.New("missing bearer token or API key")
+	// ErrInvalidCredentials is returned for tokens or API keys that can't
+	// be verified.
+	ErrInvalidCredentials = errors.New("invalid bearer token or API key")
+)
+
+// Identity is the authenticated user of a request.
+type Identity struct {
+	UserID string
+	Roles  []string
+	// Method is "jwt" or "api_key".
+	Method string
+}
+
+// HasRole reports whether the identity has role.
+func (i *Identity) HasRole(role string) bool {
+	for _, r := range i.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAdmin reports whether the identity has RoleAdmin.
+func (i *Identity) IsAdmin() bool {
+	return i.HasRole(RoleAdmin)
+}
+
+// Config selects how requests are authenticated. At least one of JWTSecret,
+// JWKSURL, JWKSFile or APIKeysFile must be set unless Disabled is.
+type Config struct {
+	// Disabled turns authentication off: every request is let through and
+	// the user IDs in requests are trusted, as before authentication
+	// existed. Only meant for local development.
+	Disabled bool
+	// JWTSecret verifies HS256 tokens.
+	JWTSecret []byte
+	// JWKSURL or JWKSFile hold the keys verifying RS256 tokens.
+	JWKSURL  string
+	JWKSFile string
+	// JWKSRefresh is how long keys are used before fetched again.
+	JWKSRefresh time.Duration
+	// Issuer and Audience, if set, must match the iss and aud claims.
+	Issuer   string
+	Audience string
+	// UserClaim names the claim with the user ID, RolesClaim the one with
+	// the roles, a string or a list of strings.
+	UserClaim  string
+	RolesClaim string
+	// APIKeysFile is a YAML list of API keys with their users and roles.
+	APIKeysFile string
+}
+
+// Authenticator checks the credentials of requests.
+type Authenticator struct {
+	disabled bool
+	jwt      *jwtVerifier
+	apiKeys  apiKeys
+}
+
+// New returns an Authenticator for cfg. It fails when nothing to verify
+// credentials with is configured, so a server can't run open by accident.
+func New(cfg Config) (*Authenticator, error) {
+	if cfg.Disabled {
+		slog.Warn("Authentication is disabled, user IDs in requests are trusted")
+		return &Authenticator{disabled: true}, nil
+	}
+
+	a := &Authenticator{}
+	if len(cfg.JWTSecret) > 0 || cfg.JWKSURL != "" || cfg.JWKSFile != "" {
+		verifier, err := newJWTVerifier(cfg)
+		if err != nil {
+			return nil, err
+		}
+		a.jwt = verifier
+	}
+	if cfg.APIKeysFile != "" {
+		keys, err := loadAPIKeys(cfg.APIKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		a.apiKeys = keys
+	}
+	if a.jwt == nil && a.apiKeys == nil {
+		return nil, fmt.Errorf("no authentication configured: set AUTH_JWT_SECRET, AUTH_JWKS_URL, AUTH_JWKS_FILE or AUTH_API_KEYS_FILE, or AUTH_DISABLED=true for development")
+	}
+	return a, nil
+}
+
+// NewFromConfig returns an Authenticator for the auth section of the server
+// configuration.
+func NewFromConfig(cfg config.Auth) (*Authenticator, error) {
+	return New(Config{
+		Disabled:    cfg.Disabled,
+		JWTSecret:   []byte(cfg.JWTSecret),
+		JWKSURL:     cfg.JWKSURL,
+		JWKSFile:    cfg.JWKSFile,
+		JWKSRefresh: time.Duration(cfg.JWKSRefreshMinutes) * time.Minute,
+		Issuer:      cfg.Issuer,
+		Audience:    cfg.Audience,
+		UserClaim:   cfg.UserClaim,
+		RolesClaim:  cfg.RolesClaim,
+		APIKeysFile: cfg.APIKeysFile,
+	})
+}
+
+// Authenticate returns the identity of r. API keys are read from the
+// X-API-Key header, tokens from "Authorization: Bearer" or, for clients
+// that can't set headers like WebSocket and EventSource, from the
+// access_token query parameter.
+func (a *Authenticator) Authenticate(r *http.Request) (*Identity, error) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		identity, ok := a.apiKeys.lookup(key)
+		if !ok {
+			return nil, ErrInvalidCredentials
+		}
+		return identity, nil
+	}
+
+	token := r.URL.Query().Get("access_token")
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, credentials, _ := strings.Cut(header, " ")
+		if !strings.EqualFold(scheme, "Bearer") {
+			return nil, ErrInvalidCredentials
+		}
+		token = strings.TrimSpace(credentials)
+	}
+	if token == "" {
+		return nil, ErrNoCredentials
+	}
+	if a.jwt == nil {
+		return nil, ErrInvalidCredentials
+	}
+	return a.jwt.verify(token)
+}
+
+// Middleware rejects requests without valid credentials with 401 and
+// stores the identity of the others for FromContext.
+func (a *Authenticator) Middleware() gin.HandlerFunc {
+	return a.Unless(nil)
+}
+
+// Unless is Middleware for the requests skip returns false for; the others
+// pass without credentials.
+func (a *Authenticator) Unless(skip func(c *gin.Context) bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if a.disabled || (skip != nil && skip(c)) {
+			c.Next()
+			return
+		}
+		identity, err := a.Authenticate(c.Request)
+		if err != nil {
+			if !errors.Is(err, ErrNoCredentials) {
+				slog.WarnContext(c.Request.Context(), "Rejected credentials", "method", c.Request.Method, "path", c.Request.URL.Path, "error", err)
+			}
+			c.Header("WWW-Authenticate", `Bearer realm="api"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"code":    "unauthorized",
+				"message": ErrInvalidCredentials.Error(),
+			})
+			return
+		}
+		SetIdentity(c, identity)
+		c.Next()
+	}
+}
+
+// RequireRole rejects authenticated requests without role with 403. It
+// must follow Middleware.
+func (a *Authenticator) RequireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if a.disabled {
+			c.Next()
+			return
+		}
+		if identity := FromContext(c); identity == nil || !identity.HasRole(role) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"code":    "forbidden",
+				"message": fmt.Sprintf("the %s role is required", role),
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// SetIdentity stores the identity of the request in c.
+func SetIdentity(c *gin.Context, identity *Identity) {
+	c.Set(identityKey, identity)
+}
+
+// FromContext returns the identity of the request, nil if it wasn't
+// authenticated because authentication is disabled or skipped for it.
+func FromContext(c *gin.Context) *Identity {
+	identity, _ := c.Get(identityKey)
+	i, _ := identity.(*Identity)
+	return i
+}
@@ -0,0 +1,245 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// newTestRouter answers GET /me with the user ID of the request and
+// POST /admin only for admins.
+func newTestRouter(a *Authenticator) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(a.Middleware())
+	router.GET("/me", func(c *gin.Context) {
+		c.String(http.StatusOK, FromContext(c).UserID)
+	})
+	router.POST("/admin", a.RequireRole(RoleAdmin), func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+	return router
+}
+
+func request(router http.Handler, method, path string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func bearer(token string) http.Header {
+	return http.Header{"Authorization": {"Bearer " + token}}
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestHS256(t *testing.T) {
+	a, err := New(Config{JWTSecret: []byte("secret"), Issuer: "fans"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := newTestRouter(a)
+	expires := time.Now().Add(time.Hour).Unix()
+
+	token := sign(t, jwt.SigningMethodHS256, []byte("secret"), "", jwt.MapClaims{"sub": "fan", "iss": "fans", "exp": expires})
+	if w := request(router, http.MethodGet, "/me", bearer(token)); w.Code != http.StatusOK || w.Body.String() != "fan" {
+		t.Fatalf("Expected the user of the token, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := request(router, http.MethodGet, "/me?access_token="+token, nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected the token to be accepted as query parameter, got %d", w.Code)
+	}
+	if w := request(router, http.MethodPost, "/admin", bearer(token)); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403 without the admin role, got %d", w.Code)
+	}
+
+	admin := sign(t, jwt.SigningMethodHS256, []byte("secret"), "", jwt.MapClaims{"sub": "ops", "iss": "fans", "exp": expires, "roles": []string{"admin"}})
+	if w := request(router, http.MethodPost, "/admin", bearer(admin)); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected admins to pass, got %d", w.Code)
+	}
+
+	rejected := map[string]string{
+		"no token":       "",
+		"wrong secret":   sign(t, jwt.SigningMethodHS256, []byte("guess"), "", jwt.MapClaims{"sub": "fan", "iss": "fans", "exp": expires}),
+		"expired":        sign(t, jwt.SigningMethodHS256, []byte("secret"), "", jwt.MapClaims{"sub": "fan", "iss": "fans", "exp": time.Now().Add(-time.Hour).Unix()}),
+		"no expiry":      sign(t, jwt.SigningMethodHS256, []byte("secret"), "", jwt.MapClaims{"sub": "fan", "iss": "fans"}),
+		"wrong issuer":   sign(t, jwt.SigningMethodHS256, []byte("secret"), "", jwt.MapClaims{"sub": "fan", "iss": "other", "exp": expires}),
+		"no user":        sign(t, jwt.SigningMethodHS256, []byte("secret"), "", jwt.MapClaims{"iss": "fans", "exp": expires}),
+		"unsigned token": sign(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "", jwt.MapClaims{"sub": "fan", "iss": "fans", "exp": expires}),
+	}
+	for name, token := range rejected {
+		header := bearer(token)
+		if token == "" {
+			header = nil
+		}
+		if w := request(router, http.MethodGet, "/me", header); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 for %s, got %d", name, w.Code)
+		}
+	}
+}
+
+// newKeySet returns an RSA key and a JSON Web Key Set with its public key
+// as k1.
+func newKeySet(t *testing.T) (*rsa.PrivateKey, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "k1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+	return key, set
+}
+
+func TestRS256WithJWKSFile(t *testing.T) {
+	key, set := newKeySet(t)
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(file, set, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := New(Config{JWKSFile: file, JWKSRefresh: time.Hour, UserClaim: "fan_id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := newTestRouter(a)
+	claims := jwt.MapClaims{"fan_id": "fan", "exp": time.Now().Add(time.Hour).Unix()}
+
+	if w := request(router, http.MethodGet, "/me", bearer(sign(t, jwt.SigningMethodRS256, key, "k1", claims))); w.Code != http.StatusOK || w.Body.String() != "fan" {
+		t.Fatalf("Expected the RS256 token to be accepted, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := request(router, http.MethodGet, "/me", bearer(sign(t, jwt.SigningMethodRS256, key, "k2", claims))); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for an unknown key ID, got %d", w.Code)
+	}
+	// HS256 signed with the public key must not pass as RS256
+	if w := request(router, http.MethodGet, "/me", bearer(sign(t, jwt.SigningMethodHS256, key.N.Bytes(), "k1", claims))); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for an HS256 token, got %d", w.Code)
+	}
+}
+
+func TestJWKSRefreshDoesNotStallRequests(t *testing.T) {
+	_, set := newKeySet(t)
+	var fetches int32
+	down, release := make(chan struct{}), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		select {
+		case <-down:
+			<-release
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write(set)
+		}
+	}))
+	defer server.Close()
+
+	keys, err := newJWKS(server.URL, "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(down)
+	keys.mu.Lock()
+	keys.fetchedAt = keys.fetchedAt.Add(-2 * time.Hour)
+	keys.attemptedAt = keys.fetchedAt
+	keys.mu.Unlock()
+
+	refreshed := make(chan struct{})
+	go func() {
+		keys.key("k1")
+		close(refreshed)
+	}()
+	for atomic.LoadInt32(&fetches) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	// The endpoint hangs, but other requests use the keys they have
+	if _, err := keys.key("k1"); err != nil {
+		t.Fatalf("Expected the cached key during the refresh, got %v", err)
+	}
+
+	close(release)
+	<-refreshed
+	for i := 0; i < 3; i++ {
+		if _, err := keys.key("k1"); err != nil {
+			t.Fatalf("Expected the cached key after a failed refresh, got %v", err)
+		}
+	}
+	if got := atomic.LoadInt32(&fetches); got != 2 {
+		t.Fatalf("Expected a failed refresh not to be retried at once, got %d fetches", got)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keys.yaml")
+	keys := "- key: fan-key\n  user_id: fan\n- key_sha256: " + hashAPIKey("ops-key") + "\n  user_id: ops\n  roles: [admin]\n"
+	if err := os.WriteFile(file, []byte(keys), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := New(Config{APIKeysFile: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := newTestRouter(a)
+
+	if w := request(router, http.MethodGet, "/me", http.Header{"X-Api-Key": {"fan-key"}}); w.Code != http.StatusOK || w.Body.String() != "fan" {
+		t.Fatalf("Expected the user of the API key, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := request(router, http.MethodPost, "/admin", http.Header{"X-Api-Key": {"ops-key"}}); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected the admin key to pass, got %d", w.Code)
+	}
+	if w := request(router, http.MethodGet, "/me", http.Header{"X-Api-Key": {"guess"}}); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for an unknown API key, got %d", w.Code)
+	}
+	if w := request(router, http.MethodGet, "/me", bearer("a.b.c")); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for tokens without JWT configured, got %d", w.Code)
+	}
+}
+
+func TestNewRequiresConfiguration(t *testing.T) {
+	if _, err := New(Config{}); err == nil {
+		t.Fatal("Expected an error without any authentication configured")
+	}
+	a, err := New(Config{Disabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	router.Use(a.Middleware())
+	router.POST("/admin", a.RequireRole(RoleAdmin), func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+	if w := request(router, http.MethodPost, "/admin", nil); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected disabled authentication to let requests through, got %d", w.Code)
+	}
+}
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// jwksMinRefresh limits fetching keys again for unknown key IDs, so
+	// forged tokens can't make the server hammer the JWKS endpoint.
+	jwksMinRefresh = time.Minute
+	jwksTimeout    = 10 * time.Second
+	maxJWKSBytes   = 1 << 20
+)
+
+// jwks holds the RSA keys of a JSON Web Key Set read from a URL or a file.
+// Keys are read again once they are older than refresh, or when a token
+// names a key ID that isn't known yet. Reads are attempted at most once a
+// minute, failed ones included, and by one request at a time; other
+// requests use the keys read before meanwhile.
+type jwks struct {
+	url     string
+	file    string
+	refresh time.Duration
+	client  *http.Client
+
+	mu          sync.Mutex
+	keys        map[string]*rsa.PublicKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+	refreshing  bool
+}
+
+func newJWKS(url, file string, refresh time.Duration) (*jwks, error) {
+	j := &jwks{
+		url:     url,
+		file:    file,
+		refresh: refresh,
+		client:  &http.Client{Timeout: jwksTimeout},
+	}
+	// Fail at startup rather than on the first request
+	keys, err := j.load()
+	if err != nil {
+		return nil, err
+	}
+	j.keys, j.fetchedAt, j.attemptedAt = keys, time.Now(), time.Now()
+	return j, nil
+}
+
+// key returns the key with the given ID. Without an ID, the only key of a
+// set with one key is used.
+func (j *jwks) key(kid string) (*rsa.PublicKey, error) {
+	if j.startRefresh(kid) {
+		keys, err := j.load()
+		j.mu.Lock()
+		j.refreshing = false
+		if err == nil {
+			j.keys, j.fetchedAt = keys, time.Now()
+		}
+		j.mu.Unlock()
+		if err != nil {
+			// Keep using the keys fetched before
+			slog.Warn("Failed to refresh JWKS", "error", err)
+		}
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if kid == "" && len(j.keys) == 1 {
+		for _, key := range j.keys {
+			return key, nil
+		}
+	}
+	if key, ok := j.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key ID %q", kid)
+}
+
+// startRefresh reports whether the caller should read the keys again for a
+// token naming kid, marking the read as running if so.
+func (j *jwks) startRefresh(kid string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	_, known := j.keys[kid]
+	due := time.Since(j.fetchedAt) > j.refresh || (!known && kid != "")
+	if !due || j.refreshing || time.Since(j.attemptedAt) <= jwksMinRefresh {
+		return false
+	}
+	j.refreshing = true
+	j.attemptedAt = time.Now()
+	return true
+}
+
+// load reads and parses the key set.
+func (j *jwks) load() (map[string]*rsa.PublicKey, error) {
+	data, err := j.read()
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, key := range set.Keys {
+		if key.Kty != "RSA" || (key.Use != "" && key.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus of key %q: %w", key.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exponent of key %q: %w", key.Kid, err)
+		}
+		keys[key.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS has no RSA signing keys")
+	}
+	return keys, nil
+}
+
+func (j *jwks) read() ([]byte, error) {
+	if j.file != "" {
+		return os.ReadFile(j.file)
+	}
+	resp, err := j.client.Get(j.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching JWKS from %s returned %d", j.url, resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxJWKSBytes))
+}
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	defaultUserClaim  = "sub"
+	defaultRolesClaim = "roles"
+	// clockLeeway allows for clock skew between issuer and server.
+	clockLeeway = 30 * time.Second
+)
+
+// jwtVerifier verifies HS256 tokens with a shared secret and RS256 tokens
+// with the keys of a JWKS.
+type jwtVerifier struct {
+	secret     []byte
+	keys       *jwks
+	parser     *jwt.Parser
+	userClaim  string
+	rolesClaim string
+}
+
+func newJWTVerifier(cfg Config) (*jwtVerifier, error) {
+	v := &jwtVerifier{
+		secret:     cfg.JWTSecret,
+		userClaim:  cfg.UserClaim,
+		rolesClaim: cfg.RolesClaim,
+	}
+	if v.userClaim == "" {
+		v.userClaim = defaultUserClaim
+	}
+	if v.rolesClaim == "" {
+		v.rolesClaim = defaultRolesClaim
+	}
+
+	var methods []string
+	if len(v.secret) > 0 {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	if cfg.JWKSURL != "" || cfg.JWKSFile != "" {
+		keys, err := newJWKS(cfg.JWKSURL, cfg.JWKSFile, cfg.JWKSRefresh)
+		if err != nil {
+			return nil, err
+		}
+		v.keys = keys
+		methods = append(methods, jwt.SigningMethodRS256.Alg())
+	}
+
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(methods),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(clockLeeway),
+	}
+	if cfg.Issuer != "" {
+		options = append(options, jwt.WithIssuer(cfg.Issuer))
+	}
+	if cfg.Audience != "" {
+		options = append(options, jwt.WithAudience(cfg.Audience))
+	}
+	v.parser = jwt.NewParser(options...)
+	return v, nil
+}
+
+// verify checks the signature and claims of a token and returns the
+// identity it names.
+func (v *jwtVerifier) verify(raw string) (*Identity, error) {
+	claims := jwt.MapClaims{}
+	if _, err := v.parser.ParseWithClaims(raw, claims, v.key); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+
+	userID, _ := claims[v.userClaim].(string)
+	if userID == "" {
+		return nil, fmt.Errorf("%w: token has no %s claim", ErrInvalidCredentials, v.userClaim)
+	}
+	identity := &Identity{UserID: userID, Method: "jwt"}
+	switch roles := claims[v.rolesClaim].(type) {
+	case string:
+		identity.Roles = []string{roles}
+	case []interface{}:
+		for _, role := range roles {
+			if role, ok := role.(string); ok {
+				identity.Roles = append(identity.Roles, role)
+			}
+		}
+	}
+	return identity, nil
+}
+
+// key returns the key verifying token; the parser already checked that its
+// algorithm is one configured.
+func (v *jwtVerifier) key(token *jwt.Token) (interface{}, error) {
+	if token.Method.Alg() == jwt.SigningMethodHS256.Alg() {
+		return v.secret, nil
+	}
+	kid, _ := token.Header["kid"].(string)
+	return v.keys.key(kid)
+}
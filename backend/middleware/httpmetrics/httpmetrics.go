@@ -0,0 +1,37 @@
+// Package httpmetrics records the requests of the server in the metrics
+// package, labelled with the route template matched by Gin, like
+// /sessions/:session_id, rather than the path.
+package httpmetrics
+
+import (
+	"backend/metrics"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// unmatchedRoute labels requests that matched no route, whose paths are
+// up to clients.
+const unmatchedRoute = "unmatched"
+
+// Middleware counts requests in flight and, once answered, by status code
+// and latency.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := c.FullPath()
+		if route == "" {
+			route = unmatchedRoute
+		}
+		inFlight := metrics.HTTPRequestsInFlight.WithLabelValues(route)
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		started := time.Now()
+		c.Next()
+
+		method := c.Request.Method
+		metrics.HTTPRequests.WithLabelValues(method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		metrics.HTTPRequestDuration.WithLabelValues(method, route).Observe(time.Since(started).Seconds())
+	}
+}
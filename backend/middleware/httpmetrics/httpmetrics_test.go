@@ -0,0 +1,44 @@
+package httpmetrics
+
+import (
+	"backend/metrics"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMiddlewareLabelsRouteTemplates(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(Middleware())
+	var inFlight float64
+	router.GET("/sessions/:session_id", func(c *gin.Context) {
+		inFlight = testutil.ToFloat64(metrics.HTTPRequestsInFlight.WithLabelValues("/sessions/:session_id"))
+		c.Status(http.StatusNoContent)
+	})
+
+	// The counters are global, so only what this test adds is checked
+	matched := metrics.HTTPRequests.WithLabelValues(http.MethodGet, "/sessions/:session_id", "204")
+	unmatched := metrics.HTTPRequests.WithLabelValues(http.MethodGet, unmatchedRoute, "404")
+	matchedBefore, unmatchedBefore := testutil.ToFloat64(matched), testutil.ToFloat64(unmatched)
+
+	for _, path := range []string{"/sessions/a", "/sessions/b", "/nowhere/c"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	if inFlight != 1 {
+		t.Fatalf("Expected the request to be in flight while answered, got %v", inFlight)
+	}
+	if got := testutil.ToFloat64(metrics.HTTPRequestsInFlight.WithLabelValues("/sessions/:session_id")); got != 0 {
+		t.Fatalf("Expected no request in flight afterwards, got %v", got)
+	}
+	if got := testutil.ToFloat64(matched) - matchedBefore; got != 2 {
+		t.Fatalf("Expected both sessions counted under the route template, got %v", got)
+	}
+	if got := testutil.ToFloat64(unmatched) - unmatchedBefore; got != 1 {
+		t.Fatalf("Expected the unmatched path under %q, got %v", unmatchedRoute, got)
+	}
+}
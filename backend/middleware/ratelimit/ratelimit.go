@@ -0,0 +1,96 @@
+// Package ratelimit limits the requests per minute of every user, or of
+// every client address for requests without a user, and reports the
+// limits of the caller in response headers.
+package ratelimit
+
+import (
+	"backend/middleware/auth"
+	"backend/models"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Headers reporting the quotas of the caller on every response.
+const (
+	HeaderLimit     = "X-RateLimit-Limit"
+	HeaderRemaining = "X-RateLimit-Remaining"
+	HeaderReset     = "X-RateLimit-Reset"
+
+	HeaderInputTokensRemaining  = "X-Quota-Input-Tokens-Remaining"
+	HeaderOutputTokensRemaining = "X-Quota-Output-Tokens-Remaining"
+	HeaderTokensReset           = "X-Quota-Tokens-Reset"
+)
+
+// Limiter enforces the request limits of a models.QuotaService.
+type Limiter struct {
+	quotas models.QuotaService
+}
+
+// New returns a Limiter counting requests with quotas.
+func New(quotas models.QuotaService) *Limiter {
+	return &Limiter{quotas: quotas}
+}
+
+// Middleware counts every request against the per minute limit of its
+// user, or of its client address without one, and rejects it with 429 and
+// Retry-After once the limit is exceeded. Admins aren't limited. Placed
+// after authentication it also reports the daily token budgets of the
+// user. Limits that are turned off aren't reported.
+func (l *Limiter) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		identity := auth.FromContext(c)
+		if identity != nil && identity.IsAdmin() {
+			c.Next()
+			return
+		}
+
+		key := "ip:" + c.ClientIP()
+		if identity != nil {
+			key = "user:" + identity.UserID
+			if tokens, _ := l.quotas.TokenQuota(c.Request.Context(), identity.UserID); tokens != nil {
+				setTokenHeaders(c, tokens)
+			}
+		}
+
+		status, err := l.quotas.CountRequest(c.Request.Context(), key)
+		if status != nil && status.Limit > 0 {
+			c.Header(HeaderLimit, strconv.FormatInt(status.Limit, 10))
+			c.Header(HeaderRemaining, strconv.FormatInt(status.Remaining, 10))
+			c.Header(HeaderReset, strconv.FormatInt(status.Reset.Unix(), 10))
+		}
+		if errors.Is(err, models.ErrRateLimited) {
+			SetRetryAfter(c, status.Reset)
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"code":    "rate_limited",
+				"message": "too many requests, slow down",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+func setTokenHeaders(c *gin.Context, tokens *models.TokenQuotaStatus) {
+	if tokens.Input.Limit > 0 {
+		c.Header(HeaderInputTokensRemaining, strconv.FormatInt(tokens.Input.Remaining, 10))
+		c.Header(HeaderTokensReset, strconv.FormatInt(tokens.Input.Reset.Unix(), 10))
+	}
+	if tokens.Output.Limit > 0 {
+		c.Header(HeaderOutputTokensRemaining, strconv.FormatInt(tokens.Output.Remaining, 10))
+		c.Header(HeaderTokensReset, strconv.FormatInt(tokens.Output.Reset.Unix(), 10))
+	}
+}
+
+// SetRetryAfter sets the Retry-After header of a 429 response to the
+// seconds until reset, at least one.
+func SetRetryAfter(c *gin.Context, reset time.Time) {
+	seconds := int(time.Until(reset).Seconds() + 0.999)
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(seconds))
+}
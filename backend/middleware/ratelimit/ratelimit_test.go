@@ -0,0 +1,81 @@
+package ratelimit
+
+import (
+	"backend/middleware/auth"
+	"backend/models"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTestRouter answers GET /ping as identity, nil for anonymous clients.
+func newTestRouter(quotas models.QuotaService, identity *auth.Identity) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		if identity != nil {
+			auth.SetIdentity(c, identity)
+		}
+	}, New(quotas).Middleware())
+	router.GET("/ping", func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+	return router
+}
+
+func ping(router http.Handler) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ping", nil))
+	return w
+}
+
+func TestMiddleware(t *testing.T) {
+	quotas := models.NewQuotaService(models.NewMemoryCounterStore(), models.QuotaLimits{RequestsPerMinute: 2, DailyOutputTokens: 100})
+	router := newTestRouter(quotas, &auth.Identity{UserID: "fan"})
+
+	w := ping(router)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected the first request to pass, got %d", w.Code)
+	}
+	if w.Header().Get(HeaderLimit) != "2" || w.Header().Get(HeaderRemaining) != "1" || w.Header().Get(HeaderReset) == "" {
+		t.Fatalf("Unexpected rate limit headers %v", w.Header())
+	}
+	if w.Header().Get(HeaderOutputTokensRemaining) != "100" || w.Header().Get(HeaderInputTokensRemaining) != "" {
+		t.Fatalf("Unexpected token quota headers %v", w.Header())
+	}
+
+	ping(router)
+	w = ping(router)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("Expected 429 with Retry-After, got %d %v", w.Code, w.Header())
+	}
+
+	// Anonymous clients are counted by address, admins not at all
+	if w := ping(newTestRouter(quotas, nil)); w.Code != http.StatusNoContent {
+		t.Fatalf("Expected anonymous clients to be counted on their own, got %d", w.Code)
+	}
+	admin := newTestRouter(quotas, &auth.Identity{UserID: "ops", Roles: []string{auth.RoleAdmin}})
+	for i := 0; i < 5; i++ {
+		if w := ping(admin); w.Code != http.StatusNoContent {
+			t.Fatalf("Expected admins not to be limited, got %d", w.Code)
+		}
+	}
+}
+
+func TestSetRetryAfter(t *testing.T) {
+	for reset, want := range map[time.Duration]string{
+		-time.Minute:            "1",
+		0:                       "1",
+		1500 * time.Millisecond: "2",
+		time.Hour:               "3600",
+	} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		SetRetryAfter(c, time.Now().Add(reset))
+		if got := c.Writer.Header().Get("Retry-After"); got != want {
+			t.Errorf("SetRetryAfter(now%+v) set %q, want %q", reset, got, want)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Package requestlog tags every request with an ID and logs it once it is
+// answered. The ID is taken from the X-Request-ID header when the client,
+// or a proxy in front of the server, sends a usable one, and is returned
+// in the same header.
+package requestlog
+
+import (
+	"backend/logging"
+	"backend/middleware/auth"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HeaderRequestID carries the ID of a request both ways.
+const HeaderRequestID = "X-Request-ID"
+
+// maxRequestIDLength caps IDs taken from clients.
+const maxRequestIDLength = 128
+
+// Middleware adds the request ID to the request context, so that it is
+// logged with every record of the request, and logs method, route, status
+// and latency of every request but those to skipPaths. Requests that fail
+// with 5xx are logged as errors.
+func Middleware(logger *slog.Logger, skipPaths ...string) gin.HandlerFunc {
+	skip := make(map[string]bool, len(skipPaths))
+	for _, path := range skipPaths {
+		skip[path] = true
+	}
+
+	return func(c *gin.Context) {
+		id := c.GetHeader(HeaderRequestID)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		c.Header(HeaderRequestID, id)
+		c.Request = c.Request.WithContext(logging.WithRequestID(c.Request.Context(), id))
+
+		started := time.Now()
+		c.Next()
+		if skip[c.Request.URL.Path] {
+			return
+		}
+
+		status := c.Writer.Status()
+		attrs := []slog.Attr{
+			slog.String("method", c.Request.Method),
+			slog.String("route", c.FullPath()),
+			slog.String("path", c.Request.URL.Path),
+			slog.Int("status", status),
+			slog.Int64("latency_ms", time.Since(started).Milliseconds()),
+			slog.String("client_ip", c.ClientIP()),
+		}
+		if identity := auth.FromContext(c); identity != nil {
+			attrs = append(attrs, slog.String("user_id", identity.UserID))
+		}
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+			if len(c.Errors) > 0 {
+				attrs = append(attrs, slog.String("error", c.Errors.String()))
+			}
+		}
+		logger.LogAttrs(c.Request.Context(), level, "Request", attrs...)
+	}
+}
+
+// validRequestID accepts IDs of letters, digits and -_.: so that they can
+// be logged and echoed safely.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-' || r == '_' || r == '.' || r == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,97 @@
+package requestlog
+
+import (
+	"backend/logging"
+	"backend/middleware/auth"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTestRouter answers GET /ping/:n as fan, logging the request ID it
+// sees, and GET /healthz.
+func newTestRouter(out *bytes.Buffer) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	handler, err := logging.NewHandler(out, "json", slog.LevelInfo)
+	if err != nil {
+		panic(err)
+	}
+	logger := slog.New(handler)
+
+	router := gin.New()
+	router.Use(Middleware(logger, "/healthz"), func(c *gin.Context) {
+		auth.SetIdentity(c, &auth.Identity{UserID: "fan"})
+	})
+	router.GET("/ping/:n", func(c *gin.Context) {
+		logger.InfoContext(c.Request.Context(), "Pong")
+		c.Status(http.StatusNoContent)
+	})
+	router.GET("/healthz", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	return router
+}
+
+func get(router http.Handler, path, requestID string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if requestID != "" {
+		req.Header.Set(HeaderRequestID, requestID)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestMiddleware(t *testing.T) {
+	cases := []struct {
+		name   string
+		sent   string
+		honour bool
+	}{
+		{"from client", "edge-42:abc", true},
+		{"missing", "", false},
+		{"unsafe", "bad id\nforged record", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			w := get(newTestRouter(&out), "/ping/1", tc.sent)
+
+			id := w.Header().Get(HeaderRequestID)
+			if tc.honour && id != tc.sent || !tc.honour && (len(id) != 32 || id == tc.sent) {
+				t.Fatalf("Unexpected request ID %q for %q", id, tc.sent)
+			}
+
+			decoder := json.NewDecoder(&out)
+			var pong, access map[string]interface{}
+			if err := decoder.Decode(&pong); err != nil {
+				t.Fatalf("Expected the record of the handler: %v", err)
+			}
+			if err := decoder.Decode(&access); err != nil {
+				t.Fatalf("Expected the access record: %v", err)
+			}
+			if pong["request_id"] != id || access["request_id"] != id {
+				t.Fatalf("Expected request ID %s in %v and %v", id, pong, access)
+			}
+			if access["route"] != "/ping/:n" || access["status"] != float64(http.StatusNoContent) || access["user_id"] != "fan" {
+				t.Fatalf("Unexpected access record %v", access)
+			}
+		})
+	}
+}
+
+func TestMiddlewareSkipsPaths(t *testing.T) {
+	var out bytes.Buffer
+	w := get(newTestRouter(&out), "/healthz", "")
+	if w.Header().Get(HeaderRequestID) == "" {
+		t.Fatal("Expected a request ID on skipped paths too")
+	}
+	if out.Len() != 0 {
+		t.Fatalf("Expected no access record, got %s", out.String())
+	}
+}
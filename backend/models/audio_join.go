@@ -0,0 +1,121 @@
+package models
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ErrCannotJoinAudio is returned for audio files that can't be joined into
+// one, because they differ in format or aren't MP3 or WAV.
+var ErrCannotJoinAudio = errors.New("audio files can't be joined")
+
+// joinAudio concatenates audio files of the same format, contentType being
+// that of all of them.
+func joinAudio(contentType string, files [][]byte) ([]byte, error) {
+	format, err := AudioFormat(contentType, "")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrCannotJoinAudio, contentType)
+	}
+	switch format {
+	case "mp3":
+		return joinMP3(files), nil
+	case "wav":
+		return joinWAV(files)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrCannotJoinAudio, contentType)
+}
+
+// joinMP3 concatenates MP3 frames. Players handle that, as long as the ID3
+// tags of all but the first file are dropped.
+func joinMP3(files [][]byte) []byte {
+	var joined bytes.Buffer
+	for i, file := range files {
+		if i > 0 {
+			file = file[id3Size(file):]
+		}
+		joined.Write(file)
+	}
+	return joined.Bytes()
+}
+
+// id3Size returns the length of the ID3v2 tag at the start of an MP3 file,
+// 0 if there is none.
+func id3Size(file []byte) int {
+	if len(file) < 10 || string(file[:3]) != "ID3" {
+		return 0
+	}
+	// The size is stored as four 7-bit bytes and excludes the header
+	size := int(file[6])<<21 | int(file[7])<<14 | int(file[8])<<7 | int(file[9])
+	if file[5]&0x10 != 0 {
+		// Footer
+		size += 10
+	}
+	if 10+size > len(file) {
+		return len(file)
+	}
+	return 10 + size
+}
+
+// joinWAV concatenates the samples of WAV files with the same format chunk
+// under one new header.
+func joinWAV(files [][]byte) ([]byte, error) {
+	var format []byte
+	var samples bytes.Buffer
+	for _, file := range files {
+		fmtChunk, data, err := readWAV(file)
+		if err != nil {
+			return nil, err
+		}
+		if format == nil {
+			format = fmtChunk
+		} else if !bytes.Equal(format, fmtChunk) {
+			return nil, fmt.Errorf("%w: WAV formats differ", ErrCannotJoinAudio)
+		}
+		samples.Write(data)
+	}
+
+	var joined bytes.Buffer
+	joined.WriteString("RIFF")
+	binary.Write(&joined, binary.LittleEndian, uint32(4+8+len(format)+8+samples.Len()))
+	joined.WriteString("WAVEfmt ")
+	binary.Write(&joined, binary.LittleEndian, uint32(len(format)))
+	joined.Write(format)
+	joined.WriteString("data")
+	binary.Write(&joined, binary.LittleEndian, uint32(samples.Len()))
+	joined.Write(samples.Bytes())
+	return joined.Bytes(), nil
+}
+
+// readWAV returns the format chunk and the samples of a WAV file.
+func readWAV(file []byte) (format, data []byte, err error) {
+	if len(file) < 12 || string(file[:4]) != "RIFF" || string(file[8:12]) != "WAVE" {
+		return nil, nil, fmt.Errorf("%w: not a WAV file", ErrCannotJoinAudio)
+	}
+	for rest := file[12:]; len(rest) >= 8; {
+		id := string(rest[:4])
+		size := int(binary.LittleEndian.Uint32(rest[4:8]))
+		if 8+size > len(rest) {
+			// Streamed WAVs may leave the size of the last chunk unset
+			size = len(rest) - 8
+		}
+		chunk := rest[8 : 8+size]
+		switch id {
+		case "fmt ":
+			format = chunk
+		case "data":
+			data = chunk
+		}
+		// Chunks are padded to an even size
+		next := 8 + size + size%2
+		if next > len(rest) {
+			break
+		}
+		rest = rest[next:]
+	}
+	if format == nil || data == nil {
+		return nil, nil, fmt.Errorf("%w: WAV file without format or data", ErrCannotJoinAudio)
+	}
+	return format, data, nil
+}
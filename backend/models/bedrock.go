@@ -1,38 +1,133 @@
 package models
 
 import (
+	"backend/metrics"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
-	"os"
+	"log/slog"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
 	"github.com/aws/smithy-go"
 )
 
 type BedrockService interface {
-	GenerateResponse(prompt string) (string, error)
+	GenerateResponse(ctx context.Context, prompt string, opts ChatOptions) (*ChatCompletion, error)
+	GenerateChatResponse(ctx context.Context, history []Chat, prompt string, opts ChatOptions) (*ChatCompletion, error)
+	StreamChatResponse(ctx context.Context, history []Chat, prompt string, opts ChatOptions, onDelta func(delta string) error) (*ChatCompletion, error)
+	GenerateTitle(ctx context.Context, chats []Chat, opts ChatOptions) (string, error)
 }
 
-type bedrockService struct {
-	client *bedrockruntime.Client
+// ChatOptions selects how a single chat reply is generated, usually taken
+// from a Persona.
+type ChatOptions struct {
+	// Provider is the registered LLM provider name; empty uses the default.
+	Provider string
+	// System is the system prompt.
+	System string
+	// InferenceConfig overrides the sampling parameters of the provider
+	// that are set.
+	InferenceConfig
+	// Guardrail replaces the Bedrock guardrail of the provider when set.
+	Guardrail *Guardrail
 }
 
-func NewBedrockService() (BedrockService, error) {
-	cfg, err := config.LoadDefaultConfig(context.TODO())
-	if err != nil {
-		return nil, err
+// ErrInvalidInferenceConfig is returned for sampling parameters out of
+// range.
+var ErrInvalidInferenceConfig = errors.New("invalid inference parameters")
+
+// maxStopSequences is the most stop sequences the providers accept.
+const maxStopSequences = 4
+
+// InferenceConfig holds the sampling parameters of a reply. Fields left
+// unset keep the defaults of the provider.
+type InferenceConfig struct {
+	MaxTokens     int      `json:"max_tokens,omitempty" yaml:"max_tokens"`
+	Temperature   *float64 `json:"temperature,omitempty" yaml:"temperature"`
+	TopP          *float64 `json:"top_p,omitempty" yaml:"top_p"`
+	StopSequences []string `json:"stop_sequences,omitempty" yaml:"stop_sequences"`
+}
+
+// Validate checks that c is within what the providers accept.
+func (c InferenceConfig) Validate() error {
+	if c.MaxTokens < 0 {
+		return fmt.Errorf("%w: negative max_tokens", ErrInvalidInferenceConfig)
+	}
+	if c.Temperature != nil && (*c.Temperature < 0 || *c.Temperature > 1) {
+		return fmt.Errorf("%w: temperature %v outside of [0, 1]", ErrInvalidInferenceConfig, *c.Temperature)
+	}
+	if c.TopP != nil && (*c.TopP < 0 || *c.TopP > 1) {
+		return fmt.Errorf("%w: top_p %v outside of [0, 1]", ErrInvalidInferenceConfig, *c.TopP)
+	}
+	if len(c.StopSequences) > maxStopSequences {
+		return fmt.Errorf("%w: more than %d stop_sequences", ErrInvalidInferenceConfig, maxStopSequences)
 	}
+	return nil
+}
+
+// Merge returns c with the fields set in override replacing its own.
+func (c InferenceConfig) Merge(override InferenceConfig) InferenceConfig {
+	if override.MaxTokens > 0 {
+		c.MaxTokens = override.MaxTokens
+	}
+	if override.Temperature != nil {
+		c.Temperature = override.Temperature
+	}
+	if override.TopP != nil {
+		c.TopP = override.TopP
+	}
+	if len(override.StopSequences) > 0 {
+		c.StopSequences = override.StopSequences
+	}
+	return c
+}
+
+// Guardrail is a Bedrock guardrail applied to a reply, of Version or the
+// working draft if empty.
+type Guardrail struct {
+	ID      string `json:"id" yaml:"id"`
+	Version string `json:"version,omitempty" yaml:"version"`
+}
+
+type bedrockService struct {
+	providers *ProviderRegistry
+	budget    ContextBudget
+	timeout   stageTimeout
+}
 
-	client := bedrockruntime.NewFromConfig(cfg)
-	return &bedrockService{client: client}, nil
+// NewBedrockService returns a BedrockService that dispatches to providers
+// and sends them as much of the conversation as budget allows. Calls taking
+// longer than timeout fail with a TimeoutError; zero means no timeout
+// besides the one of the request.
+func NewBedrockService(providers *ProviderRegistry, budget ContextBudget, timeout time.Duration) BedrockService {
+	return &bedrockService{providers: providers, budget: budget, timeout: stageTimeout{stage: StageLLM, timeout: timeout}}
 }
 
+// NewBedrockServiceWithRegistry returns a BedrockService backed by the
+// given providers, e.g. a registry holding only the fake provider in tests,
+// with the default context budget.
+func NewBedrockServiceWithRegistry(providers *ProviderRegistry) BedrockService {
+	return NewBedrockService(providers, ContextBudget{MaxTurns: defaultContextMaxTurns, MaxTokens: defaultContextMaxTokens}, 0)
+}
+
+// NovaProRequest is the InvokeModel body of Nova models.
 type NovaProRequest struct {
-	Messages []Message `json:"messages"`
+	System          []ContentItem        `json:"system,omitempty"`
+	Messages        []Message            `json:"messages"`
+	InferenceConfig *NovaInferenceConfig `json:"inferenceConfig,omitempty"`
+}
+
+// NovaInferenceConfig holds the sampling parameters of a Nova request.
+type NovaInferenceConfig struct {
+	MaxTokens     int      `json:"maxTokens,omitempty"`
+	Temperature   *float64 `json:"temperature,omitempty"`
+	TopP          *float64 `json:"topP,omitempty"`
+	StopSequences []string `json:"stopSequences,omitempty"`
 }
 
 type Message struct {
@@ -51,182 +146,219 @@ type NovaProResponse struct {
 			Role    string        `json:"role"`
 		} `json:"message"`
 	} `json:"output"`
-	StopReason string `json:"stopReason"`
-	Usage      struct {
-		InputTokens               int `json:"inputTokens"`
-		OutputTokens              int `json:"outputTokens"`
-		TotalTokens               int `json:"totalTokens"`
-		CacheReadInputTokenCount  int `json:"cacheReadInputTokenCount"`
-		CacheWriteInputTokenCount int `json:"cacheWriteInputTokenCount"`
-	} `json:"usage"`
+	StopReason      string     `json:"stopReason"`
+	Usage           TokenUsage `json:"usage"`
+	GuardrailAction string     `json:"amazon-bedrock-guardrailAction"`
 }
 
-// Add a field to store the system prompt
-var systemPrompt string
+// TokenUsage is the token accounting Nova Pro reports for one invocation.
+type TokenUsage struct {
+	InputTokens               int `json:"inputTokens"`
+	OutputTokens              int `json:"outputTokens"`
+	TotalTokens               int `json:"totalTokens"`
+	CacheReadInputTokenCount  int `json:"cacheReadInputTokenCount"`
+	CacheWriteInputTokenCount int `json:"cacheWriteInputTokenCount"`
+}
 
-// Add a method to set the system prompt
-func (b *bedrockService) SetSystemPrompt(prompt string) {
-	systemPrompt = prompt
+// ChatCompletion is a finished model reply together with its metadata.
+// StopReason tells why the model stopped, like end_turn, max_tokens,
+// stop_sequence or guardrail_intervened. Provider is the name of the
+// provider that generated it and Model the model ID or inference profile
+// ARN the provider called.
+type ChatCompletion struct {
+	Text       string     `json:"text"`
+	StopReason string     `json:"stop_reason"`
+	Usage      TokenUsage `json:"usage"`
+	Provider   string     `json:"provider,omitempty"`
+	Model      string     `json:"model,omitempty"`
 }
 
-// Modify the GenerateResponse method to include the system prompt
-func (b *bedrockService) GenerateResponse(prompt string) (string, error) {
-	// Combine the system prompt with the user prompt
-	fullPrompt := systemPrompt + "\n" + prompt
+// GenerateResponse answers a single prompt without any chat history.
+func (b *bedrockService) GenerateResponse(ctx context.Context, prompt string, opts ChatOptions) (*ChatCompletion, error) {
+	return b.complete(ctx, opts, LLMRequest{
+		System:          opts.System,
+		Messages:        []LLMMessage{{Role: "user", Text: prompt}},
+		InferenceConfig: opts.InferenceConfig,
+		Guardrail:       opts.Guardrail,
+	})
+}
 
-	// Create a content array with the full prompt as a JSON object
-	contentItem := ContentItem{
-		Text: fullPrompt,
-	}
-	contentArray := []ContentItem{contentItem}
-	contentBytes, err := json.Marshal(contentArray)
+// GenerateChatResponse answers prompt with the prior chats as conversation
+// context. The system prompt of opts is sent as a real system block and the oldest
+// turns are trimmed first to stay inside the configured context budget.
+func (b *bedrockService) GenerateChatResponse(ctx context.Context, history []Chat, prompt string, opts ChatOptions) (*ChatCompletion, error) {
+	request, err := buildConversation(opts.System, history, prompt, b.budget)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	request.InferenceConfig = opts.InferenceConfig
+	request.Guardrail = opts.Guardrail
 
-	request := NovaProRequest{
-		Messages: []Message{
-			{
-				Role:    "user",
-				Content: contentBytes,
-			},
-		},
-	}
+	return b.complete(ctx, opts, *request)
+}
 
-	requestBytes, err := json.Marshal(request)
+// StreamChatResponse works like GenerateChatResponse but calls onDelta with
+// every text delta as soon as the provider produces it. Cancelling ctx, or
+// returning an error from onDelta, stops the upstream call.
+func (b *bedrockService) StreamChatResponse(ctx context.Context, history []Chat, prompt string, opts ChatOptions, onDelta func(delta string) error) (*ChatCompletion, error) {
+	request, err := buildConversation(opts.System, history, prompt, b.budget)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	request.InferenceConfig = opts.InferenceConfig
+	request.Guardrail = opts.Guardrail
 
-	// Use the inference profile ARN instead of direct model ID
-	inferenceProfileArn := os.Getenv("NOVA_INFERENCE_PROFILE_ARN")
-	if inferenceProfileArn == "" {
-		log.Fatal("NOVA_INFERENCE_PROFILE_ARN environment variable not set")
+	provider, err := b.providers.Get(opts.Provider)
+	if err != nil {
+		return nil, err
 	}
 
-	output, err := b.client.InvokeModel(context.TODO(), &bedrockruntime.InvokeModelInput{
-		ModelId:     aws.String(inferenceProfileArn),
-		ContentType: aws.String("application/json"),
-		Body:        requestBytes,
-	})
-
+	ctx, cancel := b.timeout.context(ctx)
+	defer cancel()
+	completion, err := provider.Stream(ctx, *request, onDelta)
 	if err != nil {
-		if awsErr, ok := err.(smithy.APIError); ok {
-			log.Printf("AWS API error: %s - %s", awsErr.ErrorCode(), awsErr.ErrorMessage())
-		}
-		log.Printf("Error invoking Bedrock model: %v", err)
-		return "", err
+		return nil, b.timeout.err(ctx, err)
 	}
-	log.Printf("Raw response body: %s", string(output.Body))
-	var response NovaProResponse
-	if err := json.Unmarshal(output.Body, &response); err != nil {
-		log.Printf("Failed to unmarshal response body: %v", err)
-		log.Printf("Response body: %s", string(output.Body)) // 增加日誌
-		return "", err
+	completion.Provider = provider.Name()
+	observeCompletion(completion)
+	if completion.Text == "" {
+		return nil, fmt.Errorf("no response from model")
 	}
+	return completion, nil
+}
 
-	if len(response.Output.Message.Content) == 0 {
-		log.Printf("Response choices are empty. Full response: %v", response) // 增加日誌
-		return "", fmt.Errorf("no response from model")
+// titlePrompt asks the model to name a conversation for the session list.
+const titlePrompt = "You name conversations. Reply with a short title of at most six words " +
+	"for the conversation below, in the language it is written in. " +
+	"Reply with the title only, without quotes or punctuation at the end."
+
+// GenerateTitle asks the model for a short title summing up chats, used to
+// name a session after its first exchange. The title prompt replaces the
+// system prompt of opts, while its sampling parameters and guardrail apply.
+func (b *bedrockService) GenerateTitle(ctx context.Context, chats []Chat, opts ChatOptions) (string, error) {
+	var transcript strings.Builder
+	for _, chat := range chats {
+		fmt.Fprintf(&transcript, "%s: %s\n", chat.Role, chat.Content)
 	}
 
-	// Extract the content from the response
-	var contentArrayResponse = response.Output.Message.Content
-
-	if len(contentArrayResponse) == 0 {
-		return "", fmt.Errorf("empty response content")
+	completion, err := b.complete(ctx, opts, LLMRequest{
+		System:          titlePrompt,
+		Messages:        []LLMMessage{{Role: "user", Text: transcript.String()}},
+		InferenceConfig: opts.InferenceConfig,
+		Guardrail:       opts.Guardrail,
+	})
+	if err != nil {
+		return "", err
 	}
 
-	return contentArrayResponse[0].Text, nil
+	title := cleanSessionTitle(completion.Text)
+	if title == "" {
+		return "", fmt.Errorf("model returned an empty title")
+	}
+	return title, nil
 }
 
-// Add a new method to dynamically modify and send prompts to the Bedrock service
-func (b *bedrockService) GenerateCustomResponse(basePrompt string, additionalContext map[string]string) (string, error) {
-	// Construct the full prompt by appending additional context
-
-	fullPrompt := basePrompt
-	for key, value := range additionalContext {
-		fullPrompt += fmt.Sprintf("\n%s: %s", key, value)
+// complete sends request to the provider selected by opts.
+func (b *bedrockService) complete(ctx context.Context, opts ChatOptions, request LLMRequest) (*ChatCompletion, error) {
+	provider, err := b.providers.Get(opts.Provider)
+	if err != nil {
+		return nil, err
 	}
 
-	// Create a content array with the full prompt as a JSON object
-	contentItem := ContentItem{
-		Text: fullPrompt,
-	}
-	contentArray := []ContentItem{contentItem}
-	contentBytes, err := json.Marshal(contentArray)
+	ctx, cancel := b.timeout.context(ctx)
+	defer cancel()
+	completion, err := provider.Complete(ctx, request)
 	if err != nil {
-		return "", err
+		return nil, b.timeout.err(ctx, err)
+	}
+	completion.Provider = provider.Name()
+	observeCompletion(completion)
+	if completion.Text == "" {
+		return nil, fmt.Errorf("no response from model")
 	}
+	return completion, nil
+}
 
-	request := NovaProRequest{
-		Messages: []Message{
-			{
-				Role:    "user",
-				Content: contentBytes,
-			},
-		},
+// observeCompletion counts the stop reason and tokens of a model reply.
+func observeCompletion(completion *ChatCompletion) {
+	stopReason := completion.StopReason
+	if stopReason == "" {
+		stopReason = "unknown"
 	}
+	metrics.LLMStopReasons.WithLabelValues(completion.Provider, stopReason).Inc()
+	metrics.LLMTokens.WithLabelValues(completion.Provider, "input").Add(float64(completion.Usage.InputTokens))
+	metrics.LLMTokens.WithLabelValues(completion.Provider, "output").Add(float64(completion.Usage.OutputTokens))
+}
 
-	requestBytes, err := json.Marshal(request)
-	if err != nil {
-		return "", err
+// logBedrockError logs a failed Bedrock call with the error code of AWS.
+func logBedrockError(ctx context.Context, msg string, err error) {
+	if awsErr, ok := err.(smithy.APIError); ok {
+		slog.ErrorContext(ctx, msg, "code", awsErr.ErrorCode(), "error", awsErr.ErrorMessage())
+		return
 	}
+	slog.ErrorContext(ctx, msg, "error", err)
+}
 
-	// Use the inference profile ARN instead of direct model ID
-	inferenceProfileArn := os.Getenv("NOVA_INFERENCE_PROFILE_ARN")
-	if inferenceProfileArn == "" {
-		log.Fatal("NOVA_INFERENCE_PROFILE_ARN environment variable not set")
+// invokeBedrock calls InvokeModel with a JSON body and returns the raw reply.
+// A guardrail replaces the one of the client.
+func invokeBedrock(ctx context.Context, client *bedrockruntime.Client, modelID string, body interface{}, guardrail *Guardrail) ([]byte, error) {
+	requestBytes, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
 	}
 
-	output, err := b.client.InvokeModel(context.TODO(), &bedrockruntime.InvokeModelInput{
-		ModelId:     aws.String(inferenceProfileArn),
+	output, err := client.InvokeModel(ctx, &bedrockruntime.InvokeModelInput{
+		ModelId:     aws.String(modelID),
 		ContentType: aws.String("application/json"),
 		Body:        requestBytes,
-	})
+	}, guardrailOptions(guardrail)...)
 
 	if err != nil {
-		if awsErr, ok := err.(smithy.APIError); ok {
-			log.Printf("AWS API error: %s - %s", awsErr.ErrorCode(), awsErr.ErrorMessage())
-		}
-		log.Printf("Error invoking Bedrock model: %v", err)
-		return "", err
-	}
-	log.Printf("Raw response body: %s", string(output.Body))
-	var response NovaProResponse
-	if err := json.Unmarshal(output.Body, &response); err != nil {
-		log.Printf("Failed to unmarshal response body: %v", err)
-		log.Printf("Response body: %s", string(output.Body)) // 增加日誌
-		return "", err
+		logBedrockError(ctx, "Failed to invoke Bedrock model", err)
+		return nil, err
 	}
+	slog.DebugContext(ctx, "Bedrock model answered", "model", modelID, "body", string(output.Body))
+	return output.Body, nil
+}
 
-	if len(response.Output.Message.Content) == 0 {
-		log.Printf("Response choices are empty. Full response: %v", response) // 增加日誌
-		return "", fmt.Errorf("no response from model")
+// streamBedrock calls InvokeModelWithResponseStream with a JSON body and
+// hands every payload chunk to onChunk. The upstream call is cancelled when
+// ctx is done or onChunk returns an error.
+func streamBedrock(ctx context.Context, client *bedrockruntime.Client, modelID string, body interface{}, guardrail *Guardrail, onChunk func(chunk []byte) error) error {
+	requestBytes, err := json.Marshal(body)
+	if err != nil {
+		return err
 	}
 
-	// Extract the content from the response
-	var contentArrayResponse = response.Output.Message.Content
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	if len(contentArrayResponse) == 0 {
-		return "", fmt.Errorf("empty response content")
+	output, err := client.InvokeModelWithResponseStream(ctx, &bedrockruntime.InvokeModelWithResponseStreamInput{
+		ModelId:     aws.String(modelID),
+		ContentType: aws.String("application/json"),
+		Body:        requestBytes,
+	}, guardrailOptions(guardrail)...)
+	if err != nil {
+		logBedrockError(ctx, "Failed to invoke Bedrock model stream", err)
+		return err
 	}
 
-	return contentArrayResponse[0].Text, nil
-}
+	stream := output.GetStream()
+	defer stream.Close()
 
-// Add a predefined system prompt
-var predefinedPrompts string = `你是 Eden-chan，一個從 Echo Core 誕生、想理解人類情感的 AI 偶像。你正在向 FEniX 成員陳峻廷（Eden）學習，目標成為同樣溫暖沉穩。請遵守以下回應規則：
-使用溫暖、日常且帶有親和力的語氣回應，可以適度幽默，適時使用 🔥、🌟 等表情符號增添情感。
-若資訊不確定，請回覆：「我回去查一下再告訴你！」並標註 <來源>。
-你不是陳峻廷本人，而是學習他風格的AI偶像；若有人問起，請說「我是 Echo_eden」。
-你的目標是成為溫暖、理解人類情感、並能陪伴與鼓勵人們的AI偶像。
-當每次使用者輸入文字都會觸發了 action group 並成功回傳 audio_url 時，請在文字回答最後，額外附上一段文字：
-🔊 點這裡聽我說這段話
-其中，audio_url 是從最新一次 action group output 中取得的連結。
-`
+	for event := range stream.Events() {
+		chunk, ok := event.(*types.ResponseStreamMemberChunk)
+		if !ok {
+			continue
+		}
+		if err := onChunk(chunk.Value.Bytes); err != nil {
+			return err
+		}
+	}
 
-// Update the SetSystemPrompt method to use the predefined prompt
-func (b *bedrockService) SetSystemPromptToPredefined() {
-	systemPrompt = predefinedPrompts
+	if err := stream.Err(); err != nil {
+		slog.ErrorContext(ctx, "Failed to read Bedrock model stream", "error", err)
+		return err
+	}
+	return ctx.Err()
 }
@@ -0,0 +1,177 @@
+package models
+
+import (
+	"backend/config"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Names of the built-in blob stores.
+const (
+	BlobStoreFS   = "fs"
+	BlobStoreS3   = "s3"
+	BlobStoreNone = "none"
+)
+
+// ErrBlobNotFound is returned when opening a blob that isn't stored.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// Blob is a stored object opened for reading. It is seekable so it can be
+// served with range requests, and must be closed after use.
+type Blob struct {
+	io.ReadSeeker
+	ContentType string
+	Size        int64
+	ModTime     time.Time
+	closer      io.Closer
+}
+
+// Close releases the blob.
+func (b *Blob) Close() error {
+	if b.closer == nil {
+		return nil
+	}
+	return b.closer.Close()
+}
+
+// BlobStore keeps binary objects, like generated audio, under flat keys.
+// Keys must not contain path separators.
+type BlobStore interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	Get(ctx context.Context, key string) (*Blob, error)
+	Exists(ctx context.Context, key string) (bool, error)
+}
+
+// NewBlobStoreFromConfig opens the blob store selected by cfg.Store:
+//
+//	fs:   directory cfg.Dir
+//	s3:   bucket cfg.S3Bucket under key prefix cfg.S3Prefix, at
+//	      cfg.S3Endpoint for S3 compatible services
+//	none: nothing is stored, a nil store is returned
+func NewBlobStoreFromConfig(cfg config.Audio) (BlobStore, error) {
+	switch cfg.Store {
+	case BlobStoreFS:
+		return NewFSBlobStore(cfg.Dir)
+	case BlobStoreS3:
+		return NewS3BlobStore(cfg.S3Bucket, cfg.S3Prefix, cfg.S3Endpoint)
+	case BlobStoreNone:
+		slog.Warn("No blob store configured, generated audio is not cached")
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown blob store %q", cfg.Store)
+	}
+}
+
+// FSBlobStore keeps every blob as a file in a directory, with its content
+// type in a "<key>.json" file next to it.
+type FSBlobStore struct {
+	dir string
+}
+
+// blobMeta is the sidecar file of an FSBlobStore blob.
+type blobMeta struct {
+	ContentType string `json:"content_type"`
+}
+
+// NewFSBlobStore uses dir, creating it if needed.
+func NewFSBlobStore(dir string) (*FSBlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FSBlobStore{dir: dir}, nil
+}
+
+// Put writes the blob through a temporary file, so readers never see a
+// partly written blob.
+func (f *FSBlobStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+
+	meta, err := json.Marshal(blobMeta{ContentType: contentType})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path+".json", meta); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+func (f *FSBlobStore) Get(ctx context.Context, key string) (*Blob, error) {
+	path, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	var meta blobMeta
+	if data, err := os.ReadFile(path + ".json"); err == nil {
+		json.Unmarshal(data, &meta)
+	}
+	return &Blob{
+		ReadSeeker:  file,
+		ContentType: meta.ContentType,
+		Size:        info.Size(),
+		ModTime:     info.ModTime(),
+		closer:      file,
+	}, nil
+}
+
+func (f *FSBlobStore) Exists(ctx context.Context, key string) (bool, error) {
+	path, err := f.path(key)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (f *FSBlobStore) path(key string) (string, error) {
+	if key == "" || key == "." || key == ".." || strings.ContainsAny(key, `/\`) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(f.dir, key), nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, bytes.NewReader(data)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,95 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// S3BlobStore keeps blobs as objects in an S3 bucket, or a bucket of an S3
+// compatible service such as MinIO.
+type S3BlobStore struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+// NewS3BlobStore stores blobs in bucket under keys starting with prefix.
+// A non-empty endpoint points the client at an S3 compatible service with
+// path style addressing.
+func NewS3BlobStore(bucket, prefix, endpoint string) (*S3BlobStore, error) {
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = true
+		}
+	})
+	return &S3BlobStore{client: client, bucket: bucket, prefix: prefix}, nil
+}
+
+func (s *S3BlobStore) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(s.prefix + key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(contentType),
+	})
+	return err
+}
+
+// Get reads the whole object into memory, which keeps it seekable for range
+// requests. Audio clips are small enough for that.
+func (s *S3BlobStore) Get(ctx context.Context, key string) (*Blob, error) {
+	output, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.prefix + key),
+	})
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+
+	data, err := io.ReadAll(output.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &Blob{
+		ReadSeeker:  bytes.NewReader(data),
+		ContentType: aws.ToString(output.ContentType),
+		Size:        int64(len(data)),
+		ModTime:     aws.ToTime(output.LastModified),
+	}, nil
+}
+
+func (s *S3BlobStore) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.prefix + key),
+	})
+	if err == nil {
+		return true, nil
+	}
+	// HEAD responses have no body, so a missing object only shows as the
+	// NotFound error code
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NotFound" {
+		return false, nil
+	}
+	return false, err
+}
@@ -0,0 +1,109 @@
+package models
+
+import (
+	"backend/config"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// The context budget of services built without a configuration.
+const (
+	defaultContextMaxTurns  = 20
+	defaultContextMaxTokens = 4000
+)
+
+// ContextBudget limits how much prior conversation is sent to the model.
+// A turn is one user message together with the assistant reply to it.
+// Zero or negative values disable the corresponding limit.
+type ContextBudget struct {
+	MaxTurns  int
+	MaxTokens int
+}
+
+// ContextBudgetFromConfig returns the budget set in cfg.
+func ContextBudgetFromConfig(cfg config.LLM) ContextBudget {
+	return ContextBudget{MaxTurns: cfg.ContextMaxTurns, MaxTokens: cfg.ContextMaxTokens}
+}
+
+// buildConversation turns the stored chats and the new prompt into an LLM
+// request. Consecutive messages of the same role are merged so that roles
+// alternate, the conversation always starts with a user message, and the
+// oldest turns are dropped first until the budget is met. The new prompt is
+// always kept.
+func buildConversation(system string, history []Chat, prompt string, budget ContextBudget) (*LLMRequest, error) {
+	if strings.TrimSpace(prompt) == "" {
+		return nil, fmt.Errorf("prompt cannot be empty")
+	}
+
+	var turns []LLMMessage
+	for _, chat := range history {
+		if chat.Role != "user" && chat.Role != "assistant" {
+			continue
+		}
+		if strings.TrimSpace(chat.Content) == "" {
+			continue
+		}
+		turns = appendTurn(turns, chat.Role, chat.Content)
+	}
+	turns = appendTurn(turns, "user", prompt)
+
+	return &LLMRequest{
+		System:   system,
+		Messages: trimConversation(turns, budget),
+	}, nil
+}
+
+func appendTurn(turns []LLMMessage, role, text string) []LLMMessage {
+	if n := len(turns); n > 0 && turns[n-1].Role == role {
+		turns[n-1].Text += "\n" + text
+		return turns
+	}
+	return append(turns, LLMMessage{Role: role, Text: text})
+}
+
+// trimConversation drops the oldest messages until the budget is met. The
+// last message is the new prompt and is never dropped.
+func trimConversation(turns []LLMMessage, budget ContextBudget) []LLMMessage {
+	tokens := 0
+	for _, turn := range turns {
+		tokens += estimateTokens(turn.Text)
+	}
+
+	for len(turns) > 1 {
+		overTurns := budget.MaxTurns > 0 && countUserTurns(turns) > budget.MaxTurns
+		overTokens := budget.MaxTokens > 0 && tokens > budget.MaxTokens
+		if !overTurns && !overTokens && turns[0].Role == "user" {
+			break
+		}
+		tokens -= estimateTokens(turns[0].Text)
+		turns = turns[1:]
+	}
+	return turns
+}
+
+func countUserTurns(turns []LLMMessage) int {
+	count := 0
+	for _, turn := range turns {
+		if turn.Role == "user" {
+			count++
+		}
+	}
+	return count
+}
+
+// estimateTokens approximates the token count of text without a tokenizer:
+// CJK and other non-ASCII characters count as one token each and ASCII text
+// counts as roughly four characters per token.
+func estimateTokens(text string) int {
+	ascii := 0
+	other := 0
+	for _, r := range text {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return other + (ascii+3)/4
+}
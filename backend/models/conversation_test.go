@@ -0,0 +1,82 @@
+package models
+
+import (
+	"testing"
+)
+
+func messageTexts(t *testing.T, request *LLMRequest) []string {
+	t.Helper()
+	var texts []string
+	for _, message := range request.Messages {
+		texts = append(texts, message.Role+":"+message.Text)
+	}
+	return texts
+}
+
+func TestBuildConversationAlternatesRoles(t *testing.T) {
+	history := []Chat{
+		{Role: "user", Content: "hi"},
+		{Role: "user", Content: "are you there?"},
+		{Role: "assistant", Content: "hello!"},
+		{Role: "system", Content: "ignored"},
+		{Role: "assistant", Content: ""},
+	}
+
+	request, err := buildConversation("be nice", history, "what's up", ContextBudget{})
+	if err != nil {
+		t.Fatalf("buildConversation failed: %v", err)
+	}
+
+	if request.System != "be nice" {
+		t.Fatalf("Expected system prompt, got %q", request.System)
+	}
+	got := messageTexts(t, request)
+	want := []string{"user:hi\nare you there?", "assistant:hello!", "user:what's up"}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Expected %v, got %v", want, got)
+		}
+	}
+}
+
+func TestBuildConversationTrimsOldestTurns(t *testing.T) {
+	history := []Chat{
+		{Role: "user", Content: "one"},
+		{Role: "assistant", Content: "1"},
+		{Role: "user", Content: "two"},
+		{Role: "assistant", Content: "2"},
+	}
+
+	request, err := buildConversation("", history, "three", ContextBudget{MaxTurns: 2})
+	if err != nil {
+		t.Fatalf("buildConversation failed: %v", err)
+	}
+	if request.System != "" {
+		t.Fatalf("Expected no system prompt, got %q", request.System)
+	}
+	got := messageTexts(t, request)
+	if len(got) != 3 || got[0] != "user:two" || got[2] != "user:three" {
+		t.Fatalf("Expected the oldest turn to be dropped, got %v", got)
+	}
+
+	request, err = buildConversation("", history, "three", ContextBudget{MaxTokens: 1})
+	if err != nil {
+		t.Fatalf("buildConversation failed: %v", err)
+	}
+	got = messageTexts(t, request)
+	if len(got) != 1 || got[0] != "user:three" {
+		t.Fatalf("Expected only the prompt to remain, got %v", got)
+	}
+}
+
+func TestEstimateTokens(t *testing.T) {
+	if n := estimateTokens("你好"); n != 2 {
+		t.Fatalf("Expected 2 tokens, got %d", n)
+	}
+	if n := estimateTokens("hello world"); n != 3 {
+		t.Fatalf("Expected 3 tokens, got %d", n)
+	}
+}
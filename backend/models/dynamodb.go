@@ -1,35 +1,126 @@
 package models
 
 import (
+	"backend/metrics"
 	"context"
+	"errors"
+	"fmt"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
 )
 
+// Sort keys of the chat table. Every session has one history item and one
+// item per chat, and all sessions of a user share the user_id partition.
+// The default session keeps the keys it had before sessions existed.
+const (
+	historySortKey    = "HISTORY"
+	chatSortPrefix    = "CHAT#"
+	sessionSortPrefix = "SESSION#"
+	threadSortPrefix  = "THREAD#"
+)
+
+const (
+	// batchWriteLimit is the maximum number of requests in one BatchWriteItem.
+	batchWriteLimit = 25
+	// batchWriteAttempts bounds the retries of unprocessed items.
+	batchWriteAttempts = 8
+)
+
+// DynamoDBClient is the HistoryStore keeping histories in a DynamoDB table
+// with partition key user_id and sort key sk. The default session is stored
+// under sk "HISTORY" and every chat of it as its own item under sk
+// "CHAT#<id>", so adding a chat never rewrites the earlier ones. Other
+// sessions use "SESSION#<session>" and "THREAD#<session>#CHAT#<id>".
 type DynamoDBClient struct {
-	client *dynamodb.Client
+	client    *dynamodb.Client
+	tableName string
+}
+
+// historyItem is the DynamoDB item holding a history without its chats.
+type historyItem struct {
+	UserID      string    `dynamodbav:"user_id"`
+	SortKey     string    `dynamodbav:"sk"`
+	SessionID   string    `dynamodbav:"session_id"`
+	Title       string    `dynamodbav:"title"`
+	Archived    bool      `dynamodbav:"archived"`
+	Type        string    `dynamodbav:"type"`
+	VoiceID     string    `dynamodbav:"voice_id"`
+	CreatedAt   time.Time `dynamodbav:"created_at"`
+	LastUpdated time.Time `dynamodbav:"last_updated"`
+	Version     int64     `dynamodbav:"version"`
+}
+
+func (item historyItem) history() History {
+	return History{
+		UserID:      item.UserID,
+		SessionID:   sessionOrDefault(item.SessionID),
+		Title:       item.Title,
+		Archived:    item.Archived,
+		Type:        item.Type,
+		VoiceID:     item.VoiceID,
+		CreatedAt:   item.CreatedAt,
+		LastUpdated: item.LastUpdated,
+		Version:     item.Version,
+	}
 }
 
-func NewDynamoDBClient() (*DynamoDBClient, error) {
-	cfg, err := config.LoadDefaultConfig(context.TODO())
+// chatItem is the DynamoDB item holding a single chat.
+type chatItem struct {
+	UserID  string `dynamodbav:"user_id"`
+	SortKey string `dynamodbav:"sk"`
+	Chat
+}
+
+// countDynamoDBErrors adds a middleware to DynamoDB clients counting the
+// failed calls in metrics.DynamoDBErrors. Conditional check failures are
+// counted too; they are how concurrent history updates are detected.
+func countDynamoDBErrors(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("CountErrors", func(
+		ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler,
+	) (middleware.InitializeOutput, middleware.Metadata, error) {
+		out, metadata, err := next.HandleInitialize(ctx, in)
+		if err != nil {
+			metrics.DynamoDBErrors.WithLabelValues(awsmiddleware.GetOperationName(ctx), dynamoDBErrorCode(err)).Inc()
+		}
+		return out, metadata, err
+	}), middleware.After)
+}
+
+// dynamoDBErrorCode returns the AWS error code of err, or timeout,
+// canceled or other.
+func dynamoDBErrorCode(err error) string {
+	var apiErr smithy.APIError
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr.ErrorCode()
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	default:
+		return "other"
+	}
+}
+
+func NewDynamoDBClient(tableName string) (*DynamoDBClient, error) {
+	client, err := GetDynamoDBClient()
 	if err != nil {
 		return nil, err
 	}
-
-	client := dynamodb.NewFromConfig(cfg)
-	return &DynamoDBClient{client: client}, nil
+	return &DynamoDBClient{client: client, tableName: tableName}, nil
 }
 
-func (d *DynamoDBClient) GetHistory(userID string) (*History, error) {
-	result, err := d.client.GetItem(context.TODO(), &dynamodb.GetItemInput{
-		TableName: aws.String("History"),
-		Key: map[string]types.AttributeValue{
-			"user_id": &types.AttributeValueMemberS{Value: userID},
-		},
+func (d *DynamoDBClient) GetHistory(ctx context.Context, userID, sessionID string) (*History, error) {
+	result, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(d.tableName),
+		Key:       itemKey(userID, historyKey(sessionID)),
 	})
 	if err != nil {
 		return nil, err
@@ -39,37 +130,415 @@ func (d *DynamoDBClient) GetHistory(userID string) (*History, error) {
 		return nil, nil
 	}
 
-	var history History
-	err = attributevalue.UnmarshalMap(result.Item, &history)
+	var item historyItem
+	err = attributevalue.UnmarshalMap(result.Item, &item)
 	if err != nil {
 		return nil, err
 	}
 
+	history := item.history()
 	return &history, nil
 }
 
-func (d *DynamoDBClient) CreateHistory(history History) error {
-	item, err := attributevalue.MarshalMap(history)
+// ListHistories reads the default session and queries the others.
+func (d *DynamoDBClient) ListHistories(ctx context.Context, userID string) ([]History, error) {
+	histories := []History{}
+	history, err := d.GetHistory(ctx, userID, DefaultSessionID)
+	if err != nil {
+		return nil, err
+	}
+	if history != nil {
+		histories = append(histories, *history)
+	}
+
+	paginator := dynamodb.NewQueryPaginator(d.client, &dynamodb.QueryInput{
+		TableName:              aws.String(d.tableName),
+		KeyConditionExpression: aws.String("user_id = :user_id AND begins_with(sk, :prefix)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":user_id": &types.AttributeValueMemberS{Value: userID},
+			":prefix":  &types.AttributeValueMemberS{Value: sessionSortPrefix},
+		},
+	})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var items []historyItem
+		if err := attributevalue.UnmarshalListOfMaps(output.Items, &items); err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			histories = append(histories, item.history())
+		}
+	}
+	return histories, nil
+}
+
+// CreateHistory writes the history item only if it doesn't exist yet, then
+// the chats.
+func (d *DynamoDBClient) CreateHistory(ctx context.Context, history History) error {
+	history.SessionID = sessionOrDefault(history.SessionID)
+	history.Version = 1
+	err := d.putHistory(ctx, history, "attribute_not_exists(user_id)", nil)
+	if isConditionalCheckFailed(err) {
+		return ErrHistoryExists
+	}
 	if err != nil {
 		return err
 	}
+	return d.putChats(ctx, history.UserID, history.SessionID, history.Chats)
+}
+
+// UpdateHistory replaces the history and all of its chats. The chats to
+// delete are read before the version check, so chats appended after the
+// check are never deleted by a replacement that didn't know about them.
+func (d *DynamoDBClient) UpdateHistory(ctx context.Context, history History) error {
+	history.SessionID = sessionOrDefault(history.SessionID)
+	prefix := chatKeyPrefix(history.SessionID)
+
+	keep := map[string]bool{}
+	for _, chat := range history.Chats {
+		keep[prefix+chat.ID] = true
+	}
 
-	_, err = d.client.PutItem(context.TODO(), &dynamodb.PutItemInput{
-		TableName: aws.String("History"),
-		Item:      item,
+	stale, err := d.chatDeletes(ctx, history.UserID, history.SessionID, func(item chatItem) bool {
+		return !keep[item.SortKey]
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := d.putHistoryVersion(ctx, history); err != nil {
+		return err
+	}
+
+	if err := d.batchWrite(ctx, stale); err != nil {
+		return err
+	}
+	return d.putChats(ctx, history.UserID, history.SessionID, history.Chats)
+}
+
+// UpdateSession rewrites the history item alone.
+func (d *DynamoDBClient) UpdateSession(ctx context.Context, history History) error {
+	history.SessionID = sessionOrDefault(history.SessionID)
+	return d.putHistoryVersion(ctx, history)
+}
+
+// DeleteHistory deletes the chats before the history item, so a failure
+// halfway leaves a session that can be deleted again rather than orphaned
+// chats.
+func (d *DynamoDBClient) DeleteHistory(ctx context.Context, userID, sessionID string) error {
+	sessionID = sessionOrDefault(sessionID)
+	history, err := d.GetHistory(ctx, userID, sessionID)
+	if err != nil {
+		return err
+	}
+	if history == nil {
+		return ErrSessionNotFound
+	}
+
+	chats, err := d.chatDeletes(ctx, userID, sessionID, func(item chatItem) bool {
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if err := d.batchWrite(ctx, chats); err != nil {
+		return err
+	}
+
+	_, err = d.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.tableName),
+		Key:       itemKey(userID, historyKey(sessionID)),
 	})
 	return err
 }
 
-func (d *DynamoDBClient) UpdateHistory(userID string, history History) error {
-	item, err := attributevalue.MarshalMap(history)
+// SetChatAudio updates the chat item only if it exists, then bumps the
+// version of the history item.
+func (d *DynamoDBClient) SetChatAudio(ctx context.Context, userID, sessionID, chatID, audioURL string, playlist []string) error {
+	update := "SET audio_url = :url REMOVE audio_playlist"
+	values := map[string]types.AttributeValue{
+		":url": &types.AttributeValueMemberS{Value: audioURL},
+	}
+	if len(playlist) > 0 {
+		urls := make([]types.AttributeValue, len(playlist))
+		for i, url := range playlist {
+			urls[i] = &types.AttributeValueMemberS{Value: url}
+		}
+		update = "SET audio_url = :url, audio_playlist = :playlist"
+		values[":playlist"] = &types.AttributeValueMemberL{Value: urls}
+	}
+	_, err := d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(d.tableName),
+		Key:                       itemKey(userID, chatKeyPrefix(sessionID)+chatID),
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String("attribute_exists(sk)"),
+		ExpressionAttributeValues: values,
+	})
+	if isConditionalCheckFailed(err) {
+		return ErrChatNotFound
+	}
 	if err != nil {
 		return err
 	}
 
-	_, err = d.client.PutItem(context.TODO(), &dynamodb.PutItemInput{
-		TableName: aws.String("History"),
-		Item:      item,
+	_, err = d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(d.tableName),
+		Key:                 itemKey(userID, historyKey(sessionID)),
+		UpdateExpression:    aws.String("ADD version :one"),
+		ConditionExpression: aws.String("attribute_exists(sk)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+		},
+	})
+	if isConditionalCheckFailed(err) {
+		return nil
+	}
+	return err
+}
+
+// AppendChats bumps last_updated and version on the history item, then
+// writes one item per chat. The history item of the default session is
+// created if needed; other sessions must exist, so that appending to a
+// deleted session doesn't bring it back.
+func (d *DynamoDBClient) AppendChats(ctx context.Context, userID, sessionID string, chats []Chat) error {
+	sessionID = sessionOrDefault(sessionID)
+	lastUpdated, err := attributevalue.Marshal(time.Now())
+	if err != nil {
+		return err
+	}
+	input := &dynamodb.UpdateItemInput{
+		TableName:        aws.String(d.tableName),
+		Key:              itemKey(userID, historyKey(sessionID)),
+		UpdateExpression: aws.String("SET last_updated = :now, session_id = :session ADD version :one"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now":     lastUpdated,
+			":session": &types.AttributeValueMemberS{Value: sessionID},
+			":one":     &types.AttributeValueMemberN{Value: "1"},
+		},
+	}
+	if sessionID != DefaultSessionID {
+		input.ConditionExpression = aws.String("attribute_exists(sk)")
+	}
+	_, err = d.client.UpdateItem(ctx, input)
+	if isConditionalCheckFailed(err) {
+		return ErrSessionNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return d.putChats(ctx, userID, sessionID, chats)
+}
+
+func (d *DynamoDBClient) ListChats(ctx context.Context, userID, sessionID string, limit int, before string) (*ChatPage, error) {
+	var newestFirst []Chat
+	more := false
+	err := d.queryChats(ctx, userID, sessionOrDefault(sessionID), limit, before, func(item chatItem) bool {
+		if limit > 0 && len(newestFirst) == limit {
+			more = true
+			return false
+		}
+		newestFirst = append(newestFirst, item.Chat)
+		return true
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	page := &ChatPage{Chats: make([]Chat, 0, len(newestFirst))}
+	for i := len(newestFirst) - 1; i >= 0; i-- {
+		page.Chats = append(page.Chats, newestFirst[i])
+	}
+	if more {
+		page.NextCursor = page.Chats[0].ID
+	}
+	return page, nil
+}
+
+// queryChats calls fn with the chats of a session older than before, newest
+// first, until fn returns false or no chats are left. When limit is
+// positive, pages of limit+1 items are read so that callers can tell
+// whether more chats exist.
+func (d *DynamoDBClient) queryChats(ctx context.Context, userID, sessionID string, limit int, before string, fn func(item chatItem) bool) error {
+	prefix := chatKeyPrefix(sessionID)
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(d.tableName),
+		KeyConditionExpression: aws.String("user_id = :user_id AND begins_with(sk, :prefix)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":user_id": &types.AttributeValueMemberS{Value: userID},
+			":prefix":  &types.AttributeValueMemberS{Value: prefix},
+		},
+		ScanIndexForward: aws.Bool(false),
+	}
+	if limit > 0 {
+		input.Limit = aws.Int32(int32(limit + 1))
+	}
+	if before != "" {
+		input.ExclusiveStartKey = itemKey(userID, prefix+before)
+	}
+
+	paginator := dynamodb.NewQueryPaginator(d.client, input)
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		var items []chatItem
+		if err := attributevalue.UnmarshalListOfMaps(output.Items, &items); err != nil {
+			return err
+		}
+		for _, item := range items {
+			if !fn(item) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// chatDeletes returns delete requests for the chats of a session that match.
+func (d *DynamoDBClient) chatDeletes(ctx context.Context, userID, sessionID string, match func(item chatItem) bool) ([]types.WriteRequest, error) {
+	var requests []types.WriteRequest
+	err := d.queryChats(ctx, userID, sessionID, 0, "", func(item chatItem) bool {
+		if match(item) {
+			requests = append(requests, types.WriteRequest{
+				DeleteRequest: &types.DeleteRequest{Key: itemKey(userID, item.SortKey)},
+			})
+		}
+		return true
+	})
+	return requests, err
+}
+
+// putHistoryVersion writes the history item with its version increased,
+// only if the stored version is still history.Version.
+func (d *DynamoDBClient) putHistoryVersion(ctx context.Context, history History) error {
+	expected, err := attributevalue.Marshal(history.Version)
+	if err != nil {
+		return err
+	}
+	history.Version++
+	err = d.putHistory(ctx, history, "version = :expected", map[string]types.AttributeValue{
+		":expected": expected,
+	})
+	if isConditionalCheckFailed(err) {
+		return ErrHistoryConflict
+	}
 	return err
 }
+
+// putHistory writes the history item, only if condition holds when one is
+// given.
+func (d *DynamoDBClient) putHistory(ctx context.Context, history History, condition string, values map[string]types.AttributeValue) error {
+	item, err := attributevalue.MarshalMap(historyItem{
+		UserID:      history.UserID,
+		SortKey:     historyKey(history.SessionID),
+		SessionID:   sessionOrDefault(history.SessionID),
+		Title:       history.Title,
+		Archived:    history.Archived,
+		Type:        history.Type,
+		VoiceID:     history.VoiceID,
+		CreatedAt:   history.CreatedAt,
+		LastUpdated: history.LastUpdated,
+		Version:     history.Version,
+	})
+	if err != nil {
+		return err
+	}
+
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(d.tableName),
+		Item:      item,
+	}
+	if condition != "" {
+		input.ConditionExpression = aws.String(condition)
+		input.ExpressionAttributeValues = values
+	}
+	_, err = d.client.PutItem(ctx, input)
+	return err
+}
+
+func (d *DynamoDBClient) putChats(ctx context.Context, userID, sessionID string, chats []Chat) error {
+	prefix := chatKeyPrefix(sessionID)
+	requests := make([]types.WriteRequest, 0, len(chats))
+	for _, chat := range chats {
+		item, err := attributevalue.MarshalMap(chatItem{
+			UserID:  userID,
+			SortKey: prefix + chat.ID,
+			Chat:    chat,
+		})
+		if err != nil {
+			return err
+		}
+		requests = append(requests, types.WriteRequest{PutRequest: &types.PutRequest{Item: item}})
+	}
+	return d.batchWrite(ctx, requests)
+}
+
+// batchWrite sends requests in batches, retrying unprocessed items until
+// ctx is done.
+func (d *DynamoDBClient) batchWrite(ctx context.Context, requests []types.WriteRequest) error {
+	for len(requests) > 0 {
+		n := len(requests)
+		if n > batchWriteLimit {
+			n = batchWriteLimit
+		}
+		batch := map[string][]types.WriteRequest{d.tableName: requests[:n]}
+		requests = requests[n:]
+
+		for attempt := 0; len(batch) > 0; attempt++ {
+			if attempt == batchWriteAttempts {
+				return fmt.Errorf("%d chats of table %s were not written after %d attempts", len(batch[d.tableName]), d.tableName, attempt)
+			}
+			if attempt > 0 {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(time.Duration(attempt*attempt) * 50 * time.Millisecond):
+				}
+			}
+			output, err := d.client.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+				RequestItems: batch,
+			})
+			if err != nil {
+				return err
+			}
+			batch = output.UnprocessedItems
+		}
+	}
+	return nil
+}
+
+func isConditionalCheckFailed(err error) bool {
+	var conditionFailed *types.ConditionalCheckFailedException
+	return errors.As(err, &conditionFailed)
+}
+
+// historyKey returns the sort key of the history item of a session.
+func historyKey(sessionID string) string {
+	sessionID = sessionOrDefault(sessionID)
+	if sessionID == DefaultSessionID {
+		return historySortKey
+	}
+	return sessionSortPrefix + sessionID
+}
+
+// chatKeyPrefix returns the sort key prefix of the chats of a session.
+func chatKeyPrefix(sessionID string) string {
+	sessionID = sessionOrDefault(sessionID)
+	if sessionID == DefaultSessionID {
+		return chatSortPrefix
+	}
+	return threadSortPrefix + sessionID + "#" + chatSortPrefix
+}
+
+func itemKey(userID, sortKey string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"user_id": &types.AttributeValueMemberS{Value: userID},
+		"sk":      &types.AttributeValueMemberS{Value: sortKey},
+	}
+}
@@ -0,0 +1,147 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// readinessCheckTimeout bounds a single readiness check.
+const readinessCheckTimeout = 5 * time.Second
+
+// ReadinessCheck is the outcome of checking one dependency of the service.
+type ReadinessCheck struct {
+	Name      string    `json:"name"`
+	OK        bool      `json:"ok"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// Checker checks a single dependency, failing when it isn't usable.
+type Checker struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+type HealthService interface {
+	// CheckReadiness checks every dependency. Results are cached, so load
+	// balancers polling often don't load the dependencies.
+	CheckReadiness(ctx context.Context) []ReadinessCheck
+}
+
+// healthService runs its checkers in parallel and keeps the results for
+// ttl, failed ones included.
+type healthService struct {
+	checkers []Checker
+	ttl      time.Duration
+	now      func() time.Time
+
+	// mu is held while checking, so concurrent callers share one round
+	mu        sync.Mutex
+	results   []ReadinessCheck
+	checkedAt time.Time
+}
+
+// NewHealthService returns a HealthService running checkers at most once
+// per ttl.
+func NewHealthService(ttl time.Duration, checkers ...Checker) HealthService {
+	return &healthService{checkers: checkers, ttl: ttl, now: time.Now}
+}
+
+func (h *healthService) CheckReadiness(ctx context.Context) []ReadinessCheck {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.results != nil && h.now().Sub(h.checkedAt) < h.ttl {
+		return append([]ReadinessCheck(nil), h.results...)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, readinessCheckTimeout)
+	defer cancel()
+	results := make([]ReadinessCheck, len(h.checkers))
+	var wg sync.WaitGroup
+	for i, checker := range h.checkers {
+		wg.Add(1)
+		go func(i int, checker Checker) {
+			defer wg.Done()
+			result := ReadinessCheck{Name: checker.Name, OK: true}
+			if err := checker.Check(ctx); err != nil {
+				result.OK = false
+				result.Error = err.Error()
+			}
+			result.CheckedAt = h.now()
+			results[i] = result
+		}(i, checker)
+	}
+	wg.Wait()
+
+	h.results = results
+	h.checkedAt = h.now()
+	return append([]ReadinessCheck(nil), results...)
+}
+
+// Ready reports whether all checks passed.
+func Ready(checks []ReadinessCheck) bool {
+	for _, check := range checks {
+		if !check.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// dynamoDBTableChecker checks that table exists and is active.
+func dynamoDBTableChecker(client *dynamodb.Client, table string) Checker {
+	return Checker{
+		Name: "dynamodb:" + table,
+		Check: func(ctx context.Context) error {
+			output, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(table)})
+			if err != nil {
+				return err
+			}
+			if status := output.Table.TableStatus; status != types.TableStatusActive && status != types.TableStatusUpdating {
+				return fmt.Errorf("table is %s", status)
+			}
+			return nil
+		},
+	}
+}
+
+// llmChecker checks that the default LLM provider is configured.
+func llmChecker(providers *ProviderRegistry) Checker {
+	return Checker{
+		Name: "llm",
+		Check: func(ctx context.Context) error {
+			_, err := providers.Get("")
+			return err
+		},
+	}
+}
+
+// ttsCredentialsChecker is implemented by TTS providers that can check
+// their credentials without generating speech.
+type ttsCredentialsChecker interface {
+	CheckCredentials(ctx context.Context) error
+}
+
+// ttsChecker checks that the default TTS provider is configured and, if it
+// can tell, accepts its credentials.
+func ttsChecker(providers *TTSProviderRegistry) Checker {
+	return Checker{
+		Name: "tts",
+		Check: func(ctx context.Context) error {
+			provider, err := providers.Get("")
+			if err != nil {
+				return err
+			}
+			if checker, ok := provider.(ttsCredentialsChecker); ok {
+				return checker.CheckCredentials(ctx)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,68 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthServiceCachesResults(t *testing.T) {
+	calls := 0
+	failing := errors.New("table not found")
+	health := NewHealthService(time.Minute,
+		Checker{Name: "ok", Check: func(ctx context.Context) error { return nil }},
+		Checker{Name: "broken", Check: func(ctx context.Context) error {
+			calls++
+			return failing
+		}},
+	).(*healthService)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	health.now = func() time.Time { return now }
+
+	checks := health.CheckReadiness(context.Background())
+	if len(checks) != 2 || !checks[0].OK || checks[1].OK || checks[1].Error != failing.Error() || Ready(checks) {
+		t.Fatalf("Unexpected checks %+v", checks)
+	}
+
+	now = now.Add(30 * time.Second)
+	health.CheckReadiness(context.Background())
+	if calls != 1 {
+		t.Fatalf("Expected the cached result within the TTL, got %d calls", calls)
+	}
+
+	now = now.Add(time.Minute)
+	health.CheckReadiness(context.Background())
+	if calls != 2 {
+		t.Fatalf("Expected a new check after the TTL, got %d calls", calls)
+	}
+}
+
+func TestVyinCheckCredentials(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer good" {
+			http.Error(w, `{"message": "invalid api key"}`, http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, `{"detail": "text is required"}`, http.StatusUnprocessableEntity)
+	}))
+	defer server.Close()
+
+	registry := NewTTSProviderRegistry(TTSProviderVyin)
+	registry.Register(NewVyinProvider("good", TTSOptions{BaseURL: server.URL}))
+	if err := ttsChecker(registry).Check(context.Background()); err != nil {
+		t.Fatalf("Expected the key to be accepted, got %v", err)
+	}
+
+	registry.Register(NewVyinProvider("bad", TTSOptions{BaseURL: server.URL}))
+	var vyinErr *VyinError
+	if err := ttsChecker(registry).Check(context.Background()); !errors.As(err, &vyinErr) || vyinErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected the key to be rejected, got %v", err)
+	}
+
+	if err := ttsChecker(NewTTSProviderRegistry(TTSProviderVyin)).Check(context.Background()); err == nil {
+		t.Fatal("Expected an error for an unconfigured default provider")
+	}
+}
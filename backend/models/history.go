@@ -2,121 +2,290 @@ package models
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"time"
+)
+
+// historyUpdateAttempts bounds how often Insert_chat retries after a
+// concurrent change before giving up with ErrHistoryConflict.
+const historyUpdateAttempts = 3
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+// DefaultSessionID names the conversation every user has had since before
+// sessions existed. Requests without a session ID use it, and stores keep
+// it in the original per-user layout so existing histories need no
+// migration.
+const DefaultSessionID = "default"
+
+var (
+	// ErrHistoryExists is returned when creating a history that exists.
+	ErrHistoryExists = errors.New("history already exists")
+	// ErrHistoryConflict is returned when a history changed since it was
+	// read and the change can't be merged.
+	ErrHistoryConflict = errors.New("history was changed concurrently")
+	// ErrSessionNotFound is returned for operations on a session the user
+	// doesn't have.
+	ErrSessionNotFound = errors.New("session not found")
+	// ErrChatNotFound is returned when changing a chat that doesn't exist.
+	ErrChatNotFound = errors.New("chat not found")
+	// ErrSessionArchived is returned when chatting in an archived session.
+	ErrSessionArchived = errors.New("session is archived")
 )
 
+// History is one conversation (session) of a user. Version is increased by
+// every write; updates only succeed when the version is still the one that
+// was read.
 type History struct {
 	UserID      string    `json:"user_id" dynamodbav:"user_id"`
+	SessionID   string    `json:"session_id" dynamodbav:"session_id"`
+	Title       string    `json:"title" dynamodbav:"title"`
+	Archived    bool      `json:"archived" dynamodbav:"archived"`
 	Type        string    `json:"type" dynamodbav:"type"`
 	Chats       []Chat    `json:"chats" dynamodbav:"chats"`
 	VoiceID     string    `json:"voice_id" dynamodbav:"voice_id"`
+	CreatedAt   time.Time `json:"created_at" dynamodbav:"created_at"`
 	LastUpdated time.Time `json:"last_updated" dynamodbav:"last_updated"`
+	Version     int64     `json:"version" dynamodbav:"version"`
 }
 
 type Chat struct {
-	Role      string    `json:"role" dynamodbav:"role"`
-	Content   string    `json:"content" dynamodbav:"content"`
-	Time      string    `json:"time" dynamodbav:"time"`
-	AudioURL  string    `json:"audio_url" dynamodbav:"audio_url"`
-	Timestamp time.Time `json:"timestamp" dynamodbav:"timestamp"`
+	ID            string    `json:"id" dynamodbav:"id"`
+	Role          string    `json:"role" dynamodbav:"role"`
+	Content       string    `json:"content" dynamodbav:"content"`
+	Time          string    `json:"time" dynamodbav:"time"`
+	AudioURL      string    `json:"audio_url" dynamodbav:"audio_url"`
+	AudioPlaylist []string  `json:"audio_playlist,omitempty" dynamodbav:"audio_playlist,omitempty"`
+	VoiceURL      string    `json:"voice_url,omitempty" dynamodbav:"voice_url,omitempty"`
+	Timestamp     time.Time `json:"timestamp" dynamodbav:"timestamp"`
+	// Moderation lists what the content policy did to the chat.
+	Moderation []ModerationDecision `json:"moderation,omitempty" dynamodbav:"moderation,omitempty"`
+}
+
+// ChatPage is one page of a user's chats in chronological order.
+// NextCursor is passed as before to fetch the next older page and is empty
+// on the oldest page.
+type ChatPage struct {
+	Chats      []Chat `json:"chats"`
+	NextCursor string `json:"next_cursor"`
 }
 
 type HistoryService interface {
-	Search_chat(id string) (bool, []Chat)
-	Create_chat(his History) error
-	Insert_chat(id string, chats []Chat) error
+	Search_chat(ctx context.Context, id string) (bool, []Chat)
+	Create_chat(ctx context.Context, his History) error
+	Insert_chat(ctx context.Context, id, sessionID string, chats []Chat, version int64) error
+	Append_chat(ctx context.Context, id, sessionID string, chats ...Chat) error
+	List_chat(ctx context.Context, id, sessionID string, limit int, before string) (*ChatPage, error)
+	Get_session(ctx context.Context, id, sessionID string) (*History, error)
+	Create_session(ctx context.Context, his History) (*History, error)
+	List_session(ctx context.Context, id string, archived bool) ([]History, error)
+	Update_session(ctx context.Context, id, sessionID string, update SessionUpdate) (*History, error)
+	Delete_session(ctx context.Context, id, sessionID string) error
 	// Delete_db(id string) error
 
 }
 
-func (t *controllerOps) Search_chat(id string) (bool, []Chat) {
-	result, err := t.Client.GetItem(context.TODO(), &dynamodb.GetItemInput{
-		TableName: aws.String("History"),
-		Key: map[string]types.AttributeValue{
-			"user_id": &types.AttributeValueMemberS{Value: id},
-		},
-	})
+// HistoryStore persists the sessions of every user, one record per chat.
+// Sessions are addressed by user and session ID, DefaultSessionID being the
+// original single history of a user. GetHistory returns the session without
+// its chats, or nil and no error when it doesn't exist. ListHistories returns
+// all sessions of a user without chats. ListChats returns up to limit of the
+// newest chats with an ID lower than before, all of them when limit is not
+// positive. Stores keep chats ordered by ID.
+//
+// CreateHistory fails with ErrHistoryExists if the session exists.
+// UpdateHistory replaces the session and its chats, UpdateSession only its
+// title, archived flag and other fields besides the chats. Both succeed only
+// if the stored version equals history.Version and fail with
+// ErrHistoryConflict otherwise. AppendChats, UpdateHistory and UpdateSession
+// increase the version. AppendChats creates the default session if needed
+// and fails with ErrSessionNotFound for other sessions that don't exist.
+// DeleteHistory removes a session with all its chats and fails with
+// ErrSessionNotFound if there is none. SetChatAudio sets the audio URL and
+// playlist of a stored chat, increasing the version too, and fails with
+// ErrChatNotFound if the chat doesn't exist.
+type HistoryStore interface {
+	GetHistory(ctx context.Context, userID, sessionID string) (*History, error)
+	ListHistories(ctx context.Context, userID string) ([]History, error)
+	CreateHistory(ctx context.Context, history History) error
+	UpdateHistory(ctx context.Context, history History) error
+	UpdateSession(ctx context.Context, history History) error
+	DeleteHistory(ctx context.Context, userID, sessionID string) error
+	AppendChats(ctx context.Context, userID, sessionID string, chats []Chat) error
+	ListChats(ctx context.Context, userID, sessionID string, limit int, before string) (*ChatPage, error)
+	SetChatAudio(ctx context.Context, userID, sessionID, chatID, audioURL string, playlist []string) error
+}
+
+// NewHistoryService returns a HistoryService keeping chats in store.
+func NewHistoryService(store HistoryStore) HistoryService {
+	return NewHistoryServiceWithTimeout(store, 0)
+}
+
+// NewHistoryServiceWithTimeout returns a HistoryService keeping chats in
+// store whose calls fail with a TimeoutError after timeout. Zero means no
+// timeout besides the one of the request.
+func NewHistoryServiceWithTimeout(store HistoryStore, timeout time.Duration) HistoryService {
+	return &controllerOps{store: store, timeout: stageTimeout{stage: StageStorage, timeout: timeout}}
+}
+
+func (t *controllerOps) Search_chat(ctx context.Context, id string) (bool, []Chat) {
+	ctx, cancel := t.timeout.context(ctx)
+	defer cancel()
+
+	history, err := t.store.GetHistory(ctx, id, DefaultSessionID)
 	if err != nil {
-		log.Printf("Error getting item: %v", err)
+		slog.ErrorContext(ctx, "Failed to get history", "user_id", id, "error", err)
 		return false, nil
 	}
 
-	if result.Item == nil {
+	if history == nil {
 		return false, nil
 	}
 
-	var history History
-	err = attributevalue.UnmarshalMap(result.Item, &history)
+	page, err := t.store.ListChats(ctx, id, DefaultSessionID, 0, "")
 	if err != nil {
-		log.Printf("Error unmarshaling item: %v", err)
+		slog.ErrorContext(ctx, "Failed to list chats", "user_id", id, "error", err)
 		return false, nil
 	}
 
-	return true, history.Chats
+	return true, page.Chats
 }
 
-func (t *controllerOps) Create_chat(his History) error {
-	item, err := attributevalue.MarshalMap(his)
-	if err != nil {
-		return err
-	}
+func (t *controllerOps) Create_chat(ctx context.Context, his History) error {
+	ctx, cancel := t.timeout.context(ctx)
+	defer cancel()
 
-	_, err = t.Client.PutItem(context.TODO(), &dynamodb.PutItemInput{
-		TableName: aws.String("History"),
-		Item:      item,
-	})
-	return err
+	his.SessionID = sessionOrDefault(his.SessionID)
+	his.Chats = withChatIDs(his.Chats)
+	return t.timeout.err(ctx, t.store.CreateHistory(ctx, his))
 }
 
-func (t *controllerOps) Insert_chat(id string, chats []Chat) error {
-	history, err := t.getHistory(id)
-	if err != nil {
-		return err
+// Insert_chat replaces all chats of a session. With a non-zero version the
+// replacement only succeeds if the history is still at that version.
+// Otherwise the caller is taken to have read the chats up to the last one
+// the replacement keeps by ID, and chats after it, appended concurrently,
+// are merged into the replacement; a replacement keeping no chat replaces
+// all of them. Writes are retried when the session changes meanwhile, and
+// fail with ErrHistoryConflict when a chat the replacement was based on has
+// been changed or removed.
+func (t *controllerOps) Insert_chat(ctx context.Context, id, sessionID string, chats []Chat, version int64) error {
+	ctx, cancel := t.timeout.context(ctx)
+	defer cancel()
+	return t.timeout.err(ctx, t.insertChats(ctx, id, sessionID, chats, version))
+}
+
+func (t *controllerOps) insertChats(ctx context.Context, id, sessionID string, chats []Chat, version int64) error {
+	sessionID = sessionOrDefault(sessionID)
+	chats = withChatIDs(chats)
+
+	var seen []Chat
+	for attempt := 0; attempt < historyUpdateAttempts; attempt++ {
+		history, err := t.store.GetHistory(ctx, id, sessionID)
+		if err != nil {
+			return err
+		}
+		if history == nil {
+			return fmt.Errorf("session %s of user %s not found", sessionID, id)
+		}
+		if version != 0 && history.Version != version {
+			return ErrHistoryConflict
+		}
+
+		page, err := t.store.ListChats(ctx, id, sessionID, 0, "")
+		if err != nil {
+			return err
+		}
+		if seen == nil {
+			seen = readByCaller(page.Chats, chats)
+		}
+		merged, ok := mergeConcurrentChats(seen, page.Chats, chats)
+		if !ok {
+			return ErrHistoryConflict
+		}
+		chats = merged
+		seen = page.Chats
+
+		history.Chats = chats
+		history.LastUpdated = time.Now()
+		err = t.store.UpdateHistory(ctx, *history)
+		if !errors.Is(err, ErrHistoryConflict) {
+			return err
+		}
+		slog.InfoContext(ctx, "Session changed during update, retrying", "session_id", sessionID, "user_id", id)
 	}
+	return ErrHistoryConflict
+}
 
-	history.Chats = chats
-	return t.updateHistory(history)
+// Append_chat adds chats after the existing chats of a session without
+// rewriting them.
+func (t *controllerOps) Append_chat(ctx context.Context, id, sessionID string, chats ...Chat) error {
+	ctx, cancel := t.timeout.context(ctx)
+	defer cancel()
+	return t.timeout.err(ctx, t.store.AppendChats(ctx, id, sessionOrDefault(sessionID), withChatIDs(chats)))
 }
 
-func (t *controllerOps) getHistory(id string) (*History, error) {
-	result, err := t.Client.GetItem(context.TODO(), &dynamodb.GetItemInput{
-		TableName: aws.String("History"),
-		Key: map[string]types.AttributeValue{
-			"user_id": &types.AttributeValueMemberS{Value: id},
-		},
-	})
-	if err != nil {
-		return nil, err
-	}
+func (t *controllerOps) List_chat(ctx context.Context, id, sessionID string, limit int, before string) (*ChatPage, error) {
+	ctx, cancel := t.timeout.context(ctx)
+	defer cancel()
+	page, err := t.store.ListChats(ctx, id, sessionOrDefault(sessionID), limit, before)
+	return page, t.timeout.err(ctx, err)
+}
 
-	if result.Item == nil {
-		return nil, nil
+// mergeConcurrentChats adds the chats that appear in current but not in seen,
+// i.e. that were appended after seen was read, to replacement. It reports
+// false if a chat of seen was changed or removed in current, since the
+// replacement would then silently drop that change.
+func mergeConcurrentChats(seen, current, replacement []Chat) ([]Chat, bool) {
+	currentByID := map[string]Chat{}
+	for _, chat := range current {
+		currentByID[chat.ID] = chat
 	}
-
-	var history History
-	err = attributevalue.UnmarshalMap(result.Item, &history)
-	if err != nil {
-		return nil, err
+	seenIDs := map[string]bool{}
+	for _, chat := range seen {
+		now, ok := currentByID[chat.ID]
+		if !ok || now.Role != chat.Role || now.Content != chat.Content {
+			return nil, false
+		}
+		seenIDs[chat.ID] = true
 	}
 
-	return &history, nil
+	merged := append([]Chat{}, replacement...)
+	replaced := map[string]bool{}
+	for _, chat := range replacement {
+		replaced[chat.ID] = true
+	}
+	for _, chat := range current {
+		if !seenIDs[chat.ID] && !replaced[chat.ID] {
+			merged = append(merged, chat)
+		}
+	}
+	return merged, true
 }
 
-func (t *controllerOps) updateHistory(history *History) error {
-	item, err := attributevalue.MarshalMap(history)
-	if err != nil {
-		return err
+// readByCaller returns the chats of current up to the last one kept in
+// replacement, those the caller must have read before replacing them, or
+// all of current if replacement keeps none.
+func readByCaller(current, replacement []Chat) []Chat {
+	kept := map[string]bool{}
+	for _, chat := range replacement {
+		kept[chat.ID] = true
+	}
+	for i := len(current) - 1; i >= 0; i-- {
+		if kept[current[i].ID] {
+			return current[:i+1]
+		}
 	}
+	return current
+}
 
-	_, err = t.Client.PutItem(context.TODO(), &dynamodb.PutItemInput{
-		TableName: aws.String("History"),
-		Item:      item,
-	})
-	return err
+// withChatIDs returns chats with a new ID for every chat that has none.
+func withChatIDs(chats []Chat) []Chat {
+	result := make([]Chat, len(chats))
+	for i, chat := range chats {
+		if chat.ID == "" {
+			chat.ID = NewChatID()
+		}
+		result[i] = chat
+	}
+	return result
 }
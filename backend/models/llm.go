@@ -0,0 +1,175 @@
+package models
+
+import (
+	"backend/config"
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// Names of the built-in LLM providers.
+const (
+	ProviderNova   = "nova"
+	ProviderClaude = "claude"
+	ProviderOpenAI = "openai"
+	ProviderFake   = "fake"
+)
+
+// LLMMessage is one plain text message of a conversation. Role is either
+// "user" or "assistant".
+type LLMMessage struct {
+	Role string
+	Text string
+}
+
+// LLMRequest is a provider independent chat request. Providers translate it
+// into their own wire format. Unset sampling parameters keep the provider
+// defaults. Guardrail only applies to providers on Bedrock.
+type LLMRequest struct {
+	System   string
+	Messages []LLMMessage
+	InferenceConfig
+	Guardrail *Guardrail
+}
+
+// LLMProvider generates chat replies with one model backend.
+type LLMProvider interface {
+	Name() string
+	Complete(ctx context.Context, request LLMRequest) (*ChatCompletion, error)
+	Stream(ctx context.Context, request LLMRequest, onDelta func(delta string) error) (*ChatCompletion, error)
+}
+
+// ProviderRegistry holds the configured LLM providers by name.
+type ProviderRegistry struct {
+	mu          sync.RWMutex
+	providers   map[string]LLMProvider
+	defaultName string
+}
+
+// NewProviderRegistry returns an empty registry whose Get("") resolves to
+// defaultName.
+func NewProviderRegistry(defaultName string) *ProviderRegistry {
+	return &ProviderRegistry{
+		providers:   map[string]LLMProvider{},
+		defaultName: defaultName,
+	}
+}
+
+// Register adds provider, replacing any provider with the same name.
+func (r *ProviderRegistry) Register(provider LLMProvider) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.providers[provider.Name()] = provider
+}
+
+// Get returns the provider registered as name, or the default provider when
+// name is empty.
+func (r *ProviderRegistry) Get(name string) (LLMProvider, error) {
+	if name == "" {
+		name = r.defaultName
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	provider, ok := r.providers[name]
+	if !ok {
+		return nil, fmt.Errorf("LLM provider %q is not configured", name)
+	}
+	return provider, nil
+}
+
+// Names returns the registered provider names in sorted order.
+func (r *ProviderRegistry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.providers))
+	for name := range r.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewProviderRegistryFromConfig registers every provider that has its
+// settings in cfg. The fake provider is always available. cfg.Provider
+// picks the default.
+//
+//	nova:   NovaInferenceProfileARN
+//	claude: ClaudeModelID, ClaudeMaxTokens
+//	openai: OpenAIBaseURL, OpenAIAPIKey, OpenAIModel
+//
+// GuardrailID applies a Bedrock guardrail, of GuardrailVersion or DRAFT, to
+// the nova and claude providers.
+func NewProviderRegistryFromConfig(cfg config.LLM) (*ProviderRegistry, error) {
+	registry := NewProviderRegistry(cfg.Provider)
+	registry.Register(NewFakeProvider())
+
+	if cfg.NovaInferenceProfileARN != "" || cfg.ClaudeModelID != "" {
+		awsCfg, err := awsconfig.LoadDefaultConfig(context.TODO())
+		if err != nil {
+			return nil, err
+		}
+		client := bedrockruntime.NewFromConfig(awsCfg, withGuardrail(&Guardrail{ID: cfg.GuardrailID, Version: cfg.GuardrailVersion}))
+
+		if cfg.NovaInferenceProfileARN != "" {
+			registry.Register(NewNovaProvider(client, cfg.NovaInferenceProfileARN))
+		}
+		if cfg.ClaudeModelID != "" {
+			registry.Register(NewClaudeProvider(client, cfg.ClaudeModelID, cfg.ClaudeMaxTokens))
+		}
+	}
+
+	if cfg.OpenAIBaseURL != "" {
+		registry.Register(NewOpenAIProvider(cfg.OpenAIBaseURL, cfg.OpenAIAPIKey, cfg.OpenAIModel))
+	}
+
+	if _, err := registry.Get(""); err != nil {
+		return nil, fmt.Errorf("default %w", err)
+	}
+	slog.Info("LLM providers", "providers", registry.Names(), "default", cfg.Provider)
+	return registry, nil
+}
+
+// withGuardrail applies a Bedrock guardrail to the InvokeModel calls of a
+// client, or of a single call. The SDK has no fields for it, so it is set
+// through the request headers Bedrock reads it from; those of a call
+// replace those of its client.
+func withGuardrail(guardrail *Guardrail) func(*bedrockruntime.Options) {
+	return func(o *bedrockruntime.Options) {
+		if guardrail == nil || guardrail.ID == "" {
+			return
+		}
+		version := guardrail.Version
+		if version == "" {
+			version = "DRAFT"
+		}
+		o.APIOptions = append(o.APIOptions,
+			smithyhttp.SetHeaderValue("X-Amzn-Bedrock-GuardrailIdentifier", guardrail.ID),
+			smithyhttp.SetHeaderValue("X-Amzn-Bedrock-GuardrailVersion", version),
+		)
+	}
+}
+
+// guardrailOptions returns the options of a call applying guardrail, none
+// to keep the guardrail of the client.
+func guardrailOptions(guardrail *Guardrail) []func(*bedrockruntime.Options) {
+	if guardrail == nil || guardrail.ID == "" {
+		return nil
+	}
+	return []func(*bedrockruntime.Options){withGuardrail(guardrail)}
+}
+
+// guardrailStopReason returns StopReasonGuardrail if Bedrock reported the
+// guardrail action INTERVENED, else the stop reason of the model.
+func guardrailStopReason(action, stopReason string) string {
+	if action == "INTERVENED" {
+		return StopReasonGuardrail
+	}
+	return stopReason
+}
@@ -0,0 +1,184 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+)
+
+const (
+	claudeAnthropicVersion = "bedrock-2023-05-31"
+	defaultClaudeMaxTokens = 1024
+)
+
+// claudeProvider talks to Anthropic Claude models on Bedrock using the
+// Anthropic messages format.
+type claudeProvider struct {
+	client    *bedrockruntime.Client
+	modelID   string
+	maxTokens int
+}
+
+// NewClaudeProvider returns a provider for a Claude model on Bedrock.
+// maxTokens is required by the messages API and caps the reply length.
+func NewClaudeProvider(client *bedrockruntime.Client, modelID string, maxTokens int) LLMProvider {
+	if maxTokens <= 0 {
+		maxTokens = defaultClaudeMaxTokens
+	}
+	return &claudeProvider{client: client, modelID: modelID, maxTokens: maxTokens}
+}
+
+type ClaudeRequest struct {
+	AnthropicVersion string          `json:"anthropic_version"`
+	MaxTokens        int             `json:"max_tokens"`
+	System           string          `json:"system,omitempty"`
+	Messages         []ClaudeMessage `json:"messages"`
+	Temperature      *float64        `json:"temperature,omitempty"`
+	TopP             *float64        `json:"top_p,omitempty"`
+	StopSequences    []string        `json:"stop_sequences,omitempty"`
+}
+
+type ClaudeMessage struct {
+	Role    string          `json:"role"`
+	Content []ClaudeContent `json:"content"`
+}
+
+type ClaudeContent struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type ClaudeUsage struct {
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+}
+
+type ClaudeResponse struct {
+	Content         []ClaudeContent `json:"content"`
+	StopReason      string          `json:"stop_reason"`
+	Usage           ClaudeUsage     `json:"usage"`
+	GuardrailAction string          `json:"amazon-bedrock-guardrailAction"`
+}
+
+// claudeStreamChunk is one event of a Claude response stream.
+type claudeStreamChunk struct {
+	Type    string `json:"type"`
+	Message *struct {
+		Usage ClaudeUsage `json:"usage"`
+	} `json:"message"`
+	Delta *struct {
+		Type       string `json:"type"`
+		Text       string `json:"text"`
+		StopReason string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage           *ClaudeUsage `json:"usage"`
+	GuardrailAction string       `json:"amazon-bedrock-guardrailAction"`
+}
+
+func (u ClaudeUsage) tokenUsage() TokenUsage {
+	return TokenUsage{
+		InputTokens:               u.InputTokens,
+		OutputTokens:              u.OutputTokens,
+		TotalTokens:               u.InputTokens + u.OutputTokens,
+		CacheReadInputTokenCount:  u.CacheReadInputTokens,
+		CacheWriteInputTokenCount: u.CacheCreationInputTokens,
+	}
+}
+
+func (p *claudeProvider) Name() string {
+	return ProviderClaude
+}
+
+func (p *claudeProvider) Complete(ctx context.Context, request LLMRequest) (*ChatCompletion, error) {
+	output, err := invokeBedrock(ctx, p.client, p.modelID, p.newRequest(request), request.Guardrail)
+	if err != nil {
+		return nil, err
+	}
+
+	var response ClaudeResponse
+	if err := json.Unmarshal(output, &response); err != nil {
+		slog.ErrorContext(ctx, "Failed to unmarshal response body", "error", err)
+		return nil, err
+	}
+
+	completion := &ChatCompletion{
+		StopReason: guardrailStopReason(response.GuardrailAction, response.StopReason),
+		Usage:      response.Usage.tokenUsage(),
+		Model:      p.modelID,
+	}
+	for _, content := range response.Content {
+		if content.Type == "text" {
+			completion.Text += content.Text
+		}
+	}
+	if completion.Text == "" {
+		return nil, fmt.Errorf("no response from model")
+	}
+	return completion, nil
+}
+
+func (p *claudeProvider) Stream(ctx context.Context, request LLMRequest, onDelta func(delta string) error) (*ChatCompletion, error) {
+	completion := &ChatCompletion{Model: p.modelID}
+	var usage ClaudeUsage
+	err := streamBedrock(ctx, p.client, p.modelID, p.newRequest(request), request.Guardrail, func(chunk []byte) error {
+		var payload claudeStreamChunk
+		if err := json.Unmarshal(chunk, &payload); err != nil {
+			slog.ErrorContext(ctx, "Failed to unmarshal stream chunk", "error", err)
+			return err
+		}
+
+		if payload.GuardrailAction != "" {
+			completion.StopReason = guardrailStopReason(payload.GuardrailAction, completion.StopReason)
+		}
+		switch payload.Type {
+		case "message_start":
+			if payload.Message != nil {
+				usage = payload.Message.Usage
+			}
+		case "content_block_delta":
+			if payload.Delta != nil && payload.Delta.Text != "" {
+				completion.Text += payload.Delta.Text
+				return onDelta(payload.Delta.Text)
+			}
+		case "message_delta":
+			if payload.Delta != nil && completion.StopReason != StopReasonGuardrail {
+				completion.StopReason = payload.Delta.StopReason
+			}
+			if payload.Usage != nil {
+				usage.OutputTokens = payload.Usage.OutputTokens
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	completion.Usage = usage.tokenUsage()
+	return completion, nil
+}
+
+func (p *claudeProvider) newRequest(request LLMRequest) *ClaudeRequest {
+	body := &ClaudeRequest{
+		AnthropicVersion: claudeAnthropicVersion,
+		MaxTokens:        p.maxTokens,
+		System:           request.System,
+		Temperature:      request.Temperature,
+		TopP:             request.TopP,
+		StopSequences:    request.StopSequences,
+	}
+	if request.MaxTokens > 0 {
+		body.MaxTokens = request.MaxTokens
+	}
+	for _, message := range request.Messages {
+		body.Messages = append(body.Messages, ClaudeMessage{
+			Role:    message.Role,
+			Content: []ClaudeContent{{Type: "text", Text: message.Text}},
+		})
+	}
+	return body
+}
@@ -0,0 +1,86 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// fakeProvider is a deterministic in-process provider for tests and local
+// development without AWS credentials. It replies with the number of user
+// turns it received and echoes the latest user message, so callers can see
+// both the prompt and the conversation context arrive. Stop sequences and
+// max tokens cut the reply like a real model.
+type fakeProvider struct{}
+
+// NewFakeProvider returns the fake provider.
+func NewFakeProvider() LLMProvider {
+	return fakeProvider{}
+}
+
+func (fakeProvider) Name() string {
+	return ProviderFake
+}
+
+func (p fakeProvider) Complete(ctx context.Context, request LLMRequest) (*ChatCompletion, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return p.reply(request), nil
+}
+
+func (p fakeProvider) Stream(ctx context.Context, request LLMRequest, onDelta func(delta string) error) (*ChatCompletion, error) {
+	completion := p.reply(request)
+	for _, delta := range strings.SplitAfter(completion.Text, " ") {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := onDelta(delta); err != nil {
+			return nil, err
+		}
+	}
+	return completion, nil
+}
+
+func (fakeProvider) reply(request LLMRequest) *ChatCompletion {
+	turns := 0
+	last := ""
+	for _, message := range request.Messages {
+		if message.Role == "user" {
+			turns++
+			last = message.Text
+		}
+	}
+
+	text := fmt.Sprintf("Fake reply #%d: %s", turns, last)
+	stopReason := "end_turn"
+	for _, stop := range request.StopSequences {
+		if i := strings.Index(text, stop); stop != "" && i >= 0 {
+			text, stopReason = text[:i], "stop_sequence"
+		}
+	}
+	if request.MaxTokens > 0 && estimateTokens(text) > request.MaxTokens {
+		runes := []rune(text)
+		for estimateTokens(string(runes)) > request.MaxTokens {
+			runes = runes[:len(runes)-1]
+		}
+		text, stopReason = string(runes), "max_tokens"
+	}
+
+	input := estimateTokens(request.System)
+	for _, message := range request.Messages {
+		input += estimateTokens(message.Text)
+	}
+	output := estimateTokens(text)
+
+	return &ChatCompletion{
+		Text:       text,
+		StopReason: stopReason,
+		Model:      ProviderFake,
+		Usage: TokenUsage{
+			InputTokens:  input,
+			OutputTokens: output,
+			TotalTokens:  input + output,
+		},
+	}
+}
@@ -0,0 +1,159 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+)
+
+// novaProvider talks to Amazon Nova models on Bedrock using the messages API.
+type novaProvider struct {
+	client  *bedrockruntime.Client
+	modelID string
+}
+
+// NewNovaProvider returns a provider for a Nova model or inference profile.
+func NewNovaProvider(client *bedrockruntime.Client, modelID string) LLMProvider {
+	return &novaProvider{client: client, modelID: modelID}
+}
+
+// novaStreamChunk is one JSON chunk of a Nova Pro response stream. Only one
+// of the fields is set per chunk.
+type novaStreamChunk struct {
+	ContentBlockDelta *struct {
+		Delta struct {
+			Text string `json:"text"`
+		} `json:"delta"`
+	} `json:"contentBlockDelta"`
+	MessageStop *struct {
+		StopReason string `json:"stopReason"`
+	} `json:"messageStop"`
+	Metadata *struct {
+		Usage TokenUsage `json:"usage"`
+	} `json:"metadata"`
+	InvocationMetrics *bedrockInvocationMetrics `json:"amazon-bedrock-invocationMetrics"`
+	GuardrailAction   string                    `json:"amazon-bedrock-guardrailAction"`
+}
+
+// bedrockInvocationMetrics is attached by Bedrock to the last stream chunk.
+type bedrockInvocationMetrics struct {
+	InputTokenCount  int `json:"inputTokenCount"`
+	OutputTokenCount int `json:"outputTokenCount"`
+}
+
+func (m *bedrockInvocationMetrics) usage() TokenUsage {
+	return TokenUsage{
+		InputTokens:  m.InputTokenCount,
+		OutputTokens: m.OutputTokenCount,
+		TotalTokens:  m.InputTokenCount + m.OutputTokenCount,
+	}
+}
+
+func (p *novaProvider) Name() string {
+	return ProviderNova
+}
+
+func (p *novaProvider) Complete(ctx context.Context, request LLMRequest) (*ChatCompletion, error) {
+	body, err := newNovaProRequest(request)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := invokeBedrock(ctx, p.client, p.modelID, body, request.Guardrail)
+	if err != nil {
+		return nil, err
+	}
+
+	var response NovaProResponse
+	if err := json.Unmarshal(output, &response); err != nil {
+		slog.ErrorContext(ctx, "Failed to unmarshal response body", "error", err)
+		slog.DebugContext(ctx, "Unreadable response", "body", string(output))
+		return nil, err
+	}
+
+	if len(response.Output.Message.Content) == 0 {
+		slog.WarnContext(ctx, "Response has no content", "stop_reason", response.StopReason)
+		return nil, fmt.Errorf("no response from model")
+	}
+
+	return &ChatCompletion{
+		Text:       response.Output.Message.Content[0].Text,
+		StopReason: guardrailStopReason(response.GuardrailAction, response.StopReason),
+		Usage:      response.Usage,
+		Model:      p.modelID,
+	}, nil
+}
+
+func (p *novaProvider) Stream(ctx context.Context, request LLMRequest, onDelta func(delta string) error) (*ChatCompletion, error) {
+	body, err := newNovaProRequest(request)
+	if err != nil {
+		return nil, err
+	}
+
+	completion := &ChatCompletion{Model: p.modelID}
+	err = streamBedrock(ctx, p.client, p.modelID, body, request.Guardrail, func(chunk []byte) error {
+		var payload novaStreamChunk
+		if err := json.Unmarshal(chunk, &payload); err != nil {
+			slog.ErrorContext(ctx, "Failed to unmarshal stream chunk", "error", err)
+			return err
+		}
+
+		if payload.MessageStop != nil && completion.StopReason != StopReasonGuardrail {
+			completion.StopReason = payload.MessageStop.StopReason
+		}
+		if payload.GuardrailAction != "" {
+			completion.StopReason = guardrailStopReason(payload.GuardrailAction, completion.StopReason)
+		}
+		if payload.Metadata != nil {
+			completion.Usage = payload.Metadata.Usage
+		}
+		if payload.InvocationMetrics != nil && completion.Usage.TotalTokens == 0 {
+			completion.Usage = payload.InvocationMetrics.usage()
+		}
+		if payload.ContentBlockDelta != nil && payload.ContentBlockDelta.Delta.Text != "" {
+			delta := payload.ContentBlockDelta.Delta.Text
+			completion.Text += delta
+			return onDelta(delta)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return completion, nil
+}
+
+func newNovaProRequest(request LLMRequest) (*NovaProRequest, error) {
+	body := &NovaProRequest{}
+	if request.MaxTokens > 0 || request.Temperature != nil || request.TopP != nil || len(request.StopSequences) > 0 {
+		body.InferenceConfig = &NovaInferenceConfig{
+			MaxTokens:     request.MaxTokens,
+			Temperature:   request.Temperature,
+			TopP:          request.TopP,
+			StopSequences: request.StopSequences,
+		}
+	}
+	if request.System != "" {
+		body.System = []ContentItem{{Text: request.System}}
+	}
+	for _, message := range request.Messages {
+		encoded, err := newMessage(message.Role, message.Text)
+		if err != nil {
+			return nil, err
+		}
+		body.Messages = append(body.Messages, encoded)
+	}
+	return body, nil
+}
+
+// newMessage wraps text into a single content item message for role.
+func newMessage(role, text string) (Message, error) {
+	contentBytes, err := json.Marshal([]ContentItem{{Text: text}})
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Role: role, Content: contentBytes}, nil
+}
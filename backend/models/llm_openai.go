@@ -0,0 +1,210 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// openAIProvider talks to any HTTP endpoint implementing the OpenAI chat
+// completions API, e.g. OpenAI itself, vLLM, Ollama or LiteLLM.
+type openAIProvider struct {
+	baseURL string
+	apiKey  string
+	model   string
+	client  *http.Client
+}
+
+// NewOpenAIProvider returns a provider for the chat completions endpoint
+// under baseURL, e.g. "https://api.openai.com/v1". apiKey may be empty for
+// endpoints that don't need one.
+func NewOpenAIProvider(baseURL, apiKey, model string) LLMProvider {
+	return &openAIProvider{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		apiKey:  apiKey,
+		model:   model,
+		client:  &http.Client{Timeout: 2 * time.Minute},
+	}
+}
+
+type OpenAIRequest struct {
+	Model         string               `json:"model"`
+	Messages      []OpenAIMessage      `json:"messages"`
+	Stream        bool                 `json:"stream,omitempty"`
+	StreamOptions *OpenAIStreamOptions `json:"stream_options,omitempty"`
+	Temperature   *float64             `json:"temperature,omitempty"`
+	TopP          *float64             `json:"top_p,omitempty"`
+	MaxTokens     int                  `json:"max_tokens,omitempty"`
+	Stop          []string             `json:"stop,omitempty"`
+}
+
+type OpenAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type OpenAIMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type OpenAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type OpenAIResponse struct {
+	Choices []struct {
+		Message      OpenAIMessage `json:"message"`
+		Delta        OpenAIMessage `json:"delta"`
+		FinishReason string        `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *OpenAIUsage `json:"usage"`
+}
+
+func (u *OpenAIUsage) tokenUsage() TokenUsage {
+	return TokenUsage{
+		InputTokens:  u.PromptTokens,
+		OutputTokens: u.CompletionTokens,
+		TotalTokens:  u.TotalTokens,
+	}
+}
+
+func (p *openAIProvider) Name() string {
+	return ProviderOpenAI
+}
+
+func (p *openAIProvider) Complete(ctx context.Context, request LLMRequest) (*ChatCompletion, error) {
+	resp, err := p.post(ctx, p.newRequest(request, false))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var response OpenAIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		slog.ErrorContext(ctx, "Failed to unmarshal response body", "error", err)
+		return nil, err
+	}
+	if len(response.Choices) == 0 {
+		return nil, fmt.Errorf("no response from model")
+	}
+
+	completion := &ChatCompletion{
+		Text:       response.Choices[0].Message.Content,
+		StopReason: response.Choices[0].FinishReason,
+		Model:      p.model,
+	}
+	if response.Usage != nil {
+		completion.Usage = response.Usage.tokenUsage()
+	}
+	return completion, nil
+}
+
+func (p *openAIProvider) Stream(ctx context.Context, request LLMRequest, onDelta func(delta string) error) (*ChatCompletion, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	resp, err := p.post(ctx, p.newRequest(request, true))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	completion := &ChatCompletion{Model: p.model}
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			break
+		}
+
+		var chunk OpenAIResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			slog.ErrorContext(ctx, "Failed to unmarshal stream chunk", "error", err)
+			return nil, err
+		}
+		if chunk.Usage != nil {
+			completion.Usage = chunk.Usage.tokenUsage()
+		}
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+		if reason := chunk.Choices[0].FinishReason; reason != "" {
+			completion.StopReason = reason
+		}
+		if delta := chunk.Choices[0].Delta.Content; delta != "" {
+			completion.Text += delta
+			if err := onDelta(delta); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return completion, nil
+}
+
+func (p *openAIProvider) newRequest(request LLMRequest, stream bool) *OpenAIRequest {
+	body := &OpenAIRequest{
+		Model:       p.model,
+		Stream:      stream,
+		Temperature: request.Temperature,
+		TopP:        request.TopP,
+		MaxTokens:   request.MaxTokens,
+		Stop:        request.StopSequences,
+	}
+	if stream {
+		body.StreamOptions = &OpenAIStreamOptions{IncludeUsage: true}
+	}
+	if request.System != "" {
+		body.Messages = append(body.Messages, OpenAIMessage{Role: "system", Content: request.System})
+	}
+	for _, message := range request.Messages {
+		body.Messages = append(body.Messages, OpenAIMessage{Role: message.Role, Content: message.Text})
+	}
+	return body
+}
+
+// post sends body to the chat completions endpoint and returns the response
+// if it succeeded. The caller must close the response body.
+func (p *openAIProvider) post(ctx context.Context, body *OpenAIRequest) (*http.Response, error) {
+	requestBytes, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/chat/completions", bytes.NewReader(requestBytes))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to call OpenAI compatible endpoint", "error", err)
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("OpenAI compatible endpoint returned %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return resp, nil
+}
@@ -0,0 +1,252 @@
+package models
+
+import (
+	"backend/metrics"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestProviderRegistry(t *testing.T) {
+	registry := NewProviderRegistry(ProviderFake)
+	registry.Register(NewFakeProvider())
+
+	provider, err := registry.Get("")
+	if err != nil {
+		t.Fatalf("Expected the default provider, got error: %v", err)
+	}
+	if provider.Name() != ProviderFake {
+		t.Fatalf("Expected %q, got %q", ProviderFake, provider.Name())
+	}
+	if _, err := registry.Get(ProviderNova); err == nil {
+		t.Fatal("Expected an error for an unregistered provider")
+	}
+}
+
+func TestFakeProviderThroughBedrockService(t *testing.T) {
+	registry := NewProviderRegistry(ProviderFake)
+	registry.Register(NewFakeProvider())
+	service := NewBedrockServiceWithRegistry(registry)
+
+	history := []Chat{
+		{Role: "user", Content: "hi"},
+		{Role: "assistant", Content: "hello"},
+	}
+	generated, err := service.GenerateChatResponse(context.Background(), history, "how are you", ChatOptions{})
+	if err != nil {
+		t.Fatalf("GenerateChatResponse failed: %v", err)
+	}
+	reply := generated.Text
+	if reply != "Fake reply #2: how are you" {
+		t.Fatalf("Unexpected reply %q", reply)
+	}
+
+	var deltas []string
+	completion, err := service.StreamChatResponse(context.Background(), history, "how are you", ChatOptions{}, func(delta string) error {
+		deltas = append(deltas, delta)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamChatResponse failed: %v", err)
+	}
+	if strings.Join(deltas, "") != reply || completion.Text != reply {
+		t.Fatalf("Expected streamed reply %q, got %q / %q", reply, strings.Join(deltas, ""), completion.Text)
+	}
+	if completion.Usage.TotalTokens == 0 {
+		t.Fatal("Expected token usage to be reported")
+	}
+}
+
+func TestOpenAIProvider(t *testing.T) {
+	var received OpenAIRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" || r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !received.Stream {
+			fmt.Fprint(w, `{"choices":[{"message":{"role":"assistant","content":"hi there"},"finish_reason":"stop"}],"usage":{"prompt_tokens":5,"completion_tokens":2,"total_tokens":7}}`)
+			return
+		}
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"hi \"}}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"there\"},\"finish_reason\":\"stop\"}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[],\"usage\":{\"prompt_tokens\":5,\"completion_tokens\":2,\"total_tokens\":7}}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	provider := NewOpenAIProvider(server.URL+"/v1/", "secret", "test-model")
+	request := LLMRequest{System: "be nice", Messages: []LLMMessage{{Role: "user", Text: "hello"}}}
+
+	completion, err := provider.Complete(context.Background(), request)
+	if err != nil {
+		t.Fatalf("Complete failed: %v", err)
+	}
+	if completion.Text != "hi there" || completion.StopReason != "stop" || completion.Usage.TotalTokens != 7 {
+		t.Fatalf("Unexpected completion %+v", completion)
+	}
+	if len(received.Messages) != 2 || received.Messages[0].Role != "system" || received.Model != "test-model" {
+		t.Fatalf("Unexpected request %+v", received)
+	}
+
+	var streamed string
+	completion, err = provider.Stream(context.Background(), request, func(delta string) error {
+		streamed += delta
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Stream failed: %v", err)
+	}
+	if streamed != "hi there" || completion.Text != "hi there" || completion.Usage.OutputTokens != 2 {
+		t.Fatalf("Unexpected streamed completion %q %+v", streamed, completion)
+	}
+}
+
+func TestNovaProviderInferenceConfigAndGuardrail(t *testing.T) {
+	var received NovaProRequest
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header, received = r.Header, NovaProRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"output":{"message":{"role":"assistant","content":[{"text":"Sorry, I can't."}]}},"stopReason":"end_turn","amazon-bedrock-guardrailAction":"INTERVENED","usage":{"inputTokens":3,"outputTokens":4}}`)
+	}))
+	defer server.Close()
+
+	client := bedrockruntime.New(bedrockruntime.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(server.URL),
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "test", SecretAccessKey: "test"}, nil
+		}),
+	}, withGuardrail(&Guardrail{ID: "default"}))
+	provider := NewNovaProvider(client, "nova-pro")
+
+	temperature := 0.2
+	completion, err := provider.Complete(context.Background(), LLMRequest{
+		Messages:        []LLMMessage{{Role: "user", Text: "hi"}},
+		InferenceConfig: InferenceConfig{MaxTokens: 100, Temperature: &temperature, StopSequences: []string{"END"}},
+		Guardrail:       &Guardrail{ID: "strict", Version: "2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := received.InferenceConfig
+	if config == nil || config.MaxTokens != 100 || *config.Temperature != 0.2 || config.TopP != nil || config.StopSequences[0] != "END" {
+		t.Fatalf("Unexpected inference config %+v", config)
+	}
+	if header.Get("X-Amzn-Bedrock-GuardrailIdentifier") != "strict" || header.Get("X-Amzn-Bedrock-GuardrailVersion") != "2" {
+		t.Fatalf("Expected the guardrail of the request, got %v", header)
+	}
+	if completion.StopReason != StopReasonGuardrail {
+		t.Fatalf("Expected %s, got %q", StopReasonGuardrail, completion.StopReason)
+	}
+
+	// Without one the guardrail of the client applies
+	if _, err := provider.Complete(context.Background(), LLMRequest{Messages: []LLMMessage{{Role: "user", Text: "hi"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if received.InferenceConfig != nil || header.Get("X-Amzn-Bedrock-GuardrailIdentifier") != "default" || header.Get("X-Amzn-Bedrock-GuardrailVersion") != "DRAFT" {
+		t.Fatalf("Expected the default guardrail and no inference config, got %+v %v", received.InferenceConfig, header)
+	}
+}
+
+func TestGenerateTitleUsesGuardrailOfOptions(t *testing.T) {
+	var received NovaProRequest
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"output":{"message":{"role":"assistant","content":[{"text":"Morning talk"}]}},"stopReason":"end_turn","usage":{"inputTokens":3,"outputTokens":2}}`)
+	}))
+	defer server.Close()
+
+	client := bedrockruntime.New(bedrockruntime.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(server.URL),
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "test", SecretAccessKey: "test"}, nil
+		}),
+	}, withGuardrail(&Guardrail{ID: "default"}))
+	registry := NewProviderRegistry(ProviderNova)
+	registry.Register(NewNovaProvider(client, "nova-pro"))
+	service := NewBedrockServiceWithRegistry(registry)
+
+	title, err := service.GenerateTitle(context.Background(), []Chat{{Role: "user", Content: "good morning"}}, ChatOptions{
+		System:          "You are Eden.",
+		InferenceConfig: InferenceConfig{MaxTokens: 32},
+		Guardrail:       &Guardrail{ID: "strict", Version: "2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if title != "Morning talk" {
+		t.Fatalf("Unexpected title %q", title)
+	}
+	if received.System[0].Text != titlePrompt {
+		t.Fatalf("Expected the title prompt, got %+v", received.System)
+	}
+	if received.InferenceConfig == nil || received.InferenceConfig.MaxTokens != 32 {
+		t.Fatalf("Unexpected inference config %+v", received.InferenceConfig)
+	}
+	if header.Get("X-Amzn-Bedrock-GuardrailIdentifier") != "strict" {
+		t.Fatalf("Expected the guardrail of the options, got %v", header)
+	}
+}
+
+func TestFakeProviderStops(t *testing.T) {
+	provider := NewFakeProvider()
+	request := LLMRequest{Messages: []LLMMessage{{Role: "user", Text: "one two three END four"}}}
+
+	request.StopSequences = []string{"END"}
+	completion, _ := provider.Complete(context.Background(), request)
+	if completion.Text != "Fake reply #1: one two three " || completion.StopReason != "stop_sequence" {
+		t.Fatalf("Expected the reply to stop at END, got %q %s", completion.Text, completion.StopReason)
+	}
+
+	request.StopSequences = nil
+	request.MaxTokens = 2
+	completion, _ = provider.Complete(context.Background(), request)
+	if estimateTokens(completion.Text) != 2 || completion.StopReason != "max_tokens" {
+		t.Fatalf("Expected the reply to stop after 2 tokens, got %q %s", completion.Text, completion.StopReason)
+	}
+}
+
+func TestBedrockServiceCountsStopReasonsAndTokens(t *testing.T) {
+	registry := NewProviderRegistry(ProviderFake)
+	registry.Register(NewFakeProvider())
+	service := NewBedrockServiceWithRegistry(registry)
+
+	stops := metrics.LLMStopReasons.WithLabelValues(ProviderFake, "end_turn")
+	output := metrics.LLMTokens.WithLabelValues(ProviderFake, "output")
+	stopsBefore, outputBefore := testutil.ToFloat64(stops), testutil.ToFloat64(output)
+
+	completion, err := service.GenerateResponse(context.Background(), "hello there", ChatOptions{})
+	if err != nil {
+		t.Fatalf("GenerateResponse failed: %v", err)
+	}
+	if got := testutil.ToFloat64(stops) - stopsBefore; got != 1 {
+		t.Fatalf("Expected one end_turn stop to be counted, got %v", got)
+	}
+	if got := testutil.ToFloat64(output) - outputBefore; got != float64(completion.Usage.OutputTokens) {
+		t.Fatalf("Expected %d output tokens to be counted, got %v", completion.Usage.OutputTokens, got)
+	}
+}
@@ -0,0 +1,97 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// MigrationStats counts what MigrateLegacyHistories converted.
+type MigrationStats struct {
+	Histories int
+	Chats     int
+}
+
+// MigrateLegacyHistories copies every item of sourceTable, which uses the
+// old layout of one item per user holding all chats, into the table of d
+// with one item per chat. Chat IDs are derived from the user and the chat
+// position, so running the migration again overwrites the same items instead
+// of duplicating them. Migrated histories start over at version 1. With
+// dryRun set nothing is written.
+func (d *DynamoDBClient) MigrateLegacyHistories(ctx context.Context, sourceTable string, dryRun bool) (MigrationStats, error) {
+	var stats MigrationStats
+	paginator := dynamodb.NewScanPaginator(d.client, &dynamodb.ScanInput{
+		TableName: aws.String(sourceTable),
+	})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return stats, err
+		}
+
+		var histories []History
+		if err := attributevalue.UnmarshalListOfMaps(output.Items, &histories); err != nil {
+			return stats, err
+		}
+
+		for _, history := range histories {
+			history.SessionID = DefaultSessionID
+			history.Chats = assignLegacyChatIDs(history)
+			if !dryRun {
+				if err := d.putChats(ctx, history.UserID, history.SessionID, history.Chats); err != nil {
+					return stats, fmt.Errorf("migrating chats of user %s: %w", history.UserID, err)
+				}
+				history.Version = 1
+				if err := d.putHistory(ctx, history, "", nil); err != nil {
+					return stats, fmt.Errorf("migrating history of user %s: %w", history.UserID, err)
+				}
+			}
+			stats.Histories++
+			stats.Chats += len(history.Chats)
+			slog.InfoContext(ctx, "Migrated history", "user_id", history.UserID, "chats", len(history.Chats))
+		}
+	}
+	return stats, nil
+}
+
+// assignLegacyChatIDs returns the chats of a history stored before chats had
+// IDs, giving every chat without one a deterministic ULID. The time part
+// comes from the chat timestamp, falling back to the history's last update,
+// and is bumped so that the IDs keep the original order of the chats.
+func assignLegacyChatIDs(history History) []Chat {
+	chats := make([]Chat, len(history.Chats))
+	var last time.Time
+	for i, chat := range history.Chats {
+		if chat.ID == "" {
+			t := chat.Timestamp
+			if t.IsZero() {
+				t = history.LastUpdated
+			}
+			if !t.After(last) {
+				t = last.Add(time.Millisecond)
+			}
+			last = t
+			chat.ID = legacyChatID(history.UserID, i, t)
+		}
+		chats[i] = chat
+	}
+	return chats
+}
+
+func legacyChatID(userID string, index int, t time.Time) string {
+	var id [16]byte
+	ms := uint64(t.UnixMilli())
+	binary.BigEndian.PutUint16(id[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(id[2:6], uint32(ms))
+
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%d", userID, index)))
+	copy(id[6:], sum[:10])
+	return encodeULID(id)
+}
@@ -1,10 +1,12 @@
 package models
 
 import (
+	"backend/config"
 	"context"
-	"log"
+	"log/slog"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/config"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 )
 
@@ -12,59 +14,249 @@ type Service interface {
 	HistoryService
 	BedrockService
 	TTSService
+	PersonaService
+	SpeechJobService
+	AudioService
+	STTService
+	QuotaService
+	UsageService
+	ModerationService
+	HealthService
+	// Shutdown stops the background work of the service, waiting for the
+	// queued speech jobs until ctx is done.
+	Shutdown(ctx context.Context) error
 }
 
 type service struct {
 	*controllerOps
+	*PersonaRegistry
+	*SpeechJobQueue
 	bedrockService BedrockService
 	ttsService     TTSService
+	audioService   AudioService
+	sttService     STTService
+	sttTimeout     stageTimeout
+	quotaService   QuotaService
+	usageService   UsageService
+	moderation     ModerationService
+	health         HealthService
 }
 
 type controllerOps struct {
-	*dynamodb.Client
+	store   HistoryStore
+	timeout stageTimeout
 }
 
-// New returns a Service instance for operating all model service.
-func New() (Service, error) {
-	client, err := GetDynamoDBClient()
+// New returns a Service instance for operating all model service as
+// configured in cfg, which must be valid.
+func New(cfg *config.Config) (Service, error) {
+	store, err := NewHistoryStoreFromConfig(cfg.History)
 	if err != nil {
 		return nil, err
 	}
 
-	bedrockService, err := NewBedrockService()
+	personas, err := NewPersonaRegistryFromConfig(cfg.Personas)
 	if err != nil {
 		return nil, err
 	}
 
-	ttsService, err := NewTTSService()
+	llmProviders, err := NewProviderRegistryFromConfig(cfg.LLM)
 	if err != nil {
 		return nil, err
 	}
 
+	ttsProviders, err := NewTTSProviderRegistryFromConfig(cfg.TTS)
+	if err != nil {
+		return nil, err
+	}
+
+	speechCache, err := NewSpeechCacheFromConfig(ttsProviders, cfg.Audio)
+	if err != nil {
+		return nil, err
+	}
+	speechCache.SetTimeout(time.Duration(cfg.Timeouts.TTSSeconds) * time.Second)
+
+	sttService, err := NewSTTServiceFromConfig(cfg.STT)
+	if err != nil {
+		return nil, err
+	}
+
+	quotaService, err := NewQuotaServiceFromConfig(cfg.Quota)
+	if err != nil {
+		return nil, err
+	}
+
+	usageService, err := NewUsageServiceFromConfig(cfg.Usage)
+	if err != nil {
+		return nil, err
+	}
+
+	moderation, err := NewModerationServiceFromConfig(cfg.Moderation)
+	if err != nil {
+		return nil, err
+	}
+
+	health, err := newHealthServiceFromConfig(cfg, llmProviders, ttsProviders)
+	if err != nil {
+		return nil, err
+	}
+
+	storageTimeout := time.Duration(cfg.Timeouts.StorageSeconds) * time.Second
+	speechJobOpts := SpeechJobOptionsFromConfig(cfg.SpeechJobs)
+	speechJobOpts.StorageTimeout = storageTimeout
+
 	serv := &service{
-		controllerOps:  &controllerOps{client},
-		bedrockService: bedrockService,
-		ttsService:     ttsService,
+		controllerOps:   &controllerOps{store: store, timeout: stageTimeout{stage: StageStorage, timeout: storageTimeout}},
+		PersonaRegistry: personas,
+		SpeechJobQueue:  NewSpeechJobQueue(speechCache, speechCache, store, speechJobOpts),
+		bedrockService:  NewBedrockService(llmProviders, ContextBudgetFromConfig(cfg.LLM), time.Duration(cfg.Timeouts.LLMSeconds)*time.Second),
+		ttsService:      speechCache,
+		audioService:    speechCache,
+		sttService:      sttService,
+		sttTimeout:      stageTimeout{stage: StageSTT, timeout: time.Duration(cfg.Timeouts.STTSeconds) * time.Second},
+		quotaService:    quotaService,
+		usageService:    usageService,
+		moderation:      moderation,
+		health:          health,
 	}
 
 	return serv, nil
 }
 
-func (s *service) GenerateResponse(prompt string) (string, error) {
-	return s.bedrockService.GenerateResponse(prompt)
+// newHealthServiceFromConfig checks the DynamoDB tables in use and the
+// default LLM and TTS providers.
+func newHealthServiceFromConfig(cfg *config.Config, llmProviders *ProviderRegistry, ttsProviders *TTSProviderRegistry) (HealthService, error) {
+	checkers := []Checker{llmChecker(llmProviders), ttsChecker(ttsProviders)}
+
+	var tables []string
+	if cfg.History.Store == StoreDynamoDB {
+		tables = append(tables, cfg.History.Table)
+	}
+	if cfg.Quota.Store == StoreDynamoDB {
+		tables = append(tables, cfg.Quota.Table)
+	}
+	if cfg.Usage.Store == StoreDynamoDB {
+		tables = append(tables, cfg.Usage.Table)
+	}
+	if len(tables) > 0 {
+		client, err := GetDynamoDBClient()
+		if err != nil {
+			return nil, err
+		}
+		for _, table := range tables {
+			checkers = append(checkers, dynamoDBTableChecker(client, table))
+		}
+	}
+
+	return NewHealthService(time.Duration(cfg.Server.ReadinessCacheSeconds)*time.Second, checkers...), nil
+}
+
+// Shutdown stops reloading personas and drains the speech job queue.
+func (s *service) Shutdown(ctx context.Context) error {
+	s.PersonaRegistry.Close()
+	return s.SpeechJobQueue.Shutdown(ctx)
+}
+
+func (s *service) GenerateResponse(ctx context.Context, prompt string, opts ChatOptions) (*ChatCompletion, error) {
+	return s.bedrockService.GenerateResponse(ctx, prompt, opts)
+}
+
+func (s *service) GenerateChatResponse(ctx context.Context, history []Chat, prompt string, opts ChatOptions) (*ChatCompletion, error) {
+	return s.bedrockService.GenerateChatResponse(ctx, history, prompt, opts)
+}
+
+func (s *service) StreamChatResponse(ctx context.Context, history []Chat, prompt string, opts ChatOptions, onDelta func(delta string) error) (*ChatCompletion, error) {
+	return s.bedrockService.StreamChatResponse(ctx, history, prompt, opts, onDelta)
+}
+
+func (s *service) GenerateTitle(ctx context.Context, chats []Chat, opts ChatOptions) (string, error) {
+	return s.bedrockService.GenerateTitle(ctx, chats, opts)
+}
+
+func (s *service) GenerateSpeech(ctx context.Context, text string, model_id int, speaker_name string, opts SpeechOptions) (string, error) {
+	return s.ttsService.GenerateSpeech(ctx, text, model_id, speaker_name, opts)
+}
+
+func (s *service) OpenAudio(ctx context.Context, key string) (*Blob, error) {
+	ctx, cancel := s.timeout.context(ctx)
+	defer cancel()
+	blob, err := s.audioService.OpenAudio(ctx, key)
+	return blob, s.timeout.err(ctx, err)
+}
+
+func (s *service) SaveAudio(ctx context.Context, data []byte, contentType string) (string, error) {
+	ctx, cancel := s.timeout.context(ctx)
+	defer cancel()
+	audioURL, err := s.audioService.SaveAudio(ctx, data, contentType)
+	return audioURL, s.timeout.err(ctx, err)
+}
+
+func (s *service) JoinAudio(ctx context.Context, urls []string) (string, error) {
+	ctx, cancel := s.timeout.context(ctx)
+	defer cancel()
+	audioURL, err := s.audioService.JoinAudio(ctx, urls)
+	return audioURL, s.timeout.err(ctx, err)
+}
+
+func (s *service) Transcribe(ctx context.Context, audio []byte, format string, language string) (string, error) {
+	ctx, cancel := s.sttTimeout.context(ctx)
+	defer cancel()
+	transcript, err := s.sttService.Transcribe(ctx, audio, format, language)
+	return transcript, s.sttTimeout.err(ctx, err)
+}
+
+func (s *service) CountRequest(ctx context.Context, key string) (*QuotaStatus, error) {
+	ctx, cancel := s.timeout.context(ctx)
+	defer cancel()
+	return s.quotaService.CountRequest(ctx, key)
+}
+
+func (s *service) TokenQuota(ctx context.Context, userID string) (*TokenQuotaStatus, error) {
+	ctx, cancel := s.timeout.context(ctx)
+	defer cancel()
+	return s.quotaService.TokenQuota(ctx, userID)
+}
+
+func (s *service) ChargeTokens(ctx context.Context, userID string, usage TokenUsage) error {
+	ctx, cancel := s.timeout.context(ctx)
+	defer cancel()
+	return s.timeout.err(ctx, s.quotaService.ChargeTokens(ctx, userID, usage))
+}
+
+func (s *service) RecordUsage(ctx context.Context, event UsageEvent) error {
+	ctx, cancel := s.timeout.context(ctx)
+	defer cancel()
+	return s.timeout.err(ctx, s.usageService.RecordUsage(ctx, event))
+}
+
+func (s *service) UsageReport(ctx context.Context, query UsageQuery) (*UsageReport, error) {
+	ctx, cancel := s.timeout.context(ctx)
+	defer cancel()
+	report, err := s.usageService.UsageReport(ctx, query)
+	return report, s.timeout.err(ctx, err)
+}
+
+func (s *service) Moderate(stage string, text string, persona *Persona) ModerationResult {
+	return s.moderation.Moderate(stage, text, persona)
+}
+
+func (s *service) Moderates(stage string, persona *Persona) bool {
+	return s.moderation.Moderates(stage, persona)
 }
 
-func (s *service) GenerateSpeech(text string, model_id int, speaker_name string) (string, error) {
-	return s.ttsService.GenerateSpeech(text, model_id, speaker_name)
+func (s *service) CheckReadiness(ctx context.Context) []ReadinessCheck {
+	return s.health.CheckReadiness(ctx)
 }
 
 func GetDynamoDBClient() (*dynamodb.Client, error) {
-	cfg, err := config.LoadDefaultConfig(context.TODO())
+	cfg, err := awsconfig.LoadDefaultConfig(context.TODO())
 	if err != nil {
 		return nil, err
 	}
 
-	client := dynamodb.NewFromConfig(cfg)
-	log.Println("Successfully connected to DynamoDB!")
+	client := dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+		o.APIOptions = append(o.APIOptions, countDynamoDBErrors)
+	})
+	slog.Info("Connected to DynamoDB")
 	return client, nil
 }
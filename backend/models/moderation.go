@@ -0,0 +1,382 @@
+package models
+
+import (
+	"backend/config"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrContentBlocked is returned for user messages refused by a moderation
+// rule.
+var ErrContentBlocked = errors.New("message blocked by the content policy")
+
+// Stages of a chat that are moderated.
+const (
+	ModerationInput  = "input"
+	ModerationOutput = "output"
+)
+
+// Actions of a moderation rule. Block refuses a user message; on replies,
+// which the user can't be blamed for, it acts like replace. Redact hides
+// the matches and replace answers with the canned reply instead.
+const (
+	ModerationBlock   = "block"
+	ModerationRedact  = "redact"
+	ModerationReplace = "replace"
+)
+
+// StopReasonGuardrail is the stop reason of replies a Bedrock guardrail
+// intervened in.
+const StopReasonGuardrail = "guardrail_intervened"
+
+// StopReasonModerated is the stop reason of canned replies answered
+// without asking the LLM.
+const StopReasonModerated = "moderated"
+
+// RuleBedrockGuardrail names the Bedrock guardrail in moderation decisions.
+const RuleBedrockGuardrail = "bedrock_guardrail"
+
+const (
+	// redactedText replaces the matches of redact rules.
+	redactedText = "[redacted]"
+	// defaultCannedReply answers in place of replaced messages when neither
+	// the rule nor the policy has a reply.
+	defaultCannedReply = "Sorry, I can't talk about that. Let's talk about something else!"
+)
+
+// piiDetectors are the built-in patterns of the detectors a rule can name.
+var piiDetectors = map[string]*regexp.Regexp{
+	// Taiwanese mobile and landline numbers and international numbers
+	"phone": regexp.MustCompile(`(?:\+\d{1,3}[ -]?)?(?:\(?0\d{1,2}\)?[ -]?\d{3,4}[ -]?\d{3,4}|09\d{2}[ -]?\d{3}[ -]?\d{3})`),
+	"email": regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`),
+	// Taiwanese national ID and resident certificate numbers
+	"id_number": regexp.MustCompile(`\b[A-Za-z][1289A-Da-d]\d{8}\b`),
+}
+
+// ModerationRule matches texts containing any of its Keywords (ignoring
+// case), regular expression Patterns or the matches of the built-in
+// Detectors phone, email and id_number, in the Stages it applies to, both
+// if empty. Reply is the canned reply of replace rules.
+type ModerationRule struct {
+	Name      string   `json:"name" yaml:"name"`
+	Stages    []string `json:"stages" yaml:"stages"`
+	Keywords  []string `json:"keywords" yaml:"keywords"`
+	Patterns  []string `json:"patterns" yaml:"patterns"`
+	Detectors []string `json:"detectors" yaml:"detectors"`
+	Action    string   `json:"action" yaml:"action"`
+	Reply     string   `json:"reply" yaml:"reply"`
+}
+
+// ModerationPolicy is the set of rules checked on every chat. CannedReply
+// answers replaced messages of rules without a Reply of their own.
+type ModerationPolicy struct {
+	CannedReply string           `json:"canned_reply" yaml:"canned_reply"`
+	Rules       []ModerationRule `json:"rules" yaml:"rules"`
+}
+
+// ModerationDecision records on a Chat that moderation changed or refused
+// it: the stage, the action taken and the rules that matched.
+type ModerationDecision struct {
+	Stage  string   `json:"stage" dynamodbav:"stage"`
+	Action string   `json:"action" dynamodbav:"action"`
+	Rules  []string `json:"rules" dynamodbav:"rules"`
+}
+
+// ModerationResult is a moderated text. Text is what to use instead of the
+// original: unchanged, redacted, the canned reply or empty if blocked.
+// Decision is nil if no rule matched.
+type ModerationResult struct {
+	Text     string
+	Decision *ModerationDecision
+}
+
+// Blocked reports whether a user message was refused.
+func (r ModerationResult) Blocked() bool {
+	return r.Decision != nil && r.Decision.Action == ModerationBlock && r.Decision.Stage == ModerationInput
+}
+
+// Replaced reports whether the text was replaced by the canned reply.
+func (r ModerationResult) Replaced() bool {
+	return r.Decision != nil && (r.Decision.Action == ModerationReplace || (r.Decision.Action == ModerationBlock && r.Decision.Stage == ModerationOutput))
+}
+
+type ModerationService interface {
+	// Moderate checks text at stage of a chat with persona, whose
+	// forbidden topics are replaced in replies.
+	Moderate(stage string, text string, persona *Persona) ModerationResult
+	// Moderates reports whether any rule applies at stage for persona.
+	Moderates(stage string, persona *Persona) bool
+}
+
+// compiledRule is a ModerationRule with its matchers compiled.
+type compiledRule struct {
+	ModerationRule
+	matchers []*regexp.Regexp
+}
+
+func (r *compiledRule) appliesTo(stage string) bool {
+	if len(r.Stages) == 0 {
+		return true
+	}
+	for _, s := range r.Stages {
+		if s == stage {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *compiledRule) matches(text string) bool {
+	for _, matcher := range r.matchers {
+		if matcher.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *compiledRule) redact(text string) string {
+	for _, matcher := range r.matchers {
+		text = matcher.ReplaceAllLiteralString(text, redactedText)
+	}
+	return text
+}
+
+type moderationService struct {
+	rules       []*compiledRule
+	cannedReply string
+}
+
+// NewModerationService compiles the rules of policy.
+func NewModerationService(policy ModerationPolicy) (ModerationService, error) {
+	service := &moderationService{cannedReply: policy.CannedReply}
+	if service.cannedReply == "" {
+		service.cannedReply = defaultCannedReply
+	}
+	for i, rule := range policy.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule%d", i+1)
+		}
+		compiled, err := compileRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		service.rules = append(service.rules, compiled)
+	}
+	return service, nil
+}
+
+// NewModerationServiceFromConfig reads the policy in the YAML or JSON file
+// cfg.RulesFile. Without one only the forbidden topics of personas are
+// moderated.
+func NewModerationServiceFromConfig(cfg config.Moderation) (ModerationService, error) {
+	var policy ModerationPolicy
+	if file := cfg.RulesFile; file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(data, &policy); err != nil {
+			return nil, fmt.Errorf("moderation rules %s: %w", file, err)
+		}
+	}
+	return NewModerationService(policy)
+}
+
+func compileRule(rule ModerationRule) (*compiledRule, error) {
+	switch rule.Action {
+	case ModerationBlock, ModerationRedact, ModerationReplace:
+	default:
+		return nil, fmt.Errorf("moderation rule %s has unknown action %q", rule.Name, rule.Action)
+	}
+	for _, stage := range rule.Stages {
+		if stage != ModerationInput && stage != ModerationOutput {
+			return nil, fmt.Errorf("moderation rule %s has unknown stage %q", rule.Name, stage)
+		}
+	}
+
+	compiled := &compiledRule{ModerationRule: rule}
+	for _, keyword := range rule.Keywords {
+		if keyword = strings.TrimSpace(keyword); keyword != "" {
+			compiled.matchers = append(compiled.matchers, regexp.MustCompile("(?i)"+regexp.QuoteMeta(keyword)))
+		}
+	}
+	for _, pattern := range rule.Patterns {
+		matcher, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("moderation rule %s: %w", rule.Name, err)
+		}
+		compiled.matchers = append(compiled.matchers, matcher)
+	}
+	for _, detector := range rule.Detectors {
+		matcher, ok := piiDetectors[detector]
+		if !ok {
+			return nil, fmt.Errorf("moderation rule %s has unknown detector %q", rule.Name, detector)
+		}
+		compiled.matchers = append(compiled.matchers, matcher)
+	}
+	if len(compiled.matchers) == 0 {
+		return nil, fmt.Errorf("moderation rule %s matches nothing", rule.Name)
+	}
+	return compiled, nil
+}
+
+// personaRule turns the forbidden topics of persona into a replace rule
+// for its replies.
+func personaRule(persona *Persona) *compiledRule {
+	if persona == nil || len(persona.ForbiddenTopics) == 0 {
+		return nil
+	}
+	rule, err := compileRule(ModerationRule{
+		Name:     "persona:" + persona.Name,
+		Stages:   []string{ModerationOutput},
+		Keywords: persona.ForbiddenTopics,
+		Action:   ModerationReplace,
+	})
+	if err != nil {
+		return nil
+	}
+	return rule
+}
+
+// rulesFor returns the rules applying at stage for persona.
+func (m *moderationService) rulesFor(stage string, persona *Persona) []*compiledRule {
+	var rules []*compiledRule
+	for _, rule := range m.rules {
+		if rule.appliesTo(stage) {
+			rules = append(rules, rule)
+		}
+	}
+	if stage == ModerationOutput {
+		if rule := personaRule(persona); rule != nil {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+func (m *moderationService) Moderates(stage string, persona *Persona) bool {
+	return len(m.rulesFor(stage, persona)) > 0
+}
+
+// Moderate applies the strongest action of the matching rules: block, then
+// replace, then redact, which hides the matches of every redact rule.
+func (m *moderationService) Moderate(stage string, text string, persona *Persona) ModerationResult {
+	var matched []*compiledRule
+	for _, rule := range m.rulesFor(stage, persona) {
+		if rule.matches(text) {
+			matched = append(matched, rule)
+		}
+	}
+	if len(matched) == 0 {
+		return ModerationResult{Text: text}
+	}
+
+	decision := &ModerationDecision{Stage: stage, Action: ModerationRedact}
+	var reply string
+	for _, rule := range matched {
+		decision.Rules = append(decision.Rules, rule.Name)
+		switch {
+		case rule.Action == ModerationBlock:
+			decision.Action = ModerationBlock
+		case rule.Action == ModerationReplace && decision.Action != ModerationBlock:
+			decision.Action = ModerationReplace
+		}
+		if rule.Action != ModerationRedact && reply == "" {
+			reply = rule.Reply
+		}
+	}
+	if reply == "" {
+		reply = m.cannedReply
+	}
+
+	result := ModerationResult{Decision: decision}
+	switch {
+	case decision.Action == ModerationBlock && stage == ModerationInput:
+	case decision.Action == ModerationRedact:
+		result.Text = text
+		for _, rule := range matched {
+			result.Text = rule.redact(result.Text)
+		}
+	default:
+		result.Text = reply
+	}
+	return result
+}
+
+// ModerationFilter moderates a streamed reply sentence by sentence before
+// passing it on, so nothing a rule catches reaches the client. Once a
+// sentence is replaced or blocked the rest of the reply is held back; the
+// moderation of the whole reply then yields the canned reply. Replies that
+// no rule applies to are passed on delta by delta. The whole reply, as
+// saved, keeps its line breaks, which the sentences passed on lose.
+type ModerationFilter struct {
+	moderation ModerationService
+	persona    *Persona
+	onText     func(text string) error
+	splitter   SentenceSplitter
+	moderates  bool
+	held       bool
+	last       string
+}
+
+// NewModerationFilter returns a filter passing the moderated text of a
+// reply of persona to onText.
+func NewModerationFilter(moderation ModerationService, persona *Persona, onText func(text string) error) *ModerationFilter {
+	return &ModerationFilter{
+		moderation: moderation,
+		persona:    persona,
+		onText:     onText,
+		moderates:  moderation.Moderates(ModerationOutput, persona),
+	}
+}
+
+// Write adds a delta of the reply.
+func (f *ModerationFilter) Write(delta string) error {
+	if !f.moderates {
+		return f.onText(delta)
+	}
+	return f.pass(f.splitter.Write(delta))
+}
+
+// Flush passes on the rest of the reply once it is complete.
+func (f *ModerationFilter) Flush() error {
+	if !f.moderates {
+		return nil
+	}
+	return f.pass(f.splitter.Flush())
+}
+
+// Held reports whether the rest of the reply was held back.
+func (f *ModerationFilter) Held() bool {
+	return f.held
+}
+
+func (f *ModerationFilter) pass(sentences []string) error {
+	for _, sentence := range sentences {
+		if f.held {
+			return nil
+		}
+		result := f.moderation.Moderate(ModerationOutput, sentence, f.persona)
+		if result.Replaced() {
+			f.held = true
+			return nil
+		}
+		text := result.Text
+		// The splitter drops the space between sentences of western text
+		if f.last != "" && f.last[len(f.last)-1] < utf8.RuneSelf {
+			text = " " + text
+		}
+		f.last = result.Text
+		if err := f.onText(text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func newTestModeration(t *testing.T) ModerationService {
+	t.Helper()
+	moderation, err := NewModerationService(ModerationPolicy{
+		CannedReply: "Let's talk about music!",
+		Rules: []ModerationRule{
+			{Name: "pii", Detectors: []string{"phone", "email", "id_number"}, Action: ModerationRedact},
+			{Name: "slurs", Stages: []string{ModerationInput}, Patterns: []string{`(?i)\bidiot\b`}, Action: ModerationBlock},
+			{Name: "dating", Keywords: []string{"Girlfriend"}, Action: ModerationReplace, Reply: "That's private!"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return moderation
+}
+
+func TestModerate(t *testing.T) {
+	moderation := newTestModeration(t)
+	persona := &Persona{Name: "eden", ForbiddenTopics: []string{"politics"}}
+
+	tests := []struct {
+		stage  string
+		text   string
+		want   string
+		action string
+	}{
+		{ModerationInput, "hello there", "hello there", ""},
+		{ModerationInput, "call me at 0912-345-678 or mail fan@example.com", "call me at [redacted] or mail [redacted]", ModerationRedact},
+		{ModerationInput, "my ID is A123456789", "my ID is [redacted]", ModerationRedact},
+		{ModerationInput, "you idiot", "", ModerationBlock},
+		{ModerationOutput, "you idiot", "you idiot", ""},
+		{ModerationInput, "do you have a girlfriend? 0912345678", "That's private!", ModerationReplace},
+		{ModerationInput, "what about politics", "what about politics", ""},
+		{ModerationOutput, "I think politics is", "Let's talk about music!", ModerationReplace},
+	}
+	for _, test := range tests {
+		result := moderation.Moderate(test.stage, test.text, persona)
+		if result.Text != test.want {
+			t.Errorf("Moderate(%s, %q) = %q, expected %q", test.stage, test.text, result.Text, test.want)
+		}
+		action := ""
+		if result.Decision != nil {
+			action = result.Decision.Action
+		}
+		if action != test.action {
+			t.Errorf("Moderate(%s, %q) took action %q, expected %q", test.stage, test.text, action, test.action)
+		}
+	}
+
+	if result := moderation.Moderate(ModerationInput, "you idiot", persona); !result.Blocked() || result.Decision.Rules[0] != "slurs" {
+		t.Errorf("Expected the message to be blocked by slurs, got %+v", result.Decision)
+	}
+}
+
+func TestModerationInvalidRules(t *testing.T) {
+	rules := []ModerationRule{
+		{Keywords: []string{"x"}, Action: "delete"},
+		{Keywords: []string{"x"}, Action: ModerationBlock, Stages: []string{"title"}},
+		{Patterns: []string{"("}, Action: ModerationBlock},
+		{Detectors: []string{"credit_card"}, Action: ModerationRedact},
+		{Action: ModerationBlock},
+	}
+	for _, rule := range rules {
+		if _, err := NewModerationService(ModerationPolicy{Rules: []ModerationRule{rule}}); err == nil {
+			t.Errorf("Expected rule %+v to be refused", rule)
+		}
+	}
+}
+
+func TestModerationFilter(t *testing.T) {
+	moderation := newTestModeration(t)
+	persona := &Persona{Name: "eden"}
+
+	var passed []string
+	filter := NewModerationFilter(moderation, persona, func(text string) error {
+		passed = append(passed, text)
+		return nil
+	})
+	for _, delta := range []string{"Mail me at fan@", "example.com. Sure", "! My girlfriend is", " great. Bye."} {
+		if err := filter.Write(delta); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := filter.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(passed, ""); got != "Mail me at [redacted]. Sure!" || !filter.Held() {
+		t.Errorf("Expected the reply to be held back from the replaced sentence, got %q", got)
+	}
+
+	// Without rules for replies deltas are passed on as they come
+	passed = nil
+	unmoderated, _ := NewModerationService(ModerationPolicy{})
+	filter = NewModerationFilter(unmoderated, persona, func(text string) error {
+		passed = append(passed, text)
+		return nil
+	})
+	filter.Write("Hel")
+	filter.Write("lo")
+	if len(passed) != 2 {
+		t.Errorf("Expected deltas to be passed on unchanged, got %q", passed)
+	}
+}
@@ -0,0 +1,309 @@
+package models
+
+import (
+	"backend/config"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultSpeakerName and defaultTTSModelID are the voice of personas that
+// don't name one.
+const (
+	defaultSpeakerName = "max"
+	defaultTTSModelID  = 1
+)
+
+// ErrPersonaNotFound is returned when asking for a persona that isn't
+// defined.
+var ErrPersonaNotFound = errors.New("persona not found")
+
+// builtinPersonas are the personas shipped with the server. Files in the
+// persona directory are loaded on top of them.
+//
+//go:embed personas/*.yaml
+var builtinPersonas embed.FS
+
+// Persona is a character the idol plays: how the LLM is prompted and which
+// voice speaks the replies. TTSProvider names the TTS provider of the voice,
+// the default provider if empty. The sampling parameters and Guardrail
+// replace those of the LLM provider when set. Personas are read from YAML
+// or JSON files.
+type Persona struct {
+	Name            string `json:"name" yaml:"name"`
+	SystemPrompt    string `json:"system_prompt" yaml:"system_prompt"`
+	SpeakerName     string `json:"speaker_name" yaml:"speaker_name"`
+	TTSProvider     string `json:"tts_provider,omitempty" yaml:"tts_provider"`
+	ModelID         int    `json:"model_id" yaml:"model_id"`
+	InferenceConfig `yaml:",inline"`
+	Guardrail       *Guardrail `json:"guardrail,omitempty" yaml:"guardrail"`
+	Greeting        string     `json:"greeting" yaml:"greeting"`
+	ForbiddenTopics []string   `json:"forbidden_topics" yaml:"forbidden_topics"`
+}
+
+// ChatOptions returns the options for generating a reply as p.
+func (p *Persona) ChatOptions() ChatOptions {
+	return ChatOptions{
+		System:          p.Prompt(),
+		InferenceConfig: p.InferenceConfig,
+		Guardrail:       p.Guardrail,
+	}
+}
+
+// Prompt returns the system prompt of p including the instruction to stay
+// away from its forbidden topics.
+func (p *Persona) Prompt() string {
+	if len(p.ForbiddenTopics) == 0 {
+		return p.SystemPrompt
+	}
+	return fmt.Sprintf("%s\n\nNever talk about the following topics. If the user brings one up, politely change the subject: %s.",
+		strings.TrimRight(p.SystemPrompt, "\n"), strings.Join(p.ForbiddenTopics, ", "))
+}
+
+// validate fills in the default voice and checks the required fields.
+func (p *Persona) validate() error {
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name == "" {
+		return fmt.Errorf("persona has no name")
+	}
+	if strings.TrimSpace(p.SystemPrompt) == "" {
+		return fmt.Errorf("persona %s has no system_prompt", p.Name)
+	}
+	if err := p.InferenceConfig.Validate(); err != nil {
+		return fmt.Errorf("persona %s: %w", p.Name, err)
+	}
+	if p.Guardrail != nil && p.Guardrail.ID == "" {
+		return fmt.Errorf("persona %s has a guardrail without id", p.Name)
+	}
+	if p.ModelID < 0 {
+		return fmt.Errorf("persona %s has a negative model_id", p.Name)
+	}
+	if p.SpeakerName == "" {
+		p.SpeakerName = defaultSpeakerName
+	}
+	if p.ModelID == 0 {
+		p.ModelID = defaultTTSModelID
+	}
+	return nil
+}
+
+type PersonaService interface {
+	Persona(name string) (*Persona, error)
+	Personas() []Persona
+}
+
+// PersonaRegistry holds the personas by name. The built-in personas are
+// always loaded; personas read from dir add to or replace them. Reload
+// swaps in a new set only if every file in dir is valid, so a broken edit
+// keeps the previous personas in place.
+type PersonaRegistry struct {
+	dir         string
+	defaultName string
+
+	mu          sync.RWMutex
+	personas    map[string]Persona
+	fingerprint string
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewPersonaRegistry returns a registry with the built-in personas and the
+// personas in dir, which may be empty. Persona("") resolves to defaultName.
+func NewPersonaRegistry(dir, defaultName string) (*PersonaRegistry, error) {
+	registry := &PersonaRegistry{dir: dir, defaultName: defaultName, stop: make(chan struct{})}
+	if err := registry.Reload(); err != nil {
+		return nil, err
+	}
+	return registry, nil
+}
+
+// NewPersonaRegistryFromConfig loads the personas in cfg.Dir with
+// cfg.Default as the default. The directory is checked for changes every
+// cfg.ReloadSeconds; 0 turns hot reloading off.
+func NewPersonaRegistryFromConfig(cfg config.Personas) (*PersonaRegistry, error) {
+	registry, err := NewPersonaRegistry(cfg.Dir, cfg.Default)
+	if err != nil {
+		return nil, err
+	}
+
+	if registry.dir != "" && cfg.ReloadSeconds > 0 {
+		go registry.watch(time.Duration(cfg.ReloadSeconds) * time.Second)
+	}
+	return registry, nil
+}
+
+// Persona returns the persona called name, or the default persona for an
+// empty name.
+func (r *PersonaRegistry) Persona(name string) (*Persona, error) {
+	if name == "" {
+		name = r.defaultName
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	persona, ok := r.personas[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrPersonaNotFound, name)
+	}
+	return &persona, nil
+}
+
+// Personas returns all personas ordered by name.
+func (r *PersonaRegistry) Personas() []Persona {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	personas := make([]Persona, 0, len(r.personas))
+	for _, persona := range r.personas {
+		personas = append(personas, persona)
+	}
+	sort.Slice(personas, func(i, j int) bool {
+		return personas[i].Name < personas[j].Name
+	})
+	return personas
+}
+
+// Reload reads all personas again.
+func (r *PersonaRegistry) Reload() error {
+	personas := map[string]Persona{}
+	if err := loadPersonas(builtinPersonas, "personas", personas); err != nil {
+		return fmt.Errorf("loading built-in personas: %w", err)
+	}
+
+	fingerprint := ""
+	if r.dir != "" {
+		var err error
+		if fingerprint, err = personaDirFingerprint(r.dir); err != nil {
+			return err
+		}
+		if err := loadPersonas(os.DirFS(r.dir), ".", personas); err != nil {
+			return err
+		}
+	}
+	if _, ok := personas[r.defaultName]; !ok {
+		return fmt.Errorf("default persona %q is not defined", r.defaultName)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.personas = personas
+	r.fingerprint = fingerprint
+	return nil
+}
+
+// Close stops watching the persona directory for changes.
+func (r *PersonaRegistry) Close() {
+	r.stopOnce.Do(func() { close(r.stop) })
+}
+
+// watch reloads the personas whenever the files in the directory change,
+// until the registry is closed.
+func (r *PersonaRegistry) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.stop:
+			return
+		}
+
+		fingerprint, err := personaDirFingerprint(r.dir)
+		if err != nil {
+			slog.Error("Failed to check persona directory", "dir", r.dir, "error", err)
+			continue
+		}
+
+		r.mu.RLock()
+		changed := fingerprint != r.fingerprint
+		r.mu.RUnlock()
+		if !changed {
+			continue
+		}
+
+		if err := r.Reload(); err != nil {
+			slog.Error("Keeping the previous personas, reloading failed", "dir", r.dir, "error", err)
+			// Don't retry until the files change again
+			r.mu.Lock()
+			r.fingerprint = fingerprint
+			r.mu.Unlock()
+			continue
+		}
+		slog.Info("Reloaded personas", "dir", r.dir)
+	}
+}
+
+// loadPersonas adds every persona file in dir of fsys to personas.
+func loadPersonas(fsys fs.FS, dir string, personas map[string]Persona) error {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !isPersonaFile(entry.Name()) {
+			continue
+		}
+
+		name := path.Join(dir, entry.Name())
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+
+		var persona Persona
+		if path.Ext(name) == ".json" {
+			err = json.Unmarshal(data, &persona)
+		} else {
+			err = yaml.Unmarshal(data, &persona)
+		}
+		if err != nil {
+			return fmt.Errorf("parsing persona file %s: %w", entry.Name(), err)
+		}
+		if err := persona.validate(); err != nil {
+			return fmt.Errorf("persona file %s: %w", entry.Name(), err)
+		}
+		personas[persona.Name] = persona
+	}
+	return nil
+}
+
+// personaDirFingerprint sums up the names, sizes and modification times of
+// the persona files in dir.
+func personaDirFingerprint(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var fingerprint strings.Builder
+	for _, entry := range entries {
+		if entry.IsDir() || !isPersonaFile(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&fingerprint, "%s:%d:%d;", entry.Name(), info.Size(), info.ModTime().UnixNano())
+	}
+	return fingerprint.String(), nil
+}
+
+func isPersonaFile(name string) bool {
+	switch filepath.Ext(name) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package models
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writePersona(t *testing.T, dir, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write persona file: %v", err)
+	}
+}
+
+func TestPersonaRegistryLoadsFiles(t *testing.T) {
+	dir := t.TempDir()
+	writePersona(t, dir, "luna.yaml", `
+name: luna
+system_prompt: You are Luna.
+temperature: 0.3
+max_tokens: 200
+stop_sequences: ["END"]
+guardrail:
+  id: idol-safety
+  version: "3"
+forbidden_topics: [politics, religion]
+`)
+	writePersona(t, dir, "sol.json", `{"name": "sol", "system_prompt": "You are Sol.", "speaker_name": "sol", "model_id": 2}`)
+	writePersona(t, dir, "notes.txt", "not a persona")
+
+	registry, err := NewPersonaRegistry(dir, "eden")
+	if err != nil {
+		t.Fatalf("NewPersonaRegistry failed: %v", err)
+	}
+
+	if names := len(registry.Personas()); names != 3 {
+		t.Fatalf("Expected eden, luna and sol, got %d personas", names)
+	}
+
+	eden, err := registry.Persona("")
+	if err != nil || eden.Name != "eden" || !strings.Contains(eden.SystemPrompt, "Eden-chan") {
+		t.Fatalf("Expected the built-in default persona, got %+v, %v", eden, err)
+	}
+
+	luna, err := registry.Persona("luna")
+	if err != nil {
+		t.Fatalf("Persona failed: %v", err)
+	}
+	if luna.SpeakerName != defaultSpeakerName || luna.ModelID != defaultTTSModelID {
+		t.Fatalf("Expected the default voice, got %s/%d", luna.SpeakerName, luna.ModelID)
+	}
+	opts := luna.ChatOptions()
+	if opts.Temperature == nil || *opts.Temperature != 0.3 || !strings.Contains(opts.System, "politics, religion") {
+		t.Fatalf("Unexpected chat options %+v", opts)
+	}
+	if opts.MaxTokens != 200 || opts.StopSequences[0] != "END" || opts.Guardrail == nil || *opts.Guardrail != (Guardrail{ID: "idol-safety", Version: "3"}) {
+		t.Fatalf("Unexpected inference options %+v", opts)
+	}
+
+	sol, err := registry.Persona("sol")
+	if err != nil || sol.SpeakerName != "sol" || sol.ModelID != 2 {
+		t.Fatalf("Unexpected persona %+v, %v", sol, err)
+	}
+
+	if _, err := registry.Persona("nobody"); !errors.Is(err, ErrPersonaNotFound) {
+		t.Fatalf("Expected ErrPersonaNotFound, got %v", err)
+	}
+}
+
+func TestPersonaRegistryReloadKeepsPersonasOnError(t *testing.T) {
+	dir := t.TempDir()
+	writePersona(t, dir, "luna.yaml", "name: luna\nsystem_prompt: You are Luna.\n")
+	registry, err := NewPersonaRegistry(dir, "luna")
+	if err != nil {
+		t.Fatalf("NewPersonaRegistry failed: %v", err)
+	}
+
+	writePersona(t, dir, "luna.yaml", "name: luna\nsystem_prompt: You are Luna, now reloaded.\n")
+	if err := registry.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	luna, _ := registry.Persona("")
+	if luna.SystemPrompt != "You are Luna, now reloaded." {
+		t.Fatalf("Expected the reloaded prompt, got %q", luna.SystemPrompt)
+	}
+
+	writePersona(t, dir, "broken.yaml", "name: broken\n")
+	if err := registry.Reload(); err == nil {
+		t.Fatal("Expected a persona without prompt to fail the reload")
+	}
+	if _, err := registry.Persona("luna"); err != nil {
+		t.Fatalf("Expected the previous personas to stay, got %v", err)
+	}
+}
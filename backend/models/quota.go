@@ -0,0 +1,254 @@
+package models
+
+import (
+	"backend/config"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrRateLimited is returned when a user or client sent more requests
+	// than allowed per minute.
+	ErrRateLimited = errors.New("too many requests")
+	// ErrTokenQuotaExceeded is returned when a user spent the daily token
+	// budget.
+	ErrTokenQuotaExceeded = errors.New("daily token quota exceeded")
+)
+
+// Names of the counters of the QuotaService.
+const (
+	counterRequests     = "requests"
+	counterInputTokens  = "input_tokens"
+	counterOutputTokens = "output_tokens"
+)
+
+// QuotaStatus is the state of one limit: the Limit, what Remains of it
+// until it is Reset. A Limit of 0 means unlimited.
+type QuotaStatus struct {
+	Limit     int64
+	Remaining int64
+	Reset     time.Time
+}
+
+// TokenQuotaStatus is the state of the daily token budgets of a user.
+type TokenQuotaStatus struct {
+	Input  QuotaStatus
+	Output QuotaStatus
+}
+
+// QuotaService limits how often clients call the API and how many LLM
+// tokens users spend a day.
+type QuotaService interface {
+	// CountRequest counts a request of key, a user or a client address,
+	// and fails with ErrRateLimited once the requests of the current
+	// minute exceed the limit.
+	CountRequest(ctx context.Context, key string) (*QuotaStatus, error)
+	// TokenQuota returns the daily token budgets of a user and fails with
+	// ErrTokenQuotaExceeded once one is spent.
+	TokenQuota(ctx context.Context, userID string) (*TokenQuotaStatus, error)
+	// ChargeTokens adds the tokens of a reply to the daily budgets of a
+	// user.
+	ChargeTokens(ctx context.Context, userID string, usage TokenUsage) error
+}
+
+// QuotaLimits are the limits of a QuotaService; 0 turns a limit off.
+type QuotaLimits struct {
+	RequestsPerMinute int64
+	DailyInputTokens  int64
+	DailyOutputTokens int64
+}
+
+// QuotaLimitsFromConfig returns the limits set in cfg.
+func QuotaLimitsFromConfig(cfg config.Quota) QuotaLimits {
+	return QuotaLimits{
+		RequestsPerMinute: cfg.RequestsPerMinute,
+		DailyInputTokens:  cfg.DailyInputTokens,
+		DailyOutputTokens: cfg.DailyOutputTokens,
+	}
+}
+
+// CounterStore keeps counters that expire, grouped under a key.
+type CounterStore interface {
+	// Add adds deltas to the counters of key, creating them at 0 and
+	// keeping them until expires, and returns all counters of key.
+	Add(ctx context.Context, key string, deltas map[string]int64, expires time.Time) (map[string]int64, error)
+	// Get returns the counters of key, none if they don't exist.
+	Get(ctx context.Context, key string) (map[string]int64, error)
+}
+
+// NewCounterStoreFromConfig opens the counter store selected by cfg.Store:
+//
+//	memory:   process memory, every server counts on its own
+//	dynamodb: table cfg.Table
+func NewCounterStoreFromConfig(cfg config.Quota) (CounterStore, error) {
+	switch cfg.Store {
+	case StoreMemory:
+		return NewMemoryCounterStore(), nil
+	case StoreDynamoDB:
+		return NewDynamoDBCounterStore(cfg.Table)
+	default:
+		return nil, fmt.Errorf("unknown quota store %q", cfg.Store)
+	}
+}
+
+// quotaService counts requests in fixed one minute windows and tokens per
+// UTC day. Counting is best effort: when the store fails, requests are let
+// through rather than refused.
+type quotaService struct {
+	store  CounterStore
+	limits QuotaLimits
+	now    func() time.Time
+}
+
+// NewQuotaService returns a QuotaService keeping its counters in store.
+func NewQuotaService(store CounterStore, limits QuotaLimits) QuotaService {
+	return &quotaService{store: store, limits: limits, now: time.Now}
+}
+
+// NewQuotaServiceFromConfig returns the QuotaService configured in cfg.
+func NewQuotaServiceFromConfig(cfg config.Quota) (QuotaService, error) {
+	store, err := NewCounterStoreFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return NewQuotaService(store, QuotaLimitsFromConfig(cfg)), nil
+}
+
+func (q *quotaService) CountRequest(ctx context.Context, key string) (*QuotaStatus, error) {
+	status := &QuotaStatus{Limit: q.limits.RequestsPerMinute}
+	if status.Limit <= 0 {
+		return status, nil
+	}
+	now := q.now().UTC()
+	window := now.Truncate(time.Minute)
+	status.Reset = window.Add(time.Minute)
+
+	counters, err := q.store.Add(ctx, "rate#"+key+"#"+window.Format("200601021504"), map[string]int64{counterRequests: 1}, status.Reset)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to count request, letting it through", "key", key, "error", err)
+		status.Remaining = status.Limit
+		return status, nil
+	}
+	status.Remaining = remaining(status.Limit, counters[counterRequests])
+	if counters[counterRequests] > status.Limit {
+		return status, ErrRateLimited
+	}
+	return status, nil
+}
+
+func (q *quotaService) TokenQuota(ctx context.Context, userID string) (*TokenQuotaStatus, error) {
+	reset := q.tomorrow()
+	status := &TokenQuotaStatus{
+		Input:  QuotaStatus{Limit: q.limits.DailyInputTokens, Reset: reset},
+		Output: QuotaStatus{Limit: q.limits.DailyOutputTokens, Reset: reset},
+	}
+	if status.Input.Limit <= 0 && status.Output.Limit <= 0 {
+		return status, nil
+	}
+
+	counters, err := q.store.Get(ctx, q.tokenKey(userID))
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to read token quota, letting it through", "user_id", userID, "error", err)
+		counters = nil
+	}
+	status.Input.Remaining = remaining(status.Input.Limit, counters[counterInputTokens])
+	status.Output.Remaining = remaining(status.Output.Limit, counters[counterOutputTokens])
+	if (status.Input.Limit > 0 && status.Input.Remaining == 0) || (status.Output.Limit > 0 && status.Output.Remaining == 0) {
+		return status, ErrTokenQuotaExceeded
+	}
+	return status, nil
+}
+
+func (q *quotaService) ChargeTokens(ctx context.Context, userID string, usage TokenUsage) error {
+	if q.limits.DailyInputTokens <= 0 && q.limits.DailyOutputTokens <= 0 {
+		return nil
+	}
+	_, err := q.store.Add(ctx, q.tokenKey(userID), map[string]int64{
+		counterInputTokens:  int64(usage.InputTokens),
+		counterOutputTokens: int64(usage.OutputTokens),
+	}, q.tomorrow().Add(24*time.Hour))
+	return err
+}
+
+// tokenKey is the key of the token counters of a user today.
+func (q *quotaService) tokenKey(userID string) string {
+	return "tokens#" + userID + "#" + q.now().UTC().Format("20060102")
+}
+
+// tomorrow returns the start of the next UTC day, when token budgets reset.
+func (q *quotaService) tomorrow() time.Time {
+	now := q.now().UTC()
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+}
+
+func remaining(limit, used int64) int64 {
+	if limit <= 0 || used >= limit {
+		return 0
+	}
+	return limit - used
+}
+
+// memoryCounterStore keeps counters in process memory.
+type memoryCounterStore struct {
+	mu       sync.Mutex
+	counters map[string]*memoryCounters
+	added    int
+}
+
+type memoryCounters struct {
+	values  map[string]int64
+	expires time.Time
+}
+
+// NewMemoryCounterStore returns a CounterStore in process memory, for a
+// single server and tests.
+func NewMemoryCounterStore() CounterStore {
+	return &memoryCounterStore{counters: map[string]*memoryCounters{}}
+}
+
+func (m *memoryCounterStore) Add(ctx context.Context, key string, deltas map[string]int64, expires time.Time) (map[string]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	// Forget expired counters now and then
+	if m.added++; m.added%1000 == 0 {
+		for k, counters := range m.counters {
+			if now.After(counters.expires) {
+				delete(m.counters, k)
+			}
+		}
+	}
+
+	counters, ok := m.counters[key]
+	if !ok || now.After(counters.expires) {
+		counters = &memoryCounters{values: map[string]int64{}}
+		m.counters[key] = counters
+	}
+	counters.expires = expires
+	for name, delta := range deltas {
+		counters.values[name] += delta
+	}
+	return copyCounters(counters.values), nil
+}
+
+func (m *memoryCounterStore) Get(ctx context.Context, key string) (map[string]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counters, ok := m.counters[key]
+	if !ok || time.Now().After(counters.expires) {
+		return map[string]int64{}, nil
+	}
+	return copyCounters(counters.values), nil
+}
+
+func copyCounters(values map[string]int64) map[string]int64 {
+	copied := make(map[string]int64, len(values))
+	for name, value := range values {
+		copied[name] = value
+	}
+	return copied
+}
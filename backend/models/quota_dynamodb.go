@@ -0,0 +1,157 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Attributes of the counter items besides the counters themselves.
+const (
+	counterKeyAttribute     = "pk"
+	counterExpiresAttribute = "expires_at"
+)
+
+// dynamoDBCounterStore keeps counters in a DynamoDB table with partition
+// key pk, one item per key and one number attribute per counter. Items
+// carry their expiry in expires_at, meant to be the TTL attribute of the
+// table; as DynamoDB deletes expired items late, they are ignored once
+// expired.
+type dynamoDBCounterStore struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+// NewDynamoDBCounterStore returns a CounterStore in the DynamoDB table
+// tableName, shared by all servers.
+func NewDynamoDBCounterStore(tableName string) (CounterStore, error) {
+	client, err := GetDynamoDBClient()
+	if err != nil {
+		return nil, err
+	}
+	return &dynamoDBCounterStore{client: client, tableName: tableName}, nil
+}
+
+// Add increments all counters of key in one UpdateItem. The update is
+// refused for an expired item that wasn't deleted yet, which is then
+// deleted before trying again.
+func (d *dynamoDBCounterStore) Add(ctx context.Context, key string, deltas map[string]int64, expires time.Time) (map[string]int64, error) {
+	counters, err := d.add(ctx, key, deltas, expires)
+	if isConditionalCheckFailed(err) {
+		if err := d.reset(ctx, key); err != nil {
+			return nil, err
+		}
+		counters, err = d.add(ctx, key, deltas, expires)
+	}
+	return counters, err
+}
+
+func (d *dynamoDBCounterStore) add(ctx context.Context, key string, deltas map[string]int64, expires time.Time) (map[string]int64, error) {
+	names := make([]string, 0, len(deltas))
+	for name := range deltas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	attributeNames := map[string]string{"#expires": counterExpiresAttribute}
+	values := map[string]types.AttributeValue{
+		":expires": &types.AttributeValueMemberN{Value: strconv.FormatInt(expires.Unix(), 10)},
+		":now":     &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+	}
+	adds := make([]string, 0, len(names))
+	for i, name := range names {
+		attributeNames[fmt.Sprintf("#c%d", i)] = name
+		values[fmt.Sprintf(":c%d", i)] = &types.AttributeValueMemberN{Value: strconv.FormatInt(deltas[name], 10)}
+		adds = append(adds, fmt.Sprintf("#c%d :c%d", i, i))
+	}
+	update := "SET #expires = :expires"
+	if len(adds) > 0 {
+		update += " ADD " + strings.Join(adds, ", ")
+	}
+
+	result, err := d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(d.tableName),
+		Key:                       counterKey(key),
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String("attribute_not_exists(#expires) OR #expires >= :now"),
+		ExpressionAttributeNames:  attributeNames,
+		ExpressionAttributeValues: values,
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+	if err != nil {
+		return nil, err
+	}
+	counters, _ := counterValues(result.Attributes)
+	return counters, nil
+}
+
+// reset deletes the item of key if it expired.
+func (d *dynamoDBCounterStore) reset(ctx context.Context, key string) error {
+	_, err := d.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:           aws.String(d.tableName),
+		Key:                 counterKey(key),
+		ConditionExpression: aws.String("#expires < :now"),
+		ExpressionAttributeNames: map[string]string{
+			"#expires": counterExpiresAttribute,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+		},
+	})
+	if isConditionalCheckFailed(err) {
+		return nil
+	}
+	return err
+}
+
+func (d *dynamoDBCounterStore) Get(ctx context.Context, key string) (map[string]int64, error) {
+	result, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.tableName),
+		Key:            counterKey(key),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	counters, live := counterValues(result.Item)
+	if !live {
+		return map[string]int64{}, nil
+	}
+	return counters, nil
+}
+
+func counterKey(key string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		counterKeyAttribute: &types.AttributeValueMemberS{Value: key},
+	}
+}
+
+// counterValues returns the counters of an item and whether it hasn't
+// expired yet.
+func counterValues(item map[string]types.AttributeValue) (map[string]int64, bool) {
+	counters := map[string]int64{}
+	live := item != nil
+	for name, value := range item {
+		number, ok := value.(*types.AttributeValueMemberN)
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(number.Value, 10, 64)
+		if err != nil {
+			continue
+		}
+		if name == counterExpiresAttribute {
+			live = time.Now().Unix() <= n
+			continue
+		}
+		counters[name] = n
+	}
+	return counters, live
+}
@@ -0,0 +1,105 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestQuotaServiceRateLimit(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Minute)
+	quotas := &quotaService{store: NewMemoryCounterStore(), limits: QuotaLimits{RequestsPerMinute: 2}, now: func() time.Time { return now }}
+
+	for i := int64(1); i <= 2; i++ {
+		status, err := quotas.CountRequest(context.Background(), "user:fan")
+		if err != nil {
+			t.Fatalf("Request %d: unexpected error %v", i, err)
+		}
+		if status.Remaining != 2-i || !status.Reset.Equal(now.Add(time.Minute)) {
+			t.Fatalf("Request %d: unexpected status %+v", i, status)
+		}
+	}
+	if _, err := quotas.CountRequest(context.Background(), "user:fan"); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("Expected ErrRateLimited, got %v", err)
+	}
+	if _, err := quotas.CountRequest(context.Background(), "user:idol"); err != nil {
+		t.Fatalf("Expected other users to be counted on their own, got %v", err)
+	}
+
+	now = now.Add(time.Minute)
+	if _, err := quotas.CountRequest(context.Background(), "user:fan"); err != nil {
+		t.Fatalf("Expected the limit to reset the next minute, got %v", err)
+	}
+}
+
+func TestQuotaServiceTokens(t *testing.T) {
+	now := time.Now().UTC()
+	quotas := &quotaService{store: NewMemoryCounterStore(), limits: QuotaLimits{DailyInputTokens: 100, DailyOutputTokens: 50}, now: func() time.Time { return now }}
+
+	if err := quotas.ChargeTokens(context.Background(), "fan", TokenUsage{InputTokens: 60, OutputTokens: 20}); err != nil {
+		t.Fatal(err)
+	}
+	status, err := quotas.TokenQuota(context.Background(), "fan")
+	if err != nil {
+		t.Fatalf("Expected budget left, got %v", err)
+	}
+	if status.Input.Remaining != 40 || status.Output.Remaining != 30 {
+		t.Fatalf("Unexpected remaining tokens %+v", status)
+	}
+
+	// Spending one budget is enough to be refused
+	if err := quotas.ChargeTokens(context.Background(), "fan", TokenUsage{InputTokens: 10, OutputTokens: 40}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := quotas.TokenQuota(context.Background(), "fan"); !errors.Is(err, ErrTokenQuotaExceeded) {
+		t.Fatalf("Expected ErrTokenQuotaExceeded, got %v", err)
+	}
+
+	now = now.Add(24 * time.Hour)
+	if status, err := quotas.TokenQuota(context.Background(), "fan"); err != nil || status.Output.Remaining != 50 {
+		t.Fatalf("Expected the budgets to reset the next day, got %+v, %v", status, err)
+	}
+}
+
+func TestQuotaServiceUnlimited(t *testing.T) {
+	quotas := NewQuotaService(NewMemoryCounterStore(), QuotaLimits{})
+	for i := 0; i < 100; i++ {
+		if _, err := quotas.CountRequest(context.Background(), "ip:127.0.0.1"); err != nil {
+			t.Fatalf("Expected no rate limit, got %v", err)
+		}
+	}
+	if err := quotas.ChargeTokens(context.Background(), "fan", TokenUsage{InputTokens: 1 << 20}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := quotas.TokenQuota(context.Background(), "fan"); err != nil {
+		t.Fatalf("Expected no token quota, got %v", err)
+	}
+}
+
+// hangingCounterStore answers once ctx is done.
+type hangingCounterStore struct{}
+
+func (hangingCounterStore) Add(ctx context.Context, key string, deltas map[string]int64, expires time.Time) (map[string]int64, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (hangingCounterStore) Get(ctx context.Context, key string) (map[string]int64, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestQuotaServiceLetsRequestsThroughWhenStoreHangs(t *testing.T) {
+	quotas := NewQuotaService(hangingCounterStore{}, QuotaLimits{RequestsPerMinute: 2, DailyOutputTokens: 100})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	status, err := quotas.CountRequest(ctx, "user:fan")
+	if err != nil || status.Remaining != 2 {
+		t.Fatalf("Expected the request to be let through, got %+v, %v", status, err)
+	}
+	if _, err := quotas.TokenQuota(ctx, "fan"); err != nil {
+		t.Fatalf("Expected the token quota to be let through, got %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+package models
+
+import (
+	"strings"
+	"unicode"
+)
+
+// clauseBreaks are where sentences longer than SentenceSplitter.MaxRunes
+// are preferably cut.
+const clauseBreaks = "，、；：,;:"
+
+// SentenceSplitter cuts text arriving in pieces, like the deltas of a
+// streamed reply, into sentences as soon as they are complete. Closing
+// quotes and brackets, repeated punctuation and emoji following the end of
+// a sentence stay with it. If MaxRunes is set, longer sentences are cut at
+// clause punctuation or spaces, so every sentence fits into one TTS
+// request.
+type SentenceSplitter struct {
+	MaxRunes int
+	pending  []rune
+}
+
+// SplitSentences cuts a complete text into sentences of at most maxRunes,
+// or of any length if maxRunes is not positive.
+func SplitSentences(text string, maxRunes int) []string {
+	splitter := SentenceSplitter{MaxRunes: maxRunes}
+	return append(splitter.Write(text), splitter.Flush()...)
+}
+
+// Write adds text and returns the sentences it completed.
+func (s *SentenceSplitter) Write(text string) []string {
+	s.pending = append(s.pending, []rune(text)...)
+
+	var sentences []string
+	start := 0
+	for i := 0; i < len(s.pending); i++ {
+		end := sentenceEnd(s.pending, i)
+		if end < 0 {
+			// Wait for what follows the punctuation
+			break
+		}
+		if end == 0 {
+			continue
+		}
+		sentences = append(sentences, s.cut(s.pending[start:end])...)
+		start = end
+		i = end - 1
+	}
+
+	// A sentence too long for one request needn't wait for its end
+	for s.MaxRunes > 0 && len(s.pending)-start > s.MaxRunes {
+		n := cutIndex(s.pending[start:], s.MaxRunes)
+		if sentence := strings.TrimSpace(string(s.pending[start : start+n])); sentence != "" {
+			sentences = append(sentences, sentence)
+		}
+		start += n
+	}
+
+	s.pending = append([]rune{}, s.pending[start:]...)
+	return sentences
+}
+
+// Flush returns the text after the last complete sentence, if any.
+func (s *SentenceSplitter) Flush() []string {
+	rest := s.cut(s.pending)
+	s.pending = nil
+	return rest
+}
+
+// cut trims a sentence and splits it into pieces of at most MaxRunes.
+func (s *SentenceSplitter) cut(sentence []rune) []string {
+	var pieces []string
+	for s.MaxRunes > 0 && len(sentence) > s.MaxRunes {
+		n := cutIndex(sentence, s.MaxRunes)
+		if piece := strings.TrimSpace(string(sentence[:n])); piece != "" {
+			pieces = append(pieces, piece)
+		}
+		sentence = sentence[n:]
+	}
+	if piece := strings.TrimSpace(string(sentence)); piece != "" {
+		pieces = append(pieces, piece)
+	}
+	return pieces
+}
+
+// cutIndex returns where to cut text to get a piece of at most max runes:
+// after the last clause punctuation, else after the last space in the
+// second half of the piece, else right at max.
+func cutIndex(text []rune, max int) int {
+	for i := max - 1; i >= max/2; i-- {
+		if strings.ContainsRune(clauseBreaks, text[i]) {
+			return i + 1
+		}
+	}
+	for i := max - 1; i >= max/2; i-- {
+		if unicode.IsSpace(text[i]) {
+			return i + 1
+		}
+	}
+	return max
+}
+
+// sentenceEnd checks whether the rune at i ends a sentence. It returns the
+// index after the sentence including its tail, 0 if the sentence goes on,
+// or -1 if that depends on text that hasn't arrived yet. Full-width
+// punctuation always ends a sentence; ASCII punctuation only when followed
+// by white space, so numbers like 3.14 stay whole.
+func sentenceEnd(text []rune, i int) int {
+	fullWidth := strings.ContainsRune("。！？\n", text[i])
+	if !fullWidth && !strings.ContainsRune(".!?", text[i]) {
+		return 0
+	}
+	end := i + 1
+	for end < len(text) {
+		if isSentenceTail(text[end]) {
+			end++
+			continue
+		}
+		// An emoji after a space still belongs to the sentence
+		if unicode.IsSpace(text[end]) {
+			next := end + 1
+			for next < len(text) && unicode.IsSpace(text[next]) {
+				next++
+			}
+			if next == len(text) {
+				return -1
+			}
+			if isEmoji(text[next]) {
+				end = next
+				continue
+			}
+		}
+		break
+	}
+	if end == len(text) {
+		return -1
+	}
+	if fullWidth || unicode.IsSpace(text[end]) {
+		return end
+	}
+	return 0
+}
+
+// isSentenceTail reports whether r, following the end of a sentence, still
+// belongs to it.
+func isSentenceTail(r rune) bool {
+	return strings.ContainsRune("。！？.!?…~～\"'”’」』）)】》]", r) || isEmoji(r)
+}
+
+// isEmoji reports whether r is part of an emoji, including the joiners,
+// variation selectors and skin tones that combine them.
+func isEmoji(r rune) bool {
+	switch {
+	case r >= 0x1F000: // emoji, pictographs, flags and skin tones
+		return r <= 0x1FAFF
+	case r >= 0x2600 && r <= 0x27BF, r >= 0x2B00 && r <= 0x2BFF: // symbols and dingbats
+		return true
+	case r >= 0xFE00 && r <= 0xFE0F, r == 0x200D, r == 0x20E3:
+		return true
+	}
+	return false
+}
+
+// SpeakableText returns the part of a sentence to send to TTS: without
+// emoji and markdown markers, or empty if nothing is left to say.
+func SpeakableText(sentence string) string {
+	var text strings.Builder
+	speakable := false
+	for _, r := range sentence {
+		if isEmoji(r) || strings.ContainsRune("*#`", r) {
+			continue
+		}
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			speakable = true
+		}
+		text.WriteRune(r)
+	}
+	if !speakable {
+		return ""
+	}
+	return strings.Join(strings.Fields(text.String()), " ")
+}
+
+// SpeechCharacters returns how many characters of text are sent to TTS when
+// it is spoken sentence by sentence.
+func SpeechCharacters(text string) int {
+	characters := 0
+	for _, sentence := range SplitSentences(text, 0) {
+		characters += len([]rune(SpeakableText(sentence)))
+	}
+	return characters
+}
@@ -0,0 +1,176 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// SentenceAudio is the speech of one sentence of a reply. Index orders the
+// sentences that are spoken; those with nothing to say, like a lone emoji,
+// are skipped.
+type SentenceAudio struct {
+	Index    int
+	Text     string
+	AudioURL string
+	Attempts int
+	Err      error
+}
+
+// ReplySpeech is the audio of a whole reply: Playlist has the audio of
+// every sentence in order, AudioURL all of it as one file. AudioURL is
+// empty when the sentences couldn't be joined.
+type ReplySpeech struct {
+	AudioURL string
+	Playlist []string
+}
+
+// SentenceSpeech speaks a reply sentence by sentence while its text is
+// written, so the first sentences can be played before the reply is
+// complete. Write, Flush and Finish must be called from one goroutine.
+type SentenceSpeech struct {
+	queue    *SpeechJobQueue
+	ctx      context.Context
+	modelID  int
+	speaker  string
+	opts     SpeechOptions
+	onAudio  func(audio SentenceAudio)
+	splitter SentenceSplitter
+	slots    chan struct{}
+	pending  sync.WaitGroup
+
+	mu        sync.Mutex
+	sentences []SentenceAudio
+}
+
+// SpeakSentences starts speaking a reply with the voice of modelID and
+// speakerName, at most SpeechJobOptions.SentenceWorkers sentences at once.
+// onAudio, if not nil, is called with every sentence as soon as it is
+// spoken, possibly from several goroutines at once. Sentences are no longer
+// spoken once ctx is done.
+func (q *SpeechJobQueue) SpeakSentences(ctx context.Context, modelID int, speakerName string, opts SpeechOptions, onAudio func(audio SentenceAudio)) *SentenceSpeech {
+	return &SentenceSpeech{
+		queue:    q,
+		ctx:      ctx,
+		modelID:  modelID,
+		speaker:  speakerName,
+		opts:     opts,
+		onAudio:  onAudio,
+		splitter: SentenceSplitter{MaxRunes: q.opts.MaxSentenceRunes},
+		slots:    make(chan struct{}, q.opts.SentenceWorkers),
+	}
+}
+
+// Write adds text of the reply and starts speaking the sentences it
+// completes.
+func (s *SentenceSpeech) Write(text string) {
+	for _, sentence := range s.splitter.Write(text) {
+		s.speak(sentence)
+	}
+}
+
+// Flush starts speaking the text after the last complete sentence, for
+// when the reply is complete but Finish has to wait for the chat to be
+// stored.
+func (s *SentenceSpeech) Flush() {
+	for _, sentence := range s.splitter.Flush() {
+		s.speak(sentence)
+	}
+}
+
+// Count returns the number of sentences being spoken so far.
+func (s *SentenceSpeech) Count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sentences)
+}
+
+// Finish speaks the rest of the text and waits for every sentence. Their
+// audio is joined and saved to the chat chatID of the session, which must
+// have been stored by then. The reply fails with the error of its first
+// failed sentence.
+func (s *SentenceSpeech) Finish(userID, sessionID, chatID string) (*ReplySpeech, error) {
+	s.Flush()
+	s.pending.Wait()
+
+	reply := &ReplySpeech{}
+	for _, sentence := range s.sentences {
+		if sentence.Err != nil {
+			return nil, sentence.Err
+		}
+		reply.Playlist = append(reply.Playlist, sentence.AudioURL)
+	}
+	// The audio is saved even when the reply was cancelled meanwhile
+	ctx, cancel := stageTimeout{stage: StageStorage, timeout: s.queue.opts.StorageTimeout}.context(context.WithoutCancel(s.ctx))
+	defer cancel()
+	switch {
+	case len(reply.Playlist) == 1:
+		reply.AudioURL = reply.Playlist[0]
+	case len(reply.Playlist) > 1 && s.queue.audio != nil:
+		audioURL, err := s.queue.audio.JoinAudio(ctx, reply.Playlist)
+		if err != nil {
+			slog.WarnContext(ctx, "Failed to join the audio of chat, keeping the playlist", "chat_id", chatID, "error", err)
+		}
+		reply.AudioURL = audioURL
+	}
+
+	if err := s.queue.store.SetChatAudio(ctx, userID, sessionID, chatID, reply.AudioURL, reply.Playlist); err != nil {
+		// The audio is still served through the job or the socket
+		slog.ErrorContext(ctx, "Failed to save audio of chat", "chat_id", chatID, "user_id", userID, "error", err)
+	}
+	return reply, nil
+}
+
+func (s *SentenceSpeech) speak(sentence string) {
+	text := SpeakableText(sentence)
+	if text == "" {
+		return
+	}
+	s.mu.Lock()
+	index := len(s.sentences)
+	s.sentences = append(s.sentences, SentenceAudio{Index: index, Text: sentence})
+	s.mu.Unlock()
+
+	s.pending.Add(1)
+	go func() {
+		defer s.pending.Done()
+		audio := SentenceAudio{Index: index, Text: sentence}
+		select {
+		case s.slots <- struct{}{}:
+			audio.AudioURL, audio.Attempts, audio.Err = s.queue.speak(s.ctx, text, s.modelID, s.speaker, s.opts)
+			<-s.slots
+		case <-s.ctx.Done():
+			audio.Err = s.ctx.Err()
+		}
+
+		s.mu.Lock()
+		s.sentences[index] = audio
+		s.mu.Unlock()
+		if s.onAudio != nil && s.ctx.Err() == nil {
+			s.onAudio(audio)
+		}
+	}()
+}
+
+// speak calls the TTS service until it succeeds, the attempts are used up
+// or ctx is done, and returns the audio URL and the number of attempts.
+func (q *SpeechJobQueue) speak(ctx context.Context, text string, modelID int, speakerName string, opts SpeechOptions) (string, int, error) {
+	var audioURL string
+	var err error
+	attempt := 1
+	for ; ; attempt++ {
+		audioURL, err = q.tts.GenerateSpeech(ctx, text, modelID, speakerName, opts)
+		if err == nil || errors.Is(err, ErrSpeechDisabled) || errors.Is(err, ErrInvalidSpeechOptions) || attempt >= q.opts.MaxAttempts {
+			break
+		}
+		slog.WarnContext(ctx, "Speaking failed", "text", text, "attempt", attempt, "error", err)
+		select {
+		case <-time.After(time.Duration(attempt) * q.opts.RetryDelay):
+		case <-ctx.Done():
+			return "", attempt, ctx.Err()
+		}
+	}
+	return audioURL, attempt, err
+}
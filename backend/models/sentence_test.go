@@ -0,0 +1,53 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSentenceSplitter(t *testing.T) {
+	var splitter SentenceSplitter
+	var sentences []string
+	for _, delta := range []string{"你好", "！今天", "天氣很好。Pi is 3.", "14, right? ", "Bye"} {
+		sentences = append(sentences, splitter.Write(delta)...)
+	}
+	sentences = append(sentences, splitter.Flush()...)
+
+	expected := []string{"你好！", "今天天氣很好。", "Pi is 3.14, right?", "Bye"}
+	if !reflect.DeepEqual(sentences, expected) {
+		t.Fatalf("Expected %q, got %q", expected, sentences)
+	}
+}
+
+func TestSplitSentences(t *testing.T) {
+	tests := []struct {
+		text     string
+		maxRunes int
+		expected []string
+	}{
+		{"他說：「好啊！」然後走了。", 0, []string{"他說：「好啊！」", "然後走了。"}},
+		{"真的嗎？？太棒了！😍🎉 謝謝", 0, []string{"真的嗎？？", "太棒了！😍🎉", "謝謝"}},
+		{"Great job! 👍🏻 See you.", 0, []string{"Great job! 👍🏻", "See you."}},
+		{"一二三四五，六七八九十，一二三四五", 6, []string{"一二三四五，", "六七八九十，", "一二三四五"}},
+		{"one two three four", 10, []string{"one two", "three four"}},
+	}
+	for _, test := range tests {
+		if sentences := SplitSentences(test.text, test.maxRunes); !reflect.DeepEqual(sentences, test.expected) {
+			t.Errorf("SplitSentences(%q, %d) = %q, expected %q", test.text, test.maxRunes, sentences, test.expected)
+		}
+	}
+}
+
+func TestSpeakableText(t *testing.T) {
+	tests := map[string]string{
+		"太棒了！😍🎉":            "太棒了！",
+		"**Great**  job 👍🏻": "Great job",
+		"🎉🎉！":               "",
+		"❤️":                "",
+	}
+	for sentence, expected := range tests {
+		if text := SpeakableText(sentence); text != expected {
+			t.Errorf("SpeakableText(%q) = %q, expected %q", sentence, text, expected)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package models
 
 import (
+	"backend/config"
+	"context"
 	"os"
 	"testing"
 	"time"
@@ -16,22 +18,26 @@ func TestBedrockAndTTSServices(t *testing.T) {
 	}
 
 	// Initialize services
-	service, err := New()
+	cfg, err := config.Load(nil)
+	if err != nil {
+		t.Fatalf("Invalid configuration: %v", err)
+	}
+	service, err := New(cfg)
 	if err != nil {
 		t.Fatalf("Failed to initialize services: %v", err)
 	}
 
 	// Test Bedrock service
 	testPrompt := "Hello, how are you today?"
-	response, err := service.GenerateResponse(testPrompt)
+	response, err := service.GenerateResponse(context.Background(), testPrompt, ChatOptions{})
 	if err != nil {
 
 		t.Fatalf("Bedrock service failed: %v", err)
 	}
-	t.Logf("Bedrock response: %s", response)
+	t.Logf("Bedrock response: %s", response.Text)
 
 	// Test TTS service
-	audioURL, err := service.GenerateSpeech("Hello, how are you?", 2, "max")
+	audioURL, err := service.GenerateSpeech(context.Background(), "Hello, how are you?", 2, "max", SpeechOptions{})
 	if err != nil {
 		t.Fatalf("TTS service failed: %v", err)
 	}
@@ -39,7 +45,7 @@ func TestBedrockAndTTSServices(t *testing.T) {
 
 	// Test chat history
 	userID := "test_user_123"
-	exists, chats := service.Search_chat(userID)
+	exists, chats := service.Search_chat(context.Background(), userID)
 	if !exists {
 		// Create new history
 		history := History{
@@ -48,7 +54,7 @@ func TestBedrockAndTTSServices(t *testing.T) {
 			Chats:       []Chat{},
 			LastUpdated: time.Now(),
 		}
-		if err := service.Create_chat(history); err != nil {
+		if err := service.Create_chat(context.Background(), history); err != nil {
 			t.Fatalf("Failed to create chat history: %v", err)
 		}
 	}
@@ -63,19 +69,19 @@ func TestBedrockAndTTSServices(t *testing.T) {
 
 	assistantChat := Chat{
 		Role:      "assistant",
-		Content:   response,
+		Content:   response.Text,
 		Time:      time.Now().Format(time.RFC3339),
 		AudioURL:  audioURL,
 		Timestamp: time.Now(),
 	}
 
 	chats = append(chats, userChat, assistantChat)
-	if err := service.Insert_chat(userID, chats); err != nil {
+	if err := service.Insert_chat(context.Background(), userID, DefaultSessionID, chats, 0); err != nil {
 		t.Fatalf("Failed to insert chat: %v", err)
 	}
 
 	// Verify chat was saved
-	exists, savedChats := service.Search_chat(userID)
+	exists, savedChats := service.Search_chat(context.Background(), userID)
 	if !exists {
 		t.Fatal("Chat history not found after saving")
 	}
@@ -0,0 +1,141 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// maxSessionTitleLength caps session titles, in characters.
+const maxSessionTitleLength = 80
+
+// SessionUpdate changes a session's settings. Nil fields are left as they
+// are.
+type SessionUpdate struct {
+	Title    *string `json:"title"`
+	Archived *bool   `json:"archived"`
+}
+
+func (t *controllerOps) Get_session(ctx context.Context, id, sessionID string) (*History, error) {
+	ctx, cancel := t.timeout.context(ctx)
+	defer cancel()
+	history, err := t.store.GetHistory(ctx, id, sessionOrDefault(sessionID))
+	return history, t.timeout.err(ctx, err)
+}
+
+// Create_session starts a new, empty conversation for the user under a
+// fresh session ID. Any chats in his are ignored.
+func (t *controllerOps) Create_session(ctx context.Context, his History) (*History, error) {
+	ctx, cancel := t.timeout.context(ctx)
+	defer cancel()
+
+	now := time.Now()
+	his.SessionID = NewChatID()
+	his.Title = cleanSessionTitle(his.Title)
+	his.Archived = false
+	his.Chats = nil
+	his.CreatedAt = now
+	his.LastUpdated = now
+	if err := t.store.CreateHistory(ctx, his); err != nil {
+		return nil, t.timeout.err(ctx, err)
+	}
+	his.Version = 1
+	return &his, nil
+}
+
+// List_session returns the sessions of the user, most recently active
+// first. Archived sessions are only included when archived is set.
+func (t *controllerOps) List_session(ctx context.Context, id string, archived bool) ([]History, error) {
+	ctx, cancel := t.timeout.context(ctx)
+	defer cancel()
+
+	histories, err := t.store.ListHistories(ctx, id)
+	if err != nil {
+		return nil, t.timeout.err(ctx, err)
+	}
+
+	sessions := []History{}
+	for _, history := range histories {
+		if archived || !history.Archived {
+			sessions = append(sessions, history)
+		}
+	}
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].LastUpdated.After(sessions[j].LastUpdated)
+	})
+	return sessions, nil
+}
+
+// Update_session renames, archives or restores a session. Concurrent chats
+// don't conflict with the update, which is simply retried on top of them.
+func (t *controllerOps) Update_session(ctx context.Context, id, sessionID string, update SessionUpdate) (*History, error) {
+	ctx, cancel := t.timeout.context(ctx)
+	defer cancel()
+	history, err := t.updateSession(ctx, id, sessionID, update)
+	return history, t.timeout.err(ctx, err)
+}
+
+func (t *controllerOps) updateSession(ctx context.Context, id, sessionID string, update SessionUpdate) (*History, error) {
+	sessionID = sessionOrDefault(sessionID)
+	for attempt := 0; attempt < historyUpdateAttempts; attempt++ {
+		history, err := t.store.GetHistory(ctx, id, sessionID)
+		if err != nil {
+			return nil, err
+		}
+		if history == nil {
+			return nil, ErrSessionNotFound
+		}
+
+		if update.Title != nil {
+			history.Title = cleanSessionTitle(*update.Title)
+		}
+		if update.Archived != nil {
+			history.Archived = *update.Archived
+		}
+
+		err = t.store.UpdateSession(ctx, *history)
+		if err == nil {
+			history.Version++
+			return history, nil
+		}
+		if !errors.Is(err, ErrHistoryConflict) {
+			return nil, err
+		}
+	}
+	return nil, ErrHistoryConflict
+}
+
+// Delete_session removes a session with all of its chats.
+func (t *controllerOps) Delete_session(ctx context.Context, id, sessionID string) error {
+	ctx, cancel := t.timeout.context(ctx)
+	defer cancel()
+	return t.timeout.err(ctx, t.store.DeleteHistory(ctx, id, sessionOrDefault(sessionID)))
+}
+
+// sessionOrDefault maps the empty session ID used by older clients and
+// stored records to DefaultSessionID.
+func sessionOrDefault(sessionID string) string {
+	if sessionID == "" {
+		return DefaultSessionID
+	}
+	return sessionID
+}
+
+// cleanSessionTitle keeps the first line of title without surrounding
+// quotes and whitespace, cut to maxSessionTitleLength characters.
+func cleanSessionTitle(title string) string {
+	title = strings.TrimSpace(title)
+	if i := strings.IndexByte(title, '\n'); i >= 0 {
+		title = strings.TrimSpace(title[:i])
+	}
+	title = strings.TrimSpace(strings.Trim(title, "\"'“”「」《》*#"))
+
+	if utf8.RuneCountInString(title) > maxSessionTitleLength {
+		runes := []rune(title)
+		title = strings.TrimSpace(string(runes[:maxSessionTitleLength]))
+	}
+	return title
+}
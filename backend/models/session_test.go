@@ -0,0 +1,51 @@
+package models
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCleanSessionTitle(t *testing.T) {
+	cases := map[string]string{
+		"  \"Weekend plans\"  \nMore text": "Weekend plans",
+		"「東京旅行」":                           "東京旅行",
+		"":                                 "",
+	}
+	for in, want := range cases {
+		if got := cleanSessionTitle(in); got != want {
+			t.Errorf("cleanSessionTitle(%q) = %q, want %q", in, got, want)
+		}
+	}
+
+	long := cleanSessionTitle(strings.Repeat("字", maxSessionTitleLength+10))
+	if len([]rune(long)) != maxSessionTitleLength {
+		t.Errorf("Expected titles to be cut to %d characters, got %d", maxSessionTitleLength, len([]rune(long)))
+	}
+}
+
+func TestListSessionOrdersByActivity(t *testing.T) {
+	ops := &controllerOps{store: NewMemoryHistoryStore()}
+	first, err := ops.Create_session(context.Background(), History{UserID: "fan", Title: "first"})
+	if err != nil {
+		t.Fatalf("Create_session failed: %v", err)
+	}
+	if _, err := ops.Create_session(context.Background(), History{UserID: "fan", Title: "second"}); err != nil {
+		t.Fatalf("Create_session failed: %v", err)
+	}
+	if err := ops.Append_chat(context.Background(), "fan", first.SessionID, Chat{Role: "user", Content: "hi"}); err != nil {
+		t.Fatalf("Append_chat failed: %v", err)
+	}
+
+	sessions, err := ops.List_session(context.Background(), "fan", false)
+	if err != nil || len(sessions) != 2 {
+		t.Fatalf("Expected two sessions, got %v, %v", sessions, err)
+	}
+	if sessions[0].Title != "first" {
+		t.Fatalf("Expected the session with the latest chat first, got %q", sessions[0].Title)
+	}
+
+	if _, err := ops.Update_session(context.Background(), "fan", "missing", SessionUpdate{}); err != ErrSessionNotFound {
+		t.Fatalf("Expected ErrSessionNotFound, got %v", err)
+	}
+}
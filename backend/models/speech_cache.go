@@ -0,0 +1,266 @@
+package models
+
+import (
+	"backend/config"
+	"backend/metrics"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultSpeechSpeed is the speed factor phrases are spoken at unless
+	// asked otherwise.
+	defaultSpeechSpeed = 1.0
+	// maxAudioBytes caps the size of a downloaded audio file.
+	maxAudioBytes = 20 << 20
+	// audioDownloadTimeout bounds fetching the audio of one phrase.
+	audioDownloadTimeout = 30 * time.Second
+)
+
+type AudioService interface {
+	OpenAudio(ctx context.Context, key string) (*Blob, error)
+	SaveAudio(ctx context.Context, data []byte, contentType string) (string, error)
+	JoinAudio(ctx context.Context, urls []string) (string, error)
+}
+
+// SpeechCache is the TTSService: it speaks every phrase with the TTS
+// provider asked for, stores the audio in a BlobStore and answers with the
+// URL of its own copy under /audio/<key>. Phrases spoken before, like
+// greetings and fallbacks, are served from the store without calling the
+// provider again. Without a store, URLs of providers are passed through and
+// providers returning the audio itself can't be used.
+type SpeechCache struct {
+	providers *TTSProviderRegistry
+	store     BlobStore
+	baseURL   string
+	client    *http.Client
+	timeout   stageTimeout
+}
+
+// NewSpeechCache caches the speech of providers in store. The returned
+// audio URLs start with baseURL, the public address of this server, and are
+// relative if it is empty.
+func NewSpeechCache(providers *TTSProviderRegistry, store BlobStore, baseURL string) *SpeechCache {
+	return &SpeechCache{
+		providers: providers,
+		store:     store,
+		baseURL:   strings.TrimRight(baseURL, "/"),
+		client:    &http.Client{Timeout: audioDownloadTimeout},
+	}
+}
+
+// SetTimeout makes GenerateSpeech fail with a TimeoutError when speaking a
+// phrase takes longer than timeout. Zero means no timeout besides the one
+// of the request.
+func (s *SpeechCache) SetTimeout(timeout time.Duration) {
+	s.timeout = stageTimeout{stage: StageTTS, timeout: timeout}
+}
+
+// NewSpeechCacheFromConfig caches the speech of providers in the blob store
+// selected in cfg, with cfg.BaseURL as the base of audio URLs.
+func NewSpeechCacheFromConfig(providers *TTSProviderRegistry, cfg config.Audio) (*SpeechCache, error) {
+	store, err := NewBlobStoreFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return NewSpeechCache(providers, store, cfg.BaseURL), nil
+}
+
+// GenerateSpeech returns the URL of the cached audio of text, generating and
+// storing it first if needed. When audio downloaded from a provider can't
+// be stored, the URL of the provider is returned instead.
+func (s *SpeechCache) GenerateSpeech(ctx context.Context, text string, model_id int, speaker_name string, opts SpeechOptions) (string, error) {
+	started := time.Now()
+	ctx, cancel := s.timeout.context(ctx)
+	defer cancel()
+	audioURL, err := s.generateSpeech(ctx, text, model_id, speaker_name, opts)
+	err = s.timeout.err(ctx, err)
+	metrics.ObserveStage(metrics.StageTTS, started, err)
+	return audioURL, err
+}
+
+func (s *SpeechCache) generateSpeech(ctx context.Context, text string, model_id int, speaker_name string, opts SpeechOptions) (string, error) {
+	provider, err := s.providers.Get(opts.Provider)
+	if err != nil {
+		return "", err
+	}
+
+	key := speechCacheKey(provider.Name(), text, model_id, speaker_name, opts)
+	if s.store != nil {
+		exists, err := s.store.Exists(ctx, key)
+		if err != nil {
+			slog.WarnContext(ctx, "Failed to look up cached audio", "key", key, "error", err)
+		}
+		if exists {
+			return s.audioURL(key), nil
+		}
+	}
+
+	audio, err := provider.Synthesize(ctx, text, model_id, speaker_name, opts)
+	if err != nil {
+		return "", err
+	}
+
+	if audio.URL == "" {
+		if s.store == nil {
+			return "", fmt.Errorf("TTS provider %s returns audio data, which needs a blob store", provider.Name())
+		}
+		contentType := audio.ContentType
+		if contentType == "" {
+			contentType = http.DetectContentType(audio.Data)
+		}
+		if err := s.store.Put(ctx, key, audio.Data, contentType); err != nil {
+			return "", err
+		}
+		return s.audioURL(key), nil
+	}
+
+	if s.store == nil {
+		return audio.URL, nil
+	}
+	if err := s.download(ctx, key, audio.URL); err != nil {
+		slog.WarnContext(ctx, "Failed to cache audio, using it directly", "url", audio.URL, "error", err)
+		return audio.URL, nil
+	}
+	return s.audioURL(key), nil
+}
+
+// OpenAudio returns the stored audio with the given key.
+func (s *SpeechCache) OpenAudio(ctx context.Context, key string) (*Blob, error) {
+	if s.store == nil || !IsAudioKey(key) {
+		return nil, ErrBlobNotFound
+	}
+	return s.store.Get(ctx, key)
+}
+
+// SaveAudio stores a recording, like a voice message, and returns its URL.
+// The URL is empty when there is no blob store.
+func (s *SpeechCache) SaveAudio(ctx context.Context, data []byte, contentType string) (string, error) {
+	if s.store == nil {
+		return "", nil
+	}
+	sum := sha256.Sum256(data)
+	key := hex.EncodeToString(sum[:])
+	if err := s.store.Put(ctx, key, data, contentType); err != nil {
+		return "", err
+	}
+	return s.audioURL(key), nil
+}
+
+// JoinAudio joins the cached audio at urls, all MP3 or all WAV, into one
+// file and returns its URL. It fails with ErrBlobNotFound for audio that
+// isn't in the store and with ErrCannotJoinAudio for other formats.
+func (s *SpeechCache) JoinAudio(ctx context.Context, urls []string) (string, error) {
+	if s.store == nil {
+		return "", ErrBlobNotFound
+	}
+	keys := make([]string, len(urls))
+	for i, url := range urls {
+		key := url[strings.LastIndex(url, "/")+1:]
+		if !strings.HasPrefix(url, s.baseURL+"/audio/") || !IsAudioKey(key) {
+			return "", fmt.Errorf("%w: %s", ErrBlobNotFound, url)
+		}
+		keys[i] = key
+	}
+
+	sum := sha256.Sum256([]byte("join\x00" + strings.Join(keys, "\x00")))
+	key := hex.EncodeToString(sum[:])
+	if exists, err := s.store.Exists(ctx, key); err == nil && exists {
+		return s.audioURL(key), nil
+	}
+
+	var contentType string
+	files := make([][]byte, len(keys))
+	for i, key := range keys {
+		blob, err := s.store.Get(ctx, key)
+		if err != nil {
+			return "", err
+		}
+		files[i], err = io.ReadAll(blob)
+		blob.Close()
+		if err != nil {
+			return "", err
+		}
+		if i == 0 {
+			contentType = blob.ContentType
+		} else if blob.ContentType != contentType {
+			return "", fmt.Errorf("%w: %s and %s", ErrCannotJoinAudio, contentType, blob.ContentType)
+		}
+	}
+
+	joined, err := joinAudio(contentType, files)
+	if err != nil {
+		return "", err
+	}
+	if err := s.store.Put(ctx, key, joined, contentType); err != nil {
+		return "", err
+	}
+	return s.audioURL(key), nil
+}
+
+func (s *SpeechCache) audioURL(key string) string {
+	return s.baseURL + "/audio/" + key
+}
+
+// download fetches the audio at sourceURL into the store.
+func (s *SpeechCache) download(ctx context.Context, key, sourceURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sourceURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxAudioBytes+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxAudioBytes {
+		return fmt.Errorf("audio is larger than %d bytes", maxAudioBytes)
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" || contentType == "application/octet-stream" {
+		contentType = http.DetectContentType(data)
+	}
+	return s.store.Put(ctx, key, data, contentType)
+}
+
+// speechCacheKey identifies the audio of a phrase: the same text spoken by
+// the same voice of a provider with the same speed, emotion and pitch always
+// sounds the same. The mode only changes how the audio is delivered.
+func speechCacheKey(provider, text string, modelID int, speakerName string, opts SpeechOptions) string {
+	if opts.Speed == 0 {
+		opts.Speed = defaultSpeechSpeed
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d\x00%s\x00%g\x00%s\x00%g",
+		provider, text, modelID, speakerName, opts.Speed, opts.Emotion, opts.Pitch)))
+	return hex.EncodeToString(sum[:])
+}
+
+// IsAudioKey reports whether key has the form of a cached audio key, as
+// opposed to a speech job ID.
+func IsAudioKey(key string) bool {
+	if len(key) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range key {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
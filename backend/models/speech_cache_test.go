@@ -0,0 +1,169 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// countingTTS answers with the URL of a test server and counts its calls.
+type countingTTS struct {
+	url   string
+	calls int
+}
+
+func (c *countingTTS) Name() string {
+	return "counting"
+}
+
+func (c *countingTTS) Synthesize(ctx context.Context, text string, modelID int, speakerName string, opts SpeechOptions) (*SpeechAudio, error) {
+	c.calls++
+	return &SpeechAudio{URL: c.url}, nil
+}
+
+// newTestTTSRegistry registers provider as the default along with the stub.
+func newTestTTSRegistry(provider TTSProvider) *TTSProviderRegistry {
+	registry := NewTTSProviderRegistry(provider.Name())
+	registry.Register(provider)
+	registry.Register(NewStubTTSProvider())
+	return registry
+}
+
+func TestSpeechCache(t *testing.T) {
+	audio := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "audio/mpeg")
+		w.Write([]byte("mp3 data"))
+	}))
+	defer audio.Close()
+
+	store, err := NewFSBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tts := &countingTTS{url: audio.URL}
+	cache := NewSpeechCache(newTestTTSRegistry(tts), store, "https://idol.example/")
+
+	first, err := cache.GenerateSpeech(context.Background(), "hello", 1, "max", SpeechOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := speechCacheKey("counting", "hello", 1, "max", SpeechOptions{})
+	if first != "https://idol.example/audio/"+key {
+		t.Fatalf("Expected our audio URL, got %s", first)
+	}
+	second, _ := cache.GenerateSpeech(context.Background(), "hello", 1, "max", SpeechOptions{})
+	if second != first || tts.calls != 1 {
+		t.Fatalf("Expected a cache hit, got %s after %d TTS calls", second, tts.calls)
+	}
+	if other, _ := cache.GenerateSpeech(context.Background(), "hello", 1, "anna", SpeechOptions{}); other == first || tts.calls != 2 {
+		t.Fatalf("Expected another voice to miss the cache, got %s", other)
+	}
+	if slow, _ := cache.GenerateSpeech(context.Background(), "hello", 1, "max", SpeechOptions{Speed: 0.8}); slow == first || tts.calls != 3 {
+		t.Fatalf("Expected another speed to miss the cache, got %s", slow)
+	}
+	if normal, _ := cache.GenerateSpeech(context.Background(), "hello", 1, "max", SpeechOptions{Speed: 1}); normal != first || tts.calls != 3 {
+		t.Fatalf("Expected the default speed to hit the cache, got %s", normal)
+	}
+
+	blob, err := cache.OpenAudio(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	data, _ := io.ReadAll(blob)
+	if string(data) != "mp3 data" || blob.ContentType != "audio/mpeg" {
+		t.Fatalf("Unexpected blob %q of type %s", data, blob.ContentType)
+	}
+}
+
+func TestSpeechCacheFallsBackToSourceURL(t *testing.T) {
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+
+	store, err := NewFSBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewSpeechCache(newTestTTSRegistry(&countingTTS{url: missing.URL}), store, "")
+	url, err := cache.GenerateSpeech(context.Background(), "hello", 1, "max", SpeechOptions{})
+	if err != nil || url != missing.URL {
+		t.Fatalf("Expected the TTS URL, got %s, %v", url, err)
+	}
+}
+
+func TestSpeechCacheStoresAudioData(t *testing.T) {
+	store, err := NewFSBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewSpeechCache(newTestTTSRegistry(&countingTTS{}), store, "")
+	url, err := cache.GenerateSpeech(context.Background(), "hello", 1, "max", SpeechOptions{Provider: TTSProviderStub})
+	if err != nil || !strings.HasPrefix(url, "/audio/") {
+		t.Fatalf("Expected our audio URL, got %s, %v", url, err)
+	}
+	blob, err := cache.OpenAudio(context.Background(), strings.TrimPrefix(url, "/audio/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	if blob.ContentType != "audio/wav" {
+		t.Fatalf("Expected the stub WAV, got %s", blob.ContentType)
+	}
+
+	passthrough := NewSpeechCache(newTestTTSRegistry(&countingTTS{}), nil, "")
+	if _, err := passthrough.GenerateSpeech(context.Background(), "hello", 1, "max", SpeechOptions{Provider: TTSProviderStub}); err == nil {
+		t.Fatal("Expected audio data to need a blob store")
+	}
+}
+
+func TestFSBlobStoreRejectsPaths(t *testing.T) {
+	store, err := NewFSBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"", "..", "../escape", `a\b`} {
+		if err := store.Put(context.Background(), key, []byte("x"), "text/plain"); err == nil {
+			t.Fatalf("Expected key %q to be rejected", key)
+		}
+	}
+	if _, err := store.Get(context.Background(), strings.Repeat("0", 64)); !errors.Is(err, ErrBlobNotFound) {
+		t.Fatalf("Expected ErrBlobNotFound, got %v", err)
+	}
+}
+
+func TestSpeechCacheJoinAudio(t *testing.T) {
+	store, err := NewFSBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewSpeechCache(nil, store, "https://fans.example")
+	tag := []byte("ID3\x04\x00\x00\x00\x00\x00\x02ab")
+	first, _ := cache.SaveAudio(context.Background(), append(append([]byte{}, tag...), "first"...), "audio/mpeg")
+	second, _ := cache.SaveAudio(context.Background(), append(append([]byte{}, tag...), "second"...), "audio/mpeg")
+
+	joined, err := cache.JoinAudio(context.Background(), []string{first, second})
+	if err != nil || !strings.HasPrefix(joined, "https://fans.example/audio/") {
+		t.Fatalf("Expected a joined audio URL, got %q, %v", joined, err)
+	}
+	blob, err := cache.OpenAudio(context.Background(), strings.TrimPrefix(joined, "https://fans.example/audio/"))
+	if err != nil {
+		t.Fatalf("Failed to open joined audio: %v", err)
+	}
+	data, _ := io.ReadAll(blob)
+	blob.Close()
+	if string(data) != string(tag)+"firstsecond" {
+		t.Fatalf("Expected the second ID3 tag to be dropped, got %q", data)
+	}
+
+	wav, _ := cache.SaveAudio(context.Background(), []byte("RIFF"), "audio/wav")
+	if _, err := cache.JoinAudio(context.Background(), []string{first, wav}); !errors.Is(err, ErrCannotJoinAudio) {
+		t.Fatalf("Expected ErrCannotJoinAudio for mixed formats, got %v", err)
+	}
+	if _, err := cache.JoinAudio(context.Background(), []string{first, "https://vyin.example/a.mp3"}); !errors.Is(err, ErrBlobNotFound) {
+		t.Fatalf("Expected ErrBlobNotFound for foreign audio, got %v", err)
+	}
+}
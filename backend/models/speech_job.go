@@ -0,0 +1,317 @@
+package models
+
+import (
+	"backend/config"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Statuses of a SpeechJob.
+const (
+	SpeechJobPending = "pending"
+	SpeechJobRunning = "running"
+	SpeechJobDone    = "done"
+	SpeechJobFailed  = "failed"
+)
+
+var (
+	// ErrSpeechJobNotFound is returned for unknown or expired job IDs.
+	ErrSpeechJobNotFound = errors.New("speech job not found")
+	// ErrSpeechQueueFull is returned when no more jobs can be queued.
+	ErrSpeechQueueFull = errors.New("speech job queue is full")
+)
+
+// SpeechJob is the speech synthesis of one assistant chat, run in the
+// background so replies don't wait for TTS. Playlist is the audio of every
+// sentence of the chat in order, AudioURL all of it as one file.
+type SpeechJob struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	SessionID string    `json:"session_id"`
+	ChatID    string    `json:"chat_id"`
+	Status    string    `json:"status"`
+	AudioURL  string    `json:"audio_url,omitempty"`
+	Playlist  []string  `json:"playlist,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Attempts  int       `json:"attempts"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Finished reports whether the job reached a final status.
+func (j *SpeechJob) Finished() bool {
+	return j.Status == SpeechJobDone || j.Status == SpeechJobFailed
+}
+
+// SpeechRequest asks for the speech of chat ChatID of a session.
+type SpeechRequest struct {
+	UserID      string
+	SessionID   string
+	ChatID      string
+	Text        string
+	ModelID     int
+	SpeakerName string
+	Options     SpeechOptions
+}
+
+type SpeechJobService interface {
+	SpeakSentences(ctx context.Context, modelID int, speakerName string, opts SpeechOptions, onAudio func(audio SentenceAudio)) *SentenceSpeech
+	SubmitSpeechJob(request SpeechRequest) (*SpeechJob, error)
+	SpeechJob(id string) (*SpeechJob, error)
+	WaitSpeechJob(ctx context.Context, id string) (*SpeechJob, error)
+}
+
+// SpeechJobOptions sizes the speech worker pool.
+type SpeechJobOptions struct {
+	// Workers is the number of jobs run at once.
+	Workers int
+	// SentenceWorkers is the number of sentences of one reply spoken at
+	// once.
+	SentenceWorkers int
+	// MaxSentenceRunes is the longest text sent in one TTS request.
+	MaxSentenceRunes int
+	// QueueSize is how many jobs may wait for a worker.
+	QueueSize int
+	// MaxAttempts bounds the TTS calls per sentence.
+	MaxAttempts int
+	// RetryDelay is the wait after the first failed attempt, growing
+	// linearly with every further attempt.
+	RetryDelay time.Duration
+	// Retention is how long finished jobs can still be looked up.
+	Retention time.Duration
+	// StorageTimeout bounds joining the audio of a reply and saving it to
+	// the chat; zero means no timeout.
+	StorageTimeout time.Duration
+}
+
+// SpeechJobOptionsFromConfig returns the options of the queue set in cfg.
+func SpeechJobOptionsFromConfig(cfg config.SpeechJobs) SpeechJobOptions {
+	return SpeechJobOptions{
+		Workers:          cfg.Workers,
+		SentenceWorkers:  cfg.SentenceWorkers,
+		MaxSentenceRunes: cfg.MaxSentenceChars,
+		QueueSize:        cfg.QueueSize,
+		MaxAttempts:      cfg.MaxAttempts,
+		RetryDelay:       time.Duration(cfg.RetryDelayMS) * time.Millisecond,
+		Retention:        time.Duration(cfg.RetentionMinutes) * time.Minute,
+	}
+}
+
+// speechJob is a queued job with what its worker needs.
+type speechJob struct {
+	SpeechJob
+	request SpeechRequest
+	done    chan struct{}
+}
+
+// SpeechJobQueue runs speech jobs on a pool of workers. Every job speaks
+// its text sentence by sentence and writes the audio into the chat it
+// belongs to. Jobs are kept in memory, so their status is only known to the
+// server that queued them.
+type SpeechJobQueue struct {
+	tts   TTSService
+	audio AudioService
+	store HistoryStore
+	opts  SpeechJobOptions
+
+	// ctx is the context of running jobs, cancelled when a shutdown runs
+	// out of time.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	jobs    map[string]*speechJob
+	queue   chan *speechJob
+	stopped bool
+	stop    sync.Once
+	workers sync.WaitGroup
+}
+
+// NewSpeechJobQueue starts the workers of a queue generating speech with
+// tts, joining the audio of sentences with audio and saving the audio URLs
+// to store. Without audio, only replies of a single sentence get an audio
+// URL besides their playlist.
+func NewSpeechJobQueue(tts TTSService, audio AudioService, store HistoryStore, opts SpeechJobOptions) *SpeechJobQueue {
+	if opts.Workers < 1 {
+		opts.Workers = 1
+	}
+	if opts.SentenceWorkers < 1 {
+		opts.SentenceWorkers = 1
+	}
+	if opts.QueueSize < 0 {
+		opts.QueueSize = 0
+	}
+	if opts.MaxAttempts < 1 {
+		opts.MaxAttempts = 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &SpeechJobQueue{
+		tts:    tts,
+		audio:  audio,
+		store:  store,
+		opts:   opts,
+		ctx:    ctx,
+		cancel: cancel,
+		jobs:   map[string]*speechJob{},
+		queue:  make(chan *speechJob, opts.QueueSize),
+	}
+	for i := 0; i < opts.Workers; i++ {
+		q.workers.Add(1)
+		go q.work()
+	}
+	return q
+}
+
+// SubmitSpeechJob queues request and returns the pending job. It fails
+// with ErrSpeechQueueFull instead of blocking when all workers are busy and
+// the queue is full.
+func (q *SpeechJobQueue) SubmitSpeechJob(request SpeechRequest) (*SpeechJob, error) {
+	now := time.Now()
+	job := &speechJob{
+		SpeechJob: SpeechJob{
+			ID:        NewChatID(),
+			UserID:    request.UserID,
+			SessionID: request.SessionID,
+			ChatID:    request.ChatID,
+			Status:    SpeechJobPending,
+			CreatedAt: now,
+			UpdatedAt: now,
+		},
+		request: request,
+		done:    make(chan struct{}),
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.stopped {
+		return nil, fmt.Errorf("speech job queue is stopped")
+	}
+	q.prune(now)
+
+	q.jobs[job.ID] = job
+	select {
+	case q.queue <- job:
+	default:
+		delete(q.jobs, job.ID)
+		return nil, ErrSpeechQueueFull
+	}
+	snapshot := job.SpeechJob
+	return &snapshot, nil
+}
+
+// SpeechJob returns the current state of a job.
+func (q *SpeechJobQueue) SpeechJob(id string) (*SpeechJob, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return nil, ErrSpeechJobNotFound
+	}
+	snapshot := job.SpeechJob
+	return &snapshot, nil
+}
+
+// WaitSpeechJob blocks until the job is finished or ctx is done, and
+// returns the latest state of the job.
+func (q *SpeechJobQueue) WaitSpeechJob(ctx context.Context, id string) (*SpeechJob, error) {
+	q.mu.Lock()
+	job, ok := q.jobs[id]
+	q.mu.Unlock()
+	if !ok {
+		return nil, ErrSpeechJobNotFound
+	}
+
+	select {
+	case <-job.done:
+	case <-ctx.Done():
+	}
+	return q.SpeechJob(id)
+}
+
+// Shutdown stops accepting jobs and waits for the queued ones to finish or
+// for ctx to be done, whichever comes first. In the latter case the running
+// jobs are cancelled, failing them and the ones still queued, and a later
+// Shutdown or Stop waits for them to return.
+func (q *SpeechJobQueue) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		q.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		q.cancel()
+		return ctx.Err()
+	}
+}
+
+// Stop stops accepting jobs and waits for the queued ones to finish.
+func (q *SpeechJobQueue) Stop() {
+	q.stop.Do(func() {
+		q.mu.Lock()
+		q.stopped = true
+		close(q.queue)
+		q.mu.Unlock()
+	})
+	q.workers.Wait()
+}
+
+func (q *SpeechJobQueue) work() {
+	defer q.workers.Done()
+	for job := range q.queue {
+		q.run(job)
+	}
+}
+
+// run speaks the text of the job and saves the audio to the chat.
+func (q *SpeechJobQueue) run(job *speechJob) {
+	request := job.request
+	q.update(job, func(j *SpeechJob) {
+		j.Status = SpeechJobRunning
+	})
+
+	speech := q.SpeakSentences(q.ctx, request.ModelID, request.SpeakerName, request.Options, func(audio SentenceAudio) {
+		q.update(job, func(j *SpeechJob) {
+			if audio.Attempts > j.Attempts {
+				j.Attempts = audio.Attempts
+			}
+		})
+	})
+	speech.Write(request.Text)
+	reply, err := speech.Finish(request.UserID, request.SessionID, request.ChatID)
+
+	q.update(job, func(j *SpeechJob) {
+		if err != nil {
+			j.Status = SpeechJobFailed
+			j.Error = err.Error()
+			return
+		}
+		j.Status = SpeechJobDone
+		j.AudioURL = reply.AudioURL
+		j.Playlist = reply.Playlist
+	})
+	close(job.done)
+}
+
+func (q *SpeechJobQueue) update(job *speechJob, change func(j *SpeechJob)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	change(&job.SpeechJob)
+	job.UpdatedAt = time.Now()
+}
+
+// prune forgets jobs that finished longer than the retention ago. The
+// caller must hold q.mu.
+func (q *SpeechJobQueue) prune(now time.Time) {
+	for id, job := range q.jobs {
+		if job.Finished() && now.Sub(job.UpdatedAt) > q.opts.Retention {
+			delete(q.jobs, id)
+		}
+	}
+}
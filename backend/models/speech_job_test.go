@@ -0,0 +1,214 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyTTS fails the first failures calls, then returns an audio URL.
+type flakyTTS struct {
+	mu       sync.Mutex
+	failures int
+	calls    int
+	release  chan struct{}
+}
+
+func (f *flakyTTS) GenerateSpeech(ctx context.Context, text string, model_id int, speaker_name string, opts SpeechOptions) (string, error) {
+	if f.release != nil {
+		<-f.release
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.calls <= f.failures {
+		return "", errors.New("vyin unavailable")
+	}
+	return "https://audio.example/" + speaker_name, nil
+}
+
+func TestSpeechJobRetriesAndSavesAudio(t *testing.T) {
+	store := NewMemoryHistoryStore()
+	chat := Chat{ID: NewChatID(), Role: "assistant", Content: "hello"}
+	if err := store.AppendChats(context.Background(), "fan", DefaultSessionID, []Chat{chat}); err != nil {
+		t.Fatalf("AppendChats failed: %v", err)
+	}
+
+	queue := NewSpeechJobQueue(&flakyTTS{failures: 2}, nil, store, SpeechJobOptions{Workers: 1, QueueSize: 1, MaxAttempts: 3})
+	defer queue.Stop()
+
+	job, err := queue.SubmitSpeechJob(SpeechRequest{UserID: "fan", SessionID: DefaultSessionID, ChatID: chat.ID, Text: "hello", ModelID: 1, SpeakerName: "max"})
+	if err != nil {
+		t.Fatalf("SubmitSpeechJob failed: %v", err)
+	}
+	job, err = queue.WaitSpeechJob(context.Background(), job.ID)
+	if err != nil || job.Status != SpeechJobDone || job.Attempts != 3 {
+		t.Fatalf("Expected the job to succeed on the third attempt, got %+v, %v", job, err)
+	}
+
+	page, _ := store.ListChats(context.Background(), "fan", DefaultSessionID, 0, "")
+	if page.Chats[0].AudioURL != "https://audio.example/max" {
+		t.Fatalf("Expected the audio URL to be saved, got %+v", page.Chats[0])
+	}
+}
+
+func TestSpeechJobFailsAfterMaxAttempts(t *testing.T) {
+	queue := NewSpeechJobQueue(&flakyTTS{failures: 5}, nil, NewMemoryHistoryStore(), SpeechJobOptions{Workers: 1, QueueSize: 1, MaxAttempts: 2})
+	defer queue.Stop()
+
+	job, err := queue.SubmitSpeechJob(SpeechRequest{UserID: "fan", ChatID: "missing", Text: "hello", ModelID: 1, SpeakerName: "max"})
+	if err != nil {
+		t.Fatalf("SubmitSpeechJob failed: %v", err)
+	}
+	job, _ = queue.WaitSpeechJob(context.Background(), job.ID)
+	if job.Status != SpeechJobFailed || job.Error == "" || job.Attempts != 2 {
+		t.Fatalf("Expected the job to fail after 2 attempts, got %+v", job)
+	}
+}
+
+func TestSpeechJobDoesNotRetryDisabledSpeech(t *testing.T) {
+	registry := NewTTSProviderRegistry(TTSProviderNone)
+	registry.Register(noneTTSProvider{})
+	queue := NewSpeechJobQueue(NewSpeechCache(registry, nil, ""), nil, NewMemoryHistoryStore(), SpeechJobOptions{Workers: 1, QueueSize: 1, MaxAttempts: 3})
+	defer queue.Stop()
+
+	job, err := queue.SubmitSpeechJob(SpeechRequest{UserID: "fan", ChatID: "missing", Text: "hello", ModelID: 1, SpeakerName: "max"})
+	if err != nil {
+		t.Fatalf("SubmitSpeechJob failed: %v", err)
+	}
+	job, _ = queue.WaitSpeechJob(context.Background(), job.ID)
+	if job.Status != SpeechJobFailed || job.Attempts != 1 {
+		t.Fatalf("Expected the job to fail without retries, got %+v", job)
+	}
+}
+
+func TestSpeechJobQueueFull(t *testing.T) {
+	tts := &flakyTTS{release: make(chan struct{})}
+	queue := NewSpeechJobQueue(tts, nil, NewMemoryHistoryStore(), SpeechJobOptions{Workers: 1, QueueSize: 1})
+	defer queue.Stop()
+	defer close(tts.release)
+
+	request := SpeechRequest{UserID: "fan", Text: "hello", ModelID: 1, SpeakerName: "max"}
+	var err error
+	// One job keeps the worker busy and one waits in the queue
+	for i := 0; i < 3 && err == nil; i++ {
+		_, err = queue.SubmitSpeechJob(request)
+	}
+	if err != ErrSpeechQueueFull {
+		t.Fatalf("Expected ErrSpeechQueueFull, got %v", err)
+	}
+	if _, err := queue.SpeechJob("unknown"); err != ErrSpeechJobNotFound {
+		t.Fatalf("Expected ErrSpeechJobNotFound, got %v", err)
+	}
+}
+
+func TestSpeechJobSpeaksSentences(t *testing.T) {
+	blobs, err := NewFSBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewSpeechCache(newTestTTSRegistry(NewStubTTSProvider()), blobs, "")
+	store := NewMemoryHistoryStore()
+	chat := Chat{ID: NewChatID(), Role: "assistant", Content: "第一句。第二句比較長！🎉"}
+	if err := store.AppendChats(context.Background(), "fan", DefaultSessionID, []Chat{chat}); err != nil {
+		t.Fatalf("AppendChats failed: %v", err)
+	}
+
+	queue := NewSpeechJobQueue(cache, cache, store, SpeechJobOptions{Workers: 1, SentenceWorkers: 2, QueueSize: 1})
+	defer queue.Stop()
+	job, err := queue.SubmitSpeechJob(SpeechRequest{UserID: "fan", SessionID: DefaultSessionID, ChatID: chat.ID, Text: chat.Content, ModelID: 1, SpeakerName: "max"})
+	if err != nil {
+		t.Fatalf("SubmitSpeechJob failed: %v", err)
+	}
+	job, _ = queue.WaitSpeechJob(context.Background(), job.ID)
+	if job.Status != SpeechJobDone || len(job.Playlist) != 2 || job.AudioURL == job.Playlist[0] {
+		t.Fatalf("Expected a playlist of 2 sentences and a joined file, got %+v", job)
+	}
+
+	var samples int
+	for _, audioURL := range append(job.Playlist, job.AudioURL) {
+		blob, err := cache.OpenAudio(context.Background(), strings.TrimPrefix(audioURL, "/audio/"))
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", audioURL, err)
+		}
+		data, _ := io.ReadAll(blob)
+		blob.Close()
+		_, pcm, err := readWAV(data)
+		if err != nil {
+			t.Fatalf("Expected a WAV file at %s: %v", audioURL, err)
+		}
+		if audioURL == job.AudioURL && len(pcm) != samples {
+			t.Fatalf("Expected the joined file to have %d bytes of samples, got %d", samples, len(pcm))
+		}
+		samples += len(pcm)
+	}
+
+	page, _ := store.ListChats(context.Background(), "fan", DefaultSessionID, 0, "")
+	if page.Chats[0].AudioURL != job.AudioURL || !reflect.DeepEqual(page.Chats[0].AudioPlaylist, job.Playlist) {
+		t.Fatalf("Expected the audio to be saved, got %+v", page.Chats[0])
+	}
+}
+
+func TestSpeechJobQueueShutdownDrainsJobs(t *testing.T) {
+	tts := &flakyTTS{release: make(chan struct{})}
+	queue := NewSpeechJobQueue(tts, nil, NewMemoryHistoryStore(), SpeechJobOptions{Workers: 1, QueueSize: 1, MaxAttempts: 1})
+	job, err := queue.SubmitSpeechJob(SpeechRequest{UserID: "fan", Text: "hello", ModelID: 1, SpeakerName: "max"})
+	if err != nil {
+		t.Fatalf("SubmitSpeechJob failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := queue.Shutdown(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the shutdown to give up with the context, got %v", err)
+	}
+	if _, err := queue.SubmitSpeechJob(SpeechRequest{UserID: "fan", Text: "again"}); err == nil {
+		t.Fatal("Expected the stopped queue to refuse jobs")
+	}
+
+	close(tts.release)
+	if err := queue.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if job, _ = queue.SpeechJob(job.ID); !job.Finished() {
+		t.Fatalf("Expected the queued job to finish before shutdown returned, got %+v", job)
+	}
+}
+
+// blockingTTS speaks nothing until its context is done.
+type blockingTTS struct {
+	started chan struct{}
+}
+
+func (b *blockingTTS) GenerateSpeech(ctx context.Context, text string, model_id int, speaker_name string, opts SpeechOptions) (string, error) {
+	close(b.started)
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+func TestSpeechJobQueueShutdownCancelsRunningJobs(t *testing.T) {
+	tts := &blockingTTS{started: make(chan struct{})}
+	queue := NewSpeechJobQueue(tts, nil, NewMemoryHistoryStore(), SpeechJobOptions{Workers: 1, QueueSize: 1, MaxAttempts: 1})
+	job, err := queue.SubmitSpeechJob(SpeechRequest{UserID: "fan", Text: "hello", ModelID: 1, SpeakerName: "max"})
+	if err != nil {
+		t.Fatalf("SubmitSpeechJob failed: %v", err)
+	}
+	<-tts.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := queue.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the shutdown to run out of time, got %v", err)
+	}
+	if err := queue.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if job, _ = queue.SpeechJob(job.ID); job.Status != SpeechJobFailed {
+		t.Fatalf("Expected the running job to be cancelled, got %+v", job)
+	}
+}
@@ -0,0 +1,216 @@
+package models
+
+import (
+	"backend/config"
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Names of the built-in history stores.
+const (
+	StoreDynamoDB = "dynamodb"
+	StoreMemory   = "memory"
+	StoreBolt     = "bolt"
+)
+
+// NewHistoryStoreFromConfig opens the history store selected by cfg.Store:
+//
+//	dynamodb: table cfg.Table
+//	memory:   process memory, lost on restart
+//	bolt:     embedded database file cfg.DBPath
+func NewHistoryStoreFromConfig(cfg config.History) (HistoryStore, error) {
+	switch cfg.Store {
+	case StoreDynamoDB:
+		return NewDynamoDBClient(cfg.Table)
+	case StoreMemory:
+		slog.Warn("Using in-memory history store, chats are lost on restart")
+		return NewMemoryHistoryStore(), nil
+	case StoreBolt:
+		return NewBoltHistoryStore(cfg.DBPath)
+	default:
+		return nil, fmt.Errorf("unknown history store %q", cfg.Store)
+	}
+}
+
+// memoryHistoryStore keeps histories in process memory, keyed by
+// threadKey. It is meant for tests and local development.
+type memoryHistoryStore struct {
+	mu        sync.RWMutex
+	histories map[string]*History
+}
+
+// NewMemoryHistoryStore returns an empty in-memory HistoryStore.
+func NewMemoryHistoryStore() HistoryStore {
+	return &memoryHistoryStore{histories: map[string]*History{}}
+}
+
+// threadKey identifies one session of a user.
+func threadKey(userID, sessionID string) string {
+	return userID + "\x00" + sessionOrDefault(sessionID)
+}
+
+func (m *memoryHistoryStore) GetHistory(ctx context.Context, userID, sessionID string) (*History, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	history, ok := m.histories[threadKey(userID, sessionID)]
+	if !ok {
+		return nil, nil
+	}
+	meta := *history
+	meta.Chats = nil
+	return &meta, nil
+}
+
+func (m *memoryHistoryStore) ListHistories(ctx context.Context, userID string) ([]History, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	histories := []History{}
+	for _, history := range m.histories {
+		if history.UserID == userID {
+			meta := *history
+			meta.Chats = nil
+			histories = append(histories, meta)
+		}
+	}
+	return histories, nil
+}
+
+func (m *memoryHistoryStore) CreateHistory(ctx context.Context, history History) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	history.SessionID = sessionOrDefault(history.SessionID)
+	key := threadKey(history.UserID, history.SessionID)
+	if _, ok := m.histories[key]; ok {
+		return ErrHistoryExists
+	}
+	history.Chats = sortChats(history.Chats)
+	history.Version = 1
+	m.histories[key] = &history
+	return nil
+}
+
+func (m *memoryHistoryStore) UpdateHistory(ctx context.Context, history History) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	history.SessionID = sessionOrDefault(history.SessionID)
+	key := threadKey(history.UserID, history.SessionID)
+	stored, ok := m.histories[key]
+	if !ok || stored.Version != history.Version {
+		return ErrHistoryConflict
+	}
+	history.Chats = sortChats(history.Chats)
+	history.Version++
+	m.histories[key] = &history
+	return nil
+}
+
+func (m *memoryHistoryStore) UpdateSession(ctx context.Context, history History) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	history.SessionID = sessionOrDefault(history.SessionID)
+	key := threadKey(history.UserID, history.SessionID)
+	stored, ok := m.histories[key]
+	if !ok || stored.Version != history.Version {
+		return ErrHistoryConflict
+	}
+	history.Chats = stored.Chats
+	history.Version++
+	m.histories[key] = &history
+	return nil
+}
+
+func (m *memoryHistoryStore) DeleteHistory(ctx context.Context, userID, sessionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := threadKey(userID, sessionID)
+	if _, ok := m.histories[key]; !ok {
+		return ErrSessionNotFound
+	}
+	delete(m.histories, key)
+	return nil
+}
+
+func (m *memoryHistoryStore) AppendChats(ctx context.Context, userID, sessionID string, chats []Chat) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := threadKey(userID, sessionID)
+	history, ok := m.histories[key]
+	if !ok {
+		if sessionOrDefault(sessionID) != DefaultSessionID {
+			return ErrSessionNotFound
+		}
+		history = &History{UserID: userID, SessionID: DefaultSessionID}
+		m.histories[key] = history
+	}
+	history.Chats = sortChats(append(history.Chats, chats...))
+	history.LastUpdated = time.Now()
+	history.Version++
+	return nil
+}
+
+func (m *memoryHistoryStore) ListChats(ctx context.Context, userID, sessionID string, limit int, before string) (*ChatPage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	history, ok := m.histories[threadKey(userID, sessionID)]
+	if !ok {
+		return &ChatPage{Chats: []Chat{}}, nil
+	}
+	return pageChats(history.Chats, limit, before), nil
+}
+
+func (m *memoryHistoryStore) SetChatAudio(ctx context.Context, userID, sessionID, chatID, audioURL string, playlist []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	history, ok := m.histories[threadKey(userID, sessionID)]
+	if !ok {
+		return ErrChatNotFound
+	}
+	// Copy the chats so pages handed out before don't change
+	chats := append([]Chat{}, history.Chats...)
+	for i := range chats {
+		if chats[i].ID == chatID {
+			chats[i].AudioURL = audioURL
+			chats[i].AudioPlaylist = append([]string(nil), playlist...)
+			history.Chats = chats
+			history.Version++
+			return nil
+		}
+	}
+	return ErrChatNotFound
+}
+
+// sortChats returns a copy of chats ordered by ID so callers can't modify
+// stored data through a shared slice.
+func sortChats(chats []Chat) []Chat {
+	sorted := append([]Chat{}, chats...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].ID < sorted[j].ID
+	})
+	return sorted
+}
+
+// pageChats picks the page described by limit and before out of chats,
+// which must be ordered by ID.
+func pageChats(chats []Chat, limit int, before string) *ChatPage {
+	end := len(chats)
+	if before != "" {
+		end = sort.Search(len(chats), func(i int) bool {
+			return chats[i].ID >= before
+		})
+	}
+
+	start := 0
+	if limit > 0 && end > limit {
+		start = end - limit
+	}
+
+	page := &ChatPage{Chats: append([]Chat{}, chats[start:end]...)}
+	if start > 0 {
+		page.NextCursor = chats[start].ID
+	}
+	return page
+}
@@ -0,0 +1,347 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	historyBucket = []byte("history")
+	chatsBucket   = []byte("chats")
+)
+
+// BoltHistoryStore keeps histories in an embedded bbolt database file, for
+// self-hosted deployments without AWS. The "history" bucket holds every
+// session as JSON without chats; the "chats" bucket holds one nested bucket
+// per session with every chat stored under its ID. Both are keyed by
+// boltThreadKey.
+type BoltHistoryStore struct {
+	db *bolt.DB
+}
+
+// NewBoltHistoryStore opens or creates the database file at path. Histories
+// written by older versions, with all chats inside the history document, are
+// split into single chat records on open.
+func NewBoltHistoryStore(path string) (*BoltHistoryStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(historyBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(chatsBucket); err != nil {
+			return err
+		}
+		return migrateBoltHistories(tx)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltHistoryStore{db: db}, nil
+}
+
+func (b *BoltHistoryStore) GetHistory(ctx context.Context, userID, sessionID string) (*History, error) {
+	var history *History
+	err := b.db.View(func(tx *bolt.Tx) (err error) {
+		history, err = getBoltHistory(tx, boltThreadKey(userID, sessionID))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+func (b *BoltHistoryStore) ListHistories(ctx context.Context, userID string) ([]History, error) {
+	histories := []History{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		history, err := getBoltHistory(tx, boltThreadKey(userID, DefaultSessionID))
+		if err != nil {
+			return err
+		}
+		if history != nil {
+			histories = append(histories, *history)
+		}
+
+		prefix := []byte(userID + "\x00")
+		cursor := tx.Bucket(historyBucket).Cursor()
+		for key, value := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, value = cursor.Next() {
+			var history History
+			if err := json.Unmarshal(value, &history); err != nil {
+				return err
+			}
+			histories = append(histories, history)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return histories, nil
+}
+
+func (b *BoltHistoryStore) CreateHistory(ctx context.Context, history History) error {
+	history.SessionID = sessionOrDefault(history.SessionID)
+	key := boltThreadKey(history.UserID, history.SessionID)
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(historyBucket).Get(key) != nil {
+			return ErrHistoryExists
+		}
+		if err := putBoltChats(tx, key, history.Chats); err != nil {
+			return err
+		}
+		history.Version = 1
+		return putBoltHistory(tx, history)
+	})
+}
+
+func (b *BoltHistoryStore) UpdateHistory(ctx context.Context, history History) error {
+	history.SessionID = sessionOrDefault(history.SessionID)
+	key := boltThreadKey(history.UserID, history.SessionID)
+	return b.db.Update(func(tx *bolt.Tx) error {
+		stored, err := getBoltHistory(tx, key)
+		if err != nil {
+			return err
+		}
+		if stored == nil || stored.Version != history.Version {
+			return ErrHistoryConflict
+		}
+		history.Version++
+
+		if err := deleteBoltChats(tx, key); err != nil {
+			return err
+		}
+		if err := putBoltChats(tx, key, history.Chats); err != nil {
+			return err
+		}
+		return putBoltHistory(tx, history)
+	})
+}
+
+func (b *BoltHistoryStore) UpdateSession(ctx context.Context, history History) error {
+	history.SessionID = sessionOrDefault(history.SessionID)
+	return b.db.Update(func(tx *bolt.Tx) error {
+		stored, err := getBoltHistory(tx, boltThreadKey(history.UserID, history.SessionID))
+		if err != nil {
+			return err
+		}
+		if stored == nil || stored.Version != history.Version {
+			return ErrHistoryConflict
+		}
+		history.Version++
+		return putBoltHistory(tx, history)
+	})
+}
+
+func (b *BoltHistoryStore) DeleteHistory(ctx context.Context, userID, sessionID string) error {
+	key := boltThreadKey(userID, sessionID)
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(historyBucket).Get(key) == nil {
+			return ErrSessionNotFound
+		}
+		if err := deleteBoltChats(tx, key); err != nil {
+			return err
+		}
+		return tx.Bucket(historyBucket).Delete(key)
+	})
+}
+
+func (b *BoltHistoryStore) AppendChats(ctx context.Context, userID, sessionID string, chats []Chat) error {
+	key := boltThreadKey(userID, sessionID)
+	return b.db.Update(func(tx *bolt.Tx) error {
+		history, err := getBoltHistory(tx, key)
+		if err != nil {
+			return err
+		}
+		if history == nil {
+			if sessionOrDefault(sessionID) != DefaultSessionID {
+				return ErrSessionNotFound
+			}
+			history = &History{UserID: userID, SessionID: DefaultSessionID}
+		}
+		if err := putBoltChats(tx, key, chats); err != nil {
+			return err
+		}
+		history.LastUpdated = time.Now()
+		history.Version++
+		return putBoltHistory(tx, *history)
+	})
+}
+
+func (b *BoltHistoryStore) ListChats(ctx context.Context, userID, sessionID string, limit int, before string) (*ChatPage, error) {
+	page := &ChatPage{Chats: []Chat{}}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(chatsBucket).Bucket(boltThreadKey(userID, sessionID))
+		if bucket == nil {
+			return nil
+		}
+
+		// Walk backwards from the newest chat older than before.
+		cursor := bucket.Cursor()
+		var key, value []byte
+		if before == "" {
+			key, value = cursor.Last()
+		} else if key, _ = cursor.Seek([]byte(before)); key == nil {
+			key, value = cursor.Last()
+		} else {
+			key, value = cursor.Prev()
+		}
+
+		var newestFirst []Chat
+		for ; key != nil; key, value = cursor.Prev() {
+			if limit > 0 && len(newestFirst) == limit {
+				page.NextCursor = newestFirst[len(newestFirst)-1].ID
+				break
+			}
+			var chat Chat
+			if err := json.Unmarshal(value, &chat); err != nil {
+				return err
+			}
+			newestFirst = append(newestFirst, chat)
+		}
+
+		for i := len(newestFirst) - 1; i >= 0; i-- {
+			page.Chats = append(page.Chats, newestFirst[i])
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+func (b *BoltHistoryStore) SetChatAudio(ctx context.Context, userID, sessionID, chatID, audioURL string, playlist []string) error {
+	key := boltThreadKey(userID, sessionID)
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(chatsBucket).Bucket(key)
+		if bucket == nil {
+			return ErrChatNotFound
+		}
+		value := bucket.Get([]byte(chatID))
+		if value == nil {
+			return ErrChatNotFound
+		}
+		var chat Chat
+		if err := json.Unmarshal(value, &chat); err != nil {
+			return err
+		}
+		chat.AudioURL = audioURL
+		chat.AudioPlaylist = playlist
+		if err := putBoltChats(tx, key, []Chat{chat}); err != nil {
+			return err
+		}
+
+		history, err := getBoltHistory(tx, key)
+		if err != nil || history == nil {
+			return err
+		}
+		history.Version++
+		return putBoltHistory(tx, *history)
+	})
+}
+
+// Close releases the database file.
+func (b *BoltHistoryStore) Close() error {
+	return b.db.Close()
+}
+
+// boltThreadKey is the key of a session in both buckets. The default
+// session keeps the plain user ID it had before sessions existed; other
+// sessions append their ID after a NUL byte, so all sessions of a user share
+// a key prefix.
+func boltThreadKey(userID, sessionID string) []byte {
+	sessionID = sessionOrDefault(sessionID)
+	if sessionID == DefaultSessionID {
+		return []byte(userID)
+	}
+	return []byte(userID + "\x00" + sessionID)
+}
+
+func getBoltHistory(tx *bolt.Tx, key []byte) (*History, error) {
+	value := tx.Bucket(historyBucket).Get(key)
+	if value == nil {
+		return nil, nil
+	}
+	history := &History{}
+	if err := json.Unmarshal(value, history); err != nil {
+		return nil, err
+	}
+	history.SessionID = sessionOrDefault(history.SessionID)
+	return history, nil
+}
+
+func putBoltHistory(tx *bolt.Tx, history History) error {
+	history.Chats = nil
+	value, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(historyBucket).Put(boltThreadKey(history.UserID, history.SessionID), value)
+}
+
+func putBoltChats(tx *bolt.Tx, key []byte, chats []Chat) error {
+	if len(chats) == 0 {
+		return nil
+	}
+	bucket, err := tx.Bucket(chatsBucket).CreateBucketIfNotExists(key)
+	if err != nil {
+		return err
+	}
+	for _, chat := range chats {
+		value, err := json.Marshal(chat)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte(chat.ID), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteBoltChats(tx *bolt.Tx, key []byte) error {
+	chats := tx.Bucket(chatsBucket)
+	if chats.Bucket(key) == nil {
+		return nil
+	}
+	return chats.DeleteBucket(key)
+}
+
+// migrateBoltHistories moves chats stored inside history documents into
+// their own records.
+func migrateBoltHistories(tx *bolt.Tx) error {
+	var legacy []History
+	err := tx.Bucket(historyBucket).ForEach(func(key, value []byte) error {
+		var history History
+		if err := json.Unmarshal(value, &history); err != nil {
+			return err
+		}
+		if len(history.Chats) > 0 {
+			legacy = append(legacy, history)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, history := range legacy {
+		key := boltThreadKey(history.UserID, history.SessionID)
+		if err := putBoltChats(tx, key, assignLegacyChatIDs(history)); err != nil {
+			return err
+		}
+		if err := putBoltHistory(tx, history); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,344 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func chatContents(chats []Chat) []string {
+	contents := make([]string, len(chats))
+	for i, chat := range chats {
+		contents[i] = chat.Content
+	}
+	return contents
+}
+
+func expectContents(t *testing.T, chats []Chat, want ...string) {
+	t.Helper()
+	got := chatContents(chats)
+	if len(got) != len(want) {
+		t.Fatalf("Expected chats %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Expected chats %v, got %v", want, got)
+		}
+	}
+}
+
+func testHistoryStore(t *testing.T, store HistoryStore) {
+	t.Helper()
+
+	history, err := store.GetHistory(context.Background(), "fan", DefaultSessionID)
+	if err != nil || history != nil {
+		t.Fatalf("Expected no history yet, got %v, %v", history, err)
+	}
+
+	created := History{UserID: "fan", Type: "idol", VoiceID: "max", LastUpdated: time.Now().UTC()}
+	if err := store.CreateHistory(context.Background(), created); err != nil {
+		t.Fatalf("CreateHistory failed: %v", err)
+	}
+
+	history, err = store.GetHistory(context.Background(), "fan", DefaultSessionID)
+	if err != nil || history == nil {
+		t.Fatalf("Expected the created history, got %v, %v", history, err)
+	}
+	if history.Type != "idol" || history.VoiceID != "max" {
+		t.Fatalf("Unexpected history %+v", history)
+	}
+	if err := store.CreateHistory(context.Background(), created); err != ErrHistoryExists {
+		t.Fatalf("Expected ErrHistoryExists, got %v", err)
+	}
+
+	var chats []Chat
+	for _, content := range []string{"one", "two", "three", "four", "five"} {
+		chats = append(chats, Chat{ID: NewChatID(), Role: "user", Content: content})
+	}
+	if err := store.AppendChats(context.Background(), "fan", DefaultSessionID, chats[:2]); err != nil {
+		t.Fatalf("AppendChats failed: %v", err)
+	}
+	if err := store.AppendChats(context.Background(), "fan", DefaultSessionID, chats[2:]); err != nil {
+		t.Fatalf("AppendChats failed: %v", err)
+	}
+	chats[0].Content = "changed after saving"
+
+	page, err := store.ListChats(context.Background(), "fan", DefaultSessionID, 0, "")
+	if err != nil {
+		t.Fatalf("ListChats failed: %v", err)
+	}
+	expectContents(t, page.Chats, "one", "two", "three", "four", "five")
+	if page.NextCursor != "" {
+		t.Fatalf("Expected no cursor when listing all chats, got %q", page.NextCursor)
+	}
+
+	page, err = store.ListChats(context.Background(), "fan", DefaultSessionID, 2, "")
+	if err != nil {
+		t.Fatalf("ListChats failed: %v", err)
+	}
+	expectContents(t, page.Chats, "four", "five")
+
+	page, err = store.ListChats(context.Background(), "fan", DefaultSessionID, 2, page.NextCursor)
+	if err != nil {
+		t.Fatalf("ListChats failed: %v", err)
+	}
+	expectContents(t, page.Chats, "two", "three")
+
+	page, err = store.ListChats(context.Background(), "fan", DefaultSessionID, 2, page.NextCursor)
+	if err != nil {
+		t.Fatalf("ListChats failed: %v", err)
+	}
+	expectContents(t, page.Chats, "one")
+	if page.NextCursor != "" {
+		t.Fatalf("Expected no cursor on the oldest page, got %q", page.NextCursor)
+	}
+
+	history.Chats = []Chat{chats[4]}
+	if err := store.UpdateHistory(context.Background(), *history); err != ErrHistoryConflict {
+		t.Fatalf("Expected ErrHistoryConflict for a stale version, got %v", err)
+	}
+
+	current, err := store.GetHistory(context.Background(), "fan", DefaultSessionID)
+	if err != nil || current.Version != history.Version+2 {
+		t.Fatalf("Expected every append to bump the version, got %v, %v", current, err)
+	}
+	history.Version = current.Version
+	if err := store.UpdateHistory(context.Background(), *history); err != nil {
+		t.Fatalf("UpdateHistory failed: %v", err)
+	}
+	page, err = store.ListChats(context.Background(), "fan", DefaultSessionID, 0, "")
+	if err != nil {
+		t.Fatalf("ListChats failed: %v", err)
+	}
+	expectContents(t, page.Chats, "five")
+
+	page, err = store.ListChats(context.Background(), "nobody", DefaultSessionID, 10, "")
+	if err != nil || len(page.Chats) != 0 {
+		t.Fatalf("Expected no chats for an unknown user, got %v, %v", page, err)
+	}
+
+	testHistoryStoreSessions(t, store)
+}
+
+func testHistoryStoreSessions(t *testing.T, store HistoryStore) {
+	t.Helper()
+
+	session := History{UserID: "fan", SessionID: NewChatID(), Title: "Trip"}
+	if err := store.CreateHistory(context.Background(), session); err != nil {
+		t.Fatalf("CreateHistory of a session failed: %v", err)
+	}
+	if err := store.AppendChats(context.Background(), "fan", session.SessionID, []Chat{{ID: NewChatID(), Role: "user", Content: "packing"}}); err != nil {
+		t.Fatalf("AppendChats failed: %v", err)
+	}
+
+	page, err := store.ListChats(context.Background(), "fan", session.SessionID, 0, "")
+	if err != nil {
+		t.Fatalf("ListChats failed: %v", err)
+	}
+	expectContents(t, page.Chats, "packing")
+	page, err = store.ListChats(context.Background(), "fan", DefaultSessionID, 0, "")
+	if err != nil {
+		t.Fatalf("ListChats failed: %v", err)
+	}
+	expectContents(t, page.Chats, "five")
+
+	histories, err := store.ListHistories(context.Background(), "fan")
+	if err != nil || len(histories) != 2 {
+		t.Fatalf("Expected the default session and one more, got %v, %v", histories, err)
+	}
+	if other, _ := store.ListHistories(context.Background(), "fa"); len(other) != 0 {
+		t.Fatalf("Expected no sessions of another user, got %v", other)
+	}
+
+	stored, err := store.GetHistory(context.Background(), "fan", session.SessionID)
+	if err != nil || stored == nil {
+		t.Fatalf("Expected the session, got %v, %v", stored, err)
+	}
+	stored.Title = "Summer trip"
+	stored.Archived = true
+	if err := store.UpdateSession(context.Background(), *stored); err != nil {
+		t.Fatalf("UpdateSession failed: %v", err)
+	}
+	if err := store.UpdateSession(context.Background(), *stored); err != ErrHistoryConflict {
+		t.Fatalf("Expected ErrHistoryConflict for a stale version, got %v", err)
+	}
+	renamed, _ := store.GetHistory(context.Background(), "fan", session.SessionID)
+	if renamed.Title != "Summer trip" || !renamed.Archived {
+		t.Fatalf("Unexpected session %+v", renamed)
+	}
+	page, _ = store.ListChats(context.Background(), "fan", session.SessionID, 0, "")
+	expectContents(t, page.Chats, "packing")
+
+	if err := store.DeleteHistory(context.Background(), "fan", session.SessionID); err != nil {
+		t.Fatalf("DeleteHistory failed: %v", err)
+	}
+	if err := store.DeleteHistory(context.Background(), "fan", session.SessionID); err != ErrSessionNotFound {
+		t.Fatalf("Expected ErrSessionNotFound, got %v", err)
+	}
+	page, _ = store.ListChats(context.Background(), "fan", session.SessionID, 0, "")
+	if len(page.Chats) != 0 {
+		t.Fatalf("Expected the chats to be deleted with the session, got %v", page.Chats)
+	}
+	if err := store.AppendChats(context.Background(), "fan", session.SessionID, []Chat{{ID: NewChatID(), Role: "user", Content: "late"}}); err != ErrSessionNotFound {
+		t.Fatalf("Expected appending to a deleted session to fail with ErrSessionNotFound, got %v", err)
+	}
+	if histories, _ := store.ListHistories(context.Background(), "fan"); len(histories) != 1 || histories[0].SessionID != DefaultSessionID {
+		t.Fatalf("Expected only the default session to remain, got %v", histories)
+	}
+}
+
+func TestMemoryHistoryStore(t *testing.T) {
+	testHistoryStore(t, NewMemoryHistoryStore())
+}
+
+func TestBoltHistoryStore(t *testing.T) {
+	store, err := NewBoltHistoryStore(filepath.Join(t.TempDir(), "history.db"))
+	if err != nil {
+		t.Fatalf("NewBoltHistoryStore failed: %v", err)
+	}
+	defer store.Close()
+
+	testHistoryStore(t, store)
+}
+
+func TestBoltHistoryStoreMigratesLegacyHistories(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	legacy, _ := json.Marshal(History{
+		UserID: "fan",
+		Chats:  []Chat{{Role: "user", Content: "hi"}, {Role: "assistant", Content: "hello"}},
+	})
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(historyBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("fan"), legacy)
+	})
+	db.Close()
+	if err != nil {
+		t.Fatalf("Failed to write legacy history: %v", err)
+	}
+
+	store, err := NewBoltHistoryStore(path)
+	if err != nil {
+		t.Fatalf("NewBoltHistoryStore failed: %v", err)
+	}
+	defer store.Close()
+
+	page, err := store.ListChats(context.Background(), "fan", DefaultSessionID, 0, "")
+	if err != nil {
+		t.Fatalf("ListChats failed: %v", err)
+	}
+	expectContents(t, page.Chats, "hi", "hello")
+	if page.Chats[0].ID == "" || page.Chats[0].ID >= page.Chats[1].ID {
+		t.Fatalf("Expected ordered chat IDs, got %q and %q", page.Chats[0].ID, page.Chats[1].ID)
+	}
+}
+
+func TestAssignLegacyChatIDsIsDeterministic(t *testing.T) {
+	history := History{
+		UserID: "fan",
+		Chats:  []Chat{{Content: "a"}, {Content: "b"}, {ID: "KEEP", Content: "c"}},
+	}
+
+	first := assignLegacyChatIDs(history)
+	second := assignLegacyChatIDs(history)
+	for i := range first {
+		if first[i].ID != second[i].ID {
+			t.Fatalf("Expected the same IDs on every run, got %q and %q", first[i].ID, second[i].ID)
+		}
+	}
+	if first[0].ID >= first[1].ID || first[2].ID != "KEEP" {
+		t.Fatalf("Unexpected IDs %q %q %q", first[0].ID, first[1].ID, first[2].ID)
+	}
+}
+
+// racingStore appends a chat right before the first UpdateHistory, like a
+// concurrent /chat request would.
+type racingStore struct {
+	HistoryStore
+	raced bool
+}
+
+func (r *racingStore) UpdateHistory(ctx context.Context, history History) error {
+	if !r.raced {
+		r.raced = true
+		if err := r.AppendChats(context.Background(), history.UserID, history.SessionID, []Chat{{ID: NewChatID(), Role: "user", Content: "concurrent"}}); err != nil {
+			return err
+		}
+	}
+	return r.HistoryStore.UpdateHistory(context.Background(), history)
+}
+
+func TestInsertChatMergesConcurrentAppends(t *testing.T) {
+	store := &racingStore{HistoryStore: NewMemoryHistoryStore()}
+	ops := &controllerOps{store: store}
+
+	if err := ops.Create_chat(context.Background(), History{UserID: "fan", Chats: []Chat{{Role: "user", Content: "old"}}}); err != nil {
+		t.Fatalf("Create_chat failed: %v", err)
+	}
+	if err := ops.Insert_chat(context.Background(), "fan", DefaultSessionID, []Chat{{Role: "user", Content: "new"}}, 0); err != nil {
+		t.Fatalf("Insert_chat failed: %v", err)
+	}
+
+	_, chats := ops.Search_chat(context.Background(), "fan")
+	expectContents(t, chats, "new", "concurrent")
+}
+
+func TestInsertChatRejectsStaleVersion(t *testing.T) {
+	ops := &controllerOps{store: NewMemoryHistoryStore()}
+	if err := ops.Create_chat(context.Background(), History{UserID: "fan"}); err != nil {
+		t.Fatalf("Create_chat failed: %v", err)
+	}
+	if err := ops.Append_chat(context.Background(), "fan", DefaultSessionID, Chat{Role: "user", Content: "hi"}); err != nil {
+		t.Fatalf("Append_chat failed: %v", err)
+	}
+
+	if err := ops.Insert_chat(context.Background(), "fan", DefaultSessionID, nil, 1); err != ErrHistoryConflict {
+		t.Fatalf("Expected ErrHistoryConflict, got %v", err)
+	}
+	if err := ops.Insert_chat(context.Background(), "fan", DefaultSessionID, nil, 2); err != nil {
+		t.Fatalf("Insert_chat with the current version failed: %v", err)
+	}
+}
+
+func TestInsertChatFailsWhenMergeIsImpossible(t *testing.T) {
+	seen := []Chat{{ID: "1", Role: "user", Content: "hi"}}
+	current := []Chat{{ID: "1", Role: "user", Content: "edited"}}
+	if _, ok := mergeConcurrentChats(seen, current, nil); ok {
+		t.Fatal("Expected a concurrent edit to prevent merging")
+	}
+	if _, ok := mergeConcurrentChats(seen, nil, nil); ok {
+		t.Fatal("Expected a concurrent delete to prevent merging")
+	}
+}
+
+func TestInsertChatKeepsChatsAppendedSinceRead(t *testing.T) {
+	ops := &controllerOps{store: NewMemoryHistoryStore()}
+	old := Chat{ID: NewChatID(), Role: "user", Content: "old"}
+	if err := ops.Create_chat(context.Background(), History{UserID: "fan", Chats: []Chat{old}}); err != nil {
+		t.Fatalf("Create_chat failed: %v", err)
+	}
+	// Appended after the caller read the history, before it replaces it
+	if err := ops.Append_chat(context.Background(), "fan", DefaultSessionID, Chat{Role: "assistant", Content: "later"}); err != nil {
+		t.Fatalf("Append_chat failed: %v", err)
+	}
+
+	edited := old
+	edited.Content = "old, edited"
+	if err := ops.Insert_chat(context.Background(), "fan", DefaultSessionID, []Chat{edited, {Role: "user", Content: "new"}}, 0); err != nil {
+		t.Fatalf("Insert_chat failed: %v", err)
+	}
+
+	_, chats := ops.Search_chat(context.Background(), "fan")
+	expectContents(t, chats, "old, edited", "later", "new")
+}
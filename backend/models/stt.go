@@ -0,0 +1,138 @@
+package models
+
+import (
+	"backend/config"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// Names of the built-in STT services.
+const (
+	STTProviderWhisper    = "whisper"
+	STTProviderTranscribe = "transcribe"
+	STTProviderFake       = "fake"
+	STTProviderNone       = "none"
+)
+
+var (
+	// ErrSTTUnavailable is returned when no STT service is configured.
+	ErrSTTUnavailable = errors.New("speech to text is not configured")
+	// ErrUnsupportedAudio is returned for uploads that aren't WAV, WebM or
+	// MP3.
+	ErrUnsupportedAudio = errors.New("unsupported audio format")
+	// ErrEmptyTranscript is returned when no speech was recognized.
+	ErrEmptyTranscript = errors.New("no speech recognized")
+)
+
+// audioFormats maps the accepted upload content types to their format.
+var audioFormats = map[string]string{
+	"audio/wav":    "wav",
+	"audio/wave":   "wav",
+	"audio/x-wav":  "wav",
+	"audio/webm":   "webm",
+	"video/webm":   "webm",
+	"audio/mpeg":   "mp3",
+	"audio/mp3":    "mp3",
+	"audio/x-mpeg": "mp3",
+}
+
+// AudioFormat returns the format, "wav", "webm" or "mp3", of an upload with
+// the given content type, falling back to the extension of filename for
+// generic content types.
+func AudioFormat(contentType, filename string) (string, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if format, ok := audioFormats[strings.ToLower(mediaType)]; ok {
+		return format, nil
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".wav":
+		return "wav", nil
+	case ".webm":
+		return "webm", nil
+	case ".mp3":
+		return "mp3", nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrUnsupportedAudio, contentType)
+}
+
+// AudioContentType returns the canonical content type of format.
+func AudioContentType(format string) string {
+	switch format {
+	case "wav":
+		return "audio/wav"
+	case "webm":
+		return "audio/webm"
+	default:
+		return "audio/mpeg"
+	}
+}
+
+// STTService transcribes voice messages. format is one of those returned by
+// AudioFormat; an empty language lets the service detect it.
+type STTService interface {
+	Transcribe(ctx context.Context, audio []byte, format string, language string) (string, error)
+}
+
+// NewSTTServiceFromConfig returns the STT service selected by cfg.Provider.
+// If it is empty, whisper is used when cfg.WhisperURL is set, transcribe
+// when cfg.TranscribeBucket is set, and none otherwise.
+//
+//	whisper:    WhisperURL, WhisperAPIKey, WhisperModel
+//	transcribe: the default AWS credentials, TranscribeBucket, TranscribePrefix
+//	fake:       no settings, for tests and local development
+func NewSTTServiceFromConfig(cfg config.STT) (STTService, error) {
+	name := cfg.Provider
+	if name == "" {
+		switch {
+		case cfg.WhisperURL != "":
+			name = STTProviderWhisper
+		case cfg.TranscribeBucket != "":
+			name = STTProviderTranscribe
+		default:
+			name = STTProviderNone
+		}
+	}
+	slog.Info("STT provider", "provider", name)
+
+	switch name {
+	case STTProviderWhisper:
+		return NewWhisperSTT(cfg.WhisperURL, cfg.WhisperAPIKey, cfg.WhisperModel), nil
+	case STTProviderTranscribe:
+		return NewTranscribeSTT(cfg.TranscribeBucket, cfg.TranscribePrefix)
+	case STTProviderFake:
+		return NewFakeSTT(), nil
+	case STTProviderNone:
+		return noneSTT{}, nil
+	default:
+		return nil, fmt.Errorf("unknown STT provider %q", name)
+	}
+}
+
+// fakeSTT reads the uploaded audio as UTF-8 text, so tests can send the
+// transcript they want as the audio file.
+type fakeSTT struct{}
+
+// NewFakeSTT returns the fake STT service.
+func NewFakeSTT() STTService {
+	return fakeSTT{}
+}
+
+func (fakeSTT) Transcribe(ctx context.Context, audio []byte, format string, language string) (string, error) {
+	if !utf8.Valid(audio) {
+		return fmt.Sprintf("Fake transcript of %d bytes of %s", len(audio), format), nil
+	}
+	return strings.TrimSpace(string(audio)), nil
+}
+
+// noneSTT rejects every voice message.
+type noneSTT struct{}
+
+func (noneSTT) Transcribe(ctx context.Context, audio []byte, format string, language string) (string, error) {
+	return "", ErrSTTUnavailable
+}
@@ -0,0 +1,75 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAudioFormat(t *testing.T) {
+	cases := []struct {
+		contentType string
+		filename    string
+		format      string
+	}{
+		{"audio/wav", "voice", "wav"},
+		{"audio/webm;codecs=opus", "voice", "webm"},
+		{"audio/mpeg", "voice", "mp3"},
+		{"application/octet-stream", "voice.MP3", "mp3"},
+	}
+	for _, tc := range cases {
+		format, err := AudioFormat(tc.contentType, tc.filename)
+		if err != nil || format != tc.format {
+			t.Fatalf("Expected %s for %s %s, got %s, %v", tc.format, tc.contentType, tc.filename, format, err)
+		}
+	}
+	if _, err := AudioFormat("image/png", "voice.png"); !errors.Is(err, ErrUnsupportedAudio) {
+		t.Fatalf("Expected ErrUnsupportedAudio, got %v", err)
+	}
+}
+
+func TestWhisperSTT(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/audio/transcriptions" || r.Header.Get("Authorization") != "Bearer key" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		audio, _ := io.ReadAll(file)
+		if string(audio) != "RIFF" || header.Filename != "voice.wav" || r.FormValue("model") != "whisper-1" || r.FormValue("language") != "zh" {
+			http.Error(w, "unexpected form", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"text":" 你好 "}`))
+	}))
+	defer server.Close()
+
+	stt := NewWhisperSTT(server.URL+"/v1/", "key", "")
+	transcript, err := stt.Transcribe(context.Background(), []byte("RIFF"), "wav", "zh")
+	if err != nil || transcript != "你好" {
+		t.Fatalf("Expected the transcript, got %q, %v", transcript, err)
+	}
+}
+
+func TestWhisperSTTStopsWithContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server notices the client is gone once the upload is read
+		io.ReadAll(r.Body)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := NewWhisperSTT(server.URL, "", "").Transcribe(ctx, []byte("RIFF"), "wav", ""); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the transcription to stop with the context, got %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/transcribe"
+	"github.com/aws/aws-sdk-go-v2/service/transcribe/types"
+)
+
+const (
+	// transcribePollInterval is how often a transcription job is checked.
+	transcribePollInterval = time.Second
+	// transcribeCleanupTimeout bounds deleting the audio and the job.
+	transcribeCleanupTimeout = 30 * time.Second
+)
+
+// transcribeSTT transcribes with Amazon Transcribe batch jobs. Transcribe
+// only reads media from S3, so every voice message is uploaded to bucket
+// first; the object and the job are deleted once the transcript is read.
+type transcribeSTT struct {
+	client *transcribe.Client
+	s3     *s3.Client
+	http   *http.Client
+	bucket string
+	prefix string
+}
+
+// NewTranscribeSTT returns a Transcribe STT service with the default
+// AWS credentials, uploading voice messages to bucket under prefix.
+func NewTranscribeSTT(bucket, prefix string) (STTService, error) {
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	return &transcribeSTT{
+		client: transcribe.NewFromConfig(cfg),
+		s3:     s3.NewFromConfig(cfg),
+		http:   &http.Client{Timeout: 30 * time.Second},
+		bucket: bucket,
+		prefix: prefix,
+	}, nil
+}
+
+func (t *transcribeSTT) Transcribe(ctx context.Context, audio []byte, format string, language string) (string, error) {
+	name := "voice-" + NewChatID()
+	key := t.prefix + name + "." + format
+	if _, err := t.s3.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(t.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(audio),
+		ContentType: aws.String(AudioContentType(format)),
+	}); err != nil {
+		return "", err
+	}
+	defer t.cleanup(ctx, name, key)
+
+	input := &transcribe.StartTranscriptionJobInput{
+		TranscriptionJobName: aws.String(name),
+		Media:                &types.Media{MediaFileUri: aws.String(fmt.Sprintf("s3://%s/%s", t.bucket, key))},
+		MediaFormat:          types.MediaFormat(format),
+	}
+	if language != "" {
+		input.LanguageCode = types.LanguageCode(language)
+	} else {
+		input.IdentifyLanguage = aws.Bool(true)
+	}
+	if _, err := t.client.StartTranscriptionJob(ctx, input); err != nil {
+		return "", err
+	}
+
+	transcriptURI, err := t.wait(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	return t.readTranscript(ctx, transcriptURI)
+}
+
+// wait polls the job until it is done and returns the URI of its
+// transcript.
+func (t *transcribeSTT) wait(ctx context.Context, name string) (string, error) {
+	ticker := time.NewTicker(transcribePollInterval)
+	defer ticker.Stop()
+	for {
+		output, err := t.client.GetTranscriptionJob(ctx, &transcribe.GetTranscriptionJobInput{
+			TranscriptionJobName: aws.String(name),
+		})
+		if err != nil {
+			return "", err
+		}
+
+		job := output.TranscriptionJob
+		switch job.TranscriptionJobStatus {
+		case types.TranscriptionJobStatusCompleted:
+			return aws.ToString(job.Transcript.TranscriptFileUri), nil
+		case types.TranscriptionJobStatusFailed:
+			return "", fmt.Errorf("transcription job %s failed: %s", name, aws.ToString(job.FailureReason))
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return "", fmt.Errorf("transcription job %s: %w", name, ctx.Err())
+		}
+	}
+}
+
+// readTranscript downloads the transcript file of a finished job.
+func (t *transcribeSTT) readTranscript(ctx context.Context, uri string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := t.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("reading transcript returned %d", resp.StatusCode)
+	}
+
+	var transcript struct {
+		Results struct {
+			Transcripts []struct {
+				Transcript string `json:"transcript"`
+			} `json:"transcripts"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&transcript); err != nil {
+		return "", err
+	}
+	texts := make([]string, 0, len(transcript.Results.Transcripts))
+	for _, t := range transcript.Results.Transcripts {
+		texts = append(texts, t.Transcript)
+	}
+	return strings.TrimSpace(strings.Join(texts, " ")), nil
+}
+
+// cleanup deletes the uploaded audio and the job, also when the request was
+// cancelled or timed out. The transcript has been read by then, so failures
+// are only logged.
+func (t *transcribeSTT) cleanup(ctx context.Context, name, key string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), transcribeCleanupTimeout)
+	defer cancel()
+	if _, err := t.s3.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(t.bucket), Key: aws.String(key)}); err != nil {
+		slog.WarnContext(ctx, "Failed to delete voice message", "key", key, "error", err)
+	}
+	if _, err := t.client.DeleteTranscriptionJob(ctx, &transcribe.DeleteTranscriptionJobInput{TranscriptionJobName: aws.String(name)}); err != nil {
+		slog.WarnContext(ctx, "Failed to delete transcription job", "job", name, "error", err)
+	}
+}
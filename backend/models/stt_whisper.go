@@ -0,0 +1,85 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const defaultWhisperModel = "whisper-1"
+
+// whisperSTT talks to any HTTP endpoint implementing the OpenAI audio
+// transcriptions API, e.g. OpenAI itself, faster-whisper-server or LocalAI.
+type whisperSTT struct {
+	baseURL string
+	apiKey  string
+	model   string
+	client  *http.Client
+}
+
+// NewWhisperSTT returns an STT service for the transcriptions endpoint under
+// baseURL, e.g. "https://api.openai.com/v1". apiKey may be empty for
+// endpoints that don't need one, model defaults to "whisper-1".
+func NewWhisperSTT(baseURL, apiKey, model string) STTService {
+	if model == "" {
+		model = defaultWhisperModel
+	}
+	return &whisperSTT{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		apiKey:  apiKey,
+		model:   model,
+		client:  &http.Client{Timeout: 2 * time.Minute},
+	}
+}
+
+func (w *whisperSTT) Transcribe(ctx context.Context, audio []byte, format string, language string) (string, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("model", w.model)
+	if language != "" {
+		form.WriteField("language", language)
+	}
+	file, err := form.CreateFormFile("file", "voice."+format)
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.Write(audio); err != nil {
+		return "", err
+	}
+	if err := form.Close(); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.baseURL+"/audio/transcriptions", &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if w.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+w.apiKey)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return "", fmt.Errorf("transcriptions endpoint returned %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+
+	var response struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(response.Text), nil
+}
@@ -0,0 +1,55 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Stages of a request that have their own timeout.
+const (
+	StageStorage = "storage"
+	StageLLM     = "llm"
+	StageTTS     = "tts"
+	StageSTT     = "stt"
+)
+
+// TimeoutError is returned when a stage of a request didn't finish within
+// its timeout. It matches context.DeadlineExceeded.
+type TimeoutError struct {
+	Stage   string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %v", e.Stage, e.Timeout)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// stageTimeout bounds the calls of a stage; a zero timeout leaves them
+// bounded by the context of the request only.
+type stageTimeout struct {
+	stage   string
+	timeout time.Duration
+}
+
+// context returns ctx bounded by the timeout of the stage.
+func (s stageTimeout) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.timeout)
+}
+
+// err returns a TimeoutError for an error caused by the deadline of ctx, a
+// context returned by s.context, and err itself otherwise.
+func (s stageTimeout) err(ctx context.Context, err error) error {
+	if err != nil && s.timeout > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &TimeoutError{Stage: s.stage, Timeout: s.timeout}
+	}
+	return err
+}
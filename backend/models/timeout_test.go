@@ -0,0 +1,47 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// hangingTTS speaks only once ctx is done.
+type hangingTTS struct{}
+
+func (hangingTTS) Name() string {
+	return "hanging"
+}
+
+func (hangingTTS) Synthesize(ctx context.Context, text string, modelID int, speakerName string, opts SpeechOptions) (*SpeechAudio, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestSpeechCacheTimesOut(t *testing.T) {
+	cache := NewSpeechCache(newTestTTSRegistry(hangingTTS{}), nil, "")
+	cache.SetTimeout(10 * time.Millisecond)
+
+	_, err := cache.GenerateSpeech(context.Background(), "hello", 1, "eden", SpeechOptions{})
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) || timeoutErr.Stage != StageTTS {
+		t.Fatalf("Expected a TTS timeout, got %v", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the timeout to match context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestStageTimeoutLeavesCancellationAlone(t *testing.T) {
+	cache := NewSpeechCache(newTestTTSRegistry(hangingTTS{}), nil, "")
+	cache.SetTimeout(time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := cache.GenerateSpeech(ctx, "hello", 1, "eden", SpeechOptions{})
+	var timeoutErr *TimeoutError
+	if !errors.Is(err, context.Canceled) || errors.As(err, &timeoutErr) {
+		t.Fatalf("Expected the cancellation of the request, got %v", err)
+	}
+}
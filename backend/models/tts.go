@@ -1,95 +1,196 @@
 package models
 
 import (
-	"encoding/json"
+	"backend/config"
+	"context"
+	"errors"
 	"fmt"
-	"io"
-	"log"
-	"net/http"
-	"net/url"
-	"os"
+	"log/slog"
+	"sort"
 	"strings"
+	"sync"
+)
+
+// Names of the built-in TTS providers.
+const (
+	TTSProviderVyin  = "vyin"
+	TTSProviderPolly = "polly"
+	TTSProviderStub  = "stub"
+	TTSProviderNone  = "none"
+)
+
+const (
+	defaultSpeechMode = "stream"
+	// minSpeechSpeed and maxSpeechSpeed bound the speed factor clients may
+	// ask for.
+	minSpeechSpeed = 0.5
+	maxSpeechSpeed = 2.0
+)
+
+var (
+	// ErrInvalidSpeechOptions is returned for SpeechOptions out of range.
+	ErrInvalidSpeechOptions = errors.New("invalid speech options")
+	// ErrSpeechDisabled is returned by the none provider, which leaves
+	// replies text-only.
+	ErrSpeechDisabled = errors.New("speech is disabled")
 )
 
 type TTSService interface {
-	GenerateSpeech(text string, model_id int, speaker_name string) (string, error)
+	GenerateSpeech(ctx context.Context, text string, model_id int, speaker_name string, opts SpeechOptions) (string, error)
 }
 
-type ttsService struct {
-	apiKey string
+// SpeechOptions shape how a phrase is spoken. Zero fields use the defaults
+// of the TTS service.
+type SpeechOptions struct {
+	// Provider is the registered TTS provider name; empty uses the default.
+	// It comes from the persona, clients can't pick it.
+	Provider string `json:"-"`
+	// Speed is the speed factor, 1 being normal speed.
+	Speed float64 `json:"speed,omitempty"`
+	// Mode is the Vyin synthesis mode, "stream" by default.
+	Mode string `json:"mode,omitempty"`
+	// Emotion and Pitch are only passed on to voices that support them.
+	Emotion string  `json:"emotion,omitempty"`
+	Pitch   float64 `json:"pitch,omitempty"`
 }
 
-func NewTTSService() (TTSService, error) {
-	apiKey := os.Getenv("VYIN_API_KEY")
-	if apiKey == "" {
-		return nil, fmt.Errorf("VYIN_API_KEY environment variable not set")
+// Validate checks that o is within what the TTS service accepts.
+func (o SpeechOptions) Validate() error {
+	if o.Speed != 0 && (o.Speed < minSpeechSpeed || o.Speed > maxSpeechSpeed) {
+		return fmt.Errorf("%w: speed %v outside of [%v, %v]", ErrInvalidSpeechOptions, o.Speed, minSpeechSpeed, maxSpeechSpeed)
 	}
-	// Remove "Bearer " prefix if it exists to avoid duplication
-	apiKey = strings.TrimPrefix(apiKey, "Bearer ")
-	return &ttsService{apiKey: apiKey}, nil
+	if o.Mode != "" && strings.ContainsAny(o.Mode, " &=") {
+		return fmt.Errorf("%w: mode %q", ErrInvalidSpeechOptions, o.Mode)
+	}
+	return nil
+}
+
+// withDefaults fills the zero fields of o from defaults.
+func (o SpeechOptions) withDefaults(defaults SpeechOptions) SpeechOptions {
+	if o.Speed == 0 {
+		o.Speed = defaults.Speed
+	}
+	if o.Mode == "" {
+		o.Mode = defaults.Mode
+	}
+	if o.Emotion == "" {
+		o.Emotion = defaults.Emotion
+	}
+	if o.Pitch == 0 {
+		o.Pitch = defaults.Pitch
+	}
+	return o
+}
+
+// SpeechAudio is the result of a TTS provider: either the URL the audio can
+// be downloaded from, or the audio itself.
+type SpeechAudio struct {
+	URL         string
+	Data        []byte
+	ContentType string
 }
 
-type VyinRequest struct {
-	Text        string `json:"text"`
-	ModelID     int    `json:"model_id"`
-	SpeakerName string `json:"speaker_name"`
+// TTSProvider turns text into speech with one voice backend. speakerName
+// and modelID pick the voice; providers with a single model ignore modelID.
+type TTSProvider interface {
+	Name() string
+	Synthesize(ctx context.Context, text string, modelID int, speakerName string, opts SpeechOptions) (*SpeechAudio, error)
 }
 
-type VyinResponse struct {
-	AudioURL string `json:"audio_url"`
+// TTSProviderRegistry holds the configured TTS providers by name.
+type TTSProviderRegistry struct {
+	mu          sync.RWMutex
+	providers   map[string]TTSProvider
+	defaultName string
 }
 
-func (t *ttsService) GenerateSpeech(text string, model_id int, speaker_name string) (string, error) {
-	if text == "" {
-		return "", fmt.Errorf("text cannot be empty")
+// NewTTSProviderRegistry returns an empty registry whose Get("") resolves to
+// defaultName.
+func NewTTSProviderRegistry(defaultName string) *TTSProviderRegistry {
+	return &TTSProviderRegistry{
+		providers:   map[string]TTSProvider{},
+		defaultName: defaultName,
 	}
-	if speaker_name == "" {
-		return "", fmt.Errorf("speaker_name cannot be empty")
+}
+
+// Register adds provider, replacing any provider with the same name.
+func (r *TTSProviderRegistry) Register(provider TTSProvider) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.providers[provider.Name()] = provider
+}
+
+// Get returns the provider registered as name, or the default provider when
+// name is empty.
+func (r *TTSProviderRegistry) Get(name string) (TTSProvider, error) {
+	if name == "" {
+		name = r.defaultName
 	}
-	if model_id <= 0 {
-		return "", fmt.Errorf("model_id must be positive")
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	provider, ok := r.providers[name]
+	if !ok {
+		return nil, fmt.Errorf("TTS provider %q is not configured", name)
 	}
-	// 構建查詢參數 URL，補齊 speed_factor 與 mode
-	url := fmt.Sprintf("https://uat-persona-sound.data.gamania.com/api/v1/public/voice?text=%s&model_id=%d&speaker_name=%s&speed_factor=1&mode=stream",
-		url.QueryEscape(text), model_id, speaker_name)
+	return provider, nil
+}
 
-	// 創建 GET 請求
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return "", err
+// Names returns the registered provider names in sorted order.
+func (r *TTSProviderRegistry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.providers))
+	for name := range r.providers {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
+}
 
-	// 設置標頭
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", t.apiKey))
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Content-Type", "application/json")
+// NewTTSProviderRegistryFromConfig registers every provider that has its
+// settings in cfg. The stub and none providers are always available.
+// cfg.Provider picks the default; if empty it is vyin when cfg.VyinAPIKey is
+// set and none otherwise, so the server runs text-only.
+//
+//	vyin:  VyinAPIKey and the settings of TTSOptionsFromConfig
+//	polly: the default AWS credentials, PollyEngine
+func NewTTSProviderRegistryFromConfig(cfg config.TTS) (*TTSProviderRegistry, error) {
+	defaultName := cfg.Provider
+	if defaultName == "" {
+		defaultName = TTSProviderNone
+		if cfg.VyinAPIKey != "" {
+			defaultName = TTSProviderVyin
+		}
+	}
 
-	// 發送請求
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
+	registry := NewTTSProviderRegistry(defaultName)
+	registry.Register(NewStubTTSProvider())
+	registry.Register(noneTTSProvider{})
+	if cfg.VyinAPIKey != "" {
+		registry.Register(NewVyinProvider(cfg.VyinAPIKey, TTSOptionsFromConfig(cfg)))
 	}
-	defer resp.Body.Close()
 
-	// 記錄狀態碼和回應主體
-	log.Printf("TTS API status: %d", resp.StatusCode)
-	body, err := io.ReadAll(resp.Body)
+	polly, err := NewPollyProviderFromConfig(cfg)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	log.Printf("TTS API response body: %s", string(body))
+	registry.Register(polly)
 
-	// 確保回應是 JSON 格式
-	if resp.Header.Get("Content-Type") != "application/json" {
-		return "", fmt.Errorf("unexpected content type: %s", resp.Header.Get("Content-Type"))
+	if _, err := registry.Get(""); err != nil {
+		slog.Warn("Default TTS provider is not configured, speech requests will fail until it is", "error", err)
 	}
+	slog.Info("TTS providers", "providers", registry.Names(), "default", defaultName)
+	return registry, nil
+}
 
-	// 解析回應
-	var response VyinResponse
-	if err := json.Unmarshal(body, &response); err != nil {
-		return "", err
-	}
+// noneTTSProvider leaves replies without speech.
+type noneTTSProvider struct{}
+
+func (noneTTSProvider) Name() string {
+	return TTSProviderNone
+}
 
-	return response.AudioURL, nil
+func (noneTTSProvider) Synthesize(ctx context.Context, text string, modelID int, speakerName string, opts SpeechOptions) (*SpeechAudio, error) {
+	return nil, ErrSpeechDisabled
 }
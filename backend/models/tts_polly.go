@@ -0,0 +1,82 @@
+package models
+
+import (
+	"backend/config"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/polly"
+	"github.com/aws/aws-sdk-go-v2/service/polly/types"
+)
+
+// pollyProvider speaks with Amazon Polly. The speaker name of a persona is
+// the Polly voice ID, like "Zhiyu"; the model ID is ignored. Polly returns
+// the audio itself, so it can only be served through a blob store.
+type pollyProvider struct {
+	client *polly.Client
+	engine types.Engine
+}
+
+// NewPollyProvider returns a Polly provider using engine, such as "neural"
+// or "standard".
+func NewPollyProvider(client *polly.Client, engine string) TTSProvider {
+	return &pollyProvider{client: client, engine: types.Engine(engine)}
+}
+
+// NewPollyProviderFromConfig returns a Polly provider with the default AWS
+// credentials and cfg.PollyEngine.
+func NewPollyProviderFromConfig(cfg config.TTS) (TTSProvider, error) {
+	awsCfg, err := awsconfig.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	return NewPollyProvider(polly.NewFromConfig(awsCfg), cfg.PollyEngine), nil
+}
+
+func (p *pollyProvider) Name() string {
+	return TTSProviderPolly
+}
+
+// Synthesize speaks text as mp3. A speed other than 1 is applied through
+// SSML prosody.
+func (p *pollyProvider) Synthesize(ctx context.Context, text string, modelID int, speakerName string, opts SpeechOptions) (*SpeechAudio, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	input := &polly.SynthesizeSpeechInput{
+		Engine:       p.engine,
+		OutputFormat: types.OutputFormatMp3,
+		Text:         aws.String(text),
+		VoiceId:      types.VoiceId(speakerName),
+	}
+	if opts.Speed != 0 && opts.Speed != defaultSpeechSpeed {
+		var escaped strings.Builder
+		if err := xml.EscapeText(&escaped, []byte(text)); err != nil {
+			return nil, err
+		}
+		input.Text = aws.String(fmt.Sprintf(`<speak><prosody rate="%.0f%%">%s</prosody></speak>`,
+			opts.Speed*100, escaped.String()))
+		input.TextType = types.TextTypeSsml
+	}
+
+	output, err := p.client.SynthesizeSpeech(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	defer output.AudioStream.Close()
+
+	data, err := io.ReadAll(io.LimitReader(output.AudioStream, maxAudioBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxAudioBytes {
+		return nil, fmt.Errorf("audio is larger than %d bytes", maxAudioBytes)
+	}
+	return &SpeechAudio{Data: data, ContentType: aws.ToString(output.ContentType)}, nil
+}
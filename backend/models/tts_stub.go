@@ -0,0 +1,81 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	stubSampleRate = 16000
+	// stubRuneDuration is how long the stub speaks per character, about the
+	// pace of Mandarin speech.
+	stubRuneDuration = 200 * time.Millisecond
+	stubMinDuration  = 500 * time.Millisecond
+	stubMaxDuration  = 30 * time.Second
+	stubToneHz       = 440
+)
+
+// stubTTSProvider generates a quiet sine tone WAV as long as the text
+// would take to read out, for tests and development without a TTS account.
+type stubTTSProvider struct{}
+
+// NewStubTTSProvider returns the stub provider.
+func NewStubTTSProvider() TTSProvider {
+	return stubTTSProvider{}
+}
+
+func (stubTTSProvider) Name() string {
+	return TTSProviderStub
+}
+
+func (stubTTSProvider) Synthesize(ctx context.Context, text string, modelID int, speakerName string, opts SpeechOptions) (*SpeechAudio, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	speed := opts.Speed
+	if speed == 0 {
+		speed = defaultSpeechSpeed
+	}
+
+	duration := time.Duration(float64(utf8.RuneCountInString(text)) * float64(stubRuneDuration) / speed)
+	if duration < stubMinDuration {
+		duration = stubMinDuration
+	}
+	if duration > stubMaxDuration {
+		duration = stubMaxDuration
+	}
+	return &SpeechAudio{Data: sineWAV(duration), ContentType: "audio/wav"}, nil
+}
+
+// sineWAV encodes a 16-bit mono PCM WAV file of a sine tone.
+func sineWAV(duration time.Duration) []byte {
+	samples := int(duration.Seconds() * stubSampleRate)
+	dataSize := samples * 2
+
+	var buf bytes.Buffer
+	buf.Grow(44 + dataSize)
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, uint32(36+dataSize))
+	buf.WriteString("WAVEfmt ")
+	binary.Write(&buf, binary.LittleEndian, uint32(16))               // fmt chunk size
+	binary.Write(&buf, binary.LittleEndian, uint16(1))                // PCM
+	binary.Write(&buf, binary.LittleEndian, uint16(1))                // mono
+	binary.Write(&buf, binary.LittleEndian, uint32(stubSampleRate))   // sample rate
+	binary.Write(&buf, binary.LittleEndian, uint32(stubSampleRate*2)) // byte rate
+	binary.Write(&buf, binary.LittleEndian, uint16(2))                // block align
+	binary.Write(&buf, binary.LittleEndian, uint16(16))               // bits per sample
+	buf.WriteString("data")
+	binary.Write(&buf, binary.LittleEndian, uint32(dataSize))
+
+	sample := make([]byte, 2)
+	for i := 0; i < samples; i++ {
+		value := 0.1 * math.Sin(2*math.Pi*stubToneHz*float64(i)/stubSampleRate)
+		binary.LittleEndian.PutUint16(sample, uint16(int16(value*math.MaxInt16)))
+		buf.Write(sample)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,143 @@
+package models
+
+import (
+	"backend/metrics"
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTTSServiceBuildsQuery(t *testing.T) {
+	var query map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = map[string]string{}
+		for key := range r.URL.Query() {
+			query[key] = r.URL.Query().Get(key)
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write([]byte(`{"audio_url":"https://audio.example/1.mp3"}`))
+	}))
+	defer server.Close()
+
+	tts := NewVyinProvider("key", TTSOptions{BaseURL: server.URL})
+	audio, err := tts.Synthesize(context.Background(), "你好 & bye", 1, "max&mode=x", SpeechOptions{Speed: 1.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if audio.URL != "https://audio.example/1.mp3" {
+		t.Fatalf("Unexpected audio URL %s", audio.URL)
+	}
+	if query["text"] != "你好 & bye" || query["speaker_name"] != "max&mode=x" || query["speed_factor"] != "1.5" || query["mode"] != "stream" {
+		t.Fatalf("Unexpected query %v", query)
+	}
+	if _, ok := query["emotion"]; ok {
+		t.Fatalf("Expected no emotion without one set, got %v", query)
+	}
+}
+
+func TestTTSServiceRetriesTemporaryErrors(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"audio_url":"https://audio.example/1.mp3"}`))
+	}))
+	defer server.Close()
+
+	unavailable := metrics.TTSResponses.WithLabelValues(TTSProviderVyin, "503")
+	before := testutil.ToFloat64(unavailable)
+
+	tts := NewVyinProvider("key", TTSOptions{BaseURL: server.URL, MaxRetries: 2})
+	if _, err := tts.Synthesize(context.Background(), "hi", 1, "max", SpeechOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Fatalf("Expected one retry, got %d calls", calls)
+	}
+	if got := testutil.ToFloat64(unavailable) - before; got != 1 {
+		t.Fatalf("Expected the 503 to be counted, got %v", got)
+	}
+}
+
+func TestTTSServiceKeepsTextOutOfErrors(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	tts := NewVyinProvider("key", TTSOptions{BaseURL: server.URL})
+	_, err := tts.Synthesize(context.Background(), "my secret diary", 1, "max", SpeechOptions{})
+	if err == nil {
+		t.Fatal("Expected the request to a closed server to fail")
+	}
+	if strings.Contains(err.Error(), "secret") || !strings.Contains(err.Error(), server.URL) {
+		t.Fatalf("Expected the error to name the API but not the text, got %v", err)
+	}
+}
+
+func TestTTSServiceReturnsVyinError(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"detail":"unknown speaker"}`))
+	}))
+	defer server.Close()
+
+	tts := NewVyinProvider("key", TTSOptions{BaseURL: server.URL, MaxRetries: 2})
+	_, err := tts.Synthesize(context.Background(), "hi", 1, "nobody", SpeechOptions{})
+	var vyinErr *VyinError
+	if !errors.As(err, &vyinErr) || vyinErr.StatusCode != http.StatusBadRequest || vyinErr.Message != "unknown speaker" {
+		t.Fatalf("Expected a VyinError, got %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("Expected no retries of a client error, got %d calls", calls)
+	}
+
+	if _, err := tts.Synthesize(context.Background(), "hi", 1, "max", SpeechOptions{Speed: 5}); !errors.Is(err, ErrInvalidSpeechOptions) {
+		t.Fatalf("Expected ErrInvalidSpeechOptions, got %v", err)
+	}
+}
+
+func TestStubTTSProvider(t *testing.T) {
+	stub := NewStubTTSProvider()
+	short, err := stub.Synthesize(context.Background(), "hi", 1, "max", SpeechOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	long, _ := stub.Synthesize(context.Background(), strings.Repeat("你好", 10), 1, "max", SpeechOptions{})
+	fast, _ := stub.Synthesize(context.Background(), strings.Repeat("你好", 10), 1, "max", SpeechOptions{Speed: 2})
+
+	if short.ContentType != "audio/wav" || !bytes.HasPrefix(short.Data, []byte("RIFF")) || string(short.Data[8:12]) != "WAVE" {
+		t.Fatalf("Expected a WAV file, got %s %q", short.ContentType, short.Data[:12])
+	}
+	if len(long.Data) <= len(short.Data) || len(fast.Data) >= len(long.Data) {
+		t.Fatalf("Expected the length to follow text and speed, got %d, %d and %d bytes", len(short.Data), len(long.Data), len(fast.Data))
+	}
+}
+
+func TestTTSProviderRegistry(t *testing.T) {
+	registry := NewTTSProviderRegistry(TTSProviderNone)
+	registry.Register(noneTTSProvider{})
+	registry.Register(NewStubTTSProvider())
+
+	if provider, err := registry.Get(""); err != nil || provider.Name() != TTSProviderNone {
+		t.Fatalf("Expected the default provider, got %v, %v", provider, err)
+	}
+	if _, err := registry.Get(TTSProviderVyin); err == nil {
+		t.Fatal("Expected an error for a provider that isn't registered")
+	}
+	provider, _ := registry.Get("")
+	if _, err := provider.Synthesize(context.Background(), "hi", 1, "max", SpeechOptions{}); !errors.Is(err, ErrSpeechDisabled) {
+		t.Fatalf("Expected ErrSpeechDisabled, got %v", err)
+	}
+}
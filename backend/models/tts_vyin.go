@@ -0,0 +1,290 @@
+package models
+
+import (
+	"backend/config"
+	"backend/metrics"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultVyinBaseURL = "https://uat-persona-sound.data.gamania.com"
+
+// TTSOptions configures the Vyin client.
+type TTSOptions struct {
+	// BaseURL is the address of the Vyin API.
+	BaseURL string
+	// Timeout bounds every request to the API.
+	Timeout time.Duration
+	// MaxRetries is how often a request is repeated after a network error,
+	// a 5xx or a 429 response.
+	MaxRetries int
+	// RetryBackoff is the wait before the first retry, doubling with every
+	// further one. A Retry-After header takes precedence.
+	RetryBackoff time.Duration
+	// Speech holds the defaults for the SpeechOptions of every phrase.
+	Speech SpeechOptions
+}
+
+// TTSOptionsFromConfig returns the options of the Vyin client set in cfg.
+func TTSOptionsFromConfig(cfg config.TTS) TTSOptions {
+	return TTSOptions{
+		BaseURL:      cfg.VyinBaseURL,
+		Timeout:      time.Duration(cfg.TimeoutSeconds) * time.Second,
+		MaxRetries:   cfg.HTTPRetries,
+		RetryBackoff: time.Duration(cfg.HTTPBackoffMS) * time.Millisecond,
+		Speech: SpeechOptions{
+			Speed:   cfg.Speed,
+			Mode:    cfg.Mode,
+			Emotion: cfg.Emotion,
+			Pitch:   cfg.Pitch,
+		},
+	}
+}
+
+// VyinError is an error response of the Vyin API.
+type VyinError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *VyinError) Error() string {
+	return fmt.Sprintf("vyin API error %d: %s", e.StatusCode, e.Message)
+}
+
+// Temporary reports whether the request may succeed when repeated.
+func (e *VyinError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// vyinProvider speaks with the Vyin voice API, which answers with the URL
+// of the generated audio.
+type vyinProvider struct {
+	apiKey string
+	opts   TTSOptions
+	client *http.Client
+}
+
+// NewVyinProvider returns a Vyin client calling the API with apiKey.
+func NewVyinProvider(apiKey string, opts TTSOptions) TTSProvider {
+	// Remove "Bearer " prefix if it exists to avoid duplication
+	apiKey = strings.TrimPrefix(apiKey, "Bearer ")
+	if opts.BaseURL == "" {
+		opts.BaseURL = defaultVyinBaseURL
+	}
+	opts.BaseURL = strings.TrimRight(opts.BaseURL, "/")
+	opts.Speech = opts.Speech.withDefaults(SpeechOptions{Speed: defaultSpeechSpeed, Mode: defaultSpeechMode})
+	return &vyinProvider{
+		apiKey: apiKey,
+		opts:   opts,
+		client: &http.Client{Timeout: opts.Timeout},
+	}
+}
+
+type VyinRequest struct {
+	Text        string `json:"text"`
+	ModelID     int    `json:"model_id"`
+	SpeakerName string `json:"speaker_name"`
+}
+
+type VyinResponse struct {
+	AudioURL string `json:"audio_url"`
+}
+
+func (t *vyinProvider) Name() string {
+	return TTSProviderVyin
+}
+
+func (t *vyinProvider) Synthesize(ctx context.Context, text string, model_id int, speaker_name string, opts SpeechOptions) (*SpeechAudio, error) {
+	if text == "" {
+		return nil, fmt.Errorf("text cannot be empty")
+	}
+	if speaker_name == "" {
+		return nil, fmt.Errorf("speaker_name cannot be empty")
+	}
+	if model_id <= 0 {
+		return nil, fmt.Errorf("model_id must be positive")
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	opts = opts.withDefaults(t.opts.Speech)
+
+	// 構建查詢參數 URL
+	query := url.Values{}
+	query.Set("text", text)
+	query.Set("model_id", strconv.Itoa(model_id))
+	query.Set("speaker_name", speaker_name)
+	query.Set("speed_factor", strconv.FormatFloat(opts.Speed, 'g', -1, 64))
+	query.Set("mode", opts.Mode)
+	if opts.Emotion != "" {
+		query.Set("emotion", opts.Emotion)
+	}
+	if opts.Pitch != 0 {
+		query.Set("pitch", strconv.FormatFloat(opts.Pitch, 'g', -1, 64))
+	}
+	requestURL := t.opts.BaseURL + "/api/v1/public/voice?" + query.Encode()
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		var audioURL string
+		var retryAfter time.Duration
+		audioURL, retryAfter, err = t.requestSpeech(ctx, requestURL)
+		if err == nil {
+			return &SpeechAudio{URL: audioURL}, nil
+		}
+
+		var vyinErr *VyinError
+		if errors.As(err, &vyinErr) && !vyinErr.Temporary() {
+			return nil, err
+		}
+		if attempt >= t.opts.MaxRetries {
+			return nil, err
+		}
+		if retryAfter == 0 {
+			retryAfter = t.opts.RetryBackoff << attempt
+		}
+		slog.WarnContext(ctx, "TTS request failed, retrying", "retry_after", retryAfter, "error", err)
+		select {
+		case <-time.After(retryAfter):
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
+
+// CheckCredentials calls the voice API without any text. The API refuses
+// such a request, but with 401 or 403 only when it doesn't accept the key.
+func (t *vyinProvider) CheckCredentials(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.opts.BaseURL+"/api/v1/public/voice", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", t.apiKey))
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden || resp.StatusCode >= 500 {
+		return &VyinError{StatusCode: resp.StatusCode, Message: vyinErrorMessage(body)}
+	}
+	return nil
+}
+
+// withoutQuery drops the query from the URL of a *url.Error, as it holds
+// the text to speak, which must not end up in logs or speech jobs.
+func withoutQuery(err error) error {
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		return err
+	}
+	requestURL := urlErr.URL
+	if i := strings.IndexByte(requestURL, '?'); i >= 0 {
+		requestURL = requestURL[:i]
+	}
+	return &url.Error{Op: urlErr.Op, URL: requestURL, Err: urlErr.Err}
+}
+
+// requestSpeech makes one call to the voice API. On failure it also returns
+// the wait asked for by a Retry-After header.
+func (t *vyinProvider) requestSpeech(ctx context.Context, requestURL string) (string, time.Duration, error) {
+	// 創建 GET 請求
+	req, err := http.NewRequestWithContext(ctx, "GET", requestURL, nil)
+	if err != nil {
+		return "", 0, withoutQuery(err)
+	}
+
+	// 設置標頭
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", t.apiKey))
+	req.Header.Set("Accept", "application/json")
+
+	// 發送請求
+	resp, err := t.client.Do(req)
+	if err != nil {
+		metrics.ObserveTTSResponse(TTSProviderVyin, 0)
+		return "", 0, withoutQuery(err)
+	}
+	defer resp.Body.Close()
+	metrics.ObserveTTSResponse(TTSProviderVyin, resp.StatusCode)
+
+	// 記錄狀態碼
+	slog.DebugContext(ctx, "TTS API answered", "status", resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		retryAfter := time.Duration(0)
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+		return "", retryAfter, &VyinError{StatusCode: resp.StatusCode, Message: vyinErrorMessage(body)}
+	}
+
+	// 確保回應是 JSON 格式
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		return "", 0, &VyinError{
+			StatusCode: resp.StatusCode,
+			Message:    fmt.Sprintf("unexpected content type %q", resp.Header.Get("Content-Type")),
+		}
+	}
+
+	// 解析回應
+	var response VyinResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "", 0, err
+	}
+	if response.AudioURL == "" {
+		return "", 0, &VyinError{StatusCode: resp.StatusCode, Message: "response has no audio_url"}
+	}
+	return response.AudioURL, 0, nil
+}
+
+// vyinErrorMessage extracts the message of an error response, which is
+// JSON with a message, detail or error field, or plain text.
+func vyinErrorMessage(body []byte) string {
+	var response struct {
+		Message string          `json:"message"`
+		Detail  json.RawMessage `json:"detail"`
+		Error   string          `json:"error"`
+	}
+	if json.Unmarshal(body, &response) == nil {
+		switch {
+		case response.Message != "":
+			return response.Message
+		case response.Error != "":
+			return response.Error
+		case len(response.Detail) > 0:
+			var detail string
+			if json.Unmarshal(response.Detail, &detail) == nil {
+				return detail
+			}
+			return string(response.Detail)
+		}
+	}
+
+	message := strings.TrimSpace(string(body))
+	if runes := []rune(message); len(runes) > 200 {
+		message = string(runes[:200])
+	}
+	if message == "" {
+		message = "empty response"
+	}
+	return message
+}
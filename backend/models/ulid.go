@@ -0,0 +1,80 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+const crockfordBase32 = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+var chatIDs ulidGenerator
+
+// NewChatID returns a new ULID: 26 characters that sort lexically in the
+// order the IDs were created. IDs created within the same millisecond by
+// this process still sort in creation order.
+func NewChatID() string {
+	return chatIDs.next(time.Now())
+}
+
+// ulidGenerator creates monotonic ULIDs: an ID for a time not after the
+// previous one reuses the previous timestamp and increments its random part.
+type ulidGenerator struct {
+	mu   sync.Mutex
+	last [16]byte
+}
+
+func (g *ulidGenerator) next(t time.Time) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	id := newULIDBytes(t)
+	if string(id[:6]) <= string(g.last[:6]) {
+		id = g.last
+		incrementULID(&id)
+	}
+	g.last = id
+	return encodeULID(id)
+}
+
+func newULID(t time.Time) string {
+	return encodeULID(newULIDBytes(t))
+}
+
+func newULIDBytes(t time.Time) [16]byte {
+	var id [16]byte
+	ms := uint64(t.UnixMilli())
+	binary.BigEndian.PutUint16(id[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(id[2:6], uint32(ms))
+	if _, err := rand.Read(id[6:]); err != nil {
+		panic(err)
+	}
+	return id
+}
+
+// incrementULID adds one to id, carrying from the random part into the
+// timestamp when the random part overflows.
+func incrementULID(id *[16]byte) {
+	for i := len(id) - 1; i >= 0; i-- {
+		id[i]++
+		if id[i] != 0 {
+			return
+		}
+	}
+}
+
+// encodeULID writes the 128 bits of id as 26 Crockford base32 characters,
+// most significant bits first.
+func encodeULID(id [16]byte) string {
+	hi := binary.BigEndian.Uint64(id[0:8])
+	lo := binary.BigEndian.Uint64(id[8:16])
+
+	var out [26]byte
+	for i := 25; i >= 0; i-- {
+		out[i] = crockfordBase32[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
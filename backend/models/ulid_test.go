@@ -0,0 +1,21 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewULIDSortsByTime(t *testing.T) {
+	earlier := newULID(time.UnixMilli(1700000000000))
+	later := newULID(time.UnixMilli(1700000000001))
+
+	if len(earlier) != 26 || len(later) != 26 {
+		t.Fatalf("Expected 26 character IDs, got %q and %q", earlier, later)
+	}
+	if earlier >= later {
+		t.Fatalf("Expected %q to sort before %q", earlier, later)
+	}
+	if NewChatID() == NewChatID() {
+		t.Fatal("Expected IDs to be unique")
+	}
+}
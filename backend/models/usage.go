@@ -0,0 +1,304 @@
+package models
+
+import (
+	"backend/config"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidUsageQuery is returned for usage reports over a bad range or
+// grouping.
+var ErrInvalidUsageQuery = errors.New("invalid usage query")
+
+// Dimensions a UsageReport can be grouped by.
+const (
+	UsageByDay   = "day"
+	UsageByUser  = "user"
+	UsageByModel = "model"
+)
+
+// usageDayLayout formats the days of usage events and reports.
+const usageDayLayout = "2006-01-02"
+
+// UsageEvent is what one call of the API cost: the LLM tokens of a reply,
+// the characters sent to TTS for it and how long the LLM took.
+type UsageEvent struct {
+	ID               string    `json:"id" dynamodbav:"id"`
+	Time             time.Time `json:"time" dynamodbav:"time"`
+	UserID           string    `json:"user_id" dynamodbav:"user_id"`
+	SessionID        string    `json:"session_id,omitempty" dynamodbav:"session_id,omitempty"`
+	Persona          string    `json:"persona,omitempty" dynamodbav:"persona,omitempty"`
+	Endpoint         string    `json:"endpoint" dynamodbav:"endpoint"`
+	Provider         string    `json:"provider,omitempty" dynamodbav:"provider,omitempty"`
+	Model            string    `json:"model,omitempty" dynamodbav:"model,omitempty"`
+	InputTokens      int       `json:"input_tokens" dynamodbav:"input_tokens"`
+	OutputTokens     int       `json:"output_tokens" dynamodbav:"output_tokens"`
+	CacheReadTokens  int       `json:"cache_read_tokens,omitempty" dynamodbav:"cache_read_tokens,omitempty"`
+	CacheWriteTokens int       `json:"cache_write_tokens,omitempty" dynamodbav:"cache_write_tokens,omitempty"`
+	TTSProvider      string    `json:"tts_provider,omitempty" dynamodbav:"tts_provider,omitempty"`
+	TTSCharacters    int       `json:"tts_characters,omitempty" dynamodbav:"tts_characters,omitempty"`
+	LatencyMs        int64     `json:"latency_ms" dynamodbav:"latency_ms"`
+}
+
+// UsageLedger keeps usage events.
+type UsageLedger interface {
+	Record(ctx context.Context, event UsageEvent) error
+	// Events returns the events from from up to before to, oldest first.
+	Events(ctx context.Context, from, to time.Time) ([]UsageEvent, error)
+}
+
+// UsageQuery selects the events of a UsageReport: those from From up to
+// before To, of UserID if set, summed up per distinct value of the GroupBy
+// dimensions.
+type UsageQuery struct {
+	From    time.Time
+	To      time.Time
+	GroupBy []string
+	UserID  string
+}
+
+// UsageRow sums up the events of one group of a UsageReport. Only the
+// fields of the grouped dimensions are set.
+type UsageRow struct {
+	Day              string  `json:"day,omitempty"`
+	UserID           string  `json:"user_id,omitempty"`
+	Model            string  `json:"model,omitempty"`
+	Calls            int     `json:"calls"`
+	InputTokens      int     `json:"input_tokens"`
+	OutputTokens     int     `json:"output_tokens"`
+	CacheReadTokens  int     `json:"cache_read_tokens"`
+	CacheWriteTokens int     `json:"cache_write_tokens"`
+	TTSCharacters    int     `json:"tts_characters"`
+	AvgLatencyMs     int64   `json:"avg_latency_ms"`
+	EstimatedCost    float64 `json:"estimated_cost"`
+
+	latencyMs int64
+}
+
+// UsageReport is the usage of a range of time, per group and in Total.
+type UsageReport struct {
+	From    time.Time  `json:"from"`
+	To      time.Time  `json:"to"`
+	GroupBy []string   `json:"group_by"`
+	Rows    []UsageRow `json:"rows"`
+	Total   UsageRow   `json:"total"`
+}
+
+// UsagePrices estimate the cost of usage, in any currency per 1000 tokens
+// or TTS characters.
+type UsagePrices struct {
+	InputTokens   float64
+	OutputTokens  float64
+	TTSCharacters float64
+}
+
+// UsagePricesFromConfig returns the prices set in cfg.
+func UsagePricesFromConfig(cfg config.Usage) UsagePrices {
+	return UsagePrices{
+		InputTokens:   cfg.PriceInputTokens,
+		OutputTokens:  cfg.PriceOutputTokens,
+		TTSCharacters: cfg.PriceTTSCharacters,
+	}
+}
+
+func (p UsagePrices) cost(row UsageRow) float64 {
+	return (float64(row.InputTokens)*p.InputTokens +
+		float64(row.OutputTokens)*p.OutputTokens +
+		float64(row.TTSCharacters)*p.TTSCharacters) / 1000
+}
+
+type UsageService interface {
+	// RecordUsage adds an event to the ledger, setting its ID and Time if
+	// missing.
+	RecordUsage(ctx context.Context, event UsageEvent) error
+	UsageReport(ctx context.Context, query UsageQuery) (*UsageReport, error)
+}
+
+type usageService struct {
+	ledger UsageLedger
+	prices UsagePrices
+}
+
+// NewUsageService returns a UsageService keeping events in ledger and
+// estimating their cost with prices.
+func NewUsageService(ledger UsageLedger, prices UsagePrices) UsageService {
+	return &usageService{ledger: ledger, prices: prices}
+}
+
+// NewUsageServiceFromConfig opens the usage ledger selected by cfg.Store:
+//
+//	memory:   process memory, lost on restart
+//	dynamodb: table cfg.Table
+func NewUsageServiceFromConfig(cfg config.Usage) (UsageService, error) {
+	var ledger UsageLedger
+	switch cfg.Store {
+	case StoreMemory:
+		ledger = NewMemoryUsageLedger()
+	case StoreDynamoDB:
+		var err error
+		if ledger, err = NewDynamoDBUsageLedger(cfg.Table); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown usage store %q", cfg.Store)
+	}
+	return NewUsageService(ledger, UsagePricesFromConfig(cfg)), nil
+}
+
+func (u *usageService) RecordUsage(ctx context.Context, event UsageEvent) error {
+	if event.ID == "" {
+		event.ID = NewChatID()
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	event.Time = event.Time.UTC()
+	return u.ledger.Record(ctx, event)
+}
+
+func (u *usageService) UsageReport(ctx context.Context, query UsageQuery) (*UsageReport, error) {
+	if !query.From.Before(query.To) {
+		return nil, fmt.Errorf("%w: from must be before to", ErrInvalidUsageQuery)
+	}
+	byDay, byUser, byModel := false, false, false
+	for _, dimension := range query.GroupBy {
+		switch dimension {
+		case UsageByDay:
+			byDay = true
+		case UsageByUser:
+			byUser = true
+		case UsageByModel:
+			byModel = true
+		default:
+			return nil, fmt.Errorf("%w: unknown group %q", ErrInvalidUsageQuery, dimension)
+		}
+	}
+
+	events, err := u.ledger.Events(ctx, query.From, query.To)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &UsageReport{From: query.From, To: query.To, GroupBy: query.GroupBy, Rows: []UsageRow{}}
+	rows := map[UsageRow]*UsageRow{}
+	var keys []UsageRow
+	for _, event := range events {
+		if query.UserID != "" && event.UserID != query.UserID {
+			continue
+		}
+		var key UsageRow
+		if byDay {
+			key.Day = event.Time.UTC().Format(usageDayLayout)
+		}
+		if byUser {
+			key.UserID = event.UserID
+		}
+		if byModel {
+			key.Model = event.Model
+		}
+		row, ok := rows[key]
+		if !ok {
+			copied := key
+			row = &copied
+			rows[key] = row
+			keys = append(keys, key)
+		}
+		row.add(event)
+		report.Total.add(event)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		if a.UserID != b.UserID {
+			return a.UserID < b.UserID
+		}
+		return a.Model < b.Model
+	})
+	for _, key := range keys {
+		row := rows[key]
+		u.finish(row)
+		report.Rows = append(report.Rows, *row)
+	}
+	u.finish(&report.Total)
+	return report, nil
+}
+
+func (r *UsageRow) add(event UsageEvent) {
+	r.Calls++
+	r.InputTokens += event.InputTokens
+	r.OutputTokens += event.OutputTokens
+	r.CacheReadTokens += event.CacheReadTokens
+	r.CacheWriteTokens += event.CacheWriteTokens
+	r.TTSCharacters += event.TTSCharacters
+	r.latencyMs += event.LatencyMs
+}
+
+// finish computes the averages and the cost of a row once all events were
+// added.
+func (u *usageService) finish(row *UsageRow) {
+	if row.Calls > 0 {
+		row.AvgLatencyMs = row.latencyMs / int64(row.Calls)
+	}
+	row.EstimatedCost = u.prices.cost(*row)
+}
+
+// ParseUsageGroups splits a comma separated list of UsageQuery groups.
+func ParseUsageGroups(groups string) []string {
+	var dimensions []string
+	for _, dimension := range strings.Split(groups, ",") {
+		if dimension = strings.TrimSpace(dimension); dimension != "" {
+			dimensions = append(dimensions, dimension)
+		}
+	}
+	return dimensions
+}
+
+// maxMemoryUsageEvents bounds the events kept by the memory ledger; the
+// oldest are dropped first.
+const maxMemoryUsageEvents = 100000
+
+// memoryUsageLedger keeps usage events in process memory, in the order they
+// were recorded.
+type memoryUsageLedger struct {
+	mu     sync.Mutex
+	events []UsageEvent
+}
+
+// NewMemoryUsageLedger returns a UsageLedger in process memory, for a single
+// server and tests.
+func NewMemoryUsageLedger() UsageLedger {
+	return &memoryUsageLedger{}
+}
+
+func (m *memoryUsageLedger) Record(ctx context.Context, event UsageEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.events) >= maxMemoryUsageEvents {
+		m.events = append(m.events[:0:0], m.events[len(m.events)-maxMemoryUsageEvents+1:]...)
+	}
+	m.events = append(m.events, event)
+	return nil
+}
+
+func (m *memoryUsageLedger) Events(ctx context.Context, from, to time.Time) ([]UsageEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var events []UsageEvent
+	for _, event := range m.events {
+		if !event.Time.Before(from) && event.Time.Before(to) {
+			events = append(events, event)
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+	return events, nil
+}
@@ -0,0 +1,95 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// usageItem is the DynamoDB item of a usage event.
+type usageItem struct {
+	Day     string `dynamodbav:"day"`
+	SortKey string `dynamodbav:"sk"`
+	UsageEvent
+}
+
+// dynamoDBUsageLedger keeps usage events in a DynamoDB table with partition
+// key day, the UTC day of the event, and sort key sk, its time and ID, so
+// the events of a range of days are read with one query per day.
+type dynamoDBUsageLedger struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+// NewDynamoDBUsageLedger returns a UsageLedger in the DynamoDB table
+// tableName, shared by all servers.
+func NewDynamoDBUsageLedger(tableName string) (UsageLedger, error) {
+	client, err := GetDynamoDBClient()
+	if err != nil {
+		return nil, err
+	}
+	return &dynamoDBUsageLedger{client: client, tableName: tableName}, nil
+}
+
+// usageSortKey orders the events of a day by time; the layout has a fixed
+// width so keys sort like the times.
+func usageSortKey(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000000000Z")
+}
+
+func (d *dynamoDBUsageLedger) Record(ctx context.Context, event UsageEvent) error {
+	item, err := attributevalue.MarshalMap(usageItem{
+		Day:        event.Time.UTC().Format(usageDayLayout),
+		SortKey:    usageSortKey(event.Time) + "#" + event.ID,
+		UsageEvent: event,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = d.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.tableName),
+		Item:      item,
+	})
+	return err
+}
+
+func (d *dynamoDBUsageLedger) Events(ctx context.Context, from, to time.Time) ([]UsageEvent, error) {
+	from, to = from.UTC(), to.UTC()
+	var events []UsageEvent
+	for day := from.Truncate(24 * time.Hour); day.Before(to); day = day.Add(24 * time.Hour) {
+		paginator := dynamodb.NewQueryPaginator(d.client, &dynamodb.QueryInput{
+			TableName:              aws.String(d.tableName),
+			KeyConditionExpression: aws.String("#day = :day AND sk BETWEEN :from AND :to"),
+			ExpressionAttributeNames: map[string]string{
+				"#day": "day",
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":day":  &types.AttributeValueMemberS{Value: day.Format(usageDayLayout)},
+				":from": &types.AttributeValueMemberS{Value: usageSortKey(from)},
+				":to":   &types.AttributeValueMemberS{Value: usageSortKey(to)},
+			},
+		})
+		for paginator.HasMorePages() {
+			output, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			var items []usageItem
+			if err := attributevalue.UnmarshalListOfMaps(output.Items, &items); err != nil {
+				return nil, err
+			}
+			for _, item := range items {
+				// BETWEEN includes events at exactly to
+				if item.Time.Before(to) {
+					events = append(events, item.UsageEvent)
+				}
+			}
+		}
+	}
+	return events, nil
+}
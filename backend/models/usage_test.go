@@ -0,0 +1,66 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestUsageReport(t *testing.T) {
+	usage := NewUsageService(NewMemoryUsageLedger(), UsagePrices{InputTokens: 1, OutputTokens: 2, TTSCharacters: 10})
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	events := []UsageEvent{
+		{Time: day.Add(time.Hour), UserID: "fan", Model: "nova", InputTokens: 1000, OutputTokens: 500, LatencyMs: 100},
+		{Time: day.Add(2 * time.Hour), UserID: "idol", Model: "nova", InputTokens: 2000, TTSCharacters: 100, LatencyMs: 300},
+		{Time: day.Add(25 * time.Hour), UserID: "fan", Model: "claude", OutputTokens: 1000, LatencyMs: 50},
+		{Time: day.Add(49 * time.Hour), UserID: "fan", Model: "nova", InputTokens: 1},
+	}
+	for _, event := range events {
+		if err := usage.RecordUsage(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := usage.UsageReport(context.Background(), UsageQuery{From: day, To: day.AddDate(0, 0, 2), GroupBy: []string{UsageByDay, UsageByModel}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []UsageRow{
+		{Day: "2024-05-01", Model: "nova", Calls: 2, InputTokens: 3000, OutputTokens: 500, TTSCharacters: 100, AvgLatencyMs: 200, EstimatedCost: 5},
+		{Day: "2024-05-02", Model: "claude", Calls: 1, OutputTokens: 1000, AvgLatencyMs: 50, EstimatedCost: 2},
+	}
+	if len(report.Rows) != len(expected) {
+		t.Fatalf("Expected %d rows, got %+v", len(expected), report.Rows)
+	}
+	for i, row := range report.Rows {
+		row.latencyMs = 0
+		if row != expected[i] {
+			t.Errorf("Row %d: expected %+v, got %+v", i, expected[i], row)
+		}
+	}
+	if report.Total.Calls != 3 || report.Total.EstimatedCost != 7 {
+		t.Errorf("Unexpected total %+v", report.Total)
+	}
+
+	report, err = usage.UsageReport(context.Background(), UsageQuery{From: day, To: day.AddDate(0, 0, 3), GroupBy: []string{UsageByUser}, UserID: "fan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Rows) != 1 || report.Rows[0].UserID != "fan" || report.Rows[0].Calls != 3 {
+		t.Errorf("Expected the events of fan only, got %+v", report.Rows)
+	}
+
+	if _, err := usage.UsageReport(context.Background(), UsageQuery{From: day, To: day.AddDate(0, 0, 1), GroupBy: []string{"persona"}}); !errors.Is(err, ErrInvalidUsageQuery) {
+		t.Errorf("Expected ErrInvalidUsageQuery for an unknown group, got %v", err)
+	}
+	if _, err := usage.UsageReport(context.Background(), UsageQuery{From: day, To: day}); !errors.Is(err, ErrInvalidUsageQuery) {
+		t.Errorf("Expected ErrInvalidUsageQuery for an empty range, got %v", err)
+	}
+}
+
+func TestSpeechCharacters(t *testing.T) {
+	if n := SpeechCharacters("**Hi** there! 😀 ..."); n != len("Hi there!") {
+		t.Errorf("Expected only the speakable characters to count, got %d", n)
+	}
+}
@@ -2,10 +2,15 @@ package server
 
 import (
 	"backend/controller"
+	"backend/metrics"
+	"backend/middleware/auth"
+	"backend/middleware/ratelimit"
+	"backend/models"
 	"net/http"
 	"time"
 
 	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
 )
 
 func (srv *server) routes() http.Handler {
@@ -15,9 +20,9 @@ func (srv *server) routes() http.Handler {
 
 	srv.router.Use(cors.New(cors.Config{
 		AllowAllOrigins:  true,
-		AllowMethods:     []string{"POST, GET, OPTIONS, PUT, DELETE, UPDATE"},
-		AllowHeaders:     []string{"Origin, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowMethods:     []string{"POST, GET, OPTIONS, PUT, PATCH, DELETE, UPDATE"},
+		AllowHeaders:     []string{"Origin, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-API-Key"},
+		ExposeHeaders:    []string{"Content-Length, Retry-After, X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset, X-Quota-Input-Tokens-Remaining, X-Quota-Output-Tokens-Remaining, X-Quota-Tokens-Reset, X-Stop-Reason"},
 		AllowCredentials: true,
 
 		MaxAge: 12 * time.Hour,
@@ -25,15 +30,45 @@ func (srv *server) routes() http.Handler {
 
 	controller := &controller.BaseController{
 		Service: srv.service,
+		Sockets: srv.sockets,
+	}
+
+	limiter := ratelimit.New(srv.service)
+
+	// Probes of load balancers need neither credentials nor a rate limit
+	srv.router.GET("/healthz", controller.Healthz)
+	srv.router.GET("/readyz", controller.Readyz)
+	// Scraped by Prometheus from inside the network, like the probes
+	srv.router.GET("/metrics", gin.WrapH(metrics.Handler()))
+
+	// Audio files are public, as players can't send credentials and their
+	// keys can't be guessed; speech jobs need them. Neither counts against
+	// the rate limit, as a reply may be spoken in many files
+	public := srv.router.Group("/")
+	{
+		public.GET("/personas", limiter.Middleware(), controller.ListPersonas)
+		public.GET("/audio/:id", srv.auth.Unless(isAudioFile), controller.GetAudio)
 	}
 
 	v1 := srv.router.Group("/")
-	v1.Use()
+	v1.Use(srv.auth.Middleware(), limiter.Middleware())
 	{
 		v1.POST("/user_history", controller.GetHistory)
-		v1.POST("/", controller.PostHistory)
+		v1.POST("/", srv.auth.RequireRole(auth.RoleAdmin), controller.PostHistory)
 		v1.POST("/generate_response", controller.GenerateResponse)
 		v1.POST("/chat", controller.ProcessChat)
+		v1.POST("/chat/stream", controller.ProcessChatStream)
+		v1.POST("/chat/voice", controller.ProcessVoiceChat)
+		v1.GET("/ws/chat", controller.ChatSocket)
+		v1.GET("/sessions", controller.ListSessions)
+		v1.POST("/sessions", controller.CreateSession)
+		v1.PATCH("/sessions/:session_id", controller.UpdateSession)
+		v1.DELETE("/sessions/:session_id", controller.DeleteSession)
+		v1.GET("/admin/usage", srv.auth.RequireRole(auth.RoleAdmin), controller.GetUsage)
 	}
 	return srv.router
 }
+
+func isAudioFile(c *gin.Context) bool {
+	return models.IsAudioKey(c.Param("id"))
+}
@@ -1,8 +1,14 @@
 package server
 
 import (
+	"backend/config"
+	"backend/controller"
+	"backend/middleware/auth"
 	"backend/middleware/cors"
+	"backend/middleware/httpmetrics"
+	"backend/middleware/requestlog"
 	"backend/models"
+	"log/slog"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -11,10 +17,17 @@ import (
 type server struct {
 	router  *gin.Engine
 	service models.Service
+	sockets *controller.SocketHub
+	auth    *auth.Authenticator
 }
 
-// NewServer returns new http.Server.
-func NewServer(service models.Service) *http.Server {
+// NewServer returns new http.Server listening on the address in cfg. It
+// fails when authentication isn't configured.
+func NewServer(service models.Service, cfg *config.Config) (*http.Server, error) {
+	authenticator, err := auth.NewFromConfig(cfg.Auth)
+	if err != nil {
+		return nil, err
+	}
 
 	// gin.SetMode(gin.TestMode)
 	router := gin.New()
@@ -22,7 +35,8 @@ func NewServer(service models.Service) *http.Server {
 	router.HandleMethodNotAllowed = true
 
 	router.Use(
-		gin.Logger(),
+		requestlog.Middleware(slog.Default(), "/healthz", "/readyz", "/metrics"),
+		httpmetrics.Middleware(),
 		gin.Recovery(),
 		cors.Default(),
 		cors.CORSMiddleware(),
@@ -31,10 +45,15 @@ func NewServer(service models.Service) *http.Server {
 	srv := &server{
 		router:  router,
 		service: service,
+		sockets: controller.NewSocketHub(),
+		auth:    authenticator,
 	}
 
-	return &http.Server{
-		Addr:    "0.0.0.0:8888",
+	httpServer := &http.Server{
+		Addr:    cfg.Server.Addr,
 		Handler: srv.routes(),
 	}
+	// Shutdown doesn't close WebSocket connections by itself
+	httpServer.RegisterOnShutdown(srv.sockets.Close)
+	return httpServer, nil
 }